@@ -0,0 +1,335 @@
+package mu
+
+import (
+	"fmt"
+	"github.com/heyLu/fressian"
+	"math/big"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/pattern"
+	"github.com/heyLu/mu/transactor"
+)
+
+// TypedAttribute is a handle for an attribute whose values have the
+// Go type T.
+//
+// The following types are supported:
+//
+//  - string, bool, int, int64, float32 and float64
+//  - time.Time, fressian.UUID, *url.URL, *big.Int, *index.Decimal and []byte
+//  - database.Keyword (or fressian.Keyword) for keyword attributes
+//  - database.Entity or database.Id for ref attributes
+//  - []interface{} for tuple attributes
+//
+// Attributes with cardinality many use slices of these types, e.g.
+// `Attr[[]string]("note", "tags")`.
+type TypedAttribute[T any] struct {
+	Keyword database.Keyword
+}
+
+// Attr returns a typed handle for the attribute, e.g.
+// `Attr[string]("note", "title")`.
+//
+// The type is checked against the attribute in the database whenever
+// the handle is used with one, Check does so explicitly.
+func Attr[T any](namespace, name string) TypedAttribute[T] {
+	return TypedAttribute[T]{Keyword(namespace, name)}
+}
+
+// Check verifies that the attribute exists in the database and that
+// its :db/valueType and :db/cardinality match the type T.
+//
+// Get, Datum and Retraction check this as well when they are used with
+// a database, so calling Check is only needed to detect mismatches
+// early, e.g. when starting up.
+func (a TypedAttribute[T]) Check(db *database.Db) error {
+	attrId, err := a.Keyword.Lookup(db)
+	if err != nil {
+		return err
+	}
+	attr := db.Attribute(attrId)
+	if attr == nil {
+		return fmt.Errorf("%v is not an attribute", a.Keyword)
+	}
+	return a.checkAttribute(attr)
+}
+
+// checkType is like Check, but ignores attributes that do not exist
+// in the database (yet).
+func (a TypedAttribute[T]) checkType(db *database.Db) error {
+	attrId, err := a.Keyword.Lookup(db)
+	if err != nil {
+		return nil
+	}
+	attr := db.Attribute(attrId)
+	if attr == nil {
+		return nil
+	}
+	return a.checkAttribute(attr)
+}
+
+func (a TypedAttribute[T]) checkAttribute(attr *database.Attribute) error {
+	ty := reflect.TypeOf((*T)(nil)).Elem()
+	hasMany := isManyType(ty)
+	if hasMany {
+		ty = ty.Elem()
+	}
+
+	if hasMany != (attr.Cardinality() == database.CardinalityMany) {
+		return fmt.Errorf("%v has cardinality %v, but was declared as %v",
+			a.Keyword, attr.Cardinality(), reflect.TypeOf((*T)(nil)).Elem())
+	}
+
+	if !goTypeMatches(ty, attr.Type()) {
+		return fmt.Errorf("%v has type %v, but was declared as %v", a.Keyword, attr.Type(), ty)
+	}
+
+	return nil
+}
+
+// Get returns the value of the attribute for the entity.
+//
+// If the entity has no value for the attribute, or if the attribute
+// does not match the type T in the database of the entity, the zero
+// value and false are returned.  Use Check to tell these apart.
+func (a TypedAttribute[T]) Get(entity database.Entity) (T, bool) {
+	var zero T
+
+	if err := a.checkType(entity.Db()); err != nil {
+		return zero, false
+	}
+
+	val := entity.Get(a.Keyword)
+	if val == nil {
+		return zero, false
+	}
+
+	ty := reflect.TypeOf((*T)(nil)).Elem()
+	if vals, ok := val.([]interface{}); ok && isManyType(ty) {
+		if len(vals) == 0 {
+			return zero, false
+		}
+
+		slice := reflect.MakeSlice(ty, len(vals), len(vals))
+		for i, val := range vals {
+			rv, ok := fromValue(val, ty.Elem())
+			if !ok {
+				return zero, false
+			}
+			slice.Index(i).Set(rv)
+		}
+		return slice.Interface().(T), true
+	}
+
+	rv, ok := fromValue(val, ty)
+	if !ok {
+		return zero, false
+	}
+	return rv.Interface().(T), true
+}
+
+// Datum returns tx data that asserts the value for the attribute of
+// the entity.  For attributes with cardinality many all values in the
+// slice are asserted.
+//
+// The transaction fails with an Incorrect anomaly if the attribute
+// does not match the type T, see Check.
+func (a TypedAttribute[T]) Datum(entity database.HasLookup, value T) transactor.TxDatum {
+	if isManyType(reflect.TypeOf((*T)(nil)).Elem()) {
+		rv := reflect.ValueOf(value)
+		vals := make([]transactor.Value, rv.Len())
+		for i := range vals {
+			vals[i] = transactor.NewValue(toValue(rv.Index(i).Interface()))
+		}
+		return checkedDatum[T]{a, transactor.TxMap{
+			Id:         entity,
+			Attributes: map[database.Keyword][]transactor.Value{a.Keyword: vals},
+		}}
+	}
+
+	return checkedDatum[T]{a, transactor.Datum{
+		Op: transactor.Assert,
+		E:  entity,
+		A:  a.Keyword,
+		V:  transactor.NewValue(toValue(value)),
+	}}
+}
+
+// Retraction returns tx data that retracts the value for the attribute
+// of the entity.  For attributes with cardinality many all values in
+// the slice are retracted.  Like Datum, it checks the type of the
+// attribute when it is transacted.
+func (a TypedAttribute[T]) Retraction(entity database.HasLookup, value T) transactor.TxDatum {
+	if isManyType(reflect.TypeOf((*T)(nil)).Elem()) {
+		rv := reflect.ValueOf(value)
+		retractions := make([]transactor.Datum, rv.Len())
+		for i := range retractions {
+			retractions[i] = transactor.Datum{
+				Op: transactor.Retract,
+				E:  entity,
+				A:  a.Keyword,
+				V:  transactor.NewValue(toValue(rv.Index(i).Interface())),
+			}
+		}
+		return checkedDatum[T]{a, transactor.TxFn(func(db *database.Db) ([]transactor.RawDatum, error) {
+			datums := make([]transactor.RawDatum, 0, len(retractions))
+			for _, retraction := range retractions {
+				ds, err := retraction.Resolve(db)
+				if err != nil {
+					return nil, err
+				}
+				datums = append(datums, ds...)
+			}
+			return datums, nil
+		})}
+	}
+
+	return checkedDatum[T]{a, transactor.Datum{
+		Op: transactor.Retract,
+		E:  entity,
+		A:  a.Keyword,
+		V:  transactor.NewValue(toValue(value)),
+	}}
+}
+
+// checkedDatum checks the type of the attribute against the database
+// before resolving the tx data.
+type checkedDatum[T any] struct {
+	attr   TypedAttribute[T]
+	txData transactor.TxDatum
+}
+
+func (d checkedDatum[T]) Resolve(db *database.Db) ([]transactor.RawDatum, error) {
+	if err := d.attr.checkType(db); err != nil {
+		return nil, &transactor.Anomaly{Category: transactor.Incorrect, Message: err.Error(), Err: err}
+	}
+	return d.txData.Resolve(db)
+}
+
+// A returns a pattern matching all datoms of the attribute.
+func (a TypedAttribute[T]) A() pattern.Pattern {
+	return pattern.A(a.Keyword)
+}
+
+// Ae returns a pattern matching the datoms of the attribute for the
+// entity.
+func (a TypedAttribute[T]) Ae(entity database.HasLookup) pattern.Pattern {
+	return pattern.Ae(a.Keyword, entity)
+}
+
+// Aev returns a pattern matching the datom of the attribute for the
+// entity with the value.
+func (a TypedAttribute[T]) Aev(entity database.HasLookup, value T) pattern.Pattern {
+	return pattern.Aev(a.Keyword, entity, patternValue(value))
+}
+
+// Ea returns a pattern matching the datoms of the entity for the
+// attribute.
+func (a TypedAttribute[T]) Ea(entity database.HasLookup) pattern.Pattern {
+	return pattern.Ea(entity, a.Keyword)
+}
+
+// Eav returns a pattern matching the datom of the entity for the
+// attribute with the value.
+func (a TypedAttribute[T]) Eav(entity database.HasLookup, value T) pattern.Pattern {
+	return pattern.Eav(entity, a.Keyword, patternValue(value))
+}
+
+var (
+	bytesType   = reflect.TypeOf([]byte(nil))
+	tupleType   = reflect.TypeOf([]interface{}(nil))
+	entityType  = reflect.TypeOf(database.Entity{})
+	idType      = reflect.TypeOf(database.Id(0))
+	keywordType = reflect.TypeOf(database.Keyword{})
+)
+
+// isManyType returns true if values of the type are used for
+// attributes with cardinality many.
+func isManyType(ty reflect.Type) bool {
+	return ty.Kind() == reflect.Slice && ty != bytesType && ty != tupleType
+}
+
+func goTypeMatches(ty reflect.Type, valueType index.ValueType) bool {
+	switch ty {
+	case entityType, idType:
+		return valueType == index.Ref
+	case keywordType, reflect.TypeOf(fressian.Keyword{}):
+		return valueType == index.Keyword
+	case reflect.TypeOf(""):
+		return valueType == index.String
+	case reflect.TypeOf(false):
+		return valueType == index.Bool
+	case reflect.TypeOf(0), reflect.TypeOf(int64(0)):
+		return valueType == index.Long
+	case reflect.TypeOf(float32(0)):
+		return valueType == index.Float
+	case reflect.TypeOf(float64(0)):
+		return valueType == index.Double
+	case reflect.TypeOf(time.Time{}):
+		return valueType == index.Date
+	case reflect.TypeOf(fressian.UUID{}):
+		return valueType == index.UUID
+	case reflect.TypeOf(&url.URL{}):
+		return valueType == index.URI
+	case reflect.TypeOf(&big.Int{}):
+		return valueType == index.BigInt
+	case reflect.TypeOf(&index.Decimal{}):
+		return valueType == index.BigDec
+	case bytesType:
+		return valueType == index.Bytes
+	case tupleType:
+		return valueType == index.Tuple
+	default:
+		return false
+	}
+}
+
+// fromValue converts a value as returned by Entity.Get to the type.
+func fromValue(val interface{}, ty reflect.Type) (reflect.Value, bool) {
+	switch val := val.(type) {
+	case database.Entity:
+		if ty == idType {
+			return reflect.ValueOf(database.Id(val.Id())), true
+		}
+	case fressian.Keyword:
+		if ty == keywordType {
+			return reflect.ValueOf(database.Keyword{val}), true
+		}
+	case int:
+		if ty.Kind() == reflect.Int64 {
+			return reflect.ValueOf(int64(val)), true
+		}
+	}
+
+	rv := reflect.ValueOf(val)
+	if !rv.Type().AssignableTo(ty) {
+		return reflect.Value{}, false
+	}
+	return rv, true
+}
+
+// toValue converts a value to one accepted by transactor.NewValue.
+func toValue(val interface{}) interface{} {
+	if entity, ok := val.(database.Entity); ok {
+		return database.Id(entity.Id())
+	}
+	return val
+}
+
+// patternValue converts a value to one accepted by patterns.
+func patternValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case database.Entity:
+		return val.Id()
+	case database.Id:
+		return int(val)
+	case database.Keyword:
+		return val.Keyword
+	default:
+		return val
+	}
+}
@@ -0,0 +1,129 @@
+package mu
+
+import (
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+
+	"github.com/heyLu/mu/connection"
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/internal/testutil"
+	"github.com/heyLu/mu/transactor"
+)
+
+var (
+	noteTitle    = Attr[string]("note", "title")
+	noteTags     = Attr[[]string]("note", "tags")
+	noteNotebook = Attr[database.Entity]("note", "notebook")
+	notebookName = Attr[string]("notebook", "name")
+)
+
+func typedConn(t *testing.T) connection.Connection {
+	url := "memory://mu?name=" + t.Name()
+	_, err := CreateDatabase(url)
+	tu.RequireNil(t, err)
+	conn, err := Connect(url)
+	tu.RequireNil(t, err)
+	_, err = TransactString(conn, testutil.Schema(testutil.Notebooks...))
+	tu.RequireNil(t, err)
+	return conn
+}
+
+func TestTypedAttribute(t *testing.T) {
+	conn := typedConn(t)
+	db := conn.Db()
+	tu.ExpectNil(t, noteTitle.Check(db))
+	tu.ExpectNil(t, noteTags.Check(db))
+	tu.ExpectNil(t, noteNotebook.Check(db))
+
+	notebook := Tempid(DbPartUser, -1)
+	note := Tempid(DbPartUser, -2)
+	txResult, err := Transact(conn, Datums(
+		notebookName.Datum(Id(notebook), "home"),
+		noteTitle.Datum(Id(note), "groceries"),
+		noteTags.Datum(Id(note), []string{"todo", "shopping"}),
+		noteNotebook.Datum(Id(note), db.Entity(notebook))))
+	tu.RequireNil(t, err)
+	db = txResult.DbAfter
+
+	entity := db.Entity(txResult.Tempids[note])
+	title, ok := noteTitle.Get(entity)
+	tu.ExpectEqual(t, ok, true)
+	tu.ExpectEqual(t, title, "groceries")
+
+	tags, ok := noteTags.Get(entity)
+	tu.ExpectEqual(t, ok, true)
+	tu.ExpectEqual(t, len(tags), 2)
+
+	nb, ok := noteNotebook.Get(entity)
+	tu.ExpectEqual(t, ok, true)
+	name, _ := notebookName.Get(nb)
+	tu.ExpectEqual(t, name, "home")
+
+	_, ok = notebookName.Get(entity)
+	tu.ExpectEqual(t, ok, false)
+
+	iter, err := Datoms(db, noteTitle.Aev(Id(entity.Id()), "groceries"))
+	tu.RequireNil(t, err)
+	expectIterCount(t, iter, 1)
+
+	iter, err = Datoms(db, noteNotebook.Eav(Id(entity.Id()), nb))
+	tu.RequireNil(t, err)
+	expectIterCount(t, iter, 1)
+}
+
+func TestTypedAttributeCheck(t *testing.T) {
+	db := typedConn(t).Db()
+
+	tu.ExpectNotNil(t, Attr[int]("note", "title").Check(db))
+	tu.ExpectNotNil(t, Attr[string]("note", "tags").Check(db))
+	tu.ExpectNotNil(t, Attr[[]string]("note", "title").Check(db))
+	tu.ExpectNotNil(t, Attr[string]("note", "unknown").Check(db))
+	tu.ExpectNil(t, Attr[database.Id]("note", "notebook").Check(db))
+}
+
+func TestTypedAttributeTypeMismatch(t *testing.T) {
+	conn := typedConn(t)
+
+	titleInt := Attr[int]("note", "title")
+	note := Tempid(DbPartUser, -1)
+	_, err := Transact(conn, Datums(titleInt.Datum(Id(note), 3)))
+	tu.RequireNotNil(t, err)
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+
+	_, err = Transact(conn, Datums(Attr[[]string]("note", "title").Datum(Id(note), []string{"a"})))
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+
+	txResult, err := Transact(conn, Datums(noteTitle.Datum(Id(note), "groceries")))
+	tu.RequireNil(t, err)
+	entity := txResult.DbAfter.Entity(txResult.Tempids[note])
+
+	_, err = Transact(conn, Datums(titleInt.Retraction(Id(entity.Id()), 3)))
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+
+	val, ok := titleInt.Get(entity)
+	tu.ExpectEqual(t, ok, false)
+	tu.ExpectEqual(t, val, 0)
+
+	tags, ok := Attr[[]int]("note", "tags").Get(entity)
+	tu.ExpectEqual(t, ok, false)
+	tu.ExpectEqual(t, len(tags), 0)
+}
+
+func TestTypedAttributeRetractMany(t *testing.T) {
+	conn := typedConn(t)
+
+	note := Tempid(DbPartUser, -1)
+	txResult, err := Transact(conn, Datums(
+		noteTags.Datum(Id(note), []string{"todo", "shopping", "home"})))
+	tu.RequireNil(t, err)
+	id := Id(txResult.Tempids[note])
+
+	txResult, err = Transact(conn, Datums(noteTags.Retraction(id, []string{"todo", "home"})))
+	tu.RequireNil(t, err)
+	tags, ok := noteTags.Get(txResult.DbAfter.Entity(int(id)))
+	tu.ExpectEqual(t, ok, true)
+	tu.ExpectEqual(t, tags, []string{"shopping"})
+
+	_, err = Transact(conn, Datums(Attr[[]int]("note", "tags").Retraction(id, []int{1})))
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+}
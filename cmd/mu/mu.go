@@ -6,10 +6,14 @@ import (
 	"github.com/heyLu/edn"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/heyLu/mu"
 	"github.com/heyLu/mu/database"
 	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/query"
 	"github.com/heyLu/mu/transactor"
 
 	_ "github.com/heyLu/mu/store/bolt"
@@ -165,13 +169,29 @@ func main() {
 			log.Fatal(err)
 		}
 
-		res, err := mu.Q(q, db)
+		// additional arguments are inputs for :in
+		inputs := []interface{}{db}
+		for _, arg := range flag.Args()[3:] {
+			input, err := edn.DecodeString(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			inputs = append(inputs, input)
+		}
+
+		res, err := mu.Q(q, inputs...)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		for tuple, _ := range res {
-			fmt.Println(tuple)
+		if maps := res.Sort().Maps(); maps != nil {
+			for _, m := range maps {
+				fmt.Println(formatValue(m))
+			}
+			break
+		}
+		for _, row := range res.Rows() {
+			fmt.Println(formatValue(row))
 		}
 
 	default:
@@ -201,3 +221,43 @@ func printDatoms(iter index.Iterator) {
 		fmt.Println(datom)
 	}
 }
+
+// formatValue formats query results like EDN, so that strings are
+// quoted and documents are printed as maps.
+func formatValue(val interface{}) string {
+	switch val := val.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(val)
+	case []interface{}:
+		vals := make([]string, len(val))
+		for i, v := range val {
+			vals[i] = formatValue(v)
+		}
+		return "[" + strings.Join(vals, " ") + "]"
+	case *query.Collection:
+		return formatValue(val.Values)
+	case *query.Document:
+		m := make(map[interface{}]interface{}, len(val.Attrs))
+		for k, v := range val.Attrs {
+			m[k] = v
+		}
+		return formatValue(m)
+	case map[database.Keyword]interface{}:
+		m := make(map[interface{}]interface{}, len(val))
+		for k, v := range val {
+			m[k] = v
+		}
+		return formatValue(m)
+	case map[interface{}]interface{}:
+		entries := make([]string, 0, len(val))
+		for k, v := range val {
+			entries = append(entries, formatValue(k)+" "+formatValue(v))
+		}
+		sort.Strings(entries)
+		return "{" + strings.Join(entries, ", ") + "}"
+	default:
+		return fmt.Sprint(val)
+	}
+}
@@ -30,6 +30,13 @@ type findTuple struct {
 
 type findElem interface{}
 
+// return-keys                = (':keys' | ':strs' | ':syms') plain-symbol+
+
+type returnKeys struct {
+	kind edn.Keyword
+	keys []edn.Symbol
+}
+
 // pull-expr                  = ['pull' variable pattern]
 // pattern                    = (input-name | pattern-data-literal)
 // aggregate                  = [aggregate-fn-name fn-arg+]
@@ -87,11 +94,38 @@ type andClause struct {
 
 type expressionClause interface{}
 
-// TODO: rule-expr
-// TODO: not-clause
-// TODO: not-join-clause
-// TODO: or-clause
-// TODO: or-join-clause
+type ruleExpr struct {
+	source srcVar
+	name   plainSymbol
+	args   []patternValue
+}
+
+type notClause struct {
+	source  srcVar
+	clauses []clause
+}
+
+type notJoinClause struct {
+	source  srcVar
+	vars    []variable
+	clauses []clause
+}
+
+type orClause struct {
+	source  srcVar
+	clauses []clause // clause or andClause
+}
+
+type orJoinClause struct {
+	source  srcVar
+	vars    ruleVars
+	clauses []clause // clause or andClause
+}
+
+type ruleVars struct {
+	required []variable
+	free     []variable
+}
 
 type clause interface{}
 
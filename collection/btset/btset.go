@@ -674,12 +674,13 @@ func internalDistance(node anyNode, left, right, level int) int {
 		if idxL == idxR {
 			return internalDistance(node.(*pointerNode).pointers[idxL], left, right, level-levelShift)
 		} else {
+			// each child at this level contains avgLen^(level/levelShift)
+			// keys on average
 			res := idxR - idxL
-			if 0 == level {
-				return res
-			} else {
-				return res * avgLen
+			for l := level; l > 0; l -= levelShift {
+				res *= avgLen
 			}
+			return res
 		}
 	} else {
 		return idxR - idxL
@@ -887,6 +888,19 @@ func Slice(set *Set, keys ...interface{}) SetIter {
 	}
 }
 
+// EstimateCount estimates the number of keys between keyFrom and keyTo
+// without iterating over them.
+//
+// Counts within a leaf are exact, larger ones assume that all nodes
+// are of average length.
+func EstimateCount(set *Set, keyFrom, keyTo interface{}) int {
+	iter := internalSlice(set, keyFrom, keyTo)
+	if iter == nil {
+		return 0
+	}
+	return iter.estimateCount()
+}
+
 // public interface
 
 func alterSet(set *Set, root anyNode, shift, cnt int) *Set {
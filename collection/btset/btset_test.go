@@ -176,6 +176,24 @@ func TestSliceStart(t *testing.T) {
 	tu.ExpectEqual(t, iter.First(), c.Int(5))
 }
 
+func TestEstimateCount(t *testing.T) {
+	set := NewComparable()
+	for i := 0; i < 100000; i++ {
+		set = set.Conj(c.Int(i))
+	}
+
+	// exact within a leaf
+	tu.ExpectEqual(t, EstimateCount(set, c.Int(10), c.Int(19)), 10)
+	tu.ExpectEqual(t, EstimateCount(set, c.Int(10), c.Int(10)), 1)
+	tu.ExpectEqual(t, EstimateCount(set, c.Int(200000), c.Int(300000)), 0)
+
+	for _, r := range [][2]int{{0, 99999}, {1000, 50000}, {500, 5000}} {
+		n := r[1] - r[0] + 1
+		estimate := EstimateCount(set, c.Int(r[0]), c.Int(r[1]))
+		tu.ExpectEqual(t, estimate > n/4 && estimate < n*4, true)
+	}
+}
+
 func BenchmarkConj(b *testing.B) {
 	set := NewComparable()
 	for i := 0; i < b.N; i++ {
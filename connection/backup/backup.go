@@ -36,6 +36,10 @@ func (c *Connection) Transact([]transactor.TxDatum) (*transactor.TxResult, error
 	return nil, fmt.Errorf(".Transact is not supported on backups")
 }
 
+func (c *Connection) TransactWithOptions([]transactor.TxDatum, transactor.Options) (*transactor.TxResult, error) {
+	return nil, fmt.Errorf(".TransactWithOptions is not supported on backups")
+}
+
 func New(u *url.URL) (connection.Connection, error) {
 	baseDir := u.Host + u.Path
 	rootId := u.Query().Get("root")
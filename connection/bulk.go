@@ -0,0 +1,564 @@
+package connection
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/heyLu/fressian"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/heyLu/mu/comparable"
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/log"
+	"github.com/heyLu/mu/store"
+	"github.com/heyLu/mu/transactor"
+)
+
+const (
+	// the number of datoms that are sorted in memory before they are
+	// written to a temporary file
+	sortRunSize = 100000
+	// the number of transactions per log segment written by BulkImport
+	logSegmentSize = 1000
+	// the number of datoms imported by BulkImport before they are
+	// merged into the indexes in the store, so that the imported
+	// datoms don't have to be kept in memory.  every merge rewrites the
+	// segments the datoms are added to, so larger values trade memory
+	// for fewer writes.
+	bulkFlushSize = 1000000
+)
+
+// A TxDataIterator returns the tx data of the transactions to import,
+// see BulkImport.
+type TxDataIterator interface {
+	// Next returns the tx data of the next transaction, or nil if
+	// there are no more transactions.
+	Next() ([]transactor.TxDatum, error)
+}
+
+type txDataSlice struct {
+	txs [][]transactor.TxDatum
+}
+
+// TxDataFromSlice returns an iterator over the tx data of the
+// transactions.
+func TxDataFromSlice(txs [][]transactor.TxDatum) TxDataIterator {
+	return &txDataSlice{txs}
+}
+
+func (s *txDataSlice) Next() ([]transactor.TxDatum, error) {
+	if len(s.txs) == 0 {
+		return nil, nil
+	}
+	txData := s.txs[0]
+	s.txs = s.txs[1:]
+	return txData, nil
+}
+
+// BulkImportResult describes the outcome of a bulk import.
+type BulkImportResult struct {
+	DbBefore *database.Db
+	DbAfter  *database.Db
+	Txs      int // the number of imported transactions
+	Datoms   int // the number of imported datoms
+}
+
+// BulkImport transacts all transactions returned by txs, one after
+// another, but writes the result to the store only once.
+//
+// Each transaction is validated and gets its ids assigned as with
+// Transact, see transactor.Importer, but instead of rewriting the db
+// root for every one of them, the datoms are sorted per index (using
+// temporary files if there are many of them) and merged into the
+// index segments.  This happens every bulkFlushSize datoms as well,
+// and the following transactions are validated against the merged
+// indexes, so that the imported datoms are not kept in memory.  At
+// the end a single new db root is written, and the transactions are
+// added to the log as segments.
+//
+// Transactions that excise datoms can't be imported.  If any
+// transaction fails, nothing is written to the db root and the
+// segments written by the import are removed again.  If another
+// connection changes the database during the import, it fails with a
+// Conflict anomaly.
+//
+// Connections that are not backed by a store transact the
+// transactions one by one.
+func BulkImport(conn Connection, txs TxDataIterator) (*BulkImportResult, error) {
+	if c, ok := conn.(*storeConnection); ok {
+		return c.bulkImport(txs, bulkFlushSize)
+	}
+
+	result := &BulkImportResult{DbBefore: conn.Db(), DbAfter: conn.Db()}
+	for {
+		txData, err := txs.Next()
+		if err != nil {
+			return nil, err
+		}
+		if txData == nil {
+			break
+		}
+
+		txResult, err := conn.Transact(txData)
+		if err != nil {
+			return nil, fmt.Errorf("tx %d: %w", result.Txs, err)
+		}
+		result.DbAfter = txResult.DbAfter
+		result.Txs += 1
+		result.Datoms += len(txResult.Datoms)
+	}
+	return result, nil
+}
+
+// bulkIndex is an index that a bulk import adds datoms to.
+type bulkIndex struct {
+	name           string
+	compare        comparable.CompareFn
+	segmentCompare index.CompareFn
+	sorter         *datomSorter
+}
+
+// bulkImport imports the transactions, see BulkImport.  The imported
+// datoms are merged into the indexes in the store every flushSize
+// datoms.
+func (c *storeConnection) bulkImport(txs TxDataIterator, flushSize int) (*BulkImportResult, error) {
+	c.txLock.Lock()
+	defer c.txLock.Unlock()
+
+	dir, err := os.MkdirTemp("", "mu-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	indexes := []*bulkIndex{
+		{name: "eavt-main", compare: index.CompareEavt, segmentCompare: index.CompareEavtIndex},
+		{name: "aevt-main", compare: index.CompareAevt, segmentCompare: index.CompareAevtIndex},
+		{name: "avet-main", compare: index.CompareAvet, segmentCompare: index.CompareAvetIndex},
+		{name: "raet-main", compare: index.CompareVaet, segmentCompare: index.CompareVaetIndex},
+	}
+	flushes := 0
+	newSorters := func() {
+		for i, idx := range indexes {
+			idx.sorter = newDatomSorter(idx.compare, filepath.Join(dir, fmt.Sprintf("%d-%d", flushes, i)))
+		}
+	}
+	newSorters()
+
+	// the ids of the values written by the import that are still in
+	// use, which are removed again if the import fails
+	written := map[string]bool{}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		ids := make([]string, 0, len(written))
+		for id := range written {
+			ids = append(ids, id)
+		}
+		c.removeWritten(ids)
+	}()
+	put := func(handler fressian.WriteHandler) index.PutFn {
+		putValue := storePut(c.store, handler)
+		return func(val interface{}) (string, error) {
+			id, err := putValue(val)
+			if err == nil {
+				written[id] = true
+			}
+			return id, err
+		}
+	}
+	// release removes values that were replaced, if they were written
+	// by the import.  The values of the database from before the import
+	// are kept, because other connections might still read them.
+	release := func(ids []string) error {
+		for _, id := range ids {
+			if !written[id] {
+				continue
+			}
+			delete(written, id)
+			err := c.removeFromStore([]string{id})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	result := &BulkImportResult{DbBefore: c.db}
+	newLog := c.log
+	pending := []log.LogTx{}
+	writeLogSegment := func() error {
+		oldRootId := newLog.RootId
+		l, err := newLog.WithSegment(put(log.WriteHandler), pending)
+		if err != nil {
+			return err
+		}
+		newLog = l
+		pending = []log.LogTx{}
+		return release([]string{oldRootId})
+	}
+
+	// the transactions in the log tail are not part of the index
+	// segments yet, so they are merged into them with the imported
+	// ones
+	for _, tx := range c.log.Tail {
+		err = addToIndexes(c.db, indexes, tx.Datoms)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	importer := transactor.NewImporter(c.db)
+	indexRootId := c.indexRootId
+	unflushed := 0
+	for {
+		txData, err := txs.Next()
+		if err != nil {
+			return nil, err
+		}
+		if txData == nil {
+			break
+		}
+
+		db := importer.Db()
+		tx, err := importer.Transact(txData)
+		if err != nil {
+			return nil, fmt.Errorf("tx %d: %w", result.Txs, err)
+		}
+
+		err = addToIndexes(db, indexes, tx.Datoms)
+		if err != nil {
+			return nil, err
+		}
+
+		pending = append(pending, *tx)
+		if len(pending) >= logSegmentSize {
+			err = writeLogSegment()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result.Txs += 1
+		result.Datoms += len(tx.Datoms)
+
+		unflushed += len(tx.Datoms)
+		if unflushed >= flushSize {
+			indexRootId, err = c.mergeImportIndexes(indexRootId, importer.Db(), indexes, put, release)
+			if err != nil {
+				return nil, err
+			}
+			importer.Reset(dbFromLog(c.store, indexRootId, newLog))
+
+			flushes += 1
+			newSorters()
+			unflushed = 0
+		}
+	}
+
+	if result.Txs == 0 {
+		result.DbAfter = c.db
+		return result, nil
+	}
+
+	if len(pending) > 0 {
+		err = writeLogSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	indexRootId, err = c.mergeImportIndexes(indexRootId, importer.Db(), indexes, put, release)
+	if err != nil {
+		return nil, err
+	}
+
+	rootData, err := c.writeDbRoot(indexRootId, newLog)
+	if err == errRootChanged {
+		// the transactions were validated against the old database, so
+		// they can't simply be retried like in commit
+		return nil, &transactor.Anomaly{
+			Category: transactor.Conflict,
+			Message:  "database was changed by another connection during the bulk import",
+			Err:      err,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	committed = true
+
+	newDb := dbFromLog(c.store, indexRootId, newLog)
+
+	c.lock.Lock()
+	c.db = newDb
+	c.log = newLog
+	c.indexRootId = indexRootId
+	c.rootData = rootData
+	c.lock.Unlock()
+
+	result.DbAfter = newDb
+	return result, nil
+}
+
+// addToIndexes adds the datoms to the sorters of the indexes they
+// belong to.
+func addToIndexes(db *database.Db, indexes []*bulkIndex, datoms []index.Datom) error {
+	avetDatoms, vaetDatoms := database.FilterAvetAndVaet(db, datoms)
+	for i, datoms := range [][]index.Datom{datoms, datoms, avetDatoms, vaetDatoms} {
+		err := indexes[i].sorter.add(datoms)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeImportIndexes merges the sorted imported datoms into the
+// indexes of the index root, see index.SegmentedIndex.Merge, and
+// writes a new index root for them with the basis of db.
+//
+// It returns the id of the new index root.  The replaced segments and
+// roots are passed to release.
+func (c *storeConnection) mergeImportIndexes(indexRootId string, db *database.Db, indexes []*bulkIndex, put func(fressian.WriteHandler) index.PutFn, release func([]string) error) (string, error) {
+	indexRoot := index.GetFromCache(c.store, indexRootId).(map[interface{}]interface{})
+	newIndexRoot := make(map[interface{}]interface{}, len(indexRoot))
+	for k, v := range indexRoot {
+		newIndexRoot[k] = v
+	}
+
+	putSegment := put(index.SegmentWriteHandler)
+	replaced := []string{}
+	for _, idx := range indexes {
+		key := fressian.Keyword{"", idx.name}
+		rootId := indexRoot[key].(fressian.UUID).String()
+		root := index.GetRoot(c.store, rootId)
+
+		sorted, err := idx.sorter.iterator()
+		if err != nil {
+			return "", err
+		}
+		segmented, replacedIds, err := index.NewSegmentedIndex(&root, c.store, idx.segmentCompare).Merge(sorted, putSegment)
+		if err != nil {
+			return "", err
+		}
+		if idx.sorter.err != nil {
+			return "", idx.sorter.err
+		}
+		err = idx.sorter.remove()
+		if err != nil {
+			return "", err
+		}
+
+		newRootId, err := putSegment(segmented.Root())
+		if err != nil {
+			return "", err
+		}
+		newRootUUID, err := fressian.NewUUIDFromString(newRootId)
+		if err != nil {
+			return "", err
+		}
+		newIndexRoot[key] = *newRootUUID
+		replaced = append(replaced, replacedIds...)
+		replaced = append(replaced, rootId)
+	}
+	newIndexRoot[fressian.Keyword{"", "nextT"}] = db.NextT() - 1
+	newIndexRoot[fressian.Keyword{"", "basisT"}] = db.BasisT()
+
+	newIndexRootId, err := put(nil)(newIndexRoot)
+	if err != nil {
+		return "", err
+	}
+
+	return newIndexRootId, release(append(replaced, indexRootId))
+}
+
+// removeFromStore removes the values from the store and the cache.
+func (c *storeConnection) removeFromStore(ids []string) error {
+	for _, id := range ids {
+		index.RemoveFromCache(id)
+		err := c.store.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storePut returns a function that writes values to new ids in the
+// store.
+func storePut(store store.Store, handler fressian.WriteHandler) index.PutFn {
+	return func(val interface{}) (string, error) {
+		id := log.Squuid().String()
+		return id, writeToStore(store, handler, id, val)
+	}
+}
+
+// recordingPut is like storePut, but adds the ids it writes to ids.
+func recordingPut(store store.Store, handler fressian.WriteHandler, ids *[]string) index.PutFn {
+	put := storePut(store, handler)
+	return func(val interface{}) (string, error) {
+		id, err := put(val)
+		if err == nil {
+			*ids = append(*ids, id)
+		}
+		return id, err
+	}
+}
+
+// datomSorter sorts datoms that might not fit into memory.
+//
+// The datoms are sorted in runs of runSize datoms, which are
+// written to temporary files and merged when iterating over them.
+type datomSorter struct {
+	compare comparable.CompareFn
+	prefix  string
+	runSize int
+	datoms  []index.Datom
+	runs    []string
+	err     error
+}
+
+func newDatomSorter(compare comparable.CompareFn, prefix string) *datomSorter {
+	return &datomSorter{compare: compare, prefix: prefix, runSize: sortRunSize}
+}
+
+func (s *datomSorter) add(datoms []index.Datom) error {
+	s.datoms = append(s.datoms, datoms...)
+	if len(s.datoms) >= s.runSize {
+		return s.writeRun()
+	}
+	return nil
+}
+
+func (s *datomSorter) sort() {
+	sort.Slice(s.datoms, func(i, j int) bool {
+		return s.compare(&s.datoms[i], &s.datoms[j]) < 0
+	})
+}
+
+func (s *datomSorter) writeRun() error {
+	s.sort()
+
+	name := fmt.Sprintf("%s-%d", s.prefix, len(s.runs))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = writeDatoms(f, s.datoms)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	s.runs = append(s.runs, name)
+	s.datoms = s.datoms[:0]
+	return nil
+}
+
+func writeDatoms(f *os.File, datoms []index.Datom) error {
+	buf := bufio.NewWriter(f)
+	w := fressian.NewWriter(buf, log.WriteHandler)
+	err := w.WriteValue(len(datoms))
+	if err != nil {
+		return err
+	}
+	for _, datom := range datoms {
+		err = w.WriteValue(datom)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return buf.Flush()
+}
+
+// iterator returns an iterator over all added datoms in sorted order.
+//
+// Errors that occur while reading the temporary files stop the
+// iteration and are stored in s.err.
+func (s *datomSorter) iterator() (index.Iterator, error) {
+	s.sort()
+	iters := []index.Iterator{&sliceIterator{s.datoms}}
+	for _, name := range s.runs {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		r := fressian.NewReader(bufio.NewReader(f), log.ReadHandlers)
+		count, err := r.ReadValue()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		iters = append(iters, &runIterator{s, f, r, count.(int)})
+	}
+	return index.MergeIterators(s.compare, iters...), nil
+}
+
+// remove removes the temporary files of the runs.
+func (s *datomSorter) remove() error {
+	for _, name := range s.runs {
+		err := os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	s.runs = nil
+	return nil
+}
+
+type sliceIterator struct {
+	datoms []index.Datom
+}
+
+func (i *sliceIterator) Next() *index.Datom {
+	if len(i.datoms) == 0 {
+		return nil
+	}
+	datom := &i.datoms[0]
+	i.datoms = i.datoms[1:]
+	return datom
+}
+
+func (i *sliceIterator) Reverse() index.Iterator {
+	panic("not implemented")
+}
+
+// runIterator reads the datoms of a run written by
+// datomSorter.writeRun.
+type runIterator struct {
+	sorter    *datomSorter
+	f         *os.File
+	r         *fressian.Reader
+	remaining int
+}
+
+func (i *runIterator) Next() *index.Datom {
+	if i.remaining == 0 || i.sorter.err != nil {
+		i.f.Close()
+		return nil
+	}
+
+	val, err := i.r.ReadValue()
+	if val == nil && err != nil {
+		i.sorter.err = err
+		i.f.Close()
+		return nil
+	}
+	i.remaining -= 1
+	return val.(*index.Datom)
+}
+
+func (i *runIterator) Reverse() index.Iterator {
+	panic("not implemented")
+}
@@ -0,0 +1,289 @@
+package connection
+
+import (
+	"fmt"
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+	"github.com/heyLu/mu/store"
+	"github.com/heyLu/mu/transactor"
+)
+
+func connect(t *testing.T, rawUrl string) Connection {
+	u, err := url.Parse(rawUrl)
+	tu.RequireNil(t, err)
+	conn, err := New(u)
+	tu.RequireNil(t, err)
+	return conn
+}
+
+func mustTransact(t *testing.T, conn Connection, edn string) *transactor.TxResult {
+	return testutil.MustTransact(t, transactor.TxDataFromEDN, conn.Transact, edn)
+}
+
+func TestBulkImport(t *testing.T) {
+	rawUrl := "memory://bulk?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl)
+
+	mustTransact(t, conn, `[{:db/id #db/id[:db.part/db]
+  :db/ident :bookmark/url
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}
+ {:db/id #db/id[:db.part/db]
+  :db/ident :bookmark/tag
+  :db/valueType :db.type/ref
+  :db/cardinality :db.cardinality/many}
+ {:db/id #db/id[:db.part/user]
+  :db/ident :bookmark.tag/go}]`)
+
+	urlAttr := database.Keyword{fressian.Keyword{"bookmark", "url"}}
+	tagAttr := database.Keyword{fressian.Keyword{"bookmark", "tag"}}
+	goTag := database.Keyword{fressian.Keyword{"bookmark.tag", "go"}}
+
+	// enough datoms to need multiple segments
+	txs := [][]transactor.TxDatum{}
+	for i := 0; i < 600; i++ {
+		id := database.Id(-(transactor.DbPartUser*(1<<42) + 1))
+		txs = append(txs, []transactor.TxDatum{
+			transactor.Datum{Op: transactor.Assert, E: id, A: urlAttr, V: transactor.NewValue(fmt.Sprintf("https://example.com/%d", i))},
+			transactor.Datum{Op: transactor.Assert, E: id, A: tagAttr, V: transactor.NewValue(goTag)},
+		})
+	}
+
+	result, err := BulkImport(conn, TxDataFromSlice(txs))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, result.Txs, 600)
+	// two datoms and :db/txInstant per transaction
+	tu.ExpectEqual(t, result.Datoms, 1800)
+	tu.ExpectEqual(t, conn.Db().BasisT(), result.DbAfter.BasisT())
+	tu.ExpectEqual(t, result.DbAfter.BasisT() > result.DbBefore.BasisT(), true)
+
+	checkDb := func(db *database.Db) {
+		for _, i := range []int{0, 299, 599} {
+			lookup := database.LookupRef{urlAttr, index.NewValue(fmt.Sprintf("https://example.com/%d", i))}
+			id, err := lookup.Lookup(db)
+			tu.RequireNil(t, err)
+			tags := db.Entity(id).Get(tagAttr).([]interface{})
+			tu.RequireEqual(t, len(tags), 1)
+			tu.ExpectEqual(t, tags[0].(database.Entity).Get(database.Keyword{fressian.Keyword{"db", "ident"}}), goTag.Keyword)
+		}
+
+		// the schema from before the import is still there
+		tu.ExpectEqual(t, db.Attribute(db.Entid(urlAttr)).Unique(), database.UniqueIdentity)
+
+		count := 0
+		iter := db.Vaet().Datoms2(goTag, tagAttr, nil)
+		for datom := iter.Next(); datom != nil; datom = iter.Next() {
+			count += 1
+		}
+		tu.ExpectEqual(t, count, 600)
+	}
+	checkDb(conn.Db())
+
+	// the imported transactions are in the log
+	txsInLog, err := conn.Log().Txs()
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, txsInLog[len(txsInLog)-1].T, result.DbAfter.BasisT())
+	for _, i := range []int{0, len(txsInLog) / 2, len(txsInLog) - 1} {
+		tx, err := conn.Log().Tx(txsInLog[i].T)
+		tu.RequireNil(t, err)
+		tu.RequireEqual(t, tx != nil, true)
+		tu.ExpectEqual(t, tx.Id, txsInLog[i].Id)
+		tu.ExpectEqual(t, len(tx.Datoms), len(txsInLog[i].Datoms))
+	}
+	tx, err := conn.Log().Tx(result.DbAfter.BasisT() + 1)
+	tu.ExpectNil(t, err)
+	tu.ExpectEqual(t, tx == nil, true)
+
+	// other connections see the imported data
+	other := connect(t, rawUrl)
+	checkDb(other.Db())
+	tu.ExpectEqual(t, other.Db().BasisT(), result.DbAfter.BasisT())
+
+	// transactions after the import get new ids
+	txResult := mustTransact(t, other, `[{:db/id #db/id[:db.part/user] :bookmark/url "https://example.com/new"}]`)
+	for _, id := range txResult.Tempids {
+		tu.ExpectEqual(t, id%(1<<42) > result.DbAfter.BasisT(), true)
+	}
+	tu.ExpectEqual(t, txResult.DbAfter.BasisT() > result.DbAfter.BasisT(), true)
+
+	// a failing transaction stops the import
+	_, err = BulkImport(other, TxDataFromSlice([][]transactor.TxDatum{
+		{transactor.Datum{Op: transactor.Assert, E: database.Id(-(transactor.DbPartUser*(1<<42) + 1)), A: urlAttr, V: transactor.NewValue(42)}},
+	}))
+	tu.RequireNotNil(t, err)
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+	tu.ExpectEqual(t, other.Db().BasisT(), txResult.DbAfter.BasisT())
+}
+
+func TestDatomSorter(t *testing.T) {
+	sorter := newDatomSorter(index.CompareEavt, filepath.Join(t.TempDir(), "eavt"))
+	sorter.runSize = 3
+
+	tx := 3*(1<<42) + 1000
+	for _, e := range []int{5, 3, 9, 1, 7, 2, 8, 4, 6} {
+		err := sorter.add([]index.Datom{index.NewDatom(e, 10, "value", tx, true)})
+		tu.RequireNil(t, err)
+	}
+	tu.ExpectEqual(t, len(sorter.runs), 3)
+
+	iter, err := sorter.iterator()
+	tu.RequireNil(t, err)
+	for e := 1; e <= 9; e++ {
+		datom := iter.Next()
+		tu.RequireNotNil(t, datom)
+		tu.ExpectEqual(t, datom.E(), e)
+		tu.ExpectEqual(t, datom.Tx(), tx)
+		tu.ExpectEqual(t, datom.V().Val(), "value")
+	}
+	tu.ExpectNil(t, iter.Next())
+	tu.ExpectNil(t, sorter.err)
+}
+
+// interferingTxs transacts on another connection before returning the
+// tx data.
+type interferingTxs struct {
+	TxDataIterator
+	t     *testing.T
+	other Connection
+}
+
+func (i *interferingTxs) Next() ([]transactor.TxDatum, error) {
+	if i.other != nil {
+		mustTransact(i.t, i.other, `[{:db/id #db/id[:db.part/user] :db/doc "concurrent"}]`)
+		i.other = nil
+	}
+	return i.TxDataIterator.Next()
+}
+
+func TestBulkImportConflict(t *testing.T) {
+	rawUrl := "memory://bulk?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl)
+	other := connect(t, rawUrl)
+
+	txData, err := transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user] :db/doc "imported"}]`)
+	tu.RequireNil(t, err)
+	c := conn.(*storeConnection)
+	recording := &conflictingStore{CASStore: c.store.(store.CASStore)}
+	c.store = recording
+
+	_, err = BulkImport(conn, &interferingTxs{TxDataFromSlice([][]transactor.TxDatum{txData}), t, other})
+	tu.RequireNotNil(t, err)
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Conflict)
+
+	// everything written by the import is removed again
+	tu.RequireEqual(t, len(recording.written) > 0, true)
+	for _, id := range recording.written {
+		_, err := recording.Get(id)
+		tu.ExpectNotNil(t, err)
+	}
+
+	// the connection still works afterwards
+	mustTransact(t, conn, `[{:db/id #db/id[:db.part/user] :db/doc "later"}]`)
+	tu.ExpectEqual(t, conn.Db().BasisT() > other.Db().BasisT(), true)
+}
+
+func TestBulkImportFlush(t *testing.T) {
+	rawUrl := "memory://bulk?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl)
+
+	mustTransact(t, conn, testutil.Schema(
+		testutil.One("bookmark/url", "string").Identity(),
+		testutil.One("bookmark/visits", "long")))
+
+	c := conn.(*storeConnection)
+	counting := &countingStore{Store: c.store, puts: map[string]int{}, deletes: map[string]int{}}
+	c.store = counting
+
+	urlAttr := database.Keyword{fressian.Keyword{"bookmark", "url"}}
+	visitsAttr := database.Keyword{fressian.Keyword{"bookmark", "visits"}}
+
+	// the second half of the transactions upserts the entities of the
+	// first half, which are only in the flushed indexes by then
+	txs := [][]transactor.TxDatum{}
+	for i := 0; i < 600; i++ {
+		id := database.Id(-(transactor.DbPartUser*(1<<42) + 1))
+		txs = append(txs, []transactor.TxDatum{
+			transactor.Datum{Op: transactor.Assert, E: id, A: urlAttr, V: transactor.NewValue(fmt.Sprintf("https://example.com/%d", i%300))},
+			transactor.Datum{Op: transactor.Assert, E: id, A: visitsAttr, V: transactor.NewValue(i / 300)},
+		})
+	}
+
+	result, err := c.bulkImport(TxDataFromSlice(txs), 200)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, result.Txs, 600)
+
+	// the indexes written by the flushes are removed again
+	tu.ExpectEqual(t, len(counting.deletes) > 0, true)
+	for id := range counting.deletes {
+		tu.ExpectEqual(t, counting.puts[id], 1)
+	}
+
+	checkDb := func(db *database.Db) {
+		count := 0
+		iter := db.Aevt().Datoms2(urlAttr, nil, nil)
+		for datom := iter.Next(); datom != nil; datom = iter.Next() {
+			count += 1
+			tu.ExpectEqual(t, db.Entity(datom.E()).Get(visitsAttr), 1)
+		}
+		tu.ExpectEqual(t, count, 300)
+	}
+	checkDb(conn.Db())
+	checkDb(connect(t, rawUrl).Db())
+}
+
+func TestBulkImportFailureAfterFlush(t *testing.T) {
+	rawUrl := "memory://bulk?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl)
+
+	mustTransact(t, conn, testutil.Schema(testutil.One("bookmark/url", "string")))
+	basisT := conn.Db().BasisT()
+
+	c := conn.(*storeConnection)
+	counting := &countingStore{Store: c.store, puts: map[string]int{}, deletes: map[string]int{}}
+	c.store = counting
+
+	urlAttr := database.Keyword{fressian.Keyword{"bookmark", "url"}}
+	txs := [][]transactor.TxDatum{}
+	for i := 0; i < 1200; i++ {
+		txs = append(txs, []transactor.TxDatum{
+			transactor.Datum{Op: transactor.Assert, E: database.Id(-(transactor.DbPartUser*(1<<42) + 1)), A: urlAttr, V: transactor.NewValue(fmt.Sprintf("https://example.com/%d", i))},
+		})
+	}
+	txs = append(txs, []transactor.TxDatum{
+		transactor.Datum{Op: transactor.Assert, E: database.Id(-(transactor.DbPartUser*(1<<42) + 1)), A: urlAttr, V: transactor.NewValue(42)},
+	})
+
+	_, err = c.bulkImport(TxDataFromSlice(txs), 200)
+	tu.RequireNotNil(t, err)
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+
+	// the flushed indexes and log segments are removed again
+	tu.ExpectEqual(t, len(counting.puts) > 0, true)
+	for id := range counting.puts {
+		tu.ExpectEqual(t, counting.deletes[id], 1)
+	}
+
+	tu.ExpectEqual(t, conn.Db().BasisT(), basisT)
+	mustTransact(t, conn, `[{:db/id #db/id[:db.part/user] :bookmark/url "https://example.com/later"}]`)
+	tu.ExpectEqual(t, connect(t, rawUrl).Db().BasisT(), conn.Db().BasisT())
+}
@@ -18,6 +18,45 @@ type Connection interface {
 	Log() *txlog.Log
 	Index(datoms []index.Datom) error
 	Transact(datoms []transactor.TxDatum) (*transactor.TxResult, error)
+	TransactWithOptions(datoms []transactor.TxDatum, opts transactor.Options) (*transactor.TxResult, error)
+}
+
+// An AsyncConnection is a connection that can commit transactions in
+// the background, see TransactAsync.
+type AsyncConnection interface {
+	Connection
+	TransactAsync(datoms []transactor.TxDatum) *Future
+}
+
+// TransactAsync submits the datoms and returns immediately, the result
+// is available from the future once the transaction was committed.
+// Transactions are committed in the order they were submitted.
+//
+// Connections that are not AsyncConnections transact the datoms
+// synchronously and return a future that is already done.
+func TransactAsync(conn Connection, datoms []transactor.TxDatum) *Future {
+	if async, ok := conn.(AsyncConnection); ok {
+		return async.TransactAsync(datoms)
+	}
+	return CompletedFuture(conn.Transact(datoms))
+}
+
+// TransactIf transacts the datoms only if no transaction was committed
+// since expectedBasisT, otherwise it fails with a
+// *transactor.BasisConflictError.
+func TransactIf(conn Connection, expectedBasisT int, datoms []transactor.TxDatum) (*transactor.TxResult, error) {
+	opts := transactor.DefaultOptions
+	opts.IfBasisT = &expectedBasisT
+	return conn.TransactWithOptions(datoms, opts)
+}
+
+// TransactIfUntouched is like TransactIf, but only fails if one of the
+// entities was changed since expectedBasisT.
+func TransactIfUntouched(conn Connection, expectedBasisT int, entities []database.HasLookup, datoms []transactor.TxDatum) (*transactor.TxResult, error) {
+	opts := transactor.DefaultOptions
+	opts.IfBasisT = &expectedBasisT
+	opts.IfUntouched = entities
+	return conn.TransactWithOptions(datoms, opts)
 }
 
 var registeredConnectors = map[string]Connector{}
@@ -88,10 +88,17 @@ func (c *Connection) Index(datoms []index.Datom) error {
 }
 
 func (c *Connection) Transact(datoms []transactor.TxDatum) (*transactor.TxResult, error) {
-	txResult, err := c.conn.Transact(datoms)
+	return c.TransactWithOptions(datoms, transactor.DefaultOptions)
+}
+
+func (c *Connection) TransactWithOptions(datoms []transactor.TxDatum, opts transactor.Options) (*transactor.TxResult, error) {
+	txResult, err := c.conn.TransactWithOptions(datoms, opts)
 	if err != nil {
 		return nil, err
 	}
+	if txResult.Replayed {
+		return txResult, nil
+	}
 
 	err = c.Index(nil)
 	if err != nil {
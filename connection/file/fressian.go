@@ -35,6 +35,8 @@ var ReadHandlers = map[string]fressian.ReadHandler{
 	},
 	"mu.memory.Index":   index.MemoryReadHandlers["mu.memory.Index"],
 	"mu.Datom":          index.ReadHandlers["mu.Datom"],
+	"uri":               index.ReadHandlers["uri"],
+	"bigdec":            index.ReadHandlers["bigdec"],
 	"btset.Set":         btset.ReadHandlers["btset.Set"],
 	"btset.PointerNode": btset.ReadHandlers["btset.PointerNode"],
 	"btset.LeafNode":    btset.ReadHandlers["btset.LeafNode"],
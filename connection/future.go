@@ -0,0 +1,54 @@
+package connection
+
+import (
+	"context"
+
+	"github.com/heyLu/mu/transactor"
+)
+
+// A Future is the result of a transaction that might not be committed
+// yet, see TransactAsync.
+type Future struct {
+	done     chan struct{}
+	txResult *transactor.TxResult
+	err      error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// CompletedFuture returns a future that is already done, for
+// connections that commit transactions synchronously.
+func CompletedFuture(txResult *transactor.TxResult, err error) *Future {
+	f := newFuture()
+	f.deliver(txResult, err)
+	return f
+}
+
+func (f *Future) deliver(txResult *transactor.TxResult, err error) {
+	f.txResult = txResult
+	f.err = err
+	close(f.done)
+}
+
+// Done returns a channel that is closed once the transaction is
+// committed or has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Deref waits until the transaction is committed and returns its
+// result.
+//
+// If the context is done before that, the context's error is returned
+// instead.  The transaction is not cancelled in that case, it might
+// still be committed later.
+func (f *Future) Deref(ctx context.Context) (*transactor.TxResult, error) {
+	select {
+	case <-f.done:
+		return f.txResult, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
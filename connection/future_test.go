@@ -0,0 +1,31 @@
+package connection
+
+import (
+	"context"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+	"time"
+
+	"github.com/heyLu/mu/transactor"
+)
+
+func TestFutureDeref(t *testing.T) {
+	future := newFuture()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := future.Deref(ctx)
+	tu.ExpectEqual(t, err, context.DeadlineExceeded)
+
+	txResult := &transactor.TxResult{}
+	future.deliver(txResult, nil)
+	select {
+	case <-future.Done():
+	default:
+		t.Fatal("future should be done")
+	}
+
+	result, err := future.Deref(context.Background())
+	tu.ExpectNil(t, err)
+	tu.ExpectEqual(t, result, txResult)
+}
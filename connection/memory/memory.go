@@ -40,10 +40,17 @@ func (c *Connection) Index(datoms []index.Datom) error {
 }
 
 func (c *Connection) Transact(datoms []transactor.TxDatum) (*transactor.TxResult, error) {
-	_, txResult, err := transactor.Transact(c.db, datoms)
+	return c.TransactWithOptions(datoms, transactor.DefaultOptions)
+}
+
+func (c *Connection) TransactWithOptions(datoms []transactor.TxDatum, opts transactor.Options) (*transactor.TxResult, error) {
+	_, txResult, err := transactor.TransactWithOptions(c.db, datoms, opts)
 	if err != nil {
 		return nil, err
 	}
+	if txResult.Replayed {
+		return txResult, nil
+	}
 	c.db = txResult.DbAfter
 	return txResult, nil
 }
@@ -3,7 +3,9 @@ package connection
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"github.com/heyLu/fressian"
 	"net/url"
@@ -24,11 +26,22 @@ type storeConnection struct {
 	indexRootId string
 	db          *database.Db
 	log         *log.Log
+	// The db root as it was last read from or written to the store,
+	// used to detect changes by other processes.
+	rootData []byte
+
+	// Whether concurrent transactions are committed together, see
+	// connectToStore.
+	groupCommit bool
 
 	// Used to protect against dirty reads of db and log.
 	lock sync.RWMutex
 	// Used to ensure that transaction are serialized.
 	txLock sync.Mutex
+	// Used to protect pending, the transactions waiting to be
+	// committed.
+	pendingLock sync.Mutex
+	pending     []*txRequest
 }
 
 func (c *storeConnection) Db() *database.Db {
@@ -51,38 +64,317 @@ func (c *storeConnection) Index(datoms []index.Datom) error {
 }
 
 func (c *storeConnection) Transact(datoms []transactor.TxDatum) (*transactor.TxResult, error) {
+	return c.TransactWithOptions(datoms, transactor.DefaultOptions)
+}
+
+func (c *storeConnection) TransactWithOptions(datoms []transactor.TxDatum, opts transactor.Options) (*transactor.TxResult, error) {
+	future := c.enqueue(datoms, opts)
+	c.commitPending()
+	return future.Deref(context.Background())
+}
+
+func (c *storeConnection) TransactAsync(datoms []transactor.TxDatum) *Future {
+	future := c.enqueue(datoms, transactor.DefaultOptions)
+	go c.commitPending()
+	return future
+}
+
+// A txRequest is a transaction waiting to be committed.
+type txRequest struct {
+	datoms []transactor.TxDatum
+	opts   transactor.Options
+	future *Future
+}
+
+func (req *txRequest) done(txResult *transactor.TxResult, err error) {
+	req.future.deliver(txResult, err)
+}
+
+// enqueue adds the transaction to the pending ones, so that
+// transactions are committed in the order they were submitted.
+func (c *storeConnection) enqueue(datoms []transactor.TxDatum, opts transactor.Options) *Future {
+	req := &txRequest{datoms: datoms, opts: opts, future: newFuture()}
+	c.pendingLock.Lock()
+	c.pending = append(c.pending, req)
+	c.pendingLock.Unlock()
+	return req.future
+}
+
+// commitPending commits all pending transactions, which might have
+// been committed by a previous call already.
+//
+// With group commit, the pending transactions are written together,
+// otherwise one after another.
+func (c *storeConnection) commitPending() {
 	c.txLock.Lock()
 	defer c.txLock.Unlock()
-	tx, txResult, err := transactor.Transact(c.db, datoms)
+
+	c.pendingLock.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.pendingLock.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	if c.groupCommit {
+		c.commit(batch)
+		return
+	}
+
+	for _, req := range batch {
+		c.commit([]*txRequest{req})
+	}
+}
+
+// commit transacts the requests one after another, each against the
+// database after the previous one, and writes them to the store with
+// a single write of the db root.
+//
+// Requests that fail are skipped, the others fail only if the write
+// fails.  If another connection changed the db root in the meantime,
+// the root is reloaded and the requests are transacted again against
+// it, so that only requests with an explicit basis, see TransactIf,
+// fail with a conflict.  Must be called with txLock held.
+func (c *storeConnection) commit(batch []*txRequest) {
+	for {
+		results, errs, err := c.commitBatch(batch)
+		if err == errRootChanged {
+			err = c.reload()
+			if err == nil {
+				continue
+			}
+		}
+		for i, req := range batch {
+			if err != nil && errs[i] == nil && !results[i].Replayed {
+				req.done(nil, err)
+			} else {
+				req.done(results[i], errs[i])
+			}
+		}
+		return
+	}
+}
+
+// commitBatch transacts and writes the requests, see commit, and
+// returns the result or error of each of them.  The error is returned
+// if the write failed.
+func (c *storeConnection) commitBatch(batch []*txRequest) ([]*transactor.TxResult, []error, error) {
+	db := c.db
+	newLog := c.log
+	indexRootId := c.indexRootId
+	// the segments replaced by excisions, which are removed once the
+	// new root is written, and the segments written for them, which
+	// are removed if it is not
+	var excisedIds, writtenIds []string
+	results := make([]*transactor.TxResult, len(batch))
+	errs := make([]error, len(batch))
+	committed := 0
+	for i, req := range batch {
+		tx, txResult, err := transactor.TransactWithLog(db, newLog, req.datoms, req.opts)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if txResult.Replayed {
+			results[i] = txResult
+			continue
+		}
+
+		txLog := newLog.WithTx(tx)
+		if len(txResult.Excised) > 0 {
+			var logIds, ids, txIds []string
+			newIndexRootId := indexRootId
+			txLog, logIds, err = txLog.Excise(txResult.Excised, recordingPut(c.store, log.WriteHandler, &txIds))
+			if err == nil {
+				newIndexRootId, ids, err = exciseIndexes(c.store, indexRootId, txResult.Excised, &txIds)
+			}
+			if err != nil {
+				c.removeWritten(txIds)
+				errs[i] = err
+				continue
+			}
+			indexRootId = newIndexRootId
+			excisedIds = append(excisedIds, logIds...)
+			excisedIds = append(excisedIds, ids...)
+			writtenIds = append(writtenIds, txIds...)
+		}
+
+		db = txResult.DbAfter
+		newLog = txLog
+		results[i] = txResult
+		committed++
+	}
+
+	if committed == 0 {
+		return results, errs, nil
+	}
+
+	// write new root with datoms/LogTx to store
+	rootData, err := c.writeDbRoot(indexRootId, newLog)
 	if err != nil {
-		return nil, err
+		c.removeWritten(writtenIds)
+		return results, errs, err
 	}
 
-	/*newIndexRootId := log.Squuid().String()
-	indexRoot := GetFromCache(c.indexRootId).(map[interface{}]interface{})
-	indexRoot[fressian.Keyword{"", "nextT"}] = txResult.DbAfter.NextT()
-	err = writeToStore(c.store, nil, newIndexRootId, indexRoot)
+	// only remove the excised segments once the new root is written,
+	// so that the store is never left without a valid root.  they are
+	// removed from the cache as well, so that the excised datoms don't
+	// stay in memory.
+	err = c.removeFromStore(excisedIds)
+	if err != nil {
+		return results, errs, err
+	}
+	if len(excisedIds) > 0 {
+		// the db after the excision still reads the replaced segments
+		// and only hides the excised datoms, so read it from the new
+		// segments instead
+		db = dbFromLog(c.store, indexRootId, newLog)
+	}
+
+	c.lock.Lock()
+	c.db = db
+	c.log = newLog
+	c.indexRootId = indexRootId
+	c.rootData = rootData
+	c.lock.Unlock()
+
+	return results, errs, nil
+}
+
+// reload reads the db root from the store, e.g. after another
+// connection changed it.
+func (c *storeConnection) reload() error {
+	root, rootData, err := getDbRoot(c.store, c.dbRootId)
+	if err != nil {
+		return err
+	}
+	indexRootId := root[fressian.Keyword{"index", "root-id"}].(string)
+	logRootId := root[fressian.Keyword{"log", "root-id"}].(string)
+	logTail := root[fressian.Keyword{"log", "tail"}].([]byte)
+
+	db, log := CurrentDb(c.store, indexRootId, logRootId, logTail)
+
+	c.lock.Lock()
+	c.db = db
+	c.log = log
+	c.indexRootId = indexRootId
+	c.rootData = rootData
+	c.lock.Unlock()
+
+	return nil
+}
+
+// removeWritten removes segments that were written for a commit that
+// failed, e.g. because another connection changed the db root.
+//
+// Errors are ignored, the segments are unused and the commit already
+// failed.
+func (c *storeConnection) removeWritten(ids []string) {
+	_ = c.removeFromStore(ids)
+}
+
+// writeDbRoot writes a new db root pointing to the index root and log
+// to the store.
+//
+// If the store supports it, the root is only replaced if it was not
+// changed by another process since it was last read, otherwise the
+// transaction would silently overwrite the other one.  Stores without
+// support for this are last-writer-wins.
+func (c *storeConnection) writeDbRoot(indexRootId string, newLog *log.Log) ([]byte, error) {
+	dbRoot, err := newDbRoot(indexRootId, newLog.RootId, newLog.Tail)
 	if err != nil {
 		return nil, err
-	}*/
+	}
 
-	// write new root with datoms/LogTx to store
-	newLog := c.log.WithTx(tx)
-	dbRoot, err := newDbRoot(c.indexRootId, newLog.RootId, newLog.Tail)
+	data, err := encodeForStore(nil, dbRoot)
 	if err != nil {
 		return nil, err
 	}
 
-	err = writeToStore(c.store, nil, c.dbRootId, dbRoot)
+	casStore, ok := c.store.(store.CASStore)
+	if !ok {
+		return data, c.store.Put(c.dbRootId, data)
+	}
+
+	swapped, err := casStore.CompareAndSwap(c.dbRootId, c.rootData, data)
 	if err != nil {
 		return nil, err
 	}
+	if !swapped {
+		return nil, errRootChanged
+	}
+	return data, nil
+}
 
-	c.lock.Lock()
-	c.db = txResult.DbAfter
-	c.log = newLog
-	c.lock.Unlock()
-	return txResult, nil
+// errRootChanged is returned by writeDbRoot if another connection
+// changed the db root, commit retries the transactions in that case.
+var errRootChanged = errors.New("database was changed by another connection")
+
+// exciseIndexes rewrites the segments of all indexes that contain the
+// datoms and writes a new index root pointing to them.
+//
+// It returns the id of the new index root and the ids of the segments
+// that were replaced.  The ids of the new segments are added to
+// written.
+func exciseIndexes(store store.Store, indexRootId string, datoms []index.Datom, written *[]string) (string, []string, error) {
+	indexRoot := index.GetFromCache(store, indexRootId).(map[interface{}]interface{})
+	newIndexRoot := make(map[interface{}]interface{}, len(indexRoot))
+	for k, v := range indexRoot {
+		newIndexRoot[k] = v
+	}
+
+	put := recordingPut(store, index.SegmentWriteHandler, written)
+
+	indexes := []struct {
+		name    string
+		compare index.CompareFn
+	}{
+		{"eavt-main", index.CompareEavtIndex},
+		{"aevt-main", index.CompareAevtIndex},
+		{"avet-main", index.CompareAvetIndex},
+		{"raet-main", index.CompareVaetIndex},
+	}
+
+	excisedIds := []string{}
+	for _, idx := range indexes {
+		key := fressian.Keyword{"", idx.name}
+		rootId := indexRoot[key].(fressian.UUID).String()
+		root := index.GetRoot(store, rootId)
+		segmented := index.NewSegmentedIndex(&root, store, idx.compare)
+		newSegmented, replacedIds, err := segmented.Excise(datoms, put)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(replacedIds) == 0 {
+			continue
+		}
+
+		newRootId, err := put(newSegmented.Root())
+		if err != nil {
+			return "", nil, err
+		}
+		newRootUUID, err := fressian.NewUUIDFromString(newRootId)
+		if err != nil {
+			return "", nil, err
+		}
+		newIndexRoot[key] = *newRootUUID
+		excisedIds = append(excisedIds, replacedIds...)
+		excisedIds = append(excisedIds, rootId)
+	}
+
+	if len(excisedIds) == 0 {
+		return indexRootId, nil, nil
+	}
+
+	newIndexRootId, err := recordingPut(store, nil, written)(newIndexRoot)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return newIndexRootId, append(excisedIds, indexRootId), nil
 }
 
 func newDbRoot(indexRootId, logRootId string, logTail []log.LogTx) (map[interface{}]interface{}, error) {
@@ -104,16 +396,29 @@ func newDbRoot(indexRootId, logRootId string, logTail []log.LogTx) (map[interfac
 
 func writeToStore(store store.Store, handler fressian.WriteHandler, id string, val interface{}) error {
 	//fmt.Printf("writeToStore: %s -> %v\n", id, val)
+	data, err := encodeForStore(handler, val)
+	if err != nil {
+		return err
+	}
+	return store.Put(id, data)
+}
+
+func encodeForStore(handler fressian.WriteHandler, val interface{}) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	w := fressian.NewGzipWriter(buf, handler)
 	err := w.WriteValue(val)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	w.Flush()
-	return store.Put(id, buf.Bytes())
+	return buf.Bytes(), nil
 }
 
+// connectToStore connects to a database in a store.
+//
+// With the `group-commit=true` parameter, transactions that are
+// submitted concurrently are committed together, using a single write
+// to the store.
 func connectToStore(u *url.URL) (Connection, error) {
 	// get store from url scheme
 	store, err := store.Open(u)
@@ -134,7 +439,7 @@ func connectToStore(u *url.URL) (Connection, error) {
 		}
 	}
 
-	root, err := getDbRoot(store, rootId)
+	root, rootData, err := getDbRoot(store, rootId)
 	if err != nil {
 		return nil, err
 	}
@@ -150,6 +455,8 @@ func connectToStore(u *url.URL) (Connection, error) {
 		indexRootId: indexRootId,
 		db:          db,
 		log:         log,
+		rootData:    rootData,
+		groupCommit: u.Query().Get("group-commit") == "true",
 	}
 
 	return conn, nil
@@ -235,6 +542,13 @@ func DbNameToId(dbName string) string {
 }
 
 func CurrentDb(store store.Store, indexRootId, logRootId string, logTail []byte) (*database.Db, *log.Log) {
+	l := log.FromStore(store, logRootId, logTail)
+	return dbFromLog(store, indexRootId, l), l
+}
+
+// dbFromLog returns the database with the indexes from the index root
+// and the transactions of the log that are not part of them yet.
+func dbFromLog(store store.Store, indexRootId string, l *log.Log) *database.Db {
 	indexRoot := index.GetFromCache(store, indexRootId).(map[interface{}]interface{})
 
 	// get index roots from store
@@ -245,6 +559,13 @@ func CurrentDb(store store.Store, indexRootId, logRootId string, logTail []byte)
 	vaet := getIndex(indexRoot, "raet-main", store, index.CompareVaetIndex)
 	nextT := indexRoot[fressian.Keyword{"", "nextT"}].(int)
 	basisT := 0
+	// transactions up to indexBasisT are already part of the index,
+	// e.g. after a bulk import
+	indexBasisT := -1
+	if t, ok := indexRoot[fressian.Keyword{"", "basisT"}].(int); ok {
+		basisT = t
+		indexBasisT = t
+	}
 
 	memoryEavt := index.NewMemoryIndex(index.CompareEavt)
 	memoryAevt := index.NewMemoryIndex(index.CompareAevt)
@@ -257,17 +578,17 @@ func CurrentDb(store store.Store, indexRootId, logRootId string, logTail []byte)
 		index.NewMergedIndex(memoryAvet, avet, index.CompareAvet),
 		index.NewMergedIndex(memoryVaet, vaet, index.CompareVaet))
 
-	// get log from store
 	// create in-memory indexes
 	// create merged indexes
-	l := log.FromStore(store, logRootId, logTail)
 	if len(l.Tail) > 0 {
 		for _, tx := range l.Tail {
 			//fmt.Printf("adding %d datoms from tx %d\n", len(tx.Datoms), tx.T)
 			/*for _, datom := range tx.Datoms {
 				fmt.Println(datom)
 			}*/
-			// TODO: check if basisT/nextT from index root is higher
+			if tx.T <= indexBasisT {
+				continue
+			}
 			basisT = tx.T
 			nextT = tx.T
 			for _, datom := range tx.Datoms {
@@ -281,10 +602,10 @@ func CurrentDb(store store.Store, indexRootId, logRootId string, logTail []byte)
 	}
 
 	if nextT < 1000 {
-		basisT = 63
+		basisT = transactor.BootstrapTxs[len(transactor.BootstrapTxs)-1].T
 		nextT = 999
 	}
-	return db.WithDatomsT(basisT, nextT+1, nil), l
+	return db.WithDatomsT(basisT, nextT+1, nil)
 }
 
 func getIndex(root map[interface{}]interface{}, id string, store store.Store, compare index.CompareFn) *index.SegmentedIndex {
@@ -294,21 +615,21 @@ func getIndex(root map[interface{}]interface{}, id string, store store.Store, co
 	return index.NewSegmentedIndex(&indexRoot, store, compare)
 }
 
-func getDbRoot(store store.Store, id string) (map[interface{}]interface{}, error) {
+func getDbRoot(store store.Store, id string) (map[interface{}]interface{}, []byte, error) {
 	data, err := store.Get(id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	gz, err := gzip.NewReader(bytes.NewBuffer(data))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	r := fressian.NewReader(gz, nil)
 	val, err := r.ReadValue()
 	if val == nil && err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return val.(map[interface{}]interface{}), nil
+	return val.(map[interface{}]interface{}), data, nil
 }
@@ -0,0 +1,250 @@
+package connection
+
+import (
+	"fmt"
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/log"
+	"github.com/heyLu/mu/store"
+	"github.com/heyLu/mu/transactor"
+)
+
+type countingStore struct {
+	store.Store
+	lock    sync.Mutex
+	puts    map[string]int
+	deletes map[string]int
+}
+
+func (s *countingStore) Put(id string, data []byte) error {
+	s.lock.Lock()
+	s.puts[id] += 1
+	s.lock.Unlock()
+	return s.Store.Put(id, data)
+}
+
+func (s *countingStore) Delete(id string) error {
+	s.lock.Lock()
+	if s.deletes != nil {
+		s.deletes[id] += 1
+	}
+	s.lock.Unlock()
+	return s.Store.Delete(id)
+}
+
+func TestGroupCommit(t *testing.T) {
+	rawUrl := "memory://group?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl+"&group-commit=true")
+	mustTransact(t, conn, `[{:db/id #db/id[:db.part/db]
+  :db/ident :counter/name
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}]`)
+
+	c := conn.(*storeConnection)
+	counting := &countingStore{Store: c.store, puts: map[string]int{}}
+	c.store = counting
+
+	// block committing until all transactions are pending, so that
+	// they are committed in one batch
+	c.txLock.Lock()
+
+	n := 10
+	txs := make([][]transactor.TxDatum, n)
+	for i := range txs {
+		value := fmt.Sprintf("%q", fmt.Sprintf("counter-%d", i))
+		if i == n-1 {
+			// fails, but the others are committed nonetheless
+			value = "42"
+		}
+		txData, err := transactor.TxDataFromEDN(fmt.Sprintf(`[{:db/id #db/id[:db.part/user] :counter/name %s}]`, value))
+		tu.RequireNil(t, err)
+		txs[i] = txData
+	}
+
+	results := make([]*transactor.TxResult, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = conn.Transact(txs[i])
+		}(i)
+	}
+
+	for {
+		c.pendingLock.Lock()
+		pending := len(c.pending)
+		c.pendingLock.Unlock()
+		if pending == n {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.txLock.Unlock()
+	wg.Wait()
+
+	tu.ExpectEqual(t, counting.puts[c.dbRootId], 1)
+
+	basisTs := map[int]bool{}
+	for i := 0; i < n-1; i++ {
+		tu.RequireNil(t, errs[i])
+		basisTs[results[i].DbAfter.BasisT()] = true
+	}
+	tu.ExpectEqual(t, len(basisTs), n-1)
+	tu.ExpectEqual(t, transactor.CategoryOf(errs[n-1]), transactor.Incorrect)
+
+	// all transactions are persisted
+	other := connect(t, rawUrl)
+	tu.ExpectEqual(t, other.Db().BasisT(), conn.Db().BasisT())
+	nameAttr := database.Keyword{fressian.Keyword{"counter", "name"}}
+	for i := 0; i < n-1; i++ {
+		lookup := database.LookupRef{nameAttr, index.NewValue(fmt.Sprintf("counter-%d", i))}
+		_, err := lookup.Lookup(other.Db())
+		tu.ExpectNil(t, err)
+	}
+}
+
+func TestExciseFromLogSegments(t *testing.T) {
+	rawUrl := "memory://excise?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl)
+	mustTransact(t, conn, `[{:db/id #db/id[:db.part/db]
+  :db/ident :note/title
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}]`)
+
+	// the imported transactions are written to log segments
+	titleAttr := database.Keyword{fressian.Keyword{"note", "title"}}
+	txs := [][]transactor.TxDatum{}
+	for _, title := range []string{"public", "secret"} {
+		id := database.Id(-(transactor.DbPartUser*(1<<42) + 1))
+		txs = append(txs, []transactor.TxDatum{
+			transactor.Datum{Op: transactor.Assert, E: id, A: titleAttr, V: transactor.NewValue(title)},
+		})
+	}
+	_, err = BulkImport(conn, TxDataFromSlice(txs))
+	tu.RequireNil(t, err)
+
+	c := conn.(*storeConnection)
+	logRootId := c.log.RootId
+	tu.RequireEqual(t, logRootId != "", true)
+
+	secret, err := database.LookupRef{titleAttr, index.NewValue("secret")}.Lookup(conn.Db())
+	tu.RequireNil(t, err)
+	mustTransact(t, conn, fmt.Sprintf(`[{:db/id #db/id[:db.part/user] :db/excise %d}]`, secret))
+
+	logContains := func(l *log.Log, value string) bool {
+		txs, err := l.Txs()
+		tu.RequireNil(t, err)
+		for _, tx := range txs {
+			for _, datom := range tx.Datoms {
+				if datom.V().Val() == value {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	tu.ExpectEqual(t, logContains(conn.Log(), "secret"), false)
+	tu.ExpectEqual(t, logContains(conn.Log(), "public"), true)
+
+	// the db reads the new segments, the replaced ones are gone
+	titles := []interface{}{}
+	datoms := conn.Db().Eavt().Datoms()
+	for datom := datoms.Next(); datom != nil; datom = datoms.Next() {
+		if datom.A() == conn.Db().Entid(titleAttr) {
+			titles = append(titles, datom.V().Val())
+		}
+	}
+	tu.ExpectEqual(t, titles, []interface{}{"public"})
+
+	// the old log root is gone
+	_, err = c.store.Get(logRootId)
+	tu.ExpectNotNil(t, err)
+
+	other := connect(t, rawUrl)
+	tu.ExpectEqual(t, logContains(other.Log(), "secret"), false)
+	tu.ExpectEqual(t, logContains(other.Log(), "public"), true)
+}
+
+// conflictingStore fails the first compare and swap, as if another
+// connection had changed the db root, and records the ids that were
+// written before.
+type conflictingStore struct {
+	store.CASStore
+	conflicted bool
+	written    []string
+}
+
+func (s *conflictingStore) Put(id string, data []byte) error {
+	if !s.conflicted {
+		s.written = append(s.written, id)
+	}
+	return s.CASStore.Put(id, data)
+}
+
+func (s *conflictingStore) CompareAndSwap(id string, old, new []byte) (bool, error) {
+	if !s.conflicted {
+		s.conflicted = true
+		return false, nil
+	}
+	return s.CASStore.CompareAndSwap(id, old, new)
+}
+
+func TestExciseConflict(t *testing.T) {
+	rawUrl := "memory://excise?name=" + t.Name()
+	u, _ := url.Parse(rawUrl)
+	_, err := CreateDatabase(u)
+	tu.RequireNil(t, err)
+	conn := connect(t, rawUrl)
+	mustTransact(t, conn, `[{:db/id #db/id[:db.part/db]
+  :db/ident :note/title
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}]`)
+
+	titleAttr := database.Keyword{fressian.Keyword{"note", "title"}}
+	txs := [][]transactor.TxDatum{}
+	for _, title := range []string{"public", "secret"} {
+		id := database.Id(-(transactor.DbPartUser*(1<<42) + 1))
+		txs = append(txs, []transactor.TxDatum{
+			transactor.Datum{Op: transactor.Assert, E: id, A: titleAttr, V: transactor.NewValue(title)},
+		})
+	}
+	_, err = BulkImport(conn, TxDataFromSlice(txs))
+	tu.RequireNil(t, err)
+
+	c := conn.(*storeConnection)
+	conflicting := &conflictingStore{CASStore: c.store.(store.CASStore)}
+	c.store = conflicting
+
+	secret, err := database.LookupRef{titleAttr, index.NewValue("secret")}.Lookup(conn.Db())
+	tu.RequireNil(t, err)
+	mustTransact(t, conn, fmt.Sprintf(`[{:db/id #db/id[:db.part/user] :db/excise %d}]`, secret))
+
+	// the segments written before the conflict were removed
+	tu.RequireEqual(t, len(conflicting.written) > 0, true)
+	for _, id := range conflicting.written {
+		_, err := conflicting.Get(id)
+		tu.ExpectNotNil(t, err)
+	}
+
+	other := connect(t, rawUrl)
+	_, err = database.LookupRef{titleAttr, index.NewValue("secret")}.Lookup(other.Db())
+	tu.ExpectNotNil(t, err)
+}
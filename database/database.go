@@ -3,22 +3,26 @@ package database
 import (
 	"fmt"
 	"github.com/heyLu/fressian"
+	"sync"
 	"time"
 
 	"github.com/heyLu/mu/index"
 )
 
 type Db struct {
-	eavt           *index.MergedIndex
-	aevt           *index.MergedIndex
-	avet           *index.MergedIndex
-	vaet           *index.MergedIndex
-	basisT         int
-	nextT          int
-	useHistory     bool
-	asOf           int
-	since          int
-	filter         Filter
+	eavt       *index.MergedIndex
+	aevt       *index.MergedIndex
+	avet       *index.MergedIndex
+	vaet       *index.MergedIndex
+	basisT     int
+	nextT      int
+	useHistory bool
+	asOf       int
+	since      int
+	filter     Filter
+	// the cache is shared by the views of the database, e.g.
+	// History(), and used concurrently, e.g. by queries
+	cacheLock      *sync.RWMutex
 	attributeCache map[int]Attribute
 }
 
@@ -42,6 +46,7 @@ func New(eavt, aevt, avet, vaet *index.MergedIndex) *Db {
 		asOf:           -1,
 		since:          -1,
 		filter:         nil,
+		cacheLock:      new(sync.RWMutex),
 		attributeCache: make(map[int]Attribute, 100)}
 }
 
@@ -107,6 +112,15 @@ func (i *dbIndex) DatomsAt(start, end index.Datom) index.Iterator {
 	return iter
 }
 
+// Estimate estimates the number of datoms between start and end.
+//
+// The estimate ignores the filters of the database, e.g. AsOf and
+// retractions, so it may be larger than the number of datoms returned
+// by DatomsAt.
+func (i *dbIndex) Estimate(start, end index.Datom) int {
+	return i.index.Estimate(start, end)
+}
+
 func (i *dbIndex) Datoms2(entity HasLookup, attribute HasLookup, value interface{}) index.Iterator {
 	minE, maxE := index.MinDatom.E(), index.MaxDatom.E()
 	if entity != nil {
@@ -215,6 +229,12 @@ func (db *Db) Filter(filter Filter) *Db {
 	return &newDb
 }
 
+// IsHistory returns true if the database includes retractions and
+// past values, see History.
+func (db *Db) IsHistory() bool {
+	return db.useHistory
+}
+
 func (db *Db) IsFiltered() bool {
 	return db.filter != nil
 }
@@ -274,6 +294,19 @@ func (db *Db) WithDatomsT(basisT, nextT int, datoms []index.Datom) *Db {
 	return newDb
 }
 
+// WithoutDatoms returns a new database with the datoms removed from
+// all indexes, as if they had never been transacted.
+func (db *Db) WithoutDatoms(datoms []index.Datom) *Db {
+	newDb := New(
+		db.eavt.RemoveDatoms(datoms),
+		db.aevt.RemoveDatoms(datoms),
+		db.avet.RemoveDatoms(datoms),
+		db.vaet.RemoveDatoms(datoms))
+	newDb.basisT = db.basisT
+	newDb.nextT = db.nextT
+	return newDb
+}
+
 func (db *Db) Entid(lookup HasLookup) int {
 	eid, err := lookup.Lookup(db)
 	if err != nil {
@@ -308,6 +341,12 @@ func (db *Db) Entity(id int) Entity {
 	return Entity{db, id, map[Keyword]interface{}{}}
 }
 
+// Id returns the entity id.
+func (e Entity) Id() int { return e.id }
+
+// Db returns the database the entity was read from.
+func (e Entity) Db() *Db { return e.db }
+
 // Datoms returns an iterator over all datoms for this entity.
 func (e Entity) Datoms() index.Iterator {
 	return e.db.Eavt().DatomsAt(
@@ -405,8 +444,11 @@ type Attribute struct {
 	cardinality Cardinality
 	valueType   index.ValueType
 	unique      Unique
+	isComponent bool
 	indexed     bool
 	noHistory   bool
+	preds       []fressian.Keyword
+	tupleAttrs  []fressian.Keyword
 }
 
 type Unique int
@@ -456,8 +498,15 @@ func (c Cardinality) IsValid() bool {
 	return c == CardinalityOne || c == CardinalityMany
 }
 
+var (
+	attrPredsIdent  = fressian.Keyword{Namespace: "db.attr", Name: "preds"}
+	tupleAttrsIdent = fressian.Keyword{Namespace: "db", Name: "tupleAttrs"}
+)
+
 func (db *Db) Attribute(id int) *Attribute {
+	db.cacheLock.RLock()
 	attr, ok := db.attributeCache[id]
+	db.cacheLock.RUnlock()
 	if ok {
 		//log.Println("attribute from cache:", attr)
 		return &attr
@@ -470,6 +519,11 @@ func (db *Db) Attribute(id int) *Attribute {
 			id: id,
 		}
 
+		// these were added to the bootstrap transactions later, so
+		// older databases might use their ids for other attributes
+		predsId := db.Entid(Keyword{attrPredsIdent})
+		tupleAttrsId := db.Entid(Keyword{tupleAttrsIdent})
+
 		for datom := iter.Next(); datom != nil; datom = iter.Next() {
 			found = true
 
@@ -482,10 +536,23 @@ func (db *Db) Attribute(id int) *Attribute {
 				attr.cardinality = Cardinality(datom.Value().Val().(int))
 			case 42: // :db/unique
 				attr.unique = Unique(datom.Value().Val().(int))
+			case 43: // :db/isComponent
+				attr.isComponent = datom.Value().Val().(bool)
 			case 44: // :db/index
 				attr.indexed = datom.Value().Val().(bool)
 			case 45: // :db/noHistory
 				attr.noHistory = datom.Value().Val().(bool)
+			case predsId:
+				if pred, ok := datom.Value().Val().(fressian.Keyword); ok {
+					attr.preds = append(attr.preds, pred)
+				}
+			case tupleAttrsId:
+				kws, _ := datom.Value().Val().([]interface{})
+				for _, kw := range kws {
+					if kw, ok := kw.(fressian.Keyword); ok {
+						attr.tupleAttrs = append(attr.tupleAttrs, kw)
+					}
+				}
 			}
 		}
 
@@ -493,7 +560,9 @@ func (db *Db) Attribute(id int) *Attribute {
 			return nil
 		}
 
+		db.cacheLock.Lock()
 		db.attributeCache[id] = attr
+		db.cacheLock.Unlock()
 		//log.Println("attribute from db:", attr)
 		return &attr
 	}
@@ -504,5 +573,14 @@ func (a Attribute) Ident() fressian.Keyword  { return a.ident }
 func (a Attribute) Cardinality() Cardinality { return a.cardinality }
 func (a Attribute) Type() index.ValueType    { return a.valueType }
 func (a Attribute) Unique() Unique           { return a.unique }
+func (a Attribute) IsComponent() bool        { return a.isComponent }
 func (a Attribute) Indexed() bool            { return a.indexed }
 func (a Attribute) NoHistory() bool          { return a.noHistory }
+
+// Preds returns the names of the predicates that values of this
+// attribute must satisfy.
+func (a Attribute) Preds() []fressian.Keyword { return a.preds }
+
+// TupleAttrs returns the attributes that make up a composite tuple
+// attribute, or nil if the attribute is not a composite tuple.
+func (a Attribute) TupleAttrs() []fressian.Keyword { return a.tupleAttrs }
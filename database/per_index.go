@@ -23,7 +23,12 @@ func FilterAvetAndVaet(db *Db, datoms []index.Datom) ([]index.Datom, []index.Dat
 }
 
 func needsAvet(db *Db, datom index.Datom) bool {
-	a := datom.Attribute()
+	return hasAvet(db, datom.Attribute())
+}
+
+// hasAvet returns true if the datoms of the attribute are in the avet
+// index.
+func hasAvet(db *Db, a int) bool {
 	switch a {
 	case 10, // :db/ident
 		39, // :fressian/tag
@@ -36,7 +41,12 @@ func needsAvet(db *Db, datom index.Datom) bool {
 }
 
 func needsVaet(db *Db, datom index.Datom) bool {
-	a := datom.Attribute()
+	return hasVaet(db, datom.Attribute())
+}
+
+// hasVaet returns true if the datoms of the attribute are in the vaet
+// index.
+func hasVaet(db *Db, a int) bool {
 	switch a {
 	case 11, 12, 13, 14, // :db.install/*
 		15, 16, 19, // :db/excise, :db.excise/beforeT, :db.alter/attribute
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"github.com/heyLu/fressian"
+
 	"github.com/heyLu/mu/index"
 )
 
@@ -23,51 +25,70 @@ const (
 	____ = (0 << 3) + (0 << 2) + (0 << 1) + (0 << 0)
 )
 
+// Search returns an iterator over the datoms matching the pattern.
 func (db *Db) Search(pattern Pattern) index.Iterator {
-	var iter index.Iterator
 	minDatom, maxDatom := pattern.bounds(db)
-	switch pattern.toNum() {
-	case eavt:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-	case eav_:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-	case ea_t:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-		iter = index.FilterIterator(iter, func(d *index.Datom) bool {
-			return d.Tx() == minDatom.Tx()
-		})
-	case ea__:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-	case e_vt:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-		iter = index.FilterIterator(iter, func(d *index.Datom) bool {
-			return d.Tx() == minDatom.Tx() &&
-				d.V().Compare(minDatom.V()) == 0
-		})
-	case e_v_:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-		iter = index.FilterIterator(iter, func(d *index.Datom) bool {
-			return d.V().Compare(minDatom.V()) == 0
-		})
-	case e__t:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-		iter = index.FilterIterator(iter, func(d *index.Datom) bool {
-			return d.Tx() == minDatom.Tx()
-		})
-	case e___:
-		iter = db.Eavt().DatomsAt(minDatom, maxDatom)
-	case _a_t:
-		iter = db.Aevt().DatomsAt(minDatom, maxDatom)
+	idx, start, end := db.searchIndex(pattern, minDatom, maxDatom)
+	iter := idx.DatomsAt(start, end)
+
+	// the ranges only cover the leading components of the index, the
+	// other ones have to be checked for each datom
+	num := pattern.toNum()
+	hasV := num&(1<<1) != 0
+	hasTx := num&(1<<0) != 0
+	if hasV || hasTx || pattern.Added != nil {
 		iter = index.FilterIterator(iter, func(d *index.Datom) bool {
-			return d.Tx() == minDatom.Tx()
+			return (!hasV || d.V().Compare(minDatom.V()) == 0) &&
+				(!hasTx || d.Tx() == minDatom.Tx()) &&
+				(pattern.Added == nil || d.Added() == *pattern.Added)
 		})
-	case _a__:
-		iter = db.Aevt().DatomsAt(minDatom, maxDatom)
+	}
+	return iter
+}
+
+// Estimate estimates the number of datoms Search reads for the pattern
+// without reading them.
+//
+// The datoms matching the pattern may be fewer, e.g. for patterns with
+// only a value that is not a ref, which have to scan all datoms.
+func (db *Db) Estimate(pattern Pattern) int {
+	minDatom, maxDatom := pattern.bounds(db)
+	idx, start, end := db.searchIndex(pattern, minDatom, maxDatom)
+	return idx.Estimate(start, end)
+}
+
+// searchIndex returns the index that fits the pattern best and the
+// range of datoms to read from it.
+//
+// Patterns with an entity use eavt.  Patterns with an attribute and a
+// value use avet if the attribute is indexed or unique and vaet if it
+// is a ref, otherwise aevt.  Patterns with only a value use vaet for
+// refs.  All other patterns scan eavt.
+func (db *Db) searchIndex(pattern Pattern, minDatom, maxDatom index.Datom) (index.Index, index.Datom, index.Datom) {
+	switch pattern.toNum() {
+	case eavt, eav_, ea_t, ea__, e_vt, e_v_, e__t, e___:
+		return db.Eavt(), minDatom, maxDatom
+	case _avt, _av_:
+		switch a := minDatom.A(); {
+		case hasAvet(db, a):
+			return db.Avet(), minDatom, maxDatom
+		case hasVaet(db, a):
+			return db.Vaet(), minDatom, maxDatom
+		default:
+			return db.Aevt(), minDatom, maxDatom
+		}
+	case _a_t, _a__:
+		return db.Aevt(), minDatom, maxDatom
+	case __vt, __v_:
+		if pattern.isRef() {
+			return db.Vaet(), minDatom, maxDatom
+		}
+		return db.Eavt(), index.MinDatom, index.MaxDatom
+	case ___t, ____:
+		return db.Eavt(), index.MinDatom, index.MaxDatom
 	default:
 		panic("unknown datom pattern")
 	}
-	// TODO: handle p.added != nil
-	return iter
 }
 
 type Pattern struct {
@@ -123,7 +144,7 @@ func (p Pattern) bounds(db *Db) (index.Datom, index.Datom) {
 		minA, maxA = a, a
 	}
 	if p.V != nil {
-		v := index.NewValue(p.V)
+		v := p.value(db)
 		minV, maxV = v, v
 	}
 	if p.Tx != nil {
@@ -134,3 +155,70 @@ func (p Pattern) bounds(db *Db) (index.Datom, index.Datom) {
 	maxDatom := index.NewDatom(maxE, maxA, maxV, maxTx, maxAdded)
 	return minDatom, maxDatom
 }
+
+// isRef returns true if the value of the pattern is given as a
+// lookup.
+func (p Pattern) isRef() bool {
+	switch v := p.V.(type) {
+	case index.Value:
+		return v.Type() == index.Ref
+	case HasLookup:
+		return true
+	default:
+		return false
+	}
+}
+
+// value returns the value of the pattern as an index value.
+//
+// Values of ref attributes can be given as entity ids, keyword idents
+// or lookup refs ([attr value]), which are resolved to the entity they
+// refer to.  Without an attribute, only lookups (Id, Keyword and
+// LookupRef) are treated as refs.
+//
+// Refs are stored as longs in the indexes, see checkTypes in the
+// transactor, so they are returned as longs as well.
+func (p Pattern) value(db *Db) index.Value {
+	switch v := p.V.(type) {
+	case index.Value:
+		if v.Type() == index.Ref {
+			return index.NewValue(v.Val())
+		}
+		return v
+	case Id:
+		return index.NewValue(int(v))
+	case HasLookup:
+		id, _ := v.Lookup(db)
+		return index.NewValue(id)
+	}
+
+	if p.A == nil {
+		return index.NewValue(p.V)
+	}
+	a, _ := p.A.Lookup(db)
+	if attr := db.Attribute(a); attr == nil || attr.Type() != index.Ref {
+		return index.NewValue(p.V)
+	}
+
+	switch v := p.V.(type) {
+	case fressian.Keyword:
+		id, _ := Keyword{v}.Lookup(db)
+		return index.NewValue(id)
+	case []interface{}:
+		if len(v) != 2 || v[1] == nil {
+			break
+		}
+		var attr Keyword
+		switch kw := v[0].(type) {
+		case fressian.Keyword:
+			attr = Keyword{kw}
+		case Keyword:
+			attr = kw
+		default:
+			return index.NewValue(p.V)
+		}
+		id, _ := LookupRef{Attribute: attr, Value: index.NewValue(v[1])}.Lookup(db)
+		return index.NewValue(id)
+	}
+	return index.NewValue(p.V)
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heyLu/mu/index"
+)
+
+var (
+	name   = Keyword{fressian.Keyword{Namespace: "person", Name: "name"}}
+	age    = Keyword{fressian.Keyword{Namespace: "person", Name: "age"}}
+	friend = Keyword{fressian.Keyword{Namespace: "person", Name: "friend"}}
+)
+
+var searchSchema = []index.Datom{
+	index.NewDatom(100, 10, name.Keyword, tToTx(1000), true),
+	index.NewDatom(100, 40, int(index.String), tToTx(1000), true),
+	index.NewDatom(100, 41, CardinalityOne, tToTx(1000), true),
+	index.NewDatom(100, 42, int(UniqueIdentity), tToTx(1000), true),
+	index.NewDatom(101, 10, age.Keyword, tToTx(1000), true),
+	index.NewDatom(101, 40, int(index.Long), tToTx(1000), true),
+	index.NewDatom(101, 41, CardinalityOne, tToTx(1000), true),
+	index.NewDatom(102, 10, friend.Keyword, tToTx(1000), true),
+	index.NewDatom(102, 40, int(index.Ref), tToTx(1000), true),
+	index.NewDatom(102, 41, CardinalityMany, tToTx(1000), true),
+}
+
+var searchData = []index.Datom{
+	index.NewDatom(10, 100, "Jane", tToTx(1001), true),
+	index.NewDatom(10, 101, 30, tToTx(1001), true),
+	index.NewDatom(10, 102, 11, tToTx(1001), true),
+	index.NewDatom(11, 100, "Alice", tToTx(1001), true),
+	index.NewDatom(11, 101, 30, tToTx(1001), true),
+	index.NewDatom(12, 100, "Fred", tToTx(1001), true),
+	index.NewDatom(12, 102, 11, tToTx(1001), true),
+	index.NewDatom(tToTx(1001), 50, time.Unix(1001, 0), tToTx(1001), true),
+}
+
+var searchData2 = []index.Datom{
+	index.NewDatom(10, 101, 30, tToTx(1002), false),
+	index.NewDatom(10, 101, 31, tToTx(1002), true),
+	index.NewDatom(tToTx(1002), 50, time.Unix(1002, 0), tToTx(1002), true),
+}
+
+func searchDb() *Db {
+	return Empty.WithDatoms(searchSchema).WithDatoms(searchData).WithDatoms(searchData2)
+}
+
+func TestSearch(t *testing.T) {
+	db := searchDb()
+	alice := LookupRef{Attribute: name, Value: index.NewValue("Alice")}
+
+	for _, example := range []struct {
+		pattern  Pattern
+		expected []index.Datom
+	}{
+		// avet for unique attributes
+		{Pattern{A: name, V: "Alice"}, []index.Datom{searchData[3]}},
+		// aevt for other attributes
+		{Pattern{A: age, V: 30}, []index.Datom{searchData[4]}},
+		{Pattern{A: age, V: 30, Tx: Id(tToTx(1001))}, []index.Datom{searchData[4]}},
+		{Pattern{A: age, V: 30, Tx: Id(tToTx(1002))}, []index.Datom{}},
+		// vaet for refs, which can be given as ids or lookup refs
+		{Pattern{A: friend, V: 11}, []index.Datom{searchData[2], searchData[6]}},
+		{Pattern{A: friend, V: alice}, []index.Datom{searchData[2], searchData[6]}},
+		{Pattern{A: friend, V: []interface{}{name.Keyword, "Alice"}}, []index.Datom{searchData[2], searchData[6]}},
+		{Pattern{A: friend, V: []interface{}{name.Keyword, "Nobody"}}, []index.Datom{}},
+		{Pattern{E: Id(12), A: friend, V: alice}, []index.Datom{searchData[6]}},
+		// only a value
+		{Pattern{V: "Fred"}, []index.Datom{searchData[5]}},
+		{Pattern{V: alice}, []index.Datom{searchData[2], searchData[6]}},
+		{Pattern{V: 31, Tx: Id(tToTx(1002))}, []index.Datom{searchData2[1]}},
+		{Pattern{V: 30, Tx: Id(tToTx(1002))}, []index.Datom{}},
+		// only a transaction
+		{Pattern{Tx: Id(tToTx(1002))}, []index.Datom{searchData2[1], searchData2[2]}},
+		// added
+		{Pattern{E: Id(10), A: age, Added: new(bool)}, []index.Datom{}},
+	} {
+		expectIter(t, example.expected, db.Search(example.pattern))
+	}
+
+	n := 0
+	iter := db.Search(Pattern{})
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		n += 1
+	}
+	tu.ExpectEqual(t, n, len(searchSchema)+len(searchData)+len(searchData2)-2)
+}
+
+func TestSearchAdded(t *testing.T) {
+	db := searchDb().History()
+
+	added := true
+	expectIter(t,
+		[]index.Datom{searchData[1], searchData2[1]},
+		db.Search(Pattern{E: Id(10), A: age, Added: &added}))
+
+	added = false
+	expectIter(t,
+		[]index.Datom{searchData2[0]},
+		db.Search(Pattern{A: age, V: 30, Added: &added}))
+}
+
+func TestEstimate(t *testing.T) {
+	db := searchDb()
+	total := len(searchSchema) + len(searchData) + len(searchData2)
+
+	tu.ExpectEqual(t, db.Estimate(Pattern{A: name, V: "Alice"}), 1)
+	tu.ExpectEqual(t, db.Estimate(Pattern{E: Id(11)}), 2)
+	tu.ExpectEqual(t, db.Estimate(Pattern{A: friend, V: []interface{}{name.Keyword, "Alice"}}), 2)
+	tu.ExpectEqual(t, db.Estimate(Pattern{A: name, V: "Nobody"}), 0)
+	// retractions are counted as well
+	tu.ExpectEqual(t, db.Estimate(Pattern{A: age}), 4)
+	// values of other types need a full scan
+	tu.ExpectEqual(t, db.Estimate(Pattern{V: "Fred"}), total)
+	tu.ExpectEqual(t, db.Estimate(Pattern{}), total)
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	db := searchDb()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, kw := range []Keyword{name, age, friend} {
+				id, err := kw.Lookup(db)
+				tu.ExpectNil(t, err)
+				tu.ExpectNotNil(t, db.Attribute(id))
+			}
+		}()
+	}
+	wg.Wait()
+}
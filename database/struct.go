@@ -0,0 +1,246 @@
+package database
+
+import (
+	"fmt"
+	"github.com/heyLu/fressian"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A StructField is a field of a struct that is mapped to an attribute
+// using a `mu` struct tag, e.g. `mu:"note/title"`.
+//
+// The entity id can be mapped using `mu:"db/id"`.  The `omitempty`
+// option, e.g. `mu:"note/archived,omitempty"`, marks fields whose
+// zero value means that the attribute is not set.
+type StructField struct {
+	Index     int
+	Attribute Keyword
+	IsId      bool
+	OmitEmpty bool
+}
+
+var structFieldsCache sync.Map // map[reflect.Type][]StructField
+
+// StructFields returns the mapped fields of the struct type.
+//
+// Fields without a `mu` tag, with the tag `mu:"-"` and unexported
+// fields are ignored.
+func StructFields(ty reflect.Type) ([]StructField, error) {
+	if fields, ok := structFieldsCache.Load(ty); ok {
+		return fields.([]StructField), nil
+	}
+
+	if ty.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct, but got %v", ty)
+	}
+
+	fields := make([]StructField, 0, ty.NumField())
+	for i := 0; i < ty.NumField(); i++ {
+		field := ty.Field(i)
+		tag := field.Tag.Get("mu")
+		if tag == "" || tag == "-" || field.PkgPath != "" {
+			continue
+		}
+
+		omitEmpty := false
+		if pos := strings.Index(tag, ","); pos != -1 {
+			for _, option := range strings.Split(tag[pos+1:], ",") {
+				if option != "omitempty" {
+					return nil, fmt.Errorf("unknown option %q for field %s", option, field.Name)
+				}
+				omitEmpty = true
+			}
+			tag = tag[:pos]
+		}
+
+		tag = strings.TrimPrefix(tag, ":")
+		kw := fressian.Keyword{Name: tag}
+		if pos := strings.LastIndex(tag, "/"); pos != -1 {
+			kw = fressian.Keyword{Namespace: tag[:pos], Name: tag[pos+1:]}
+		}
+		if kw.Name == "" {
+			return nil, fmt.Errorf("invalid attribute %q for field %s", tag, field.Name)
+		}
+
+		isId := kw.Namespace == "db" && kw.Name == "id"
+		if isId && !IsIntKind(field.Type.Kind()) {
+			return nil, fmt.Errorf("field %s for :db/id must be an integer, but is %v", field.Name, field.Type)
+		}
+
+		fields = append(fields, StructField{Index: i, Attribute: Keyword{kw}, IsId: isId, OmitEmpty: omitEmpty})
+	}
+
+	structFieldsCache.Store(ty, fields)
+	return fields, nil
+}
+
+// IsIntKind returns true if the kind is one of the signed or unsigned
+// integer kinds.
+func IsIntKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	default:
+		return false
+	}
+}
+
+// Decode stores the attributes of the entity in the struct pointed
+// to by v, using the `mu` struct tags to map fields to attributes.
+//
+// Refs are decoded into nested structs (or pointers to them), into
+// integer fields as entity ids or into Keyword fields as the ident of
+// the referenced entity.  Attributes with cardinality many are decoded
+// into slices.  Fields for attributes without a value are left
+// unchanged.
+func (e Entity) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("expected a pointer to a struct, but got %T", v)
+	}
+
+	d := decoder{
+		pointers: map[int]reflect.Value{},
+		decoding: map[int]bool{},
+	}
+	return d.decodeEntity(e, rv.Elem())
+}
+
+type decoder struct {
+	// pointers to already decoded entities, so that cyclic references
+	// decode to the same value
+	pointers map[int]reflect.Value
+	decoding map[int]bool
+}
+
+func (d *decoder) decodeEntity(e Entity, sv reflect.Value) error {
+	fields, err := StructFields(sv.Type())
+	if err != nil {
+		return err
+	}
+
+	d.decoding[e.id] = true
+	defer delete(d.decoding, e.id)
+
+	for _, field := range fields {
+		fv := sv.Field(field.Index)
+		if field.IsId {
+			SetInt(fv, e.id)
+			continue
+		}
+
+		val := e.Get(field.Attribute)
+		if val == nil {
+			continue
+		}
+
+		vals, hasMany := val.([]interface{})
+		if !hasMany {
+			err := d.decodeValue(val, fv)
+			if err != nil {
+				return fmt.Errorf("%v: %v", field.Attribute, err)
+			}
+			continue
+		}
+
+		if fv.Kind() != reflect.Slice {
+			return fmt.Errorf("%v: cannot decode multiple values into field of type %v", field.Attribute, fv.Type())
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			err := d.decodeValue(val, slice.Index(i))
+			if err != nil {
+				return fmt.Errorf("%v: %v", field.Attribute, err)
+			}
+		}
+		fv.Set(slice)
+	}
+
+	return nil
+}
+
+func (d *decoder) decodeValue(val interface{}, fv reflect.Value) error {
+	if entity, ok := val.(Entity); ok {
+		return d.decodeRef(entity, fv)
+	}
+
+	if kw, ok := val.(fressian.Keyword); ok && fv.Type() == reflect.TypeOf(Keyword{}) {
+		fv.Set(reflect.ValueOf(Keyword{kw}))
+		return nil
+	}
+
+	rv := reflect.ValueOf(val)
+	ty := fv.Type()
+	if fv.Kind() == reflect.Ptr && !rv.Type().AssignableTo(ty) {
+		ptr := reflect.New(ty.Elem())
+		err := d.decodeValue(val, ptr.Elem())
+		if err != nil {
+			return err
+		}
+		fv.Set(ptr)
+		return nil
+	}
+
+	switch {
+	case rv.Type().AssignableTo(ty):
+		fv.Set(rv)
+	case rv.Kind() == reflect.String && ty.Kind() == reflect.String,
+		isNumberKind(rv.Kind()) && isNumberKind(ty.Kind()):
+		fv.Set(rv.Convert(ty))
+	default:
+		return fmt.Errorf("cannot decode %#v into field of type %v", val, ty)
+	}
+	return nil
+}
+
+func (d *decoder) decodeRef(entity Entity, fv reflect.Value) error {
+	ty := fv.Type()
+	switch {
+	case ty == reflect.TypeOf(Keyword{}):
+		ident := entity.db.Ident(entity.id)
+		if ident == nil {
+			return fmt.Errorf("entity %d has no :db/ident", entity.id)
+		}
+		fv.Set(reflect.ValueOf(*ident))
+	case IsIntKind(ty.Kind()):
+		SetInt(fv, entity.id)
+	case ty.Kind() == reflect.Ptr && ty.Elem().Kind() == reflect.Struct:
+		if ptr, ok := d.pointers[entity.id]; ok && ptr.Type() == ty {
+			fv.Set(ptr)
+			return nil
+		}
+
+		ptr := reflect.New(ty.Elem())
+		d.pointers[entity.id] = ptr
+		err := d.decodeEntity(entity, ptr.Elem())
+		if err != nil {
+			return err
+		}
+		fv.Set(ptr)
+	case ty.Kind() == reflect.Struct:
+		if d.decoding[entity.id] {
+			return fmt.Errorf("cyclic reference to entity %d, use a pointer instead", entity.id)
+		}
+		return d.decodeEntity(entity, fv)
+	default:
+		return fmt.Errorf("cannot decode ref to %d into field of type %v", entity.id, ty)
+	}
+	return nil
+}
+
+func isNumberKind(kind reflect.Kind) bool {
+	return IsIntKind(kind) || kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// SetInt sets the signed or unsigned integer field to i.
+func SetInt(fv reflect.Value, i int) {
+	switch fv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fv.SetUint(uint64(i))
+	default:
+		fv.SetInt(int64(i))
+	}
+}
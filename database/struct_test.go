@@ -0,0 +1,48 @@
+package database
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"reflect"
+	"testing"
+)
+
+func TestStructFields(t *testing.T) {
+	type note struct {
+		Id      int    `mu:"db/id"`
+		Title   string `mu:":note/title"`
+		Name    string `mu:"name"`
+		Ignored string `mu:"-"`
+		NoTag   string
+		private string `mu:"note/private"`
+	}
+
+	fields, err := StructFields(reflect.TypeOf(note{}))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, fields, []StructField{
+		{0, Keyword{fressian.Keyword{"db", "id"}}, true, false},
+		{1, Keyword{fressian.Keyword{"note", "title"}}, false, false},
+		{2, Keyword{fressian.Keyword{"", "name"}}, false, false},
+	})
+
+	_, err = StructFields(reflect.TypeOf(struct {
+		Id string `mu:"db/id"`
+	}{}))
+	tu.ExpectNotNil(t, err)
+
+	_, err = StructFields(reflect.TypeOf(42))
+	tu.ExpectNotNil(t, err)
+}
+
+func TestStructFieldsOptions(t *testing.T) {
+	fields, err := StructFields(reflect.TypeOf(struct {
+		Archived bool `mu:"note/archived,omitempty"`
+	}{}))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, fields[0].OmitEmpty, true)
+
+	_, err = StructFields(reflect.TypeOf(struct {
+		Archived bool `mu:"note/archived,unknown"`
+	}{}))
+	tu.ExpectNotNil(t, err)
+}
@@ -0,0 +1,110 @@
+package index
+
+import (
+	"github.com/heyLu/mu/comparable"
+)
+
+const (
+	// the number of datoms per segment written by BuildSegments
+	segmentSize = 1000
+	// the number of segments per directory written by BuildSegments
+	directorySize = 500
+)
+
+// BuildSegments writes the datoms of iter as a new segmented index,
+// using put to store the segments and directories, and returns the
+// root of the new index.
+//
+// The datoms must be sorted in the order of the index, e.g. using
+// CompareEavt for an EAVT index.  The root itself is not stored.
+func BuildSegments(iter Iterator, put PutFn) (Root, error) {
+	return buildSegments(iter, put, segmentSize, directorySize)
+}
+
+func buildSegments(iter Iterator, put PutFn, segmentSize, directorySize int) (Root, error) {
+	root := Root{}
+	directory := Directory{}
+	segment := TransposedData{}
+
+	putDirectory := func() error {
+		if len(directory.segments) == 0 {
+			return nil
+		}
+
+		id, err := put(directory)
+		if err != nil {
+			return err
+		}
+		root.tData = root.tData.append(directory.tData, 0)
+		root.directories = append(root.directories, id)
+		directory = Directory{}
+		return nil
+	}
+
+	putSegment := func() error {
+		if len(segment.entities) == 0 {
+			return nil
+		}
+
+		id, err := put(segment)
+		if err != nil {
+			return err
+		}
+		directory.tData = directory.tData.append(segment, 0)
+		directory.segments = append(directory.segments, id)
+		segment = TransposedData{}
+
+		if len(directory.segments) >= directorySize {
+			return putDirectory()
+		}
+		return nil
+	}
+
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		segment = segment.appendDatom(*datom)
+		if len(segment.entities) >= segmentSize {
+			err := putSegment()
+			if err != nil {
+				return Root{}, err
+			}
+		}
+	}
+
+	err := putSegment()
+	if err != nil {
+		return Root{}, err
+	}
+	err = putDirectory()
+	if err != nil {
+		return Root{}, err
+	}
+
+	return root, nil
+}
+
+// appendDatom returns new transposed data with the datom appended to
+// it.
+func (t TransposedData) appendDatom(datom Datom) TransposedData {
+	return TransposedData{
+		values:       append(t.values, datom.value.val),
+		entities:     append(t.entities, datom.entity),
+		attributes:   append(t.attributes, datom.attribute),
+		transactions: append(t.transactions, datom.transaction),
+		addeds:       append(t.addeds, datom.added),
+	}
+}
+
+// MergeIterators returns an iterator over the datoms of all iterators,
+// which must be sorted using compare.  Datoms contained in more than
+// one iterator are only returned once.
+func MergeIterators(compare comparable.CompareFn, iters ...Iterator) Iterator {
+	if len(iters) == 0 {
+		return emptyIterator{}
+	}
+
+	iter := iters[0]
+	for _, other := range iters[1:] {
+		iter = newMergeIterator(compare, iter, other)
+	}
+	return iter
+}
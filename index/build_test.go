@@ -0,0 +1,58 @@
+package index
+
+import (
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+)
+
+func TestBuildSegments(t *testing.T) {
+	tx := 3*(1<<42) + 1000
+	datoms := []Datom{}
+	for i := 0; i < 50; i++ {
+		datoms = append(datoms, NewDatom(100+i, 1, i, tx, true))
+	}
+
+	store := mapStore{}
+	memory := NewMemoryIndex(CompareEavt).AddDatoms(datoms)
+	root, err := buildSegments(memory.Datoms(), store.put, 4, 3)
+	tu.RequireNil(t, err)
+	// 13 segments in 5 directories
+	tu.ExpectEqual(t, len(root.directories), 5)
+
+	si := NewSegmentedIndex(&root, store, CompareEavtIndex)
+	iter := si.Datoms()
+	for _, expected := range datoms {
+		datom := iter.Next()
+		tu.RequireNotNil(t, datom)
+		tu.ExpectEqual(t, CompareEavt(datom, &expected), 0)
+	}
+	tu.ExpectNil(t, iter.Next())
+
+	start, end := NewDatom(120, 0, MinValue, MaxDatom.Tx(), false), NewDatom(120, MaxDatom.A(), MaxValue, 0, true)
+	iter = si.DatomsAt(start, end)
+	datom := iter.Next()
+	tu.RequireNotNil(t, datom)
+	tu.ExpectEqual(t, datom.V().Val(), 20)
+	tu.ExpectNil(t, iter.Next())
+}
+
+func TestBuildSegmentsEmpty(t *testing.T) {
+	store := mapStore{}
+	root, err := BuildSegments(emptyIterator{}, store.put)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(root.directories), 0)
+	tu.ExpectEqual(t, len(store), 0)
+}
+
+func TestMergeIterators(t *testing.T) {
+	a := NewMemoryIndex(CompareEavt).AddDatoms([]Datom{NewDatom(1, 1, 1, 0, true), NewDatom(3, 1, 3, 0, true)})
+	b := NewMemoryIndex(CompareEavt).AddDatoms([]Datom{NewDatom(2, 1, 2, 0, true), NewDatom(3, 1, 3, 0, true)})
+
+	iter := MergeIterators(CompareEavt, a.Datoms(), b.Datoms())
+	for _, e := range []int{1, 2, 3} {
+		datom := iter.Next()
+		tu.RequireNotNil(t, datom)
+		tu.ExpectEqual(t, datom.E(), e)
+	}
+	tu.ExpectNil(t, iter.Next())
+}
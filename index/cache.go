@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"github.com/heyLu/fressian"
+	"sync"
 
 	"github.com/heyLu/mu/store"
 )
@@ -11,23 +12,41 @@ import (
 type Cache interface {
 	Get(id string) (interface{}, bool)
 	Put(id string, val interface{})
+	Remove(id string)
 }
 
 type memoryCache struct {
+	lock  sync.RWMutex
 	cache map[string]interface{}
 }
 
 func (c *memoryCache) Get(id string) (interface{}, bool) {
+	c.lock.RLock()
 	val, ok := c.cache[id]
+	c.lock.RUnlock()
 	return val, ok
 }
 
 func (c *memoryCache) Put(id string, val interface{}) {
+	c.lock.Lock()
 	c.cache[id] = val
+	c.lock.Unlock()
+}
+
+func (c *memoryCache) Remove(id string) {
+	c.lock.Lock()
+	delete(c.cache, id)
+	c.lock.Unlock()
 }
 
 // FIXME: use "github.com/golang/groupcache/lru instead
-var cache Cache = &memoryCache{make(map[string]interface{}, 100)}
+var cache Cache = &memoryCache{cache: make(map[string]interface{}, 100)}
+
+// RemoveFromCache removes the value stored under id from the cache,
+// e.g. because it was removed from the store.
+func RemoveFromCache(id string) {
+	cache.Remove(id)
+}
 
 func GetFromCache(store store.Store, id string) interface{} {
 	if val, ok := cache.Get(id); ok {
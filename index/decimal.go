@@ -0,0 +1,107 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// A Decimal is an arbitrary precision decimal number, the value of
+// :db.type/bigdec attributes.
+//
+// Like java.math.BigDecimal, its value is Unscaled * 10^-Scale, so
+// that decimals keep their exact value and scale, e.g. 0.10M has the
+// unscaled value 10 and the scale 2.  This is also how the standard
+// fressian "bigdec" tag encodes them.
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int32
+}
+
+func NewDecimal(unscaled *big.Int, scale int32) *Decimal {
+	return &Decimal{Unscaled: unscaled, Scale: scale}
+}
+
+// ParseDecimal parses decimals like "1.25", "-0.10" or "1.5e-3".
+func ParseDecimal(s string) (*Decimal, error) {
+	mant, exp := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		exp, err = strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decimal %q", s)
+		}
+		mant = s[:i]
+	}
+
+	scale := int64(0)
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		scale = int64(len(mant) - i - 1)
+		mant = mant[:i] + mant[i+1:]
+	}
+
+	unscaled, ok := new(big.Int).SetString(mant, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	scale -= exp
+	if scale < math.MinInt32 || scale > math.MaxInt32 {
+		return nil, fmt.Errorf("scale of decimal %q is out of range", s)
+	}
+	return NewDecimal(unscaled, int32(scale)), nil
+}
+
+// DecimalFromFloat returns the shortest decimal that rounds to f, e.g.
+// 0.1 for big.NewFloat(0.1).
+func DecimalFromFloat(f *big.Float) (*Decimal, error) {
+	if f.IsInf() {
+		return nil, fmt.Errorf("cannot convert infinite %v to a decimal", f)
+	}
+	return ParseDecimal(f.Text('g', -1))
+}
+
+// Cmp compares the values of the decimals, regardless of their scale,
+// so 0.1M and 0.10M are equal.
+func (d *Decimal) Cmp(o *Decimal) int {
+	if d.Unscaled.Sign() != o.Unscaled.Sign() {
+		return d.Unscaled.Sign() - o.Unscaled.Sign()
+	}
+
+	x, y := d.Unscaled, o.Unscaled
+	switch {
+	case d.Scale < o.Scale:
+		x = new(big.Int).Mul(x, pow10(int64(o.Scale)-int64(d.Scale)))
+	case d.Scale > o.Scale:
+		y = new(big.Int).Mul(y, pow10(int64(d.Scale)-int64(o.Scale)))
+	}
+	return x.Cmp(y)
+}
+
+// String returns the decimal in plain notation if the scale is not
+// negative, e.g. 0.10, and in scientific notation otherwise, e.g.
+// 12E+3, like BigDecimal.toString.
+func (d *Decimal) String() string {
+	s := d.Unscaled.String()
+	switch {
+	case d.Scale == 0:
+		return s
+	case d.Scale < 0:
+		return fmt.Sprintf("%sE+%d", s, -int64(d.Scale))
+	}
+
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	scale := int(d.Scale)
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	return sign + s[:len(s)-scale] + "." + s[len(s)-scale:]
+}
+
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(n), nil)
+}
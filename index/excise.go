@@ -0,0 +1,142 @@
+package index
+
+// PutFn stores a segment, directory or root and returns the id it was
+// stored under.
+type PutFn func(val interface{}) (string, error)
+
+// Excise returns a new segmented index without the given datoms.
+//
+// Only the segments (and the directories and root pointing to them)
+// that contain excised datoms are rewritten, using put to store them.
+// The ids of the replaced segments and directories are returned as
+// well, so that they can be removed from storage.
+//
+// If none of the datoms are part of the index, the index is returned
+// unchanged.
+func (si SegmentedIndex) Excise(datoms []Datom, put PutFn) (*SegmentedIndex, []string, error) {
+	root := *si.root
+
+	// find the segments containing the datoms, grouped by directory
+	affected := map[int]map[int][]int{}
+	for _, datom := range datoms {
+		rootIdx, dirIdx, segmentIdx := root.Find(si.store, si.compare, datom)
+		if rootIdx >= len(root.directories) {
+			continue
+		}
+
+		directory := getDirectory(si.store, root.directories[rootIdx])
+		if dirIdx >= len(directory.segments) {
+			continue
+		}
+
+		segment := getSegment(si.store, directory.segments[dirIdx])
+		if segmentIdx >= len(segment.entities) ||
+			si.compare(segment, segmentIdx, datom) != 0 ||
+			segment.addeds[segmentIdx] != datom.added {
+			continue
+		}
+
+		if _, ok := affected[rootIdx]; !ok {
+			affected[rootIdx] = map[int][]int{}
+		}
+		affected[rootIdx][dirIdx] = append(affected[rootIdx][dirIdx], segmentIdx)
+	}
+
+	if len(affected) == 0 {
+		return &si, nil, nil
+	}
+
+	removed := []string{}
+	newRoot := Root{}
+	for rootIdx, dirId := range root.directories {
+		segmentsByDir, ok := affected[rootIdx]
+		if !ok {
+			directory := getDirectory(si.store, dirId)
+			first := getSegment(si.store, directory.segments[0])
+			newRoot.tData = newRoot.tData.append(first, 0)
+			newRoot.directories = append(newRoot.directories, dirId)
+			continue
+		}
+
+		directory := getDirectory(si.store, dirId)
+		newDirectory := Directory{}
+		hasMystery := len(directory.mystery1) == len(directory.segments) &&
+			len(directory.mystery2) == len(directory.segments)
+		for dirIdx, segmentId := range directory.segments {
+			segment := getSegment(si.store, segmentId)
+			newSegment := segment
+			newSegmentId := segmentId
+			if idxs, ok := segmentsByDir[dirIdx]; ok {
+				newSegment = segment.without(idxs)
+				removed = append(removed, segmentId)
+				if len(newSegment.entities) == 0 {
+					continue
+				}
+
+				id, err := put(newSegment)
+				if err != nil {
+					return nil, nil, err
+				}
+				newSegmentId = id
+			}
+
+			newDirectory.tData = newDirectory.tData.append(newSegment, 0)
+			newDirectory.segments = append(newDirectory.segments, newSegmentId)
+			if hasMystery {
+				newDirectory.mystery1 = append(newDirectory.mystery1, directory.mystery1[dirIdx])
+				newDirectory.mystery2 = append(newDirectory.mystery2, directory.mystery2[dirIdx])
+			}
+		}
+
+		removed = append(removed, dirId)
+		if len(newDirectory.segments) == 0 {
+			continue
+		}
+
+		newDirId, err := put(newDirectory)
+		if err != nil {
+			return nil, nil, err
+		}
+		newRoot.tData = newRoot.tData.append(newDirectory.tData, 0)
+		newRoot.directories = append(newRoot.directories, newDirId)
+	}
+
+	return NewSegmentedIndex(&newRoot, si.store, si.compare), removed, nil
+}
+
+// Root returns the root of the index.
+func (si SegmentedIndex) Root() Root {
+	return *si.root
+}
+
+// append returns new transposed data with the datom at idx in other
+// appended to it.
+func (t TransposedData) append(other TransposedData, idx int) TransposedData {
+	var value interface{}
+	if idx < len(other.values) {
+		value = other.values[idx]
+	}
+	return TransposedData{
+		values:       append(t.values, value),
+		entities:     append(t.entities, other.entities[idx]),
+		attributes:   append(t.attributes, other.attributes[idx]),
+		transactions: append(t.transactions, other.transactions[idx]),
+		addeds:       append(t.addeds, other.addeds[idx]),
+	}
+}
+
+// without returns new transposed data without the datoms at idxs.
+func (t TransposedData) without(idxs []int) TransposedData {
+	skip := make(map[int]bool, len(idxs))
+	for _, idx := range idxs {
+		skip[idx] = true
+	}
+
+	newData := TransposedData{}
+	for i := range t.entities {
+		if !skip[i] {
+			newData = newData.append(t, i)
+		}
+	}
+	return newData
+}
@@ -0,0 +1,106 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+)
+
+type mapStore map[string][]byte
+
+func (s mapStore) Get(id string) ([]byte, error) {
+	data, ok := s[id]
+	if !ok {
+		return nil, fmt.Errorf("no such object: %s", id)
+	}
+	return data, nil
+}
+
+func (s mapStore) Put(id string, data []byte) error { s[id] = data; return nil }
+func (s mapStore) Delete(id string) error           { delete(s, id); return nil }
+func (s mapStore) Close() error                     { return nil }
+
+// mapStoreIds is used to generate ids that are unique across tests,
+// because segments are cached by their id.
+var mapStoreIds = 0
+
+func (s mapStore) put(val interface{}) (string, error) {
+	mapStoreIds += 1
+	id := fmt.Sprintf("00000000-0000-0000-0000-%012d", mapStoreIds)
+	buf := new(bytes.Buffer)
+	w := fressian.NewGzipWriter(buf, SegmentWriteHandler)
+	err := w.WriteValue(val)
+	if err != nil {
+		return "", err
+	}
+	w.Flush()
+	return id, s.Put(id, buf.Bytes())
+}
+
+func transposed(datoms ...Datom) TransposedData {
+	tData := TransposedData{}
+	for _, datom := range datoms {
+		tData.values = append(tData.values, datom.value.val)
+		tData.entities = append(tData.entities, datom.entity)
+		tData.attributes = append(tData.attributes, datom.attribute)
+		tData.transactions = append(tData.transactions, datom.transaction)
+		tData.addeds = append(tData.addeds, datom.added)
+	}
+	return tData
+}
+
+func TestSegmentedIndexExcise(t *testing.T) {
+	tx := 3*(1<<42) + 1000
+	datoms := []Datom{
+		NewDatom(100, 1, "Jane", tx, true),
+		NewDatom(100, 2, "secret", tx, true),
+		NewDatom(101, 1, "Judy", tx, true),
+		NewDatom(101, 2, "public", tx, true),
+	}
+
+	store := mapStore{}
+	seg1, _ := store.put(transposed(datoms[0], datoms[1]))
+	seg2, _ := store.put(transposed(datoms[2], datoms[3]))
+	dir, _ := store.put(Directory{
+		tData:    transposed(datoms[0], datoms[2]),
+		segments: []string{seg1, seg2},
+	})
+	root := Root{tData: transposed(datoms[0]), directories: []string{dir}}
+
+	si := NewSegmentedIndex(&root, store, CompareEavtIndex)
+	newSi, removed, err := si.Excise([]Datom{datoms[1]}, store.put)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, removed, []string{seg1, dir})
+
+	iter := newSi.Datoms()
+	for _, expected := range []Datom{datoms[0], datoms[2], datoms[3]} {
+		datom := iter.Next()
+		tu.RequireNotNil(t, datom)
+		tu.ExpectEqual(t, CompareEavt(datom, &expected), 0)
+	}
+	tu.ExpectNil(t, iter.Next())
+
+	// nothing changes if the datoms are not in the index
+	sameSi, removed, err := newSi.Excise([]Datom{datoms[1]}, store.put)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(removed), 0)
+	tu.ExpectEqual(t, sameSi.Root().directories, newSi.Root().directories)
+}
+
+func TestMergedIndexRemoveDatoms(t *testing.T) {
+	datoms := []Datom{
+		NewDatom(100, 1, "Jane", 0, true),
+		NewDatom(100, 2, "secret", 0, true),
+	}
+	empty := NewSegmentedIndex(&Root{}, nil, CompareEavtIndex)
+	mi := NewMergedIndex(NewMemoryIndex(CompareEavt), empty, CompareEavt).AddDatoms(datoms)
+
+	removed := mi.RemoveDatoms(datoms[1:])
+	iter := removed.Datoms()
+	datom := iter.Next()
+	tu.RequireNotNil(t, datom)
+	tu.ExpectEqual(t, datom.V().Val(), "Jane")
+	tu.ExpectNil(t, iter.Next())
+}
@@ -2,6 +2,8 @@ package index
 
 import (
 	"github.com/heyLu/fressian"
+	"math/big"
+	"net/url"
 )
 
 const txOffset = 3 * (1 << 42)
@@ -12,6 +14,10 @@ var WriteHandler fressian.WriteHandler = func(w *fressian.Writer, val interface{
 		return w.WriteExt("mu.Datom", val.entity, val.attribute, val.value, val.added, val.transaction%txOffset)
 	case Value:
 		return w.WriteValue(val.val)
+	case *url.URL:
+		return w.WriteExt("uri", val.String())
+	case *Decimal:
+		return w.WriteExt("bigdec", twosComplement(val.Unscaled), int(val.Scale))
 	default:
 		return fressian.DefaultHandler(w, val)
 	}
@@ -33,4 +39,53 @@ var ReadHandlers = map[string]fressian.ReadHandler{
 			addedRaw.(bool),
 		}
 	},
+	"uri":    readURI,
+	"bigdec": readBigDec,
+}
+
+// readURI reads uris written with the standard fressian "uri" tag.
+func readURI(r *fressian.Reader, tag string, fieldCount int) interface{} {
+	raw, _ := r.ReadValue()
+	u, err := url.Parse(raw.(string))
+	if err != nil {
+		return raw
+	}
+	return u
+}
+
+// readBigDec reads decimals written with the standard fressian
+// "bigdec" tag, which contains the unscaled value and the scale.
+func readBigDec(r *fressian.Reader, tag string, fieldCount int) interface{} {
+	unscaledRaw, _ := r.ReadValue()
+	scaleRaw, _ := r.ReadValue()
+	return NewDecimal(fromTwosComplement(unscaledRaw.([]byte)), int32(scaleRaw.(int)))
+}
+
+// twosComplement returns the big-endian two's complement
+// representation of i, like BigInteger.toByteArray in Java.
+func twosComplement(i *big.Int) []byte {
+	if i.Sign() >= 0 {
+		bs := i.Bytes()
+		if len(bs) == 0 || bs[0]&0x80 != 0 {
+			bs = append([]byte{0}, bs...)
+		}
+		return bs
+	}
+
+	n := i.BitLen()/8 + 1
+	c := new(big.Int).Lsh(big.NewInt(1), uint(n*8))
+	c.Add(c, i)
+	bs := c.Bytes()
+	for len(bs) < n {
+		bs = append([]byte{0xff}, bs...)
+	}
+	return bs
+}
+
+func fromTwosComplement(bs []byte) *big.Int {
+	i := new(big.Int).SetBytes(bs)
+	if len(bs) > 0 && bs[0]&0x80 != 0 {
+		i.Sub(i, new(big.Int).Lsh(big.NewInt(1), uint(len(bs)*8)))
+	}
+	return i
 }
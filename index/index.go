@@ -18,6 +18,9 @@ type Index interface {
 	Datoms() Iterator
 	DatomsAt(start, end Datom) Iterator
 	SeekDatoms(start Datom) Iterator
+	// Estimate estimates the number of datoms between start and end
+	// without reading them.
+	Estimate(start, end Datom) int
 }
 
 type Iterator interface {
@@ -47,14 +50,47 @@ func (si SegmentedIndex) SeekDatoms(start Datom) Iterator {
 	return si.DatomsAt(start, MaxDatom)
 }
 
+// Estimate estimates the number of datoms between start and end.
+//
+// Only the directory and segment at the start of the range are read,
+// the directories and segments in between are assumed to be as large
+// as them.
+func (si SegmentedIndex) Estimate(start, end Datom) int {
+	root := *si.root
+	if len(root.directories) == 0 {
+		return 0
+	}
+
+	rs, ds, ss := root.Find(si.store, si.compare, start)
+	re, de, se := root.Find(si.store, si.compare, end)
+	if rs >= len(root.directories) {
+		return 0
+	}
+	directory := getDirectory(si.store, root.directories[rs])
+	if ds >= len(directory.segments) {
+		return 0
+	}
+	segment := getSegment(si.store, directory.segments[ds])
+
+	segments := (re-rs)*len(directory.segments) + de - ds
+	n := segments*len(segment.entities) + se - ss
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
 type MergedIndex struct {
 	memory    *MemoryIndex
 	segmented *SegmentedIndex
 	compare   comparable.CompareFn
+	// excised contains datoms that have been removed, but are still
+	// present in the segmented index.
+	excised *MemoryIndex
 }
 
 func NewMergedIndex(mi *MemoryIndex, si *SegmentedIndex, compare comparable.CompareFn) *MergedIndex {
-	return &MergedIndex{mi, si, compare}
+	return &MergedIndex{mi, si, compare, nil}
 }
 
 func (mi MergedIndex) Datoms() Iterator {
@@ -64,6 +100,12 @@ func (mi MergedIndex) Datoms() Iterator {
 func (mi MergedIndex) DatomsAt(start, end Datom) Iterator {
 	iter1 := mi.memory.DatomsAt(start, end)
 	iter2 := mi.segmented.DatomsAt(start, end)
+	if mi.excised != nil {
+		excised := mi.excised
+		iter2 = FilterIterator(iter2, func(datom *Datom) bool {
+			return !excised.Contains(*datom)
+		})
+	}
 	return newMergeIterator(mi.compare, iter1, iter2)
 }
 
@@ -71,7 +113,28 @@ func (mi MergedIndex) SeekDatoms(start Datom) Iterator {
 	return mi.DatomsAt(start, MaxDatom)
 }
 
+// Estimate estimates the number of datoms between start and end in
+// both indexes.  Excised datoms are not taken into account.
+func (mi MergedIndex) Estimate(start, end Datom) int {
+	return mi.memory.Estimate(start, end) + mi.segmented.Estimate(start, end)
+}
+
 func (mi MergedIndex) AddDatoms(datoms []Datom) *MergedIndex {
 	memory := mi.memory.AddDatoms(datoms)
-	return NewMergedIndex(memory, mi.segmented, mi.compare)
+	return &MergedIndex{memory, mi.segmented, mi.compare, mi.excised}
+}
+
+// RemoveDatoms returns a new index without the given datoms.
+//
+// Datoms are removed from the memory index directly.  The segmented
+// index is immutable, so datoms stored there are hidden until the
+// segments are rewritten using `SegmentedIndex.Excise`.
+func (mi MergedIndex) RemoveDatoms(datoms []Datom) *MergedIndex {
+	memory := mi.memory.RemoveDatoms(datoms)
+	excised := mi.excised
+	if excised == nil {
+		excised = NewMemoryIndex(CompareEavt)
+	}
+	excised = excised.AddDatoms(datoms)
+	return &MergedIndex{memory, mi.segmented, mi.compare, excised}
 }
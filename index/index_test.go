@@ -0,0 +1,46 @@
+package index
+
+import (
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	tx := 3*(1<<42) + 1000
+	datoms := []Datom{}
+	for i := 0; i < 50; i++ {
+		datoms = append(datoms, NewDatom(100+i, 1, i, tx, true), NewDatom(100+i, 2, "x", tx, true))
+	}
+
+	store := mapStore{}
+	memory := NewMemoryIndex(CompareEavt).AddDatoms(datoms)
+	root, err := buildSegments(memory.Datoms(), store.put, 4, 3)
+	tu.RequireNil(t, err)
+	si := NewSegmentedIndex(&root, store, CompareEavtIndex)
+
+	entity := func(e int) (Datom, Datom) {
+		return NewDatom(e, 0, MinValue, MaxDatom.Tx(), false), NewDatom(e, MaxDatom.A(), MaxValue, 0, true)
+	}
+
+	// exact within a segment
+	start, end := entity(120)
+	tu.ExpectEqual(t, memory.Estimate(start, end), 2)
+	tu.ExpectEqual(t, si.Estimate(start, end), 2)
+
+	start, end = entity(200)
+	tu.ExpectEqual(t, memory.Estimate(start, end), 0)
+	tu.ExpectEqual(t, si.Estimate(start, end), 0)
+
+	tu.ExpectEqual(t, memory.Estimate(MinDatom, MaxDatom), 100)
+	tu.ExpectEqual(t, si.Estimate(MinDatom, MaxDatom), 100)
+
+	start, _ = entity(110)
+	_, end = entity(129)
+	tu.ExpectEqual(t, si.Estimate(start, end), 40)
+
+	empty := NewSegmentedIndex(&Root{}, store, CompareEavtIndex)
+	tu.ExpectEqual(t, empty.Estimate(MinDatom, MaxDatom), 0)
+
+	merged := NewMergedIndex(NewMemoryIndex(CompareEavt).AddDatoms(datoms[:10]), si, CompareEavt)
+	tu.ExpectEqual(t, merged.Estimate(MinDatom, MaxDatom), 110)
+}
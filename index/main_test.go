@@ -3,7 +3,10 @@ package index
 import (
 	"github.com/heyLu/fressian"
 	tu "github.com/klingtnet/gol/util/testing"
+	"math/big"
+	"net/url"
 	"testing"
+	"time"
 )
 
 var (
@@ -40,6 +43,71 @@ func TestValueCompare(t *testing.T) {
 	expectLt(t, NewValue(fressian.Keyword{"", ""}), NewValue(0))
 	expectLt(t, NewValue(fressian.Keyword{"", ""}), NewValue(""))
 	expectLt(t, NewValue(0), NewValue(""))
+
+	now := time.Now()
+	expectLt(t, NewValue(now), NewValue(now.Add(time.Millisecond)))
+	expectEq(t, NewValue(now), NewValue(now))
+
+	expectLt(t, NewValue([]byte("abc")), NewValue([]byte("abd")))
+	expectEq(t, NewValue([]byte("abc")), NewValue([]byte("abc")))
+
+	expectLt(t, NewValue(big.NewInt(3)), NewValue(big.NewInt(4)))
+	expectLt(t, NewValue(mustDecimal(t, "3.5")), NewValue(mustDecimal(t, "3.75")))
+	expectEq(t, NewValue(mustDecimal(t, "3.5")), NewValue(mustDecimal(t, "3.5")))
+	expectEq(t, NewValue(mustDecimal(t, "0.1")), NewValue(mustDecimal(t, "0.10")))
+	expectLt(t, NewValue(mustDecimal(t, "-1")), NewValue(mustDecimal(t, "0.001")))
+	expectLt(t, NewValue(mustDecimal(t, "0.30000000000000000000000000001")), NewValue(mustDecimal(t, "0.30000000000000000000000000002")))
+	expectGt(t, NewValue(mustDecimal(t, "12e3")), NewValue(mustDecimal(t, "11999.99")))
+
+	u1, _ := url.Parse("http://example.com/a")
+	u2, _ := url.Parse("http://example.com/b")
+	expectLt(t, NewValue(u1), NewValue(u2))
+
+	expectLt(t, NewRef(3), NewRef(4))
+
+	expectEq(t, NewTuple("a", 1), NewTuple("a", 1))
+	expectLt(t, NewTuple("a", 1), NewTuple("a", 2))
+	expectLt(t, NewTuple(nil, 1), NewTuple("a", 1))
+	expectLt(t, NewTuple("a"), NewTuple("a", 1))
+	expectEq(t, NewValue([]interface{}{"a", int64(1)}), NewTuple("a", 1))
+}
+
+func TestDecimal(t *testing.T) {
+	for _, example := range []struct {
+		text     string
+		unscaled string
+		scale    int32
+		str      string
+	}{
+		{"0.1", "1", 1, "0.1"},
+		{"0.10", "10", 2, "0.10"},
+		{"-1.25", "-125", 2, "-1.25"},
+		{"-0.001", "-1", 3, "-0.001"},
+		{"42", "42", 0, "42"},
+		{"12e3", "12", -3, "12E+3"},
+		{"1.5e-3", "15", 4, "0.0015"},
+		{"3.14159265358979323846264338327950288", "314159265358979323846264338327950288", 35, "3.14159265358979323846264338327950288"},
+	} {
+		d := mustDecimal(t, example.text)
+		tu.ExpectEqual(t, d.Unscaled.String(), example.unscaled)
+		tu.ExpectEqual(t, d.Scale, example.scale)
+		tu.ExpectEqual(t, d.String(), example.str)
+	}
+
+	for _, text := range []string{"", ".", "1.2.3", "abc", "1e", "1e99999999999"} {
+		_, err := ParseDecimal(text)
+		tu.ExpectNotNil(t, err)
+	}
+
+	d, err := DecimalFromFloat(big.NewFloat(0.1))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, d.String(), "0.1")
+}
+
+func mustDecimal(t *testing.T, s string) *Decimal {
+	d, err := ParseDecimal(s)
+	tu.RequireNil(t, err)
+	return d
 }
 
 func expectLt(t *testing.T, v1, v2 Value) {
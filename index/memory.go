@@ -54,6 +54,12 @@ func (mi MemoryIndex) SeekDatoms(start Datom) Iterator {
 	return mi.DatomsAt(start, MaxDatom)
 }
 
+// Estimate estimates the number of datoms between start and end, see
+// btset.EstimateCount.
+func (mi MemoryIndex) Estimate(start, end Datom) int {
+	return btset.EstimateCount(mi.datoms, &start, &end)
+}
+
 func (mi MemoryIndex) AddDatoms(datoms []Datom) *MemoryIndex {
 	set := mi.datoms
 	for i := 0; i < len(datoms); i++ {
@@ -63,6 +69,20 @@ func (mi MemoryIndex) AddDatoms(datoms []Datom) *MemoryIndex {
 	return &MemoryIndex{set}
 }
 
+func (mi MemoryIndex) RemoveDatoms(datoms []Datom) *MemoryIndex {
+	set := mi.datoms
+	for i := 0; i < len(datoms); i++ {
+		datom := datoms[i]
+		set = set.Disj(&datom)
+	}
+	return &MemoryIndex{set}
+}
+
+// Contains checks whether the datom is part of the index.
+func (mi MemoryIndex) Contains(datom Datom) bool {
+	return mi.datoms.Lookup(&datom) != nil
+}
+
 var defaultHandler fressian.WriteHandler = btset.NewWriteHandler(WriteHandler)
 
 var MemoryWriteHandler fressian.WriteHandler = func(w *fressian.Writer, val interface{}) error {
@@ -0,0 +1,155 @@
+package index
+
+// Merge returns a new segmented index with the datoms of iter added to
+// it, which must be sorted in the order of the index.
+//
+// Like Excise, only the segments the datoms are added to (and the
+// directories and root pointing to them) are rewritten, using put to
+// store them, so that adding datoms to a large index does not rewrite
+// all of it.  The ids of the replaced segments and directories are
+// returned as well, so that they can be removed from storage.  The
+// root itself is not stored.
+func (si SegmentedIndex) Merge(iter Iterator, put PutFn) (*SegmentedIndex, []string, error) {
+	return si.merge(iter, put, segmentSize, directorySize)
+}
+
+func (si SegmentedIndex) merge(iter Iterator, put PutFn, segmentSize, directorySize int) (*SegmentedIndex, []string, error) {
+	root := *si.root
+	next := iter.Next()
+	if next == nil {
+		return &si, nil, nil
+	}
+
+	if len(root.directories) == 0 {
+		newRoot, err := buildSegments(&prependIterator{next, iter}, put, segmentSize, directorySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewSegmentedIndex(&newRoot, si.store, si.compare), nil, nil
+	}
+
+	removed := []string{}
+	newRoot := Root{}
+	for rootIdx, dirId := range root.directories {
+		lastDir := rootIdx == len(root.directories)-1
+
+		// datoms before the first directory are added to it, the ones
+		// after the last directory to that one
+		if next == nil || (!lastDir && si.compare(root.tData, rootIdx+1, *next) <= 0) {
+			newRoot.tData = newRoot.tData.append(root.tData, rootIdx)
+			newRoot.directories = append(newRoot.directories, dirId)
+			continue
+		}
+
+		directory := getDirectory(si.store, dirId)
+		segments := Directory{}
+		for dirIdx, segmentId := range directory.segments {
+			// inRange returns true if the datom belongs to the segment
+			inRange := func(datom *Datom) bool {
+				switch {
+				case datom == nil:
+					return false
+				case dirIdx+1 < len(directory.segments):
+					return si.compare(directory.tData, dirIdx+1, *datom) > 0
+				case !lastDir:
+					return si.compare(root.tData, rootIdx+1, *datom) > 0
+				default:
+					return true
+				}
+			}
+
+			if !inRange(next) {
+				segments.tData = segments.tData.append(directory.tData, dirIdx)
+				segments.segments = append(segments.segments, segmentId)
+				continue
+			}
+
+			segment := getSegment(si.store, segmentId)
+			merged := TransposedData{}
+			putMerged := func() error {
+				if len(merged.entities) == 0 {
+					return nil
+				}
+				id, err := put(merged)
+				if err != nil {
+					return err
+				}
+				segments.tData = segments.tData.append(merged, 0)
+				segments.segments = append(segments.segments, id)
+				merged = TransposedData{}
+				return nil
+			}
+
+			i := 0
+			for i < len(segment.entities) || inRange(next) {
+				switch {
+				case !inRange(next):
+					merged = merged.append(segment, i)
+					i += 1
+				case i == len(segment.entities) || si.compare(segment, i, *next) > 0:
+					merged = merged.appendDatom(*next)
+					next = iter.Next()
+				case si.compare(segment, i, *next) == 0:
+					merged = merged.append(segment, i)
+					i += 1
+					next = iter.Next()
+				default:
+					merged = merged.append(segment, i)
+					i += 1
+				}
+
+				if len(merged.entities) >= segmentSize {
+					err := putMerged()
+					if err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+			err := putMerged()
+			if err != nil {
+				return nil, nil, err
+			}
+			removed = append(removed, segmentId)
+		}
+		removed = append(removed, dirId)
+
+		for start := 0; start < len(segments.segments); start += directorySize {
+			end := start + directorySize
+			if end > len(segments.segments) {
+				end = len(segments.segments)
+			}
+			newDirectory := Directory{segments: segments.segments[start:end]}
+			for j := start; j < end; j++ {
+				newDirectory.tData = newDirectory.tData.append(segments.tData, j)
+			}
+
+			id, err := put(newDirectory)
+			if err != nil {
+				return nil, nil, err
+			}
+			newRoot.tData = newRoot.tData.append(newDirectory.tData, 0)
+			newRoot.directories = append(newRoot.directories, id)
+		}
+	}
+
+	return NewSegmentedIndex(&newRoot, si.store, si.compare), removed, nil
+}
+
+// prependIterator returns first before the datoms of iter.
+type prependIterator struct {
+	first *Datom
+	iter  Iterator
+}
+
+func (i *prependIterator) Next() *Datom {
+	if i.first != nil {
+		first := i.first
+		i.first = nil
+		return first
+	}
+	return i.iter.Next()
+}
+
+func (i *prependIterator) Reverse() Iterator {
+	panic("not implemented")
+}
@@ -0,0 +1,85 @@
+package index
+
+import (
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+)
+
+func TestSegmentedIndexMerge(t *testing.T) {
+	tx := 3*(1<<42) + 1000
+	datoms := []Datom{}
+	for i := 0; i < 20; i++ {
+		datoms = append(datoms, NewDatom(100+2*i, 1, i, tx, true))
+	}
+
+	store := mapStore{}
+	root, err := buildSegments(NewMemoryIndex(CompareEavt).AddDatoms(datoms).Datoms(), store.put, 4, 2)
+	tu.RequireNil(t, err)
+	// 5 segments in 3 directories
+	tu.ExpectEqual(t, len(root.directories), 3)
+	si := NewSegmentedIndex(&root, store, CompareEavtIndex)
+
+	// before the first datom, in between, already present and after
+	// the last datom, all in the first and last directory
+	added := []Datom{
+		NewDatom(1, 1, "first", tx, true),
+		NewDatom(101, 1, "between", tx, true),
+		datoms[1],
+		NewDatom(200, 1, "last", tx, true),
+		NewDatom(201, 1, "last", tx, true),
+	}
+	sorted := NewMemoryIndex(CompareEavt).AddDatoms(added)
+	merged, removed, err := si.merge(sorted.Datoms(), store.put, 4, 2)
+	tu.RequireNil(t, err)
+
+	all := NewMemoryIndex(CompareEavt).AddDatoms(datoms).AddDatoms(added)
+	expected := all.Datoms()
+	iter := merged.Datoms()
+	for datom := expected.Next(); datom != nil; datom = expected.Next() {
+		actual := iter.Next()
+		tu.RequireNotNil(t, actual)
+		tu.ExpectEqual(t, CompareEavt(actual, datom), 0)
+	}
+	tu.ExpectNil(t, iter.Next())
+
+	// the middle directory is unchanged, the first one was split
+	// because its first segment was
+	tu.ExpectEqual(t, len(merged.Root().directories), 4)
+	tu.ExpectEqual(t, merged.Root().directories[2], root.directories[1])
+	first := getDirectory(store, root.directories[0])
+	last := getDirectory(store, root.directories[2])
+	tu.ExpectEqual(t, removed, []string{first.segments[0], root.directories[0], last.segments[0], root.directories[2]})
+
+	// lookups use the new directories and segments
+	start, end := NewDatom(101, 0, MinValue, MaxDatom.Tx(), false), NewDatom(101, MaxDatom.A(), MaxValue, 0, true)
+	iter = merged.DatomsAt(start, end)
+	datom := iter.Next()
+	tu.RequireNotNil(t, datom)
+	tu.ExpectEqual(t, datom.V().Val(), "between")
+	tu.ExpectNil(t, iter.Next())
+
+	// merging nothing returns the index unchanged
+	same, removed, err := merged.Merge(emptyIterator{}, store.put)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(removed), 0)
+	tu.ExpectEqual(t, same.Root().directories, merged.Root().directories)
+}
+
+func TestSegmentedIndexMergeEmpty(t *testing.T) {
+	tx := 3*(1<<42) + 1000
+	datoms := []Datom{NewDatom(100, 1, "a", tx, true), NewDatom(101, 1, "b", tx, true)}
+
+	store := mapStore{}
+	empty := NewSegmentedIndex(&Root{}, store, CompareEavtIndex)
+	merged, removed, err := empty.Merge(NewMemoryIndex(CompareEavt).AddDatoms(datoms).Datoms(), store.put)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(removed), 0)
+
+	iter := merged.Datoms()
+	for _, expected := range datoms {
+		datom := iter.Next()
+		tu.RequireNotNil(t, datom)
+		tu.ExpectEqual(t, CompareEavt(datom, &expected), 0)
+	}
+	tu.ExpectNil(t, iter.Next())
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"fmt"
 	"github.com/heyLu/fressian"
+	"net/url"
 
 	"github.com/heyLu/mu/comparable"
 	"github.com/heyLu/mu/store"
@@ -33,19 +34,33 @@ var _ fressian.WriteHandler = SegmentWriteHandler
 func SegmentWriteHandler(w *fressian.Writer, val interface{}) error {
 	switch val := val.(type) {
 	case Root:
-		return w.WriteExt("index-root-node", val.tData, val.directories)
+		directories, err := toUUIDs(val.directories)
+		if err != nil {
+			return err
+		}
+		return w.WriteExt("index-root-node", val.tData, directories)
+	case Directory:
+		segments, err := toUUIDs(val.segments)
+		if err != nil {
+			return err
+		}
+		return w.WriteExt("index-dir-node", val.tData, segments, val.mystery1, val.mystery2)
 	case TransposedData:
 		transactions := make([]int, len(val.transactions))
 		for i, tx := range val.transactions {
 			transactions[i] = tx % (3 * (1 << 42))
 		}
 		return w.WriteExt("index-tdata", val.values, val.entities, val.attributes, transactions, val.addeds)
+	case *url.URL, *Decimal:
+		return WriteHandler(w, val)
 	default:
 		return fressian.DefaultHandler(w, val)
 	}
 }
 
 var SegmentReadHandlers = map[string]fressian.ReadHandler{
+	"uri":    readURI,
+	"bigdec": readBigDec,
 	"index-root-node": func(r *fressian.Reader, tag string, fieldCount int) interface{} {
 		tData, _ := r.ReadValue()
 		directoriesRaw, _ := r.ReadValue()
@@ -70,7 +85,7 @@ var SegmentReadHandlers = map[string]fressian.ReadHandler{
 			transactions[i] = 3*(1<<42) + tx
 		}
 		var values []interface{}
-		if values != nil {
+		if vs != nil {
 			values = vs.([]interface{})
 		}
 		return TransposedData{
@@ -100,6 +115,18 @@ var SegmentReadHandlers = map[string]fressian.ReadHandler{
 	},
 }
 
+func toUUIDs(ids []string) ([]interface{}, error) {
+	uuids := make([]interface{}, len(ids))
+	for i, id := range ids {
+		uuid, err := fressian.NewUUIDFromString(id)
+		if err != nil {
+			return nil, err
+		}
+		uuids[i] = *uuid
+	}
+	return uuids, nil
+}
+
 type CompareFn func(tData TransposedData, idx int, datom Datom) int
 
 func compareValue(a, b interface{}) int {
@@ -227,17 +254,17 @@ func (t TransposedData) Find(compare CompareFn, datom Datom) int {
 	}
 }
 
+// FindApprox returns the index of the last datom that is less than
+// or equal to datom, i.e. the index of the segment or directory that
+// would contain it if t contains their first datoms.
 func (t TransposedData) FindApprox(compare CompareFn, datom Datom) int {
 	idx := t.Find(compare, datom)
-	if idx > 0 && idx < len(t.entities) {
-		cmpPrev := compare(t, idx-1, datom)
-		if cmpPrev < 0 {
-			return idx - 1
-		} else {
-			return idx
-		}
-	} else {
+	if idx < len(t.entities) && compare(t, idx, datom) == 0 {
 		return idx
+	} else if idx > 0 {
+		return idx - 1
+	} else {
+		return 0
 	}
 }
 
@@ -1,6 +1,7 @@
 package index
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/heyLu/fressian"
 	"math/big"
@@ -36,6 +37,8 @@ const (
 	BigDec
 )
 
+const Tuple ValueType = 67
+
 func (t ValueType) String() string {
 	switch t {
 	case Ref:
@@ -66,6 +69,8 @@ func (t ValueType) String() string {
 		return "BigInt"
 	case BigDec:
 		return "BigDec"
+	case Tuple:
+		return "Tuple"
 	case Min:
 		return "Min"
 	case Max:
@@ -76,7 +81,7 @@ func (t ValueType) String() string {
 }
 
 func (t ValueType) IsValid() bool {
-	return (t >= Ref && t <= Bytes) || (t >= UUID && t <= BigDec)
+	return (t >= Ref && t <= Bytes) || (t >= UUID && t <= BigDec) || t == Tuple
 }
 
 type Value struct {
@@ -94,7 +99,6 @@ func NewValue(val interface{}) Value {
 		return Value{String, ""}
 	}
 
-	// TODO: implement more types
 	switch val.(type) {
 	case bool:
 		return Value{Bool, val}
@@ -113,11 +117,19 @@ func NewValue(val interface{}) Value {
 	case string:
 		return Value{String, val}
 	case time.Time:
-		return Value{Date, val}
+		// instants are stored with millisecond precision, like in
+		// fressian
+		return Value{Date, val.(time.Time).Truncate(time.Millisecond)}
 	case *url.URL:
 		return Value{URI, val}
 	case *big.Int:
 		return Value{BigInt, val}
+	case *Decimal:
+		return Value{BigDec, val}
+	case []byte:
+		return Value{Bytes, val}
+	case []interface{}:
+		return NewTuple(val.([]interface{})...)
 	case Value:
 		return val.(Value)
 	default:
@@ -129,6 +141,18 @@ func NewRef(id int) Value {
 	return Value{Ref, id}
 }
 
+// NewTuple creates a tuple value from the elements.  Elements may be
+// nil, e.g. for missing attributes of composite tuples.
+func NewTuple(elems ...interface{}) Value {
+	vals := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		if elem != nil {
+			vals[i] = NewValue(elem).val
+		}
+	}
+	return Value{Tuple, vals}
+}
+
 func (v Value) Type() ValueType  { return v.ty }
 func (v Value) Val() interface{} { return v.val }
 
@@ -146,7 +170,7 @@ func (v Value) Compare(ovc comparable.Comparable) int {
 			} else {
 				return 1
 			}
-		case Int:
+		case Ref, Int:
 			return v.val.(int) - ov.val.(int)
 		case Keyword:
 			v := v.val.(fressian.Keyword)
@@ -171,7 +195,13 @@ func (v Value) Compare(ovc comparable.Comparable) int {
 		case Date:
 			v := v.val.(time.Time)
 			ov := ov.val.(time.Time)
-			return int(v.Unix() - ov.Unix())
+			if v.Before(ov) {
+				return -1
+			} else if v.Equal(ov) {
+				return 0
+			} else {
+				return 1
+			}
 		case UUID:
 			v := v.val.(fressian.UUID)
 			ov := ov.val.(fressian.UUID)
@@ -222,6 +252,14 @@ func (v Value) Compare(ovc comparable.Comparable) int {
 			v := v.val.(*big.Int)
 			ov := ov.val.(*big.Int)
 			return v.Cmp(ov)
+		case BigDec:
+			v := v.val.(*Decimal)
+			ov := ov.val.(*Decimal)
+			return v.Cmp(ov)
+		case Bytes:
+			return bytes.Compare(v.val.([]byte), ov.val.([]byte))
+		case Tuple:
+			return compareTuples(v.val.([]interface{}), ov.val.([]interface{}))
 		case Min:
 			return -1
 		case Max:
@@ -236,6 +274,29 @@ func (v Value) Compare(ovc comparable.Comparable) int {
 	}
 }
 
+// compareTuples compares tuples element by element, with nil being
+// smaller than any other value.
+func compareTuples(t1, t2 []interface{}) int {
+	for i := 0; i < len(t1) && i < len(t2); i++ {
+		var cmp int
+		switch {
+		case t1[i] == nil && t2[i] == nil:
+			cmp = 0
+		case t1[i] == nil:
+			cmp = -1
+		case t2[i] == nil:
+			cmp = 1
+		default:
+			cmp = NewValue(t1[i]).Compare(NewValue(t2[i]))
+		}
+
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return len(t1) - len(t2)
+}
+
 func (v Value) String() string {
 	switch v.ty {
 	case Ref:
@@ -248,11 +309,29 @@ func (v Value) String() string {
 		return v.val.(fressian.Keyword).String()
 	case Date:
 		d := v.val.(time.Time)
-		return d.Format(time.RFC3339)
+		return d.Format(time.RFC3339Nano)
 	case UUID:
 		return v.val.(fressian.UUID).String()
 	case BigInt:
 		return fmt.Sprintf("%vN", v.val)
+	case BigDec:
+		return fmt.Sprintf("%vM", v.val)
+	case Bytes:
+		return fmt.Sprintf("#bytes %x", v.val)
+	case Tuple:
+		elems := v.val.([]interface{})
+		s := "["
+		for i, elem := range elems {
+			if i > 0 {
+				s += " "
+			}
+			if elem == nil {
+				s += "nil"
+			} else {
+				s += NewValue(elem).String()
+			}
+		}
+		return s + "]"
 	case Min:
 		return "index.MinValue"
 	case Max:
@@ -0,0 +1,96 @@
+// Package testutil provides the schema fixtures shared by the tests of
+// the other packages.
+package testutil
+
+import (
+	"strings"
+)
+
+// An Attribute is the definition of an attribute in a test schema.
+type Attribute struct {
+	ident       string
+	valueType   string
+	cardinality string
+	unique      string
+	isComponent bool
+	tupleAttrs  []string
+}
+
+// One returns an attribute with :db.cardinality/one, e.g.
+// One("note/title", "string") for :note/title of :db.type/string.
+func One(ident, valueType string) Attribute {
+	return Attribute{ident: ident, valueType: valueType, cardinality: "one"}
+}
+
+// Many returns an attribute with :db.cardinality/many.
+func Many(ident, valueType string) Attribute {
+	return Attribute{ident: ident, valueType: valueType, cardinality: "many"}
+}
+
+// Identity returns the attribute with :db.unique/identity.
+func (a Attribute) Identity() Attribute {
+	a.unique = "identity"
+	return a
+}
+
+// UniqueValue returns the attribute with :db.unique/value.
+func (a Attribute) UniqueValue() Attribute {
+	a.unique = "value"
+	return a
+}
+
+// Component returns the attribute with :db/isComponent.
+func (a Attribute) Component() Attribute {
+	a.isComponent = true
+	return a
+}
+
+// TupleAttrs returns the attribute as a composite tuple of the
+// attributes.
+func (a Attribute) TupleAttrs(idents ...string) Attribute {
+	a.tupleAttrs = idents
+	return a
+}
+
+// Schema returns the EDN transaction data that installs the
+// attributes.
+func Schema(attrs ...Attribute) string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, attr := range attrs {
+		if i > 0 {
+			sb.WriteString("\n ")
+		}
+		sb.WriteString("{:db/id #db/id[:db.part/db]")
+		sb.WriteString("\n  :db/ident :" + attr.ident)
+		sb.WriteString("\n  :db/valueType :db.type/" + attr.valueType)
+		sb.WriteString("\n  :db/cardinality :db.cardinality/" + attr.cardinality)
+		if attr.unique != "" {
+			sb.WriteString("\n  :db/unique :db.unique/" + attr.unique)
+		}
+		if attr.isComponent {
+			sb.WriteString("\n  :db/isComponent true")
+		}
+		if len(attr.tupleAttrs) > 0 {
+			sb.WriteString("\n  :db/tupleAttrs [:" + strings.Join(attr.tupleAttrs, " :") + "]")
+		}
+		sb.WriteString("}")
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// Notebooks is the schema of notes with string tags, which belong to
+// notebooks.
+var Notebooks = []Attribute{
+	One("note/title", "string").Identity(),
+	Many("note/tags", "string"),
+	One("note/notebook", "ref"),
+	One("notebook/name", "string"),
+}
+
+// Notes is the schema of notes with a unique title and content.
+var Notes = []Attribute{
+	One("note/title", "string").Identity(),
+	One("note/content", "string"),
+}
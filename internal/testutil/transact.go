@@ -0,0 +1,21 @@
+package testutil
+
+import (
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+)
+
+// MustTransact parses the EDN transaction data with parse and transacts
+// it with transact, failing the test if either of them fails.
+//
+// The functions are passed in so that the tests of the transactor can
+// use it as well, e.g.
+//
+//	MustTransact(t, transactor.TxDataFromEDN, conn.Transact, edn)
+func MustTransact[D, R any](t *testing.T, parse func(string) (D, error), transact func(D) (R, error), edn string) R {
+	txData, err := parse(edn)
+	tu.RequireNil(t, err)
+	txResult, err := transact(txData)
+	tu.RequireNil(t, err)
+	return txResult
+}
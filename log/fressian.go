@@ -2,6 +2,7 @@ package log
 
 import (
 	"github.com/heyLu/fressian"
+	"net/url"
 
 	"github.com/heyLu/mu/index"
 )
@@ -22,7 +23,7 @@ func WriteHandler(w *fressian.Writer, val interface{}) error {
 			val.Attribute(),
 			val.Value(),
 			val.Transaction()%txOffset)
-	case index.Value:
+	case index.Value, *url.URL, *index.Decimal:
 		return index.WriteHandler(w, val)
 	case LogTx:
 		m := map[interface{}]interface{}{}
@@ -2,10 +2,12 @@ package log
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"github.com/heyLu/fressian"
+	"sort"
 	"time"
 
 	"github.com/heyLu/mu/index"
@@ -26,6 +28,194 @@ func (l Log) WithTx(tx *LogTx) *Log {
 	}
 }
 
+// Excise returns a new log without the given datoms.
+//
+// The datoms are removed from the tail and from the segments
+// containing them, which are rewritten using put together with a new
+// log root.  The ids of the replaced segments and root are returned
+// as well, so that they can be removed from storage.
+func (l Log) Excise(datoms []index.Datom, put func(val interface{}) (string, error)) (*Log, []string, error) {
+	excised := index.NewMemoryIndex(index.CompareEavt).AddDatoms(datoms)
+	without := func(txs []LogTx) ([]LogTx, bool) {
+		changed := false
+		newTxs := make([]LogTx, len(txs))
+		for i, tx := range txs {
+			txDatoms := make([]index.Datom, 0, len(tx.Datoms))
+			for _, datom := range tx.Datoms {
+				if excised.Contains(datom) {
+					changed = true
+				} else {
+					txDatoms = append(txDatoms, datom)
+				}
+			}
+			newTxs[i] = LogTx{tx.Id, tx.T, txDatoms}
+		}
+		return newTxs, changed
+	}
+
+	tail, _ := without(l.Tail)
+	newLog := &Log{
+		store:  l.store,
+		RootId: l.RootId,
+		Tail:   tail,
+	}
+
+	segmentIds, err := l.segmentIds()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replaced := []string{}
+	newSegmentIds := make([]interface{}, len(segmentIds))
+	for i, id := range segmentIds {
+		newSegmentIds[i] = id
+
+		segment, err := readFromStore(l.store, id.(string))
+		if err != nil {
+			return nil, nil, err
+		}
+		txs, changed := without(txsFromRaw(segment.([]interface{})))
+		if !changed {
+			continue
+		}
+
+		newId, err := put(txs)
+		if err != nil {
+			return nil, nil, err
+		}
+		newSegmentIds[i] = newId
+		replaced = append(replaced, id.(string))
+	}
+
+	if len(replaced) == 0 {
+		return newLog, nil, nil
+	}
+
+	root := map[interface{}]interface{}{
+		fressian.Keyword{"", "segments"}: newSegmentIds,
+	}
+	newLog.RootId, err = put(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newLog, append(replaced, l.RootId), nil
+}
+
+// WithSegment returns a new log with the transactions stored in a new
+// segment, for transactions that are already part of the index, e.g.
+// after a bulk import.  The tail is not changed.
+//
+// The segment and a new log root listing all segments are stored
+// using put, which must encode them using WriteHandler.
+func (l Log) WithSegment(put func(val interface{}) (string, error), txs []LogTx) (*Log, error) {
+	segmentIds, err := l.segmentIds()
+	if err != nil {
+		return nil, err
+	}
+
+	segmentId, err := put(txs)
+	if err != nil {
+		return nil, err
+	}
+
+	root := map[interface{}]interface{}{
+		fressian.Keyword{"", "segments"}: append(segmentIds, segmentId),
+	}
+	rootId, err := put(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{
+		store:  l.store,
+		RootId: rootId,
+		Tail:   l.Tail,
+	}, nil
+}
+
+// Txs returns all transactions in the log, from the segments and the
+// tail, ordered by their t.
+func (l Log) Txs() ([]LogTx, error) {
+	segmentIds, err := l.segmentIds()
+	if err != nil {
+		return nil, err
+	}
+
+	txs := []LogTx{}
+	for _, id := range segmentIds {
+		segment, err := readFromStore(l.store, id.(string))
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, txsFromRaw(segment.([]interface{}))...)
+	}
+	txs = append(txs, l.Tail...)
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].T < txs[j].T })
+	return txs, nil
+}
+
+// Tx returns the transaction with the given t, or nil if the log does
+// not contain it.
+//
+// Recent transactions are found in the tail, older ones are searched
+// in the segments, starting with the newest one.
+func (l Log) Tx(t int) (*LogTx, error) {
+	for i := len(l.Tail) - 1; i >= 0; i-- {
+		if l.Tail[i].T == t {
+			return &l.Tail[i], nil
+		}
+	}
+
+	segmentIds, err := l.segmentIds()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(segmentIds) - 1; i >= 0; i-- {
+		segment, err := readFromStore(l.store, segmentIds[i].(string))
+		if err != nil {
+			return nil, err
+		}
+		txs := txsFromRaw(segment.([]interface{}))
+		for j := range txs {
+			if txs[j].T == t {
+				return &txs[j], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (l Log) segmentIds() ([]interface{}, error) {
+	if l.RootId == "" {
+		return []interface{}{}, nil
+	}
+
+	root, err := readFromStore(l.store, l.RootId)
+	if err != nil {
+		return nil, err
+	}
+	segmentIds := root.(map[interface{}]interface{})[fressian.Keyword{"", "segments"}].([]interface{})
+	return segmentIds, nil
+}
+
+func readFromStore(store store.Store, id string) (interface{}, error) {
+	data, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	r := fressian.NewReader(gz, ReadHandlers)
+	val, err := r.ReadValue()
+	if val == nil && err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
 type LogTx struct {
 	Id     fressian.UUID
 	T      int
@@ -38,9 +228,12 @@ func FromStore(store store.Store, logRootId string, logTail []byte) *Log {
 	if err != nil && tailRaw == nil {
 		panic(err)
 	}
-	tail := tailRaw.([]interface{})
-	txs := make([]LogTx, len(tail))
-	for i, txRaw := range tail {
+	return &Log{store, logRootId, txsFromRaw(tailRaw.([]interface{}))}
+}
+
+func txsFromRaw(txsRaw []interface{}) []LogTx {
+	txs := make([]LogTx, len(txsRaw))
+	for i, txRaw := range txsRaw {
 		tx := txRaw.(map[interface{}]interface{})
 		var id *fressian.UUID
 		// FIXME: remove this as soon as possible
@@ -61,10 +254,12 @@ func FromStore(store store.Store, logRootId string, logTail []byte) *Log {
 		}
 		txs[i] = LogTx{*id, t, data}
 	}
-	return &Log{store, logRootId, txs}
+	return txs
 }
 
 var ReadHandlers = map[string]fressian.ReadHandler{
+	"uri":    index.ReadHandlers["uri"],
+	"bigdec": index.ReadHandlers["bigdec"],
 	"datum": func(r *fressian.Reader, tag string, fieldCount int) interface{} {
 		added, _ := r.ReadValue()
 		part, _ := r.ReadValue()
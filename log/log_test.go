@@ -3,12 +3,17 @@ package log
 import (
 	"bytes"
 	"github.com/heyLu/fressian"
+	"math/big"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/heyLu/mu/index"
 )
 
+var exampleURL, _ = url.Parse("https://example.com/notes?id=1")
+
 func TestReadWrite(t *testing.T) {
 	log := &Log{
 		store:  nil,
@@ -20,6 +25,10 @@ func TestReadWrite(t *testing.T) {
 				Datoms: []index.Datom{
 					index.NewDatom(0, 1, "Jane", 3*(1<<42)+1, true),
 					index.NewDatom(1, 1, "Judy", 3*(1<<42)+1, true),
+					index.NewDatom(1, 2, index.NewTuple("work", 42, nil), 3*(1<<42)+1, true),
+					index.NewDatom(1, 3, exampleURL, 3*(1<<42)+1, true),
+					index.NewDatom(1, 4, []byte("bytes"), 3*(1<<42)+1, true),
+					index.NewDatom(1, 5, big.NewInt(42), 3*(1<<42)+1, true),
 				},
 			},
 		},
@@ -35,3 +44,46 @@ func TestReadWrite(t *testing.T) {
 		t.Errorf("%#v != %#v", log, log2)
 	}
 }
+
+func TestReadWriteValues(t *testing.T) {
+	values := []interface{}{}
+	// decimals keep their exact value and scale, even beyond the
+	// precision of float64
+	for _, text := range []string{"3.25", "-0.1", "0.1", "0.10", "0", "1e100", "-12E+3", "3.14159265358979323846264338327950288"} {
+		d, err := index.ParseDecimal(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, d)
+	}
+	values = append(values, time.Date(2016, 10, 21, 12, 30, 15, 123456789, time.UTC))
+
+	datoms := make([]index.Datom, len(values))
+	for i, val := range values {
+		datoms[i] = index.NewDatom(1, i, val, 3*(1<<42)+1, true)
+	}
+
+	buf := new(bytes.Buffer)
+	w := fressian.NewWriter(buf, WriteHandler)
+	err := w.WriteValue([]LogTx{LogTx{T: 1, Datoms: datoms}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	log := FromStore(nil, "", buf.Bytes())
+	for i, datom := range log.Tail[0].Datoms {
+		if datom.V().Compare(datoms[i].V()) != 0 {
+			t.Errorf("%v != %v", datom.V(), datoms[i].V())
+		}
+		if d, ok := datom.V().Val().(*index.Decimal); ok && d.String() != values[i].(*index.Decimal).String() {
+			t.Errorf("expected %v, got %v", values[i], d)
+		}
+	}
+
+	// instants have millisecond precision
+	instant := log.Tail[0].Datoms[len(values)-1].V().Val().(time.Time)
+	if instant.Nanosecond() != 123000000 {
+		t.Errorf("expected millisecond precision, got %v", instant)
+	}
+}
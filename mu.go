@@ -13,6 +13,7 @@ import (
 	"github.com/heyLu/mu/database"
 	"github.com/heyLu/mu/index"
 	"github.com/heyLu/mu/pattern"
+	"github.com/heyLu/mu/pull"
 	"github.com/heyLu/mu/query"
 	"github.com/heyLu/mu/transactor"
 )
@@ -58,6 +59,10 @@ func CreateDatabase(rawUrl string) (bool, error) {
 //  - backup://<path-to-backup>[?root=<t>]
 //      Connects to a datomic backup, with an optional root if
 //      the directory contains multiple backups.
+//
+// For the memory:// and files:// formats, `&group-commit=true`
+// commits transactions that are submitted concurrently together,
+// with a single write to the store.
 func Connect(rawUrl string) (connection.Connection, error) {
 	u, err := url.Parse(rawUrl)
 	if err != nil {
@@ -71,10 +76,48 @@ func Connect(rawUrl string) (connection.Connection, error) {
 // The result contains a reference to the database before and after
 // the transaction, the datoms that were transacted and a map from
 // tempids to the assigned ids.
+//
+// Errors can be inspected using `errors.As`, either as one of the
+// specific errors like *transactor.UniqueConflictError or as a
+// *transactor.Anomaly with a category.
 func Transact(conn connection.Connection, txData []transactor.TxDatum) (*transactor.TxResult, error) {
 	return conn.Transact(txData)
 }
 
+// TransactWithOptions adds the datoms given by the txData to the
+// connection, using the options to control how the transaction is
+// processed.
+//
+// For example, historical data with explicit :db/txInstant values
+// can be imported by setting AllowBackdating.
+func TransactWithOptions(conn connection.Connection, txData []transactor.TxDatum, opts transactor.Options) (*transactor.TxResult, error) {
+	return conn.TransactWithOptions(txData, opts)
+}
+
+// TransactIf adds the datoms given by the txData to the connection
+// only if no other transaction was committed since expectedBasisT.
+//
+// If one was, the transaction fails with a conflict error, see
+// transactor.BasisConflictError.
+func TransactIf(conn connection.Connection, expectedBasisT int, txData []transactor.TxDatum) (*transactor.TxResult, error) {
+	return connection.TransactIf(conn, expectedBasisT, txData)
+}
+
+// TransactIfUntouched is like TransactIf, but only fails if one of the
+// entities was changed since expectedBasisT.
+func TransactIfUntouched(conn connection.Connection, expectedBasisT int, entities []database.HasLookup, txData []transactor.TxDatum) (*transactor.TxResult, error) {
+	return connection.TransactIfUntouched(conn, expectedBasisT, entities, txData)
+}
+
+// TransactAsync submits the txData to the connection and returns
+// immediately, without waiting for the transaction to be committed.
+//
+// Use `future.Deref(ctx)` to wait for the result.  Transactions are
+// committed in the order they were submitted.
+func TransactAsync(conn connection.Connection, txData []transactor.TxDatum) *connection.Future {
+	return connection.TransactAsync(conn, txData)
+}
+
 // TransactString adds the datoms given by the txData to the
 // connection.
 //
@@ -92,16 +135,69 @@ func TransactString(conn connection.Connection, txDataEDN string) (*transactor.T
 	return Transact(conn, txData)
 }
 
+// TransactStruct adds the fields of the struct pointed to by v to
+// the connection, using the `mu` struct tags to map fields to
+// attributes.
+//
+// Once the transaction is done, the fields tagged with `mu:"db/id"`
+// are set to the ids of the corresponding entities, for the struct
+// and all nested structs.
+//
+// See transactor.NewStructTx for details.
+func TransactStruct(conn connection.Connection, v interface{}) (*transactor.TxResult, error) {
+	structTx, err := transactor.NewStructTx(conn.Db(), v)
+	if err != nil {
+		return nil, err
+	}
+
+	txResult, err := Transact(conn, structTx.TxData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = structTx.AssignIds(txResult)
+	if err != nil {
+		return nil, err
+	}
+
+	return txResult, nil
+}
+
 // With returns a database with the txData added as if it were
-// transacted.
+// transacted, see WithResult.
 func With(db *database.Db, txData []transactor.TxDatum) (*database.Db, error) {
-	_, txResult, err := transactor.Transact(db, txData)
+	txResult, err := WithResult(db, txData)
 	if err != nil {
 		return nil, err
 	}
 	return txResult.DbAfter, nil
 }
 
+// WithResult transacts the txData speculatively, without writing
+// anything to storage, and returns the full result including the
+// tempids and the datoms.
+//
+// Speculative transactions can be chained by passing the DbAfter of
+// one to the next.  The BasisT of each DbAfter is the t of the
+// speculative transaction that produced it.
+//
+// The db must not be filtered, i.e. it can't be an as-of, since or
+// history database or one with a filter.
+func WithResult(db *database.Db, txData []transactor.TxDatum) (*transactor.TxResult, error) {
+	if db.AsOfT() != -1 || db.SinceT() != -1 || db.IsHistory() || db.IsFiltered() {
+		return nil, &transactor.Anomaly{
+			Category: transactor.Incorrect,
+			Message:  "cannot transact against a filtered database",
+		}
+	}
+
+	_, txResult, err := transactor.Transact(db, txData)
+	if err != nil {
+		return nil, err
+	}
+	return txResult, nil
+}
+
 func NewDatum(entity database.HasLookup, attribute database.HasLookup, value interface{}) transactor.Datum {
 	return transactor.Datum{true, entity, attribute, transactor.NewValue(value)}
 }
@@ -212,11 +308,11 @@ func PartEnd(part int) int {
 	return (part + 1) * (1 << 42)
 }
 
-func Q(q interface{}, inputs ...interface{}) (map[query.Indexed]bool, error) {
+func Q(q interface{}, inputs ...interface{}) (*query.Result, error) {
 	return query.Q(q, inputs...)
 }
 
-func QString(queryEDN string, inputs ...interface{}) (map[query.Indexed]bool, error) {
+func QString(queryEDN string, inputs ...interface{}) (*query.Result, error) {
 	q, err := edn.DecodeString(queryEDN)
 	if err != nil {
 		return nil, err
@@ -224,3 +320,38 @@ func QString(queryEDN string, inputs ...interface{}) (map[query.Indexed]bool, er
 
 	return Q(q, inputs...)
 }
+
+// Pull returns the attributes of the entity selected by the pattern as
+// a nested map.
+//
+// The pattern is given as EDN data, e.g. as returned by
+// edn.DecodeString.  See the pull package for the supported patterns.
+func Pull(db *database.Db, pattern interface{}, eid database.HasLookup) (map[database.Keyword]interface{}, error) {
+	p, err := pull.ParsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return pull.Pull(db, p, eid)
+}
+
+// PullString is like Pull, but parses the pattern from a string in
+// EDN format.
+func PullString(db *database.Db, patternEDN string, eid database.HasLookup) (map[database.Keyword]interface{}, error) {
+	p, err := pull.PatternFromEDN(patternEDN)
+	if err != nil {
+		return nil, err
+	}
+
+	return pull.Pull(db, p, eid)
+}
+
+// PullMany is like Pull, but for multiple entities.
+func PullMany(db *database.Db, pattern interface{}, eids []database.HasLookup) ([]map[database.Keyword]interface{}, error) {
+	p, err := pull.ParsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return pull.PullMany(db, p, eids)
+}
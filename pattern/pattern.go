@@ -90,7 +90,9 @@ func Datoms(db *database.Db, pattern Pattern) (index.Iterator, error) {
 		panic("invalid index type")
 	}
 
+	// transactions are sorted in reverse, so the range starts at the
+	// largest one
 	return idx.DatomsAt(
-		index.NewDatom(minE, minA, minV, min.Tx(), min.Added()),
-		index.NewDatom(maxE, maxA, maxV, max.Tx(), max.Added())), nil
+		index.NewDatom(minE, minA, minV, max.Tx(), min.Added()),
+		index.NewDatom(maxE, maxA, maxV, min.Tx(), max.Added())), nil
 }
@@ -0,0 +1,47 @@
+package pattern
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+var (
+	attrName = database.Keyword{fressian.Keyword{"", "name"}}
+	db       = database.Empty.WithDatoms(
+		[]index.Datom{
+			index.NewDatom(1, 10, attrName.Keyword, 0, true),
+			index.NewDatom(100, 1, "Jane", 1, true),
+			index.NewDatom(101, 1, "Judy", 2, true),
+			index.NewDatom(101, 1, "Judith", 3, true),
+		})
+)
+
+func TestDatomsSpansAllTransactions(t *testing.T) {
+	iter, err := Datoms(db, Ea(database.Id(101), attrName))
+	tu.RequireNil(t, err)
+
+	txs := []int{}
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		txs = append(txs, datom.Tx())
+	}
+	tu.ExpectEqual(t, len(txs), 2)
+
+	iter, err = Datoms(db, Eav(database.Id(100), attrName, "Jane"))
+	tu.RequireNil(t, err)
+	datom := iter.Next()
+	tu.RequireNotNil(t, datom)
+	tu.ExpectEqual(t, datom.Tx(), 1)
+	tu.ExpectNil(t, iter.Next())
+
+	iter, err = Datoms(db, A(attrName))
+	tu.RequireNil(t, err)
+	n := 0
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		n++
+	}
+	tu.ExpectEqual(t, n, 3)
+}
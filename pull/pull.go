@@ -0,0 +1,509 @@
+// Package pull implements Datomic's pull api, which returns entities
+// as nested maps according to a pattern.
+//
+// A pattern is a vector of attribute specs:
+//
+//  - :ns/attr
+//      The value(s) of the attribute.  Refs are returned as maps
+//      containing only :db/id.
+//  - :ns/_attr
+//      The entities that refer to the entity via :ns/attr.
+//  - *
+//      All attributes of the entity.  Component refs are pulled
+//      recursively.
+//  - {:ns/attr pattern}
+//      The entities the ref refers to, pulled with the nested
+//      pattern.
+//  - {:ns/attr n} or {:ns/attr ...}
+//      The entities the ref refers to, pulled with the enclosing
+//      pattern up to a depth of n, or as deep as possible.
+//  - [:ns/attr :as :other/name :limit n :default v]
+//      The attribute with a different key in the result, with at
+//      most n values (nil for no limit) or with a default value if
+//      it has none.
+//
+// For example, `[:note/title {:note/tags [:tag/name]} :note/_parent]`
+// pulls the title, the names of the tags and the ids of all notes
+// that have the note as their parent.
+package pull
+
+import (
+	"fmt"
+	"github.com/heyLu/edn"
+	"github.com/heyLu/fressian"
+	"strings"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/transactor"
+)
+
+// DefaultLimit is the maximum number of values returned for
+// cardinality many and reverse attributes if no :limit is given.
+const DefaultLimit = 1000
+
+var (
+	dbId = database.Keyword{fressian.Keyword{Namespace: "db", Name: "id"}}
+
+	wildcardSym  = edn.Symbol{Name: "*"}
+	recursiveSym = edn.Symbol{Name: "..."}
+	limitSym     = edn.Symbol{Name: "limit"}
+	defaultSym   = edn.Symbol{Name: "default"}
+
+	asKw      = edn.Keyword{Name: "as"}
+	limitKw   = edn.Keyword{Name: "limit"}
+	defaultKw = edn.Keyword{Name: "default"}
+)
+
+// A Pattern describes which attributes of an entity to pull.
+type Pattern struct {
+	wildcard bool
+	specs    []*attrSpec
+}
+
+// an attrSpec describes how to pull a single attribute.
+type attrSpec struct {
+	attr    database.Keyword // the attribute, without the _ for reverse refs
+	reverse bool
+	key     database.Keyword // the key in the result
+
+	limit      int // -1 if unlimited
+	hasDefault bool
+	def        interface{}
+
+	pattern *Pattern // the pattern for refs, nil if not given
+	// the depth of recursion, -1 for unlimited and 0 if the spec is
+	// not recursive
+	recursion int
+}
+
+// PatternFromEDN parses a pattern from a string in EDN format.
+func PatternFromEDN(s string) (*Pattern, error) {
+	val, err := edn.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePattern(val)
+}
+
+// ParsePattern parses a pattern from EDN data, as returned by
+// edn.DecodeString.
+func ParsePattern(form interface{}) (*Pattern, error) {
+	forms, ok := form.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pattern must be a vector, but was %v", form)
+	}
+
+	pattern := &Pattern{}
+	for _, form := range forms {
+		switch form := form.(type) {
+		case edn.Symbol:
+			if form != wildcardSym {
+				return nil, fmt.Errorf("invalid attribute spec %v", form)
+			}
+			pattern.wildcard = true
+		case edn.Keyword:
+			pattern.specs = append(pattern.specs, newAttrSpec(form))
+		case []interface{}:
+			spec, err := parseAttrExpr(form)
+			if err != nil {
+				return nil, err
+			}
+			pattern.specs = append(pattern.specs, spec)
+		case map[interface{}]interface{}:
+			for key, val := range form {
+				spec, err := parseMapSpec(key, val)
+				if err != nil {
+					return nil, err
+				}
+				pattern.specs = append(pattern.specs, spec)
+			}
+		default:
+			return nil, fmt.Errorf("invalid attribute spec %v", form)
+		}
+	}
+
+	return pattern, nil
+}
+
+func newAttrSpec(kw edn.Keyword) *attrSpec {
+	spec := &attrSpec{
+		attr:  toKeyword(kw),
+		key:   toKeyword(kw),
+		limit: DefaultLimit,
+	}
+	if strings.HasPrefix(kw.Name, "_") {
+		spec.reverse = true
+		spec.attr = toKeyword(edn.Keyword{Namespace: kw.Namespace, Name: kw.Name[1:]})
+	}
+	return spec
+}
+
+// parseAttrExpr parses attribute specs with options, either of the
+// form [:ns/attr :as kw :limit n :default v] or the older
+// (limit :ns/attr n) and (default :ns/attr v).
+func parseAttrExpr(forms []interface{}) (*attrSpec, error) {
+	if len(forms) == 3 && (forms[0] == limitSym || forms[0] == defaultSym) {
+		kw, ok := forms[1].(edn.Keyword)
+		if !ok {
+			return nil, fmt.Errorf("invalid attribute expression %v", forms)
+		}
+
+		opt := limitKw
+		if forms[0] == defaultSym {
+			opt = defaultKw
+		}
+		return parseAttrExpr([]interface{}{kw, opt, forms[2]})
+	}
+
+	if len(forms) == 0 || len(forms)%2 != 1 {
+		return nil, fmt.Errorf("invalid attribute expression %v", forms)
+	}
+
+	kw, ok := forms[0].(edn.Keyword)
+	if !ok {
+		return nil, fmt.Errorf("invalid attribute expression %v", forms)
+	}
+
+	spec := newAttrSpec(kw)
+	for i := 1; i < len(forms); i += 2 {
+		val := forms[i+1]
+		switch forms[i] {
+		case asKw:
+			as, ok := val.(edn.Keyword)
+			if !ok {
+				return nil, fmt.Errorf(":as must be a keyword, but was %v", val)
+			}
+			spec.key = toKeyword(as)
+		case limitKw:
+			switch val := val.(type) {
+			case nil:
+				spec.limit = -1
+			case int64:
+				if val < 0 {
+					return nil, fmt.Errorf(":limit must not be negative, but was %v", val)
+				}
+				spec.limit = int(val)
+			default:
+				return nil, fmt.Errorf(":limit must be a number or nil, but was %v", val)
+			}
+		case defaultKw:
+			spec.hasDefault = true
+			spec.def = transactor.ValueFromEDN(val)
+		default:
+			return nil, fmt.Errorf("invalid option %v in attribute expression %v", forms[i], forms)
+		}
+	}
+	return spec, nil
+}
+
+// parseMapSpec parses an entry of a map spec, which is either a
+// nested pattern or a recursion limit.
+func parseMapSpec(key, val interface{}) (*attrSpec, error) {
+	var spec *attrSpec
+	switch key := key.(type) {
+	case edn.Keyword:
+		spec = newAttrSpec(key)
+	default:
+		return nil, fmt.Errorf("invalid map spec key %v", key)
+	}
+
+	switch val := val.(type) {
+	case int64:
+		if val <= 0 {
+			return nil, fmt.Errorf("recursion limit must be positive, but was %v", val)
+		}
+		spec.recursion = int(val)
+	case edn.Symbol:
+		if val != recursiveSym {
+			return nil, fmt.Errorf("invalid recursion limit %v", val)
+		}
+		spec.recursion = -1
+	default:
+		pattern, err := ParsePattern(val)
+		if err != nil {
+			return nil, err
+		}
+		spec.pattern = pattern
+	}
+	return spec, nil
+}
+
+// Pull returns the attributes of the entity that are selected by the
+// pattern as a map.
+//
+// If the entity has none of the attributes, nil is returned.
+func Pull(db *database.Db, pattern *Pattern, eid database.HasLookup) (map[database.Keyword]interface{}, error) {
+	id, err := eid.Lookup(db)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &puller{db: db}
+	res, err := p.pull(pattern, id, map[*attrSpec]int{}, map[int]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// PullMany is like Pull, but for multiple entities.
+func PullMany(db *database.Db, pattern *Pattern, eids []database.HasLookup) ([]map[database.Keyword]interface{}, error) {
+	res := make([]map[database.Keyword]interface{}, len(eids))
+	for i, eid := range eids {
+		m, err := Pull(db, pattern, eid)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = m
+	}
+	return res, nil
+}
+
+type puller struct {
+	db *database.Db
+}
+
+// pull pulls the entity with the pattern.
+//
+// depths contains the remaining depth of the recursive specs, and
+// path the entities on the way to this one, which are not pulled
+// again to avoid cycles.
+func (p *puller) pull(pattern *Pattern, id int, depths map[*attrSpec]int, path map[int]bool) (map[database.Keyword]interface{}, error) {
+	path[id] = true
+	defer delete(path, id)
+
+	res := map[database.Keyword]interface{}{}
+	entity := p.db.Entity(id)
+
+	explicit := map[database.Keyword]bool{}
+	for _, spec := range pattern.specs {
+		if !spec.reverse {
+			explicit[spec.attr] = true
+		}
+	}
+
+	if pattern.wildcard {
+		err := p.pullWildcard(entity, explicit, path, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, spec := range pattern.specs {
+		var val interface{}
+		var err error
+		if spec.attr == dbId {
+			val = id
+		} else if spec.reverse {
+			val, err = p.pullReverse(pattern, spec, id, depths, path)
+		} else {
+			val, err = p.pullAttr(pattern, spec, entity, depths, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if val == nil && spec.hasDefault {
+			val = spec.def
+		}
+		if val != nil {
+			res[spec.key] = val
+		}
+	}
+
+	return res, nil
+}
+
+// pullWildcard adds all attributes of the entity that are not
+// pulled explicitly to res.
+func (p *puller) pullWildcard(entity database.Entity, explicit map[database.Keyword]bool, path map[int]bool, res map[database.Keyword]interface{}) error {
+	wildcard := &Pattern{wildcard: true}
+	iter := entity.Datoms()
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		attr := p.db.Attribute(datom.A())
+		if attr == nil {
+			return fmt.Errorf("no attribute with id %d", datom.A())
+		}
+		key := database.Keyword{attr.Ident()}
+		if explicit[key] {
+			continue
+		}
+
+		val := datom.V().Val()
+		if attr.Type() == index.Ref {
+			ref := val.(int)
+			if attr.IsComponent() && !path[ref] {
+				m, err := p.pull(wildcard, ref, map[*attrSpec]int{}, path)
+				if err != nil {
+					return err
+				}
+				val = m
+			} else {
+				val = idMap(ref)
+			}
+		}
+
+		if attr.Cardinality() == database.CardinalityMany {
+			vals, _ := res[key].([]interface{})
+			res[key] = append(vals, val)
+		} else {
+			res[key] = val
+		}
+	}
+
+	if len(res) > 0 {
+		res[dbId] = entity.Id()
+	}
+	return nil
+}
+
+// pullAttr pulls the value(s) of the attribute of the entity.
+func (p *puller) pullAttr(pattern *Pattern, spec *attrSpec, entity database.Entity, depths map[*attrSpec]int, path map[int]bool) (interface{}, error) {
+	attrId := p.db.Entid(spec.attr)
+	if attrId == -1 {
+		return nil, nil
+	}
+	attr := p.db.Attribute(attrId)
+	if attr == nil || attr.Type() == 0 {
+		return nil, fmt.Errorf("%v is not an attribute", spec.attr)
+	}
+
+	if (spec.pattern != nil || spec.recursion != 0) && attr.Type() != index.Ref {
+		return nil, fmt.Errorf("cannot pull nested pattern for %v, it is not a ref", spec.attr)
+	}
+
+	val := entity.Get(spec.attr)
+	switch val := val.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		if len(val) == 0 {
+			return nil, nil
+		}
+		if spec.limit >= 0 && len(val) > spec.limit {
+			val = val[:spec.limit]
+		}
+
+		vals := make([]interface{}, 0, len(val))
+		for _, v := range val {
+			v, err := p.pullValue(pattern, spec, v, depths, path)
+			if err != nil {
+				return nil, err
+			}
+			if v != nil {
+				vals = append(vals, v)
+			}
+		}
+		if len(vals) == 0 {
+			return nil, nil
+		}
+		return vals, nil
+	default:
+		return p.pullValue(pattern, spec, val, depths, path)
+	}
+}
+
+// pullReverse pulls the entities that refer to id via the attribute.
+//
+// For component attributes there is at most one such entity, which
+// is returned directly instead of in a slice.
+func (p *puller) pullReverse(pattern *Pattern, spec *attrSpec, id int, depths map[*attrSpec]int, path map[int]bool) (interface{}, error) {
+	attrId := p.db.Entid(spec.attr)
+	if attrId == -1 {
+		return nil, nil
+	}
+	attr := p.db.Attribute(attrId)
+	if attr == nil || attr.Type() == 0 {
+		return nil, fmt.Errorf("%v is not an attribute", spec.attr)
+	}
+	if attr.Type() != index.Ref {
+		return nil, fmt.Errorf("cannot pull reverse attribute %v, it is not a ref", spec.attr)
+	}
+
+	vals := []interface{}{}
+	iter := p.db.Vaet().Datoms2(database.Id(id), database.Id(attrId), nil)
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		if spec.limit >= 0 && len(vals) >= spec.limit {
+			break
+		}
+
+		v, err := p.pullValue(pattern, spec, p.db.Entity(datom.E()), depths, path)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			vals = append(vals, v)
+		}
+	}
+
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	if attr.IsComponent() {
+		return vals[0], nil
+	}
+	return vals, nil
+}
+
+// pullValue converts a single value of an attribute.
+//
+// Entities are pulled with the nested pattern of the spec, or with
+// the enclosing pattern if the spec is recursive.  Without either,
+// only their ids are returned.
+func (p *puller) pullValue(pattern *Pattern, spec *attrSpec, val interface{}, depths map[*attrSpec]int, path map[int]bool) (interface{}, error) {
+	entity, ok := val.(database.Entity)
+	if !ok {
+		return val, nil
+	}
+	id := entity.Id()
+
+	switch {
+	case spec.pattern != nil:
+		return p.pullRef(spec.pattern, id, map[*attrSpec]int{}, path)
+	case spec.recursion != 0:
+		depth, ok := depths[spec]
+		if !ok {
+			depth = spec.recursion
+		}
+		if depth == 0 {
+			return nil, nil
+		}
+		if path[id] {
+			return idMap(id), nil
+		}
+
+		newDepths := make(map[*attrSpec]int, len(depths)+1)
+		for s, d := range depths {
+			newDepths[s] = d
+		}
+		if depth > 0 {
+			depth -= 1
+		}
+		newDepths[spec] = depth
+		return p.pullRef(pattern, id, newDepths, path)
+	default:
+		return idMap(id), nil
+	}
+}
+
+func (p *puller) pullRef(pattern *Pattern, id int, depths map[*attrSpec]int, path map[int]bool) (interface{}, error) {
+	m, err := p.pull(pattern, id, depths, path)
+	if err != nil || len(m) == 0 {
+		return nil, err
+	}
+	return m, nil
+}
+
+func idMap(id int) map[database.Keyword]interface{} {
+	return map[database.Keyword]interface{}{dbId: id}
+}
+
+func toKeyword(kw edn.Keyword) database.Keyword {
+	return database.Keyword{fressian.Keyword{Namespace: kw.Namespace, Name: kw.Name}}
+}
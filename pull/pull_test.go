@@ -0,0 +1,199 @@
+package pull
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+	"github.com/heyLu/mu/transactor"
+)
+
+func kw(namespace, name string) database.Keyword {
+	return database.Keyword{fressian.Keyword{Namespace: namespace, Name: name}}
+}
+
+func note(title string) database.LookupRef {
+	return database.LookupRef{Attribute: kw("note", "title"), Value: index.NewValue(title)}
+}
+
+func notesDb(t *testing.T) *database.Db {
+	txData, err := transactor.TxDataFromEDN(testutil.Schema(
+		testutil.One("note/title", "string").Identity(),
+		testutil.Many("note/tags", "ref"),
+		testutil.One("note/parent", "ref"),
+		testutil.One("note/meta", "ref").Component(),
+		testutil.One("meta/author", "string"),
+		testutil.One("tag/name", "string")))
+	tu.RequireNil(t, err)
+	_, txResult, err := transactor.Transact(transactor.InitialDb, txData)
+	tu.RequireNil(t, err)
+
+	txData, err = transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user -1] :tag/name "go"}
+ {:db/id #db/id[:db.part/user -2] :tag/name "db"}
+ {:db/id #db/id[:db.part/user -3] :tag/name "clojure"}
+ {:db/id #db/id[:db.part/user -4]
+  :note/title "root"
+  :note/meta #db/id[:db.part/user -7]}
+ [:db/add #db/id[:db.part/user -4] :note/tags #db/id[:db.part/user -1]]
+ [:db/add #db/id[:db.part/user -4] :note/tags #db/id[:db.part/user -2]]
+ [:db/add #db/id[:db.part/user -4] :note/tags #db/id[:db.part/user -3]]
+ {:db/id #db/id[:db.part/user -7] :meta/author "jane"}
+ {:db/id #db/id[:db.part/user -5] :note/title "child" :note/parent #db/id[:db.part/user -4]}
+ {:db/id #db/id[:db.part/user -6] :note/title "grandchild" :note/parent #db/id[:db.part/user -5]}]`)
+	tu.RequireNil(t, err)
+	_, txResult, err = transactor.Transact(txResult.DbAfter, txData)
+	tu.RequireNil(t, err)
+	return txResult.DbAfter
+}
+
+func mustPull(t *testing.T, db *database.Db, patternEDN string, eid database.HasLookup) map[database.Keyword]interface{} {
+	pattern, err := PatternFromEDN(patternEDN)
+	tu.RequireNil(t, err)
+	res, err := Pull(db, pattern, eid)
+	tu.RequireNil(t, err)
+	return res
+}
+
+func tagNames(t *testing.T, val interface{}) []interface{} {
+	names := []interface{}{}
+	for _, tag := range val.([]interface{}) {
+		names = append(names, tag.(map[database.Keyword]interface{})[kw("tag", "name")])
+	}
+	return names
+}
+
+func TestPull(t *testing.T) {
+	db := notesDb(t)
+
+	res := mustPull(t, db, `[:note/title {:note/tags [:tag/name]} :note/_parent]`, note("root"))
+	tu.ExpectEqual(t, res[kw("note", "title")], "root")
+	tu.ExpectEqual(t, len(tagNames(t, res[kw("note", "tags")])), 3)
+	children := res[kw("note", "_parent")].([]interface{})
+	tu.RequireEqual(t, len(children), 1)
+	child := children[0].(map[database.Keyword]interface{})
+	tu.ExpectEqual(t, child[dbId], db.Entid(note("child")))
+
+	// refs without a pattern only contain the id
+	res = mustPull(t, db, `[:db/id :note/parent]`, note("child"))
+	tu.ExpectEqual(t, res[dbId], db.Entid(note("child")))
+	tu.ExpectEqual(t, res[kw("note", "parent")], idMap(db.Entid(note("root"))))
+
+	// missing attributes are left out
+	res = mustPull(t, db, `[:note/title :note/parent]`, note("root"))
+	tu.ExpectEqual(t, len(res), 1)
+
+	// nothing found
+	res = mustPull(t, db, `[:note/parent]`, note("root"))
+	tu.ExpectNil(t, res)
+}
+
+func TestPullWildcard(t *testing.T) {
+	db := notesDb(t)
+
+	res := mustPull(t, db, `[*]`, note("root"))
+	tu.ExpectEqual(t, res[dbId], db.Entid(note("root")))
+	tu.ExpectEqual(t, res[kw("note", "title")], "root")
+	tu.ExpectEqual(t, len(res[kw("note", "tags")].([]interface{})), 3)
+	// components are pulled as well
+	meta := res[kw("note", "meta")].(map[database.Keyword]interface{})
+	tu.ExpectEqual(t, meta[kw("meta", "author")], "jane")
+
+	// explicit specs take precedence
+	res = mustPull(t, db, `[* {:note/tags [:tag/name]}]`, note("root"))
+	tu.ExpectEqual(t, res[kw("note", "title")], "root")
+	tu.ExpectEqual(t, len(tagNames(t, res[kw("note", "tags")])), 3)
+}
+
+func TestPullOptions(t *testing.T) {
+	db := notesDb(t)
+
+	res := mustPull(t, db, `[[:note/title :as :title] [:note/tags :limit 2] [:note/parent :default :none]]`, note("root"))
+	tu.ExpectEqual(t, res[kw("", "title")], "root")
+	tu.ExpectEqual(t, len(res[kw("note", "tags")].([]interface{})), 2)
+	tu.ExpectEqual(t, res[kw("note", "parent")], fressian.Keyword{Name: "none"})
+
+	res = mustPull(t, db, `[(limit :note/tags 1) (default :note/parent 0)]`, note("root"))
+	tu.ExpectEqual(t, len(res[kw("note", "tags")].([]interface{})), 1)
+	tu.ExpectEqual(t, res[kw("note", "parent")], 0)
+
+	res = mustPull(t, db, `[[:note/tags :limit nil]]`, note("root"))
+	tu.ExpectEqual(t, len(res[kw("note", "tags")].([]interface{})), 3)
+
+	for _, invalid := range []string{
+		`:note/title`,
+		`[foo]`,
+		`[[:note/title :as]]`,
+		`[[:note/title :limit "2"]]`,
+		`[[:note/title :frobnicate 1]]`,
+		`[{:note/parent 0}]`,
+		`[{:note/parent foo}]`,
+	} {
+		_, err := PatternFromEDN(invalid)
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func TestPullRecursive(t *testing.T) {
+	db := notesDb(t)
+
+	res := mustPull(t, db, `[:note/title {:note/parent ...}]`, note("grandchild"))
+	parent := res[kw("note", "parent")].(map[database.Keyword]interface{})
+	tu.ExpectEqual(t, parent[kw("note", "title")], "child")
+	grandparent := parent[kw("note", "parent")].(map[database.Keyword]interface{})
+	tu.ExpectEqual(t, grandparent[kw("note", "title")], "root")
+	tu.ExpectNil(t, grandparent[kw("note", "parent")])
+
+	res = mustPull(t, db, `[:note/title {:note/parent 1}]`, note("grandchild"))
+	parent = res[kw("note", "parent")].(map[database.Keyword]interface{})
+	tu.ExpectEqual(t, parent[kw("note", "title")], "child")
+	tu.ExpectNil(t, parent[kw("note", "parent")])
+
+	res = mustPull(t, db, `[:note/title {:note/_parent ...}]`, note("root"))
+	children := res[kw("note", "_parent")].([]interface{})
+	tu.RequireEqual(t, len(children), 1)
+	grandchildren := children[0].(map[database.Keyword]interface{})[kw("note", "_parent")].([]interface{})
+	tu.RequireEqual(t, len(grandchildren), 1)
+	tu.ExpectEqual(t, grandchildren[0].(map[database.Keyword]interface{})[kw("note", "title")], "grandchild")
+
+	// cycles end with the id of the entity
+	_, txResult, err := transactor.Transact(db, []transactor.TxDatum{
+		transactor.Datum{Op: transactor.Assert, E: note("root"), A: kw("note", "parent"), V: transactor.NewValue(database.Id(db.Entid(note("grandchild"))))},
+	})
+	tu.RequireNil(t, err)
+	db = txResult.DbAfter
+
+	res = mustPull(t, db, `[:note/title {:note/parent ...}]`, note("root"))
+	grandchild := res[kw("note", "parent")].(map[database.Keyword]interface{})
+	child := grandchild[kw("note", "parent")].(map[database.Keyword]interface{})
+	tu.ExpectEqual(t, child[kw("note", "title")], "child")
+	tu.ExpectEqual(t, child[kw("note", "parent")], idMap(db.Entid(note("root"))))
+}
+
+func TestPullMany(t *testing.T) {
+	db := notesDb(t)
+	pattern, err := PatternFromEDN(`[:note/title]`)
+	tu.RequireNil(t, err)
+
+	res, err := PullMany(db, pattern, []database.HasLookup{note("root"), note("child")})
+	tu.RequireNil(t, err)
+	tu.RequireEqual(t, len(res), 2)
+	tu.ExpectEqual(t, res[0][kw("note", "title")], "root")
+	tu.ExpectEqual(t, res[1][kw("note", "title")], "child")
+
+	_, err = PullMany(db, pattern, []database.HasLookup{note("missing")})
+	tu.ExpectNotNil(t, err)
+}
+
+func TestPullNotAnAttribute(t *testing.T) {
+	db := notesDb(t)
+
+	for _, patternEDN := range []string{`[:db.part/user]`, `[:db.part/_user]`} {
+		pattern, err := PatternFromEDN(patternEDN)
+		tu.RequireNil(t, err)
+		_, err = Pull(db, pattern, note("root"))
+		tu.ExpectNotNil(t, err)
+	}
+}
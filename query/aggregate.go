@@ -0,0 +1,355 @@
+package query
+
+import (
+	"fmt"
+	"github.com/heyLu/edn"
+	"math/rand"
+	"reflect"
+	"sort"
+)
+
+// Aggregates are functions whose last argument is the collection of
+// values of the aggregated variable, e.g. (min 3 ?x) calls the min
+// aggregate with 3 and the values of ?x.
+var aggregates = map[edn.Symbol]Function{}
+
+// RegisterAggregate makes the aggregate available under the given
+// name in :find.
+//
+// The last argument passed to the aggregate is a []interface{} with
+// the values to aggregate, the other arguments are the constants given
+// in the query.
+func RegisterAggregate(name edn.Symbol, fn Function) {
+	if _, ok := aggregates[name]; ok {
+		panic(fmt.Sprint("duplicate aggregate ", name))
+	}
+
+	aggregates[name] = fn
+}
+
+func init() {
+	builtins := map[string]Function{
+		"count":          count,
+		"count-distinct": countDistinct,
+		"sum":            sum,
+		"avg":            avg,
+		"min":            extreme("min", -1),
+		"max":            extreme("max", 1),
+		"median":         median,
+		"distinct":       distinct,
+		"sample":         sample,
+	}
+	for name, fn := range builtins {
+		RegisterAggregate(edn.Symbol{Name: name}, fn)
+	}
+}
+
+// A Collection is the result of aggregates that return multiple
+// values, e.g. distinct.
+//
+// Results are sets of tuples, which can't contain slices, so
+// collections are returned as pointers.
+type Collection struct {
+	Values []interface{}
+}
+
+func (c *Collection) String() string {
+	return fmt.Sprint(c.Values)
+}
+
+// aggregateValues returns the values to aggregate and the constant
+// arguments, after checking that there are n of them.
+func aggregateValues(name string, args []interface{}, n int) ([]interface{}, []interface{}, error) {
+	if len(args) != n+1 {
+		return nil, nil, fmt.Errorf("wrong number of arguments (%d) passed to %s", len(args), name)
+	}
+
+	vals, ok := args[n].([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("%s expects a collection of values, but got %v", name, args[n])
+	}
+	return vals, args[:n], nil
+}
+
+// distinctValues returns the values without duplicates, in the order
+// they first occur.
+func distinctValues(vals []interface{}) []interface{} {
+	seen := map[interface{}]bool{}
+	res := []interface{}{}
+	for _, val := range vals {
+		if key := hashableValue(val); !seen[key] {
+			seen[key] = true
+			res = append(res, val)
+		}
+	}
+	return res
+}
+
+func count(args ...interface{}) (interface{}, error) {
+	vals, _, err := aggregateValues("count", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return len(vals), nil
+}
+
+func countDistinct(args ...interface{}) (interface{}, error) {
+	vals, _, err := aggregateValues("count-distinct", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return len(distinctValues(vals)), nil
+}
+
+func sum(args ...interface{}) (interface{}, error) {
+	vals, _, err := aggregateValues("sum", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return add(vals...)
+}
+
+func avg(args ...interface{}) (interface{}, error) {
+	vals, _, err := aggregateValues("avg", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+
+	total, err := add(vals...)
+	if err != nil {
+		return nil, err
+	}
+	f, _ := toFloat(total)
+	return f / float64(len(vals)), nil
+}
+
+// sortValues sorts the values in ascending order.
+func sortValues(vals []interface{}) ([]interface{}, error) {
+	sorted := append([]interface{}{}, vals...)
+	var err error
+	sort.SliceStable(sorted, func(i, j int) bool {
+		cmp, cmpErr := compareValues(sorted[i], sorted[j])
+		if cmpErr != nil {
+			err = cmpErr
+		}
+		return cmp < 0
+	})
+	return sorted, err
+}
+
+// extreme returns the min (order -1) or max (order 1) aggregate.
+//
+// With a constant argument n, e.g. (min 3 ?x), it returns a collection
+// of the n smallest (or largest) distinct values.
+func extreme(name string, order int) Function {
+	return func(args ...interface{}) (interface{}, error) {
+		// the number of constant arguments, either 0 or 1
+		n := 0
+		if len(args) > 1 {
+			n = 1
+		}
+		vals, consts, err := aggregateValues(name, args, n)
+		if err != nil {
+			return nil, err
+		}
+
+		sorted, err := sortValues(vals)
+		if err != nil {
+			return nil, err
+		}
+		if order > 0 {
+			for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+				sorted[i], sorted[j] = sorted[j], sorted[i]
+			}
+		}
+
+		if len(consts) == 0 {
+			if len(sorted) == 0 {
+				return nil, nil
+			}
+			return sorted[0], nil
+		}
+
+		limit, ok := consts[0].(int)
+		if !ok || limit < 0 {
+			return nil, fmt.Errorf("%s expects a positive number of values, but got %v", name, consts[0])
+		}
+		sorted = distinctValues(sorted)
+		if limit < len(sorted) {
+			sorted = sorted[:limit]
+		}
+		return sorted, nil
+	}
+}
+
+func median(args ...interface{}) (interface{}, error) {
+	vals, _, err := aggregateValues("median", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+
+	sorted, err := sortValues(vals)
+	if err != nil {
+		return nil, err
+	}
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[mid], nil
+	}
+
+	// the mean of the two values in the middle
+	total, err := add(sorted[mid-1], sorted[mid])
+	if err != nil {
+		return nil, err
+	}
+	return divide(total, 2)
+}
+
+func distinct(args ...interface{}) (interface{}, error) {
+	vals, _, err := aggregateValues("distinct", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return distinctValues(vals), nil
+}
+
+func sample(args ...interface{}) (interface{}, error) {
+	vals, consts, err := aggregateValues("sample", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := consts[0].(int)
+	if !ok || n < 0 {
+		return nil, fmt.Errorf("sample expects a positive number of values, but got %v", consts[0])
+	}
+
+	vals = distinctValues(vals)
+	res := make([]interface{}, 0, n)
+	for _, i := range rand.Perm(len(vals)) {
+		if len(res) == n {
+			break
+		}
+		res = append(res, vals[i])
+	}
+	return res, nil
+}
+
+// resultValue converts the result of an aggregate to a value that can
+// be part of a result tuple.
+func resultValue(agg aggregate, val interface{}) (value, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	switch reflect.TypeOf(val).Kind() {
+	case reflect.Slice, reflect.Array:
+		vals, _ := toSlice(val)
+		return &Collection{Values: vals}, nil
+	}
+	if !reflect.TypeOf(val).Comparable() {
+		return nil, fmt.Errorf("result %v of aggregate %v can't be part of the results", val, agg.name)
+	}
+	return val, nil
+}
+
+// aggregateResults collects the find and :with variables from the
+// context and aggregates the values of the aggregates in find, grouped
+// by the other find elements.
+//
+// The values are aggregated from the set of tuples of the find and
+// :with variables, so :with can be used to keep duplicate values.
+func aggregateResults(context context, find []findVars, with []variable) (map[Indexed]bool, error) {
+	vars := make([]variable, 0, len(find)+len(with))
+	for _, elem := range find {
+		vars = append(vars, variable(elem.findVars()[0]))
+	}
+	vars = append(vars, with...)
+
+	fns := make([]Function, len(find))
+	for i, elem := range find {
+		agg, ok := elem.(aggregate)
+		if !ok {
+			continue
+		}
+
+		if agg.name != aggregateSym {
+			fns[i] = aggregates[agg.name]
+			continue
+		}
+		if !isBound(context, agg.fn) {
+			return nil, fmt.Errorf("insufficient bindings: %v is not bound", edn.Symbol(agg.fn))
+		}
+		rows := internalCollect(context, []variable{agg.fn})
+		if len(rows) == 0 {
+			return map[Indexed]bool{}, nil
+		}
+		fn, ok := rows[0][0].(Function)
+		if !ok {
+			return nil, fmt.Errorf("%v must be bound to a query.Function, but was %v", edn.Symbol(agg.fn), rows[0][0])
+		}
+		fns[i] = fn
+	}
+
+	type group struct {
+		vals    []value
+		aggVals [][]interface{}
+	}
+	groups := map[Indexed]*group{}
+	for key := range collect(context, vars) {
+		groupVals := []value{}
+		for i := range find {
+			if fns[i] == nil {
+				groupVals = append(groupVals, key.ValueAt(i))
+			}
+		}
+
+		groupKey := newHashKey(groupVals)
+		g, ok := groups[groupKey]
+		if !ok {
+			g = &group{vals: groupVals, aggVals: make([][]interface{}, len(find))}
+			groups[groupKey] = g
+		}
+		for i := range find {
+			if fns[i] != nil {
+				g.aggVals[i] = append(g.aggVals[i], plainValue(key.ValueAt(i)))
+			}
+		}
+	}
+
+	res := make(map[Indexed]bool, len(groups))
+	for _, g := range groups {
+		vals := make([]value, len(find))
+		j := 0
+		for i, elem := range find {
+			if fns[i] == nil {
+				vals[i] = g.vals[j]
+				j += 1
+				continue
+			}
+
+			agg := elem.(aggregate)
+			args := make([]interface{}, 0, len(agg.args)+1)
+			for _, arg := range agg.args {
+				args = append(args, arg)
+			}
+			args = append(args, g.aggVals[i])
+			val, err := fns[i](args...)
+			if err != nil {
+				return nil, err
+			}
+			vals[i], err = resultValue(agg, val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res[newHashKey(vals)] = true
+	}
+	return res, nil
+}
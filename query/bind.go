@@ -0,0 +1,177 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/transactor"
+)
+
+// inToRel returns a relation containing the input bound according to
+// the binding.
+func inToRel(binding binding, input interface{}) (relation, error) {
+	switch binding := binding.(type) {
+	case bindIgnore:
+		return relation{attrs: map[variable]int{}, tuples: []tuple{sliceTuple{}}}, nil
+	case bindScalar:
+		return relation{
+			attrs:  map[variable]int{binding.variable: 0},
+			tuples: []tuple{sliceTuple{inputValue(input)}},
+		}, nil
+	case bindTuple:
+		vals, err := toSlice(input)
+		if err != nil {
+			return relation{}, err
+		}
+		if len(vals) < len(binding.bindings) {
+			return relation{}, fmt.Errorf("not enough values in %v for tuple binding of %d elements", input, len(binding.bindings))
+		}
+
+		rel, _ := inToRel(bindIgnore{}, nil)
+		for i, b := range binding.bindings {
+			r, err := inToRel(b, vals[i])
+			if err != nil {
+				return relation{}, err
+			}
+			rel = productRels(rel, r)
+		}
+		return rel, nil
+	case bindColl:
+		return collToRel(binding.binding, input)
+	case bindRel:
+		return collToRel(binding.binding, input)
+	default:
+		return relation{}, fmt.Errorf("invalid binding %v", binding)
+	}
+}
+
+// collToRel returns a relation containing all elements of the input
+// bound according to the binding.
+func collToRel(binding binding, input interface{}) (relation, error) {
+	vals, err := toSlice(input)
+	if err != nil {
+		return relation{}, err
+	}
+
+	attrs := map[variable]int{}
+	for i, v := range binding.vars() {
+		attrs[v] = i
+	}
+	rel := relation{attrs: attrs, tuples: []tuple{}}
+	for _, val := range vals {
+		r, err := inToRel(binding, val)
+		if err != nil {
+			return relation{}, err
+		}
+		rel = sumRels(rel, r)
+	}
+	return rel, nil
+}
+
+// productRels returns the cartesian product of two relations that
+// have no variables in common.
+func productRels(rel1, rel2 relation) relation {
+	attrs := make(map[variable]int, len(rel1.attrs)+len(rel2.attrs))
+	idxs1 := make([]int, 0, len(rel1.attrs))
+	idxs2 := make([]int, 0, len(rel2.attrs))
+	for attr, idx := range rel1.attrs {
+		attrs[attr] = len(idxs1)
+		idxs1 = append(idxs1, idx)
+	}
+	for attr, idx := range rel2.attrs {
+		attrs[attr] = len(idxs1) + len(idxs2)
+		idxs2 = append(idxs2, idx)
+	}
+
+	tuples := make([]tuple, 0, len(rel1.tuples)*len(rel2.tuples))
+	for _, t1 := range rel1.tuples {
+		for _, t2 := range rel2.tuples {
+			tuples = append(tuples, joinTuples(t1, idxs1, t2, idxs2))
+		}
+	}
+	return relation{attrs: attrs, tuples: tuples}
+}
+
+// sumRels returns a relation with the tuples of both relations, which
+// must have the same variables.
+func sumRels(rel1, rel2 relation) relation {
+	idxs := make([]int, len(rel1.attrs))
+	for attr, idx := range rel1.attrs {
+		idxs[idx] = rel2.attrs[attr]
+	}
+
+	tuples := rel1.tuples
+	for _, t := range rel2.tuples {
+		newTuple := make(sliceTuple, len(idxs))
+		for i, idx := range idxs {
+			newTuple[i] = t.ValueAt(idx)
+		}
+		tuples = append(tuples, newTuple)
+	}
+	return relation{attrs: rel1.attrs, tuples: tuples}
+}
+
+// toSlice returns the elements of a slice or an array.
+func toSlice(input interface{}) ([]interface{}, error) {
+	if vals, ok := input.([]interface{}); ok {
+		return vals, nil
+	}
+
+	val := reflect.ValueOf(input)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a collection, but got %v", input)
+	}
+
+	vals := make([]interface{}, val.Len())
+	for i := range vals {
+		vals[i] = val.Index(i).Interface()
+	}
+	return vals, nil
+}
+
+// inputValue converts values passed to a query to the types used in
+// the database.
+func inputValue(val interface{}) value {
+	switch val := val.(type) {
+	case database.Id:
+		return int(val)
+	case database.Keyword:
+		return val.Keyword
+	default:
+		return hashableValue(transactor.ValueFromEDN(val))
+	}
+}
+
+// toSource converts an input to a source.
+//
+// Databases are used as is, other sources must be collections of
+// tuples.
+func toSource(input interface{}) (source, error) {
+	switch input := input.(type) {
+	case *database.Db:
+		return input, nil
+	case []tuple:
+		return input, nil
+	}
+
+	rows, err := toSlice(input)
+	if err != nil {
+		return nil, err
+	}
+
+	tuples := make([]tuple, len(rows))
+	for i, row := range rows {
+		vals, err := toSlice(row)
+		if err != nil {
+			return nil, err
+		}
+
+		t := make(sliceTuple, len(vals))
+		for j, val := range vals {
+			t[j] = inputValue(val)
+		}
+		tuples[i] = t
+	}
+	return tuples, nil
+}
@@ -0,0 +1,721 @@
+package query
+
+import (
+	"fmt"
+	"github.com/heyLu/edn"
+	"github.com/heyLu/fressian"
+	"math/big"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+// A Function can be called in predicate and function expressions in
+// queries.
+//
+// Predicates succeed if the function returns a value other than nil
+// or false.  Functions that return nil don't bind any values.
+//
+// Source arguments (e.g. $) are passed as *database.Db for databases
+// and as []tuple for collections.
+type Function func(args ...interface{}) (interface{}, error)
+
+var functions = map[edn.Symbol]Function{}
+
+// RegisterFunction makes the function available under the given name
+// in queries.
+func RegisterFunction(name edn.Symbol, fn Function) {
+	if _, ok := functions[name]; ok {
+		panic(fmt.Sprint("duplicate query function ", name))
+	}
+
+	functions[name] = fn
+}
+
+func init() {
+	builtins := map[string]Function{
+		"=":        equal,
+		"!=":       notEqual,
+		"not=":     notEqual,
+		"<":        comparison(func(cmp int) bool { return cmp < 0 }),
+		">":        comparison(func(cmp int) bool { return cmp > 0 }),
+		"<=":       comparison(func(cmp int) bool { return cmp <= 0 }),
+		">=":       comparison(func(cmp int) bool { return cmp >= 0 }),
+		"+":        add,
+		"-":        subtract,
+		"*":        multiply,
+		"/":        divide,
+		"quot":     quot,
+		"rem":      rem,
+		"mod":      mod,
+		"inc":      inc,
+		"dec":      dec,
+		"str":      str,
+		"subs":     subs,
+		"re-find":  reFind,
+		"ground":   ground,
+		"tuple":    makeTuple,
+		"untuple":  untuple,
+		"get-else": getElse,
+		"get-some": getSome,
+		"missing?": missing,
+	}
+	for name, fn := range builtins {
+		RegisterFunction(edn.Symbol{Name: name}, fn)
+	}
+}
+
+// isTruthy returns true if the value is neither nil nor false.
+func isTruthy(val value) bool {
+	return val != nil && val != false
+}
+
+// splitRels returns the product of the relations that contain one of
+// the variables, and the other relations.
+func splitRels(rels []relation, vars []variable) (relation, []relation) {
+	rel, _ := inToRel(bindIgnore{}, nil)
+	others := []relation{}
+	for _, r := range rels {
+		uses := false
+		for _, v := range vars {
+			if _, ok := r.attrs[v]; ok {
+				uses = true
+				break
+			}
+		}
+
+		if uses {
+			rel = productRels(rel, r)
+		} else {
+			others = append(others, r)
+		}
+	}
+	return rel, others
+}
+
+// fnName returns the name of a called function for error messages.
+func fnName(name interface{}) edn.Symbol {
+	switch name := name.(type) {
+	case plainSymbol:
+		return name.name
+	case variable:
+		return edn.Symbol(name)
+	default:
+		return edn.Symbol{}
+	}
+}
+
+// prepareCall checks that the arguments of a call are bound and
+// returns the relation with the values for them, the other relations
+// of the context and a function that calls the function for a tuple
+// of the relation.
+func prepareCall(context context, name interface{}, args []interface{}) (relation, []relation, func(tuple) (value, error), error) {
+	vars := []variable{}
+	if v, ok := name.(variable); ok {
+		vars = append(vars, v)
+	}
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case variable:
+			vars = append(vars, arg)
+		case srcVar:
+			if _, ok := context.sources[variable(arg.name)]; !ok {
+				return relation{}, nil, nil, fmt.Errorf("no source %v for call to %v", arg.name, fnName(name))
+			}
+		}
+	}
+	for _, v := range vars {
+		if !isBound(context, v) {
+			return relation{}, nil, nil, fmt.Errorf("insufficient bindings: %v is not bound in call to %v", edn.Symbol(v), fnName(name))
+		}
+	}
+
+	var fn Function
+	if sym, ok := name.(plainSymbol); ok {
+		fn, ok = functions[sym.name]
+		if !ok {
+			return relation{}, nil, nil, fmt.Errorf("unknown function %v", sym.name)
+		}
+	}
+
+	rel, others := splitRels(context.rels, vars)
+	call := func(t tuple) (value, error) {
+		f := fn
+		if v, ok := name.(variable); ok {
+			val := t.ValueAt(rel.attrs[v])
+			f, ok = val.(Function)
+			if !ok {
+				return nil, fmt.Errorf("%v must be bound to a query.Function, but was %v", edn.Symbol(v), val)
+			}
+		}
+
+		vals := make([]interface{}, len(args))
+		for i, arg := range args {
+			switch arg := arg.(type) {
+			case variable:
+				vals[i] = plainValue(t.ValueAt(rel.attrs[arg]))
+			case constant:
+				vals[i] = arg.value
+			case srcVar:
+				vals[i] = context.sources[variable(arg.name)]
+			}
+		}
+		return f(vals...)
+	}
+	return rel, others, call, nil
+}
+
+// resolvePredicate removes the tuples for which the predicate fails
+// from the context.
+func resolvePredicate(context context, pred predicate) (context, error) {
+	rel, others, call, err := prepareCall(context, pred.name, pred.args)
+	if err != nil {
+		return context, err
+	}
+
+	tuples := []tuple{}
+	for _, t := range rel.tuples {
+		res, err := call(t)
+		if err != nil {
+			return context, err
+		}
+
+		if isTruthy(res) {
+			tuples = append(tuples, t)
+		}
+	}
+
+	newContext := context
+	newContext.rels = append(others, relation{attrs: rel.attrs, tuples: tuples})
+	return newContext, nil
+}
+
+// resolveFunction binds the results of the function to the variables
+// in its binding.
+//
+// Variables in the binding that are already bound must be equal to the
+// results.
+func resolveFunction(context context, fn function) (context, error) {
+	rel, others, call, err := prepareCall(context, fn.name, fn.args)
+	if err != nil {
+		return context, err
+	}
+
+	attrs := make(map[variable]int, len(rel.attrs))
+	for v, idx := range rel.attrs {
+		attrs[v] = idx
+	}
+	newVars := []variable{}
+	for _, v := range fn.binding.vars() {
+		if _, ok := attrs[v]; !ok {
+			attrs[v] = len(attrs)
+			newVars = append(newVars, v)
+		}
+	}
+
+	tuples := []tuple{}
+	for _, t := range rel.tuples {
+		res, err := call(t)
+		if err != nil {
+			return context, err
+		}
+
+		if res == nil {
+			continue
+		}
+
+		bound, err := inToRel(fn.binding, res)
+		if err != nil {
+			return context, fmt.Errorf("can't bind result of %v: %w", fnName(fn.name), err)
+		}
+
+	results:
+		for _, bt := range bound.tuples {
+			for v, idx := range bound.attrs {
+				if relIdx, ok := rel.attrs[v]; ok && !hashEqual(t.ValueAt(relIdx), bt.ValueAt(idx)) {
+					continue results
+				}
+			}
+
+			newTuple := make(sliceTuple, len(attrs))
+			for _, idx := range rel.attrs {
+				newTuple[idx] = t.ValueAt(idx)
+			}
+			for _, v := range newVars {
+				newTuple[attrs[v]] = bt.ValueAt(bound.attrs[v])
+			}
+			tuples = append(tuples, newTuple)
+		}
+	}
+
+	newContext := context
+	newContext.rels = collapseRels(others, relation{attrs: attrs, tuples: tuples})
+	return newContext, nil
+}
+
+/// built-in functions
+
+func checkArgs(name string, args []interface{}, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("wrong number of arguments (%d) passed to %s", len(args), name)
+	}
+	return nil
+}
+
+func equal(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("=", args, 1, -1); err != nil {
+		return nil, err
+	}
+
+	for _, arg := range args[1:] {
+		if !hashEqual(args[0], arg) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func notEqual(args ...interface{}) (interface{}, error) {
+	res, err := equal(args...)
+	if err != nil {
+		return nil, err
+	}
+	return !res.(bool), nil
+}
+
+// isIndexValue returns true if the value can be compared using
+// index.Value.
+func isIndexValue(val value) bool {
+	switch val.(type) {
+	case bool, string, fressian.Keyword, fressian.UUID, time.Time, *url.URL, *big.Int, *index.Decimal, []byte:
+		return true
+	default:
+		return false
+	}
+}
+
+// compareValues compares numbers numerically and other values of the
+// same type in index order.
+func compareValues(a, b value) (int, error) {
+	if x, ok := a.(int); ok {
+		if y, ok := b.(int); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			default:
+				return 0, nil
+			}
+		}
+	}
+
+	x, ok1 := toFloat(a)
+	y, ok2 := toFloat(b)
+	if ok1 && ok2 {
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	}
+
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !isIndexValue(a) {
+		return 0, fmt.Errorf("can't compare %v and %v", a, b)
+	}
+	return index.NewValue(a).Compare(index.NewValue(b)), nil
+}
+
+func comparison(ok func(cmp int) bool) Function {
+	return func(args ...interface{}) (interface{}, error) {
+		if err := checkArgs("comparison", args, 1, -1); err != nil {
+			return nil, err
+		}
+
+		for i := 1; i < len(args); i++ {
+			cmp, err := compareValues(args[i-1], args[i])
+			if err != nil {
+				return nil, err
+			}
+			if !ok(cmp) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+func toFloat(val value) (float64, bool) {
+	switch val := val.(type) {
+	case int:
+		return float64(val), true
+	case float32:
+		return float64(val), true
+	case float64:
+		return val, true
+	default:
+		return 0, false
+	}
+}
+
+// arithmetic returns a function that applies the operation to the
+// arguments from left to right, using integer arithmetic as long as
+// all arguments are integers.
+func arithmetic(name string, initial int, intOp func(a, b int) int, floatOp func(a, b float64) float64) Function {
+	return func(args ...interface{}) (interface{}, error) {
+		var acc value = initial
+		if len(args) > 0 {
+			acc = args[0]
+			args = args[1:]
+		}
+		if _, ok := toFloat(acc); !ok {
+			return nil, fmt.Errorf("%s expects numbers, but got %v", name, acc)
+		}
+
+		for _, arg := range args {
+			y, ok := toFloat(arg)
+			if !ok {
+				return nil, fmt.Errorf("%s expects numbers, but got %v", name, arg)
+			}
+
+			a, ok1 := acc.(int)
+			b, ok2 := arg.(int)
+			if ok1 && ok2 {
+				acc = intOp(a, b)
+			} else {
+				x, _ := toFloat(acc)
+				acc = floatOp(x, y)
+			}
+		}
+		return acc, nil
+	}
+}
+
+var (
+	add = arithmetic("+", 0,
+		func(a, b int) int { return a + b },
+		func(a, b float64) float64 { return a + b })
+	multiply = arithmetic("*", 1,
+		func(a, b int) int { return a * b },
+		func(a, b float64) float64 { return a * b })
+	sub = arithmetic("-", 0,
+		func(a, b int) int { return a - b },
+		func(a, b float64) float64 { return a - b })
+)
+
+func subtract(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("-", args, 1, -1); err != nil {
+		return nil, err
+	}
+
+	if len(args) == 1 {
+		return sub(0, args[0])
+	}
+	return sub(args...)
+}
+
+func divide(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("/", args, 1, -1); err != nil {
+		return nil, err
+	}
+
+	if len(args) == 1 {
+		args = []interface{}{1, args[0]}
+	}
+	acc := args[0]
+	if _, ok := toFloat(acc); !ok {
+		return nil, fmt.Errorf("/ expects numbers, but got %v", acc)
+	}
+	for _, arg := range args[1:] {
+		y, ok := toFloat(arg)
+		if !ok {
+			return nil, fmt.Errorf("/ expects numbers, but got %v", arg)
+		}
+		if y == 0 {
+			return nil, fmt.Errorf("divide by zero")
+		}
+
+		// integer division only if there is no remainder
+		a, ok1 := acc.(int)
+		b, ok2 := arg.(int)
+		if ok1 && ok2 && a%b == 0 {
+			acc = a / b
+		} else {
+			x, _ := toFloat(acc)
+			acc = x / y
+		}
+	}
+	return acc, nil
+}
+
+// intArgs returns the arguments as integers.
+func intArgs(name string, args []interface{}, n int) ([]int, error) {
+	if err := checkArgs(name, args, n, n); err != nil {
+		return nil, err
+	}
+
+	ints := make([]int, n)
+	for i, arg := range args {
+		val, ok := arg.(int)
+		if !ok {
+			return nil, fmt.Errorf("%s expects integers, but got %v", name, arg)
+		}
+		ints[i] = val
+	}
+	return ints, nil
+}
+
+func quot(args ...interface{}) (interface{}, error) {
+	ints, err := intArgs("quot", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if ints[1] == 0 {
+		return nil, fmt.Errorf("divide by zero")
+	}
+	return ints[0] / ints[1], nil
+}
+
+func rem(args ...interface{}) (interface{}, error) {
+	ints, err := intArgs("rem", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if ints[1] == 0 {
+		return nil, fmt.Errorf("divide by zero")
+	}
+	return ints[0] % ints[1], nil
+}
+
+func mod(args ...interface{}) (interface{}, error) {
+	ints, err := intArgs("mod", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if ints[1] == 0 {
+		return nil, fmt.Errorf("divide by zero")
+	}
+
+	// the result has the sign of the divisor
+	m := ints[0] % ints[1]
+	if m != 0 && (m < 0) != (ints[1] < 0) {
+		m += ints[1]
+	}
+	return m, nil
+}
+
+func inc(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("inc", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return add(args[0], 1)
+}
+
+func dec(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("dec", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return sub(args[0], 1)
+}
+
+func str(args ...interface{}) (interface{}, error) {
+	var buf strings.Builder
+	for _, arg := range args {
+		if arg != nil {
+			fmt.Fprint(&buf, arg)
+		}
+	}
+	return buf.String(), nil
+}
+
+func subs(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("subs", args, 2, 3); err != nil {
+		return nil, err
+	}
+
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("subs expects a string, but got %v", args[0])
+	}
+	runes := []rune(s)
+
+	ints, err := intArgs("subs", args[1:], len(args)-1)
+	if err != nil {
+		return nil, err
+	}
+	start, end := ints[0], len(runes)
+	if len(ints) == 2 {
+		end = ints[1]
+	}
+	if start < 0 || end > len(runes) || start > end {
+		return nil, fmt.Errorf("string index out of range: %d, %d", start, end)
+	}
+	return string(runes[start:end]), nil
+}
+
+func reFind(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("re-find", args, 2, 2); err != nil {
+		return nil, err
+	}
+
+	var re *regexp.Regexp
+	switch pattern := args[0].(type) {
+	case *regexp.Regexp:
+		re = pattern
+	case string:
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("re-find expects a regular expression, but got %v", args[0])
+	}
+
+	s, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("re-find expects a string, but got %v", args[1])
+	}
+
+	match := re.FindStringSubmatchIndex(s)
+	if match == nil {
+		return nil, nil
+	}
+	if len(match) == 2 {
+		return s[match[0]:match[1]], nil
+	}
+
+	// with groups the result contains the match and the groups
+	groups := make([]interface{}, len(match)/2)
+	for i := range groups {
+		if match[2*i] >= 0 {
+			groups[i] = s[match[2*i]:match[2*i+1]]
+		}
+	}
+	return groups, nil
+}
+
+func ground(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("ground", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return args[0], nil
+}
+
+func makeTuple(args ...interface{}) (interface{}, error) {
+	return append([]interface{}{}, args...), nil
+}
+
+func untuple(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("untuple", args, 1, 1); err != nil {
+		return nil, err
+	}
+	return toSlice(args[0])
+}
+
+// entityArgs returns the database, entity and attributes for the
+// functions that access entities, e.g. (get-else $ ?e :attr default).
+func entityArgs(name string, args []interface{}) (*database.Db, int, []*database.Attribute, error) {
+	db, ok := args[0].(*database.Db)
+	if !ok {
+		return nil, 0, nil, fmt.Errorf("%s expects a database, but got %v", name, args[0])
+	}
+
+	lookup, err := lookupFromValue(args[1])
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	entity := db.Entid(lookup)
+
+	attrs := make([]*database.Attribute, len(args)-2)
+	for i, arg := range args[2:] {
+		lookup, err := lookupFromValue(arg)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		id := db.Entid(lookup)
+		if id == -1 {
+			return nil, 0, nil, fmt.Errorf("unknown attribute %v", arg)
+		}
+		attrs[i] = db.Attribute(id)
+		if attrs[i] == nil {
+			return nil, 0, nil, fmt.Errorf("%v is not an attribute", arg)
+		}
+	}
+	return db, entity, attrs, nil
+}
+
+// entityValue returns the value of the attribute of the entity, or nil
+// if it has none.
+func entityValue(db *database.Db, entity int, attr *database.Attribute) interface{} {
+	if entity == -1 {
+		return nil
+	}
+
+	iter := db.Eavt().Datoms2(database.Id(entity), database.Id(attr.Id()), nil)
+	datom := iter.Next()
+	if datom == nil {
+		return nil
+	}
+	return datom.Value().Val()
+}
+
+func getElse(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("get-else", args, 4, 4); err != nil {
+		return nil, err
+	}
+	if args[3] == nil {
+		return nil, fmt.Errorf("get-else requires a default value other than nil")
+	}
+
+	db, entity, attrs, err := entityArgs("get-else", args[:3])
+	if err != nil {
+		return nil, err
+	}
+	if attrs[0].Cardinality() == database.CardinalityMany {
+		return nil, fmt.Errorf("get-else is not supported for cardinality many attributes, but %v is", args[2])
+	}
+
+	if val := entityValue(db, entity, attrs[0]); val != nil {
+		return val, nil
+	}
+	return args[3], nil
+}
+
+func getSome(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("get-some", args, 3, -1); err != nil {
+		return nil, err
+	}
+
+	db, entity, attrs, err := entityArgs("get-some", args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attr := range attrs {
+		if val := entityValue(db, entity, attr); val != nil {
+			return []interface{}{attr.Id(), val}, nil
+		}
+	}
+	return nil, nil
+}
+
+func missing(args ...interface{}) (interface{}, error) {
+	if err := checkArgs("missing?", args, 3, 3); err != nil {
+		return nil, err
+	}
+
+	db, entity, attrs, err := entityArgs("missing?", args)
+	if err != nil {
+		return nil, err
+	}
+	return entityValue(db, entity, attrs[0]) == nil, nil
+}
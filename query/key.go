@@ -7,11 +7,12 @@ import (
 // newHashKey returns a value implementing indexed that contains
 // the given values.
 //
-// For now the maximum number of values supported is three.  This limit
-// is arbitrary and can easily be changed.  We will change it based on
-// how much joins queries need in practice.
+// Keys with up to four values are stored directly, longer ones are
+// split into a key of the first four values and a key of the rest.
 func newHashKey(vals []value) Indexed {
 	switch len(vals) {
+	case 0:
+		return key0{}
 	case 1:
 		return key1{val1: vals[0]}
 	case 2:
@@ -21,10 +22,19 @@ func newHashKey(vals []value) Indexed {
 	case 4:
 		return key4{val1: vals[0], val2: vals[1], val3: vals[2], val4: vals[3]}
 	default:
-		panic("unsupported join arity")
+		return keyN{
+			head: key4{val1: vals[0], val2: vals[1], val3: vals[2], val4: vals[3]},
+			tail: newHashKey(vals[4:]),
+		}
 	}
 }
 
+type key0 struct{}
+
+func (k key0) ValueAt(idx int) value { panic("invalid index") }
+func (k key0) Length() int           { return 0 }
+func (k key0) String() string        { return "[]" }
+
 type key1 struct{ val1 value }
 
 func (k key1) ValueAt(idx int) value {
@@ -104,3 +114,74 @@ func (k key4) Length() int { return 4 }
 func (k key4) String() string {
 	return fmt.Sprintf("[%v %v %v %v]", k.val1, k.val2, k.val3, k.val4)
 }
+
+type keyN struct {
+	head key4
+	tail Indexed
+}
+
+func (k keyN) ValueAt(idx int) value {
+	if idx < 4 {
+		return k.head.ValueAt(idx)
+	}
+	return k.tail.ValueAt(idx - 4)
+}
+
+func (k keyN) Length() int { return 4 + k.tail.Length() }
+
+func (k keyN) String() string {
+	vals := make([]value, k.Length())
+	for i := range vals {
+		vals[i] = k.ValueAt(i)
+	}
+	return fmt.Sprint(vals)
+}
+
+// tupleValue is the hashable form of tuple values, which are slices
+// and can't be part of keys.  The elements are hashable as well.
+type tupleValue struct{ key Indexed }
+
+func (t tupleValue) String() string { return fmt.Sprint(t.key) }
+
+// bytesValue is the hashable form of []byte values.
+type bytesValue string
+
+func (b bytesValue) String() string { return fmt.Sprint([]byte(b)) }
+
+// hashableValue converts tuple and bytes values to a form that can be
+// part of keys, other values are returned as is.
+//
+// Values are converted when they enter relations, and converted back
+// using plainValue when they are passed to functions or returned as
+// results.
+func hashableValue(val value) value {
+	switch val := val.(type) {
+	case []interface{}:
+		vals := make([]value, len(val))
+		for i, v := range val {
+			vals[i] = hashableValue(v)
+		}
+		return tupleValue{key: newHashKey(vals)}
+	case []byte:
+		return bytesValue(val)
+	default:
+		return val
+	}
+}
+
+// plainValue converts values returned by hashableValue back to tuples
+// and bytes.
+func plainValue(val value) value {
+	switch val := val.(type) {
+	case tupleValue:
+		vals := make([]interface{}, val.key.Length())
+		for i := range vals {
+			vals[i] = plainValue(val.key.ValueAt(i))
+		}
+		return vals
+	case bytesValue:
+		return []byte(val)
+	default:
+		return val
+	}
+}
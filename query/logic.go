@@ -0,0 +1,173 @@
+package query
+
+import (
+	"fmt"
+	"github.com/heyLu/edn"
+)
+
+// Negation and disjunction are evaluated like subqueries: the clauses
+// run in a separate context that only contains the values of the
+// variables that unify with the query, and the results are joined
+// with (or removed from) the relations of the query.
+
+// projectRel returns a relation with the distinct values of the
+// variables in the relation.
+func projectRel(rel relation, vars []variable) relation {
+	attrs := make(map[variable]int, len(vars))
+	idxs := make([]int, len(vars))
+	for i, v := range vars {
+		attrs[v] = i
+		idxs[i] = rel.attrs[v]
+	}
+
+	seen := map[Indexed]bool{}
+	tuples := []tuple{}
+	for _, t := range rel.tuples {
+		vals := make([]value, len(idxs))
+		for i, idx := range idxs {
+			vals[i] = t.ValueAt(idx)
+		}
+
+		key := newHashKey(vals)
+		if !seen[key] {
+			seen[key] = true
+			tuples = append(tuples, sliceTuple(vals))
+		}
+	}
+	return relation{attrs: attrs, tuples: tuples}
+}
+
+// subContext returns a context for running nested clauses on the
+// given relations.
+//
+// If a source other than $ is given, it is used as the default source
+// of the nested clauses.
+func subContext(context context, srcName variable, rels []relation) (context, error) {
+	sub := context
+	sub.rels = rels
+
+	if srcName != variable(defaultSrc.name) {
+		src, ok := context.sources[srcName]
+		if !ok {
+			return context, fmt.Errorf("no source %v", edn.Symbol(srcName))
+		}
+		sub.sources = make(map[variable]source, len(context.sources))
+		for name, s := range context.sources {
+			sub.sources[name] = s
+		}
+		sub.sources[variable(defaultSrc.name)] = src
+		if context.rules != nil {
+			sub.ruleEvals = map[variable]*rulesEval{}
+		}
+	}
+
+	// rule calls in nested clauses always see all facts, see
+	// rulesEval.solve
+	if context.body != nil {
+		sub.body = &bodyEval{eval: context.body.eval, delta: -1}
+	}
+	return sub, nil
+}
+
+// requireBound returns an error if one of the variables is not bound.
+func requireBound(context context, vars []variable, kind string) error {
+	for _, v := range vars {
+		if !isBound(context, v) {
+			return fmt.Errorf("insufficient bindings: %v is not bound before %s clause", edn.Symbol(v), kind)
+		}
+	}
+	return nil
+}
+
+// resolveNot removes the tuples for which the clauses match from the
+// context.
+func resolveNot(context context, not notClause) (context, error) {
+	err := requireBound(context, not.vars, "not")
+	if err != nil {
+		return context, err
+	}
+
+	rel, others := splitRels(context.rels, not.vars)
+	sub, err := subContext(context, not.source, []relation{projectRel(rel, not.vars)})
+	if err != nil {
+		return context, err
+	}
+	sub, err = runQuery(sub, not.clauses)
+	if err != nil {
+		return context, err
+	}
+	matches := collect(sub, not.vars)
+
+	tuples := []tuple{}
+	vals := make([]value, len(not.vars))
+	for _, t := range rel.tuples {
+		for i, v := range not.vars {
+			vals[i] = t.ValueAt(rel.attrs[v])
+		}
+		if !matches[newHashKey(vals)] {
+			tuples = append(tuples, t)
+		}
+	}
+
+	newContext := context
+	newContext.rels = append(others, relation{attrs: rel.attrs, tuples: tuples})
+	return newContext, nil
+}
+
+// resolveOr joins the union of the results of the branches with the
+// relations of the context.
+func resolveOr(context context, or orClause) (context, error) {
+	err := requireBound(context, or.vars.required, "or-join")
+	if err != nil {
+		return context, err
+	}
+
+	vars := append(append([]variable{}, or.vars.required...), or.vars.free...)
+	join := []variable{}
+	for _, v := range vars {
+		if isBound(context, v) {
+			join = append(join, v)
+		}
+	}
+	rel, others := splitRels(context.rels, join)
+	input := projectRel(rel, join)
+
+	attrs := make(map[variable]int, len(vars))
+	for i, v := range vars {
+		attrs[v] = i
+	}
+	union := relation{attrs: attrs, tuples: []tuple{}}
+	seen := map[Indexed]bool{}
+	for _, branch := range or.branches {
+		clauses := []clause{branch}
+		if and, ok := branch.(andClause); ok {
+			clauses = and.clauses
+		}
+
+		sub, err := subContext(context, or.source, []relation{input})
+		if err != nil {
+			return context, err
+		}
+		sub, err = runQuery(sub, clauses)
+		if err != nil {
+			return context, err
+		}
+
+		for _, v := range vars {
+			if !isBound(sub, v) {
+				return context, fmt.Errorf("insufficient bindings: %v is not bound in all branches of or clause", edn.Symbol(v))
+			}
+		}
+		for _, vals := range internalCollect(sub, vars) {
+			key := newHashKey(vals)
+			if !seen[key] {
+				seen[key] = true
+				union.tuples = append(union.tuples, sliceTuple(vals))
+			}
+		}
+	}
+
+	newContext := context
+	newContext.rels = collapseRels(append(others, rel), union)
+	return newContext, nil
+}
@@ -4,7 +4,8 @@ import (
 	"fmt"
 	"github.com/heyLu/edn"
 
-	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/pull"
+	"github.com/heyLu/mu/transactor"
 )
 
 /// utils
@@ -12,11 +13,15 @@ import (
 func parseAnyOf(form interface{}, parsers ...func(interface{}) (interface{}, error)) (interface{}, error) {
 	for _, parser := range parsers {
 		val, err := parser(form)
+		if err != nil {
+			return nil, err
+		}
+
 		if val == nil { // parser "skipped" the form, try next
 			continue
 		}
 
-		return val, err
+		return val, nil
 	}
 	return nil, nil
 }
@@ -30,13 +35,13 @@ func parseSeq(parser func(interface{}) (interface{}, error), form interface{}) (
 	res := make([]interface{}, len(forms))
 	for i, form := range forms {
 		val, err := parser(form)
-		if val == nil {
-			return nil, nil
-		}
-
 		if err != nil {
 			return nil, err
 		}
+
+		if val == nil {
+			return nil, nil
+		}
 		res[i] = val
 	}
 	return res, nil
@@ -72,7 +77,7 @@ type srcVar struct {
 }
 
 func parseSrcVar(form interface{}) (interface{}, error) {
-	if sym, ok := form.(edn.Symbol); ok && sym.Name[0] == '?' {
+	if sym, ok := form.(edn.Symbol); ok && sym.Name[0] == '$' {
 		return srcVar{name: sym}, nil
 	}
 	return nil, nil
@@ -88,14 +93,14 @@ func parseRulesVar(form interface{}) (interface{}, error) {
 }
 
 type constant struct {
-	value index.Value
+	value value
 }
 
 func parseConstant(form interface{}) (interface{}, error) {
 	if _, ok := form.(edn.Symbol); ok {
 		return nil, nil
 	}
-	return constant{value: index.NewValue(form)}, nil
+	return constant{value: transactor.ValueFromEDN(form)}, nil
 }
 
 type plainSymbol struct {
@@ -194,11 +199,14 @@ func (rv ruleVars) arity() (int, int) {
 /// bind-rel       = [ [ (binding | '_')+ ] ]
 
 type binding interface {
-	bind(val interface{})
+	// vars returns the variables bound by the binding.
+	vars() []variable
 }
 
 type bindIgnore struct{}
 
+func (b bindIgnore) vars() []variable { return nil }
+
 func parseBindIgnore(form interface{}) (interface{}, error) {
 	if sym, ok := form.(edn.Symbol); ok && sym.Name == "_" {
 		return bindIgnore{}, nil
@@ -210,6 +218,8 @@ type bindScalar struct {
 	variable variable
 }
 
+func (b bindScalar) vars() []variable { return []variable{b.variable} }
+
 func parseBindScalar(form interface{}) (interface{}, error) {
 	val, _ := parseVariable(form)
 	if val != nil {
@@ -222,6 +232,14 @@ type bindTuple struct {
 	bindings []binding
 }
 
+func (b bindTuple) vars() []variable {
+	vars := []variable{}
+	for _, binding := range b.bindings {
+		vars = append(vars, binding.vars()...)
+	}
+	return vars
+}
+
 func parseTupleEl(form interface{}) (interface{}, error) {
 	val, _ := parseBindIgnore(form)
 	if val != nil {
@@ -261,6 +279,8 @@ type bindColl struct {
 	binding binding
 }
 
+func (b bindColl) vars() []variable { return b.binding.vars() }
+
 func parseBindColl(form interface{}) (interface{}, error) {
 	forms, ok := form.([]interface{})
 	sym := edn.Symbol{Name: "..."}
@@ -280,6 +300,8 @@ type bindRel struct {
 	binding binding
 }
 
+func (b bindRel) vars() []variable { return b.binding.vars() }
+
 func parseBindRel(form interface{}) (interface{}, error) {
 	forms, ok := form.([]interface{})
 	if !ok || len(forms) != 1 {
@@ -324,7 +346,8 @@ func parseBinding(form interface{}) (interface{}, error) {
 /// find-tuple       = [ find-elem+ ]
 /// find-elem        = (variable | pull-expr | aggregate | custom-aggregate)
 /// pull-expr        = [ 'pull' src-var? variable pull-pattern ]
-/// pull-pattern     = (constant | variable)
+/// pull-pattern     = (pattern-name | variable | constant)
+/// pattern-name     = plain-symbol
 /// aggregate        = [ aggregate-fn fn-arg+ ]
 /// aggregate-fn     = plain-symbol
 /// custom-aggregate = [ 'aggregate' variable fn-arg+ ]
@@ -338,21 +361,38 @@ func (v variable) findVars() []edn.Symbol {
 	return []edn.Symbol{edn.Symbol(v)}
 }
 
-// TODO Aggregate
-
-// TODO Pull
+type aggregate struct {
+	name     edn.Symbol
+	fn       variable // for (aggregate ?fn ...), bound to a Function
+	args     []value  // constant arguments
+	variable variable
+}
 
-type findElements interface {
-	findElements() []findVars
+func (a aggregate) findVars() []edn.Symbol {
+	return []edn.Symbol{edn.Symbol(a.variable)}
 }
 
-// TODO FindRel
+type pullExpr struct {
+	source   srcVar
+	variable variable
+	pattern  *pull.Pattern
+	// the name of the input the pattern is bound to, if it is not
+	// given literally
+	patternName edn.Symbol
+}
 
-// TODO FindColl
+func (p pullExpr) findVars() []edn.Symbol {
+	return []edn.Symbol{edn.Symbol(p.variable)}
+}
 
-// TODO FindScalar
+type findElements interface {
+	findElements() []findVars
+}
 
-// TODO FindTuple
+func (f findRel) findElements() []findVars    { return f.elems }
+func (f findColl) findElements() []findVars   { return []findVars{f.elem} }
+func (f findScalar) findElements() []findVars { return []findVars{f.elem} }
+func (f findTuple) findElements() []findVars  { return f.elems }
 
 func findVariables(find findElements) []edn.Symbol {
 	vars := make([]edn.Symbol, 0)
@@ -362,18 +402,104 @@ func findVariables(find findElements) []edn.Symbol {
 	return vars
 }
 
-// TODO aggregate?
+var aggregateSym = edn.Symbol{Name: "aggregate"}
+
+func parseAggregate(form interface{}) (interface{}, error) {
+	forms, ok := form.([]interface{})
+	if !ok || len(forms) == 0 {
+		return nil, nil
+	}
+
+	name, _ := parsePlainSymbol(forms[0])
+	if name == nil {
+		return nil, nil
+	}
 
-// TODO pull?
+	agg := aggregate{name: name.(plainSymbol).name}
+	args := forms[1:]
+	if agg.name == aggregateSym {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expected [ 'aggregate' variable fn-arg+ ] but got %v", form)
+		}
+		fn, _ := parseVariable(args[0])
+		if fn == nil {
+			return nil, fmt.Errorf("expected variable for custom aggregate but got %v", args[0])
+		}
+		agg.fn = fn.(variable)
+		args = args[1:]
+	} else if _, ok := aggregates[agg.name]; !ok {
+		return nil, fmt.Errorf("unknown aggregate %v", agg.name)
+	}
 
-// TODO parse-aggregate
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected [ aggregate-fn fn-arg+ ] but got %v", form)
+	}
+	v, _ := parseVariable(args[len(args)-1])
+	if v == nil {
+		return nil, fmt.Errorf("the last argument of aggregate %v must be a variable, but was %v", form, args[len(args)-1])
+	}
+	agg.variable = v.(variable)
 
-// TODO parse-aggregate-custom
+	for _, arg := range args[:len(args)-1] {
+		c, _ := parseConstant(arg)
+		if c == nil {
+			return nil, fmt.Errorf("expected constant argument to aggregate %v but got %v", form, arg)
+		}
+		agg.args = append(agg.args, c.(constant).value)
+	}
+	return agg, nil
+}
 
-// TODO parse-pull-expr
+var pullSym = edn.Symbol{Name: "pull"}
+
+func parsePullExpr(form interface{}) (interface{}, error) {
+	forms, ok := form.([]interface{})
+	if !ok || len(forms) == 0 || forms[0] != pullSym {
+		return nil, nil
+	}
+
+	source := defaultSrc
+	args := forms[1:]
+	if len(args) == 3 {
+		src, _ := parseSrcVar(args[0])
+		if src == nil {
+			return nil, fmt.Errorf("expected [ 'pull' src-var? variable pull-pattern ] but got %v", form)
+		}
+		source = src.(srcVar)
+		args = args[1:]
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expected [ 'pull' src-var? variable pull-pattern ] but got %v", form)
+	}
+
+	v, _ := parseVariable(args[0])
+	if v == nil {
+		return nil, fmt.Errorf("expected variable in pull expression but got %v", args[0])
+	}
+
+	if sym, ok := args[1].(edn.Symbol); ok {
+		name, _ := parseAnyOf(sym, parseVariable, parsePlainSymbol)
+		if name == nil {
+			return nil, fmt.Errorf("expected pattern name, variable or pattern in pull expression but got %v", sym)
+		}
+		return pullExpr{source: source, variable: v.(variable), patternName: sym}, nil
+	}
+
+	pattern, err := pull.ParsePattern(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid pull pattern in %v: %w", form, err)
+	}
+
+	return pullExpr{source: source, variable: v.(variable), pattern: pattern}, nil
+}
 
 func parseFindElem(form interface{}) (interface{}, error) {
-	// TODO allow aggregates and pull exprs
+	expr, err := parseAnyOf(form, parsePullExpr, parseAggregate)
+	if expr != nil || err != nil {
+		return expr, err
+	}
+
 	val, err := parseAnyOf(form, parseVariable)
 	if val == nil {
 		return nil, nil
@@ -392,14 +518,14 @@ type findRel struct {
 
 func parseFindRel(form interface{}) (interface{}, error) {
 	elems, err := parseSeq(parseFindElem, form)
-	if elems == nil {
-		return nil, nil
-	}
-
 	if err != nil {
 		return nil, err
 	}
 
+	if elems == nil || len(elems.([]interface{})) == 0 {
+		return nil, nil
+	}
+
 	fvs := make([]findVars, len(elems.([]interface{})))
 	for i, elem := range elems.([]interface{}) {
 		fvs[i] = elem.(findVars)
@@ -419,19 +545,19 @@ func parseFindColl(form interface{}) (interface{}, error) {
 
 	inner, ok := forms[0].([]interface{})
 	sym := edn.Symbol{Name: "..."}
-	if !ok || len(forms) != 2 || forms[1] != sym {
+	if !ok || len(inner) != 2 || inner[1] != sym {
 		return nil, nil
 	}
 
 	elem, err := parseFindElem(inner[0])
-	if elem == nil {
-		return nil, nil
-	}
-
 	if err != nil {
 		return nil, err
 	}
 
+	if elem == nil {
+		return nil, nil
+	}
+
 	return findColl{elem: elem.(findVars)}, nil
 }
 
@@ -447,14 +573,14 @@ func parseFindScalar(form interface{}) (interface{}, error) {
 	}
 
 	elem, err := parseFindElem(forms[0])
-	if elem == nil {
-		return nil, nil
-	}
-
 	if err != nil {
 		return nil, err
 	}
 
+	if elem == nil {
+		return nil, nil
+	}
+
 	return findScalar{elem: elem.(findVars)}, nil
 }
 
@@ -468,7 +594,12 @@ func parseFindTuple(form interface{}) (interface{}, error) {
 		return nil, nil
 	}
 
-	rel, err := parseFindRel(form)
+	inner, ok := forms[0].([]interface{})
+	if !ok || len(inner) == 0 {
+		return nil, nil
+	}
+
+	rel, err := parseFindRel(inner)
 	if rel == nil || err != nil {
 		return nil, err
 	}
@@ -478,11 +609,15 @@ func parseFindTuple(form interface{}) (interface{}, error) {
 
 func parseFind(form interface{}) (interface{}, error) {
 	val, err := parseAnyOf(form, parseFindRel, parseFindColl, parseFindScalar, parseFindTuple)
+	if err != nil {
+		return nil, err
+	}
+
 	if val == nil {
-		return nil, fmt.Errorf("expected (find-rel | find-coll | find-tuple | find-scalar)")
+		return nil, fmt.Errorf("expected (find-rel | find-coll | find-tuple | find-scalar) but got %v", form)
 	}
 
-	return val, err
+	return val.(findElements), nil
 }
 
 /// with = [ variable+ ]
@@ -501,16 +636,29 @@ func parseWith(form interface{}) (interface{}, error) {
 	return vars, nil
 }
 
-/// in = [ (src-var | rules-var | binding)+ ]
+/// in          = [ (src-var | rules-var | pattern-var | binding)+ ]
+/// pattern-var = plain-symbol
+
+type patternVar struct {
+	name edn.Symbol
+}
+
+func parsePatternVar(form interface{}) (interface{}, error) {
+	sym, _ := parsePlainSymbol(form)
+	if sym == nil {
+		return nil, nil
+	}
+	return patternVar{name: sym.(plainSymbol).name}, nil
+}
 
 func parseInBinding(form interface{}) (interface{}, error) {
-	return parseAnyOf(form, parseSrcVar, parseRulesVar, parseBinding)
+	return parseAnyOf(form, parseSrcVar, parseRulesVar, parsePatternVar, parseBinding)
 }
 
 func parseIn(form []interface{}) (interface{}, error) {
 	val, err := parseSeq(parseInBinding, form)
 	if val == nil {
-		return nil, fmt.Errorf("expected [ (src-var | rules-var | binding)+ ]")
+		return nil, fmt.Errorf("expected [ (src-var | rules-var | pattern-var | binding)+ ]")
 	}
 
 	return val, err
@@ -537,7 +685,7 @@ var defaultSrc = srcVar{name: edn.Symbol{Name: "$"}}
 
 func takeSource(form interface{}) (*srcVar, interface{}) {
 	forms, ok := form.([]interface{})
-	if !ok {
+	if !ok || len(forms) == 0 {
 		return nil, nil
 	}
 
@@ -550,9 +698,15 @@ func takeSource(form interface{}) (*srcVar, interface{}) {
 	}
 }
 
-type pattern_ struct {
-	source  srcVar
-	pattern []interface{} // placeholder, variable or constant
+// isCall returns true if the form looks like a function call, i.e. if
+// it is a list starting with a symbol.
+func isCall(form interface{}) bool {
+	forms, ok := form.([]interface{})
+	if !ok || len(forms) == 0 {
+		return false
+	}
+	_, ok = forms[0].(edn.Symbol)
+	return ok
 }
 
 func parsePattern(form interface{}) (interface{}, error) {
@@ -561,16 +715,36 @@ func parsePattern(form interface{}) (interface{}, error) {
 		return nil, nil
 	}
 
-	patternRaw, _ := parseSeq(parsePatternEl, nextForm)
-	if patternRaw == nil {
+	forms := nextForm.([]interface{})
+	if len(forms) == 0 {
+		return nil, fmt.Errorf("empty pattern %v", form)
+	}
+
+	// pred-expr and fn-expr
+	if isCall(forms[0]) {
 		return nil, nil
 	}
 
-	if len(patternRaw.([]interface{})) == 0 {
-		return nil, fmt.Errorf("empty pattern")
+	patternRaw, err := parseSeq(parsePatternEl, forms)
+	if patternRaw == nil || err != nil {
+		return nil, err
+	}
+
+	els := patternRaw.([]interface{})
+	if len(els) > 5 {
+		return nil, fmt.Errorf("pattern %v has more than 5 elements", form)
 	}
 
-	return pattern_{source: *source, pattern: patternRaw.([]interface{})}, nil
+	pattern := make(pattern, len(els))
+	for i, el := range els {
+		if c, ok := el.(constant); ok {
+			pattern[i] = hashableValue(c.value)
+		} else {
+			pattern[i] = el
+		}
+	}
+
+	return patternClause{source: variable(source.name), pattern: pattern}, nil
 }
 
 func parseCall(form interface{}) (interface{}, interface{}) {
@@ -579,7 +753,7 @@ func parseCall(form interface{}) (interface{}, interface{}) {
 		return nil, nil
 	}
 
-	fn, _ := parseAnyOf(form, parsePlainSymbol, parseVariable)
+	fn, _ := parseAnyOf(forms[0], parsePlainSymbol, parseVariable)
 	args, _ := parseSeq(parseFnArg, forms[1:])
 	return fn, args
 }
@@ -610,5 +784,595 @@ type function struct {
 }
 
 func parseFunction(form interface{}) (interface{}, error) {
-	return nil, nil
+	forms, ok := form.([]interface{})
+	if !ok || len(forms) != 2 {
+		return nil, nil
+	}
+
+	name, args := parseCall(forms[0])
+	if name == nil || args == nil {
+		return nil, nil
+	}
+
+	bind, err := parseBinding(forms[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return function{name: name, args: args.([]interface{}), binding: bind.(binding)}, nil
+}
+
+type ruleExpr struct {
+	source variable
+	name   edn.Symbol
+	args   pattern // variables, placeholders or constants
+}
+
+func parseRuleExpr(form interface{}) (interface{}, error) {
+	source, nextForm := takeSource(form)
+	if source == nil {
+		return nil, nil
+	}
+
+	forms := nextForm.([]interface{})
+	if len(forms) == 0 {
+		return nil, nil
+	}
+
+	name, _ := parsePlainSymbol(forms[0])
+	if name == nil {
+		return nil, nil
+	}
+	if forms[0] == andSym {
+		return nil, fmt.Errorf("and is only allowed in or clauses, but got %v", form)
+	}
+
+	argsRaw, err := parseSeq(parsePatternEl, forms[1:])
+	if err != nil {
+		return nil, err
+	}
+	if argsRaw == nil || len(forms) < 2 {
+		return nil, fmt.Errorf("expected [ src-var? rule-name (variable | constant | '_')+ ] but got %v", form)
+	}
+
+	args := make(pattern, len(forms)-1)
+	for i, arg := range argsRaw.([]interface{}) {
+		if c, ok := arg.(constant); ok {
+			args[i] = hashableValue(c.value)
+		} else {
+			args[i] = arg
+		}
+	}
+
+	return ruleExpr{source: variable(source.name), name: name.(plainSymbol).name, args: args}, nil
+}
+
+var (
+	notSym     = edn.Symbol{Name: "not"}
+	notJoinSym = edn.Symbol{Name: "not-join"}
+	orSym      = edn.Symbol{Name: "or"}
+	orJoinSym  = edn.Symbol{Name: "or-join"}
+	andSym     = edn.Symbol{Name: "and"}
+)
+
+// takeOperator returns the source and the arguments of a clause of the
+// form [ src-var? op args* ], or nil if the clause is not of that form.
+func takeOperator(form interface{}, ops ...edn.Symbol) (*srcVar, edn.Symbol, []interface{}) {
+	source, nextForm := takeSource(form)
+	if source == nil {
+		return nil, edn.Symbol{}, nil
+	}
+
+	forms := nextForm.([]interface{})
+	if len(forms) == 0 {
+		return nil, edn.Symbol{}, nil
+	}
+
+	for _, op := range ops {
+		if forms[0] == op {
+			return source, op, forms[1:]
+		}
+	}
+	return nil, edn.Symbol{}, nil
+}
+
+type notClause struct {
+	source  variable
+	vars    []variable // the variables that unify with the query
+	clauses []clause
+}
+
+func parseNot(form interface{}) (interface{}, error) {
+	source, op, forms := takeOperator(form, notSym, notJoinSym)
+	if source == nil {
+		return nil, nil
+	}
+
+	var vars []variable
+	if op == notJoinSym {
+		if len(forms) == 0 {
+			return nil, fmt.Errorf("expected [ src-var? 'not-join' [ variable+ ] clause+ ] but got %v", form)
+		}
+		rawVars, _ := parseSeq(parseVariable, forms[0])
+		if rawVars == nil || len(rawVars.([]interface{})) == 0 {
+			return nil, fmt.Errorf("expected [ variable+ ] in not-join, but got %v", forms[0])
+		}
+		for _, v := range rawVars.([]interface{}) {
+			vars = append(vars, v.(variable))
+		}
+		forms = forms[1:]
+	}
+
+	if len(forms) == 0 {
+		return nil, fmt.Errorf("%v needs at least one clause, but got %v", op, form)
+	}
+	clauses, err := parseWhere(forms)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == notSym {
+		vars = clausesVars(clauses)
+	}
+	return notClause{source: variable(source.name), vars: vars, clauses: clauses}, nil
+}
+
+type orClause struct {
+	source variable
+	vars   ruleVars // the variables that unify with the query
+	// each branch is a clause or an andClause
+	branches []clause
+}
+
+type andClause struct {
+	clauses []clause
+}
+
+func parseAnd(form interface{}) (interface{}, error) {
+	forms, ok := form.([]interface{})
+	if !ok || len(forms) == 0 || forms[0] != andSym {
+		return nil, nil
+	}
+
+	if len(forms) == 1 {
+		return nil, fmt.Errorf("and needs at least one clause, but got %v", form)
+	}
+	clauses, err := parseWhere(forms[1:])
+	if err != nil {
+		return nil, err
+	}
+	return andClause{clauses: clauses}, nil
+}
+
+func parseOr(form interface{}) (interface{}, error) {
+	source, op, forms := takeOperator(form, orSym, orJoinSym)
+	if source == nil {
+		return nil, nil
+	}
+
+	var vars ruleVars
+	if op == orJoinSym {
+		if len(forms) == 0 {
+			return nil, fmt.Errorf("expected [ src-var? 'or-join' rule-vars (clause | and-clause)+ ] but got %v", form)
+		}
+		rawVars, err := parseRuleVars(forms[0])
+		if err != nil {
+			return nil, err
+		}
+		vars = rawVars.(ruleVars)
+		forms = forms[1:]
+	}
+
+	if len(forms) == 0 {
+		return nil, fmt.Errorf("%v needs at least one clause, but got %v", op, form)
+	}
+	branches := make([]clause, len(forms))
+	for i, form := range forms {
+		branch, err := parseAnyOf(form, parseAnd, parseClause)
+		if err != nil {
+			return nil, err
+		}
+		branches[i] = branch
+	}
+
+	if op == orSym {
+		// all branches must use the same variables
+		vars.free = clausesVars(branches[:1])
+		for _, branch := range branches[1:] {
+			if !sameVars(vars.free, clausesVars([]clause{branch})) {
+				return nil, fmt.Errorf("all clauses in %v must use the same set of variables", form)
+			}
+		}
+	}
+	return orClause{source: variable(source.name), vars: vars, branches: branches}, nil
+}
+
+// clauseVars returns the variables used by the clause that unify with
+// the enclosing query.
+func clauseVars(clause clause) []variable {
+	vars := []variable{}
+	add := func(val interface{}) {
+		if v, ok := val.(variable); ok {
+			vars = append(vars, v)
+		}
+	}
+
+	switch clause := clause.(type) {
+	case patternClause:
+		for _, val := range clause.pattern {
+			add(val)
+		}
+	case ruleExpr:
+		for _, val := range clause.args {
+			add(val)
+		}
+	case predicate:
+		add(clause.name)
+		for _, arg := range clause.args {
+			add(arg)
+		}
+	case function:
+		add(clause.name)
+		for _, arg := range clause.args {
+			add(arg)
+		}
+		vars = append(vars, clause.binding.vars()...)
+	case notClause:
+		vars = append(vars, clause.vars...)
+	case orClause:
+		vars = append(vars, clause.vars.required...)
+		vars = append(vars, clause.vars.free...)
+	case andClause:
+		vars = append(vars, clausesVars(clause.clauses)...)
+	}
+	return vars
+}
+
+// clausesVars returns the distinct variables used by the clauses.
+func clausesVars(clauses []clause) []variable {
+	seen := map[variable]bool{}
+	vars := []variable{}
+	for _, clause := range clauses {
+		for _, v := range clauseVars(clause) {
+			if !seen[v] {
+				seen[v] = true
+				vars = append(vars, v)
+			}
+		}
+	}
+	return vars
+}
+
+func sameVars(vars1, vars2 []variable) bool {
+	if len(vars1) != len(vars2) {
+		return false
+	}
+
+	set := map[variable]bool{}
+	for _, v := range vars1 {
+		set[v] = true
+	}
+	for _, v := range vars2 {
+		if !set[v] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseClause(form interface{}) (interface{}, error) {
+	val, err := parseAnyOf(form, parseNot, parseOr, parsePredicate, parseFunction, parsePattern, parseRuleExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	if val == nil {
+		return nil, fmt.Errorf("expected (data-pattern | pred-expr | fn-expr | rule-expr | not-clause | not-join-clause | or-clause | or-join-clause) but got %v", form)
+	}
+
+	return val, nil
+}
+
+func parseWhere(forms []interface{}) ([]clause, error) {
+	clauses := make([]clause, len(forms))
+	for i, form := range forms {
+		clause, err := parseClause(form)
+		if err != nil {
+			return nil, err
+		}
+		clauses[i] = clause
+	}
+	return clauses, nil
+}
+
+/// return-keys = (':keys' | ':strs' | ':syms') plain-symbol+
+
+var (
+	keysKw = edn.Keyword{Name: "keys"}
+	strsKw = edn.Keyword{Name: "strs"}
+	symsKw = edn.Keyword{Name: "syms"}
+)
+
+// parseReturnKeys returns the keys of the maps returned for each
+// result, as keywords for :keys, strings for :strs and symbols for
+// :syms.
+func parseReturnKeys(kw edn.Keyword, forms []interface{}) ([]interface{}, error) {
+	if len(forms) == 0 {
+		return nil, fmt.Errorf("expected plain-symbol+ for %v", kw)
+	}
+
+	keys := make([]interface{}, len(forms))
+	for i, form := range forms {
+		sym, ok := form.(edn.Symbol)
+		if !ok {
+			return nil, fmt.Errorf("expected plain-symbol for %v, but got %v", kw, form)
+		}
+
+		switch kw {
+		case keysKw:
+			keys[i] = edn.Keyword{Namespace: sym.Namespace, Name: sym.Name}
+		case strsKw:
+			if sym.Namespace != "" {
+				keys[i] = sym.Namespace + "/" + sym.Name
+			} else {
+				keys[i] = sym.Name
+			}
+		case symsKw:
+			keys[i] = sym
+		}
+	}
+	return keys, nil
+}
+
+/// query = {:find find-spec return-keys? :with with? :in in? :where [ clause+ ]?}
+///       | [:find find-spec return-keys? :with variable+ :in (src-var | rules-var | binding)+ :where clause+]
+
+var (
+	findKw  = edn.Keyword{Name: "find"}
+	withKw  = edn.Keyword{Name: "with"}
+	inKw    = edn.Keyword{Name: "in"}
+	whereKw = edn.Keyword{Name: "where"}
+)
+
+type query struct {
+	spec  findElements // findRel, findColl, findScalar or findTuple
+	find  []findVars
+	keys  []interface{} // the keys of return maps, if given
+	with  []variable
+	in    []interface{} // srcVar, rulesVar, patternVar or binding
+	where []clause
+}
+
+// toQueryMap returns the parts of the query by keyword, for both the
+// map and the list form of queries.
+func toQueryMap(form interface{}) (map[edn.Keyword][]interface{}, error) {
+	queryMap := map[edn.Keyword][]interface{}{}
+	switch form := form.(type) {
+	case map[interface{}]interface{}:
+		for key, val := range form {
+			kw, ok := key.(edn.Keyword)
+			if !ok {
+				return nil, fmt.Errorf("query keys must be keywords, but got %v", key)
+			}
+			vals, ok := val.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected a vector for %v, but got %v", kw, val)
+			}
+			queryMap[kw] = vals
+		}
+	case []interface{}:
+		var key *edn.Keyword
+		for _, val := range form {
+			if kw, ok := val.(edn.Keyword); ok {
+				key = &kw
+				queryMap[kw] = []interface{}{}
+				continue
+			}
+
+			if key == nil {
+				return nil, fmt.Errorf("query must start with a keyword, but got %v", val)
+			}
+			queryMap[*key] = append(queryMap[*key], val)
+		}
+	default:
+		return nil, fmt.Errorf("query must be a map or a list, but got %v", form)
+	}
+
+	for kw := range queryMap {
+		switch kw {
+		case findKw, keysKw, strsKw, symsKw, withKw, inKw, whereKw:
+		default:
+			return nil, fmt.Errorf("unknown query key %v", kw)
+		}
+	}
+	return queryMap, nil
+}
+
+// collectVars adds all variables in the form to vars.
+//
+// Variables in not clauses are skipped, because they never bind
+// anything.
+func collectVars(form interface{}, vars map[variable]bool) {
+	switch form := form.(type) {
+	case edn.Symbol:
+		if v, _ := parseVariable(form); v != nil {
+			vars[v.(variable)] = true
+		}
+	case []interface{}:
+		if source, _, _ := takeOperator(form, notSym, notJoinSym); source != nil {
+			return
+		}
+		for _, f := range form {
+			collectVars(f, vars)
+		}
+	}
+}
+
+func parseQuery(form interface{}) (*query, error) {
+	queryMap, err := toQueryMap(form)
+	if err != nil {
+		return nil, err
+	}
+
+	rawFind, ok := queryMap[findKw]
+	if !ok {
+		return nil, fmt.Errorf("query must contain :find")
+	}
+	spec, err := parseFind(rawFind)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &query{
+		spec: spec.(findElements),
+		find: spec.(findElements).findElements(),
+		in:   []interface{}{defaultSrc},
+	}
+
+	for _, kw := range []edn.Keyword{keysKw, strsKw, symsKw} {
+		rawKeys, ok := queryMap[kw]
+		if !ok {
+			continue
+		}
+		if q.keys != nil {
+			return nil, fmt.Errorf("only one of :keys, :strs and :syms can be given")
+		}
+
+		q.keys, err = parseReturnKeys(kw, rawKeys)
+		if err != nil {
+			return nil, err
+		}
+		switch spec.(type) {
+		case findRel, findTuple:
+		default:
+			return nil, fmt.Errorf("%v can only be used with find-rel or find-tuple", kw)
+		}
+		if len(q.keys) != len(q.find) {
+			return nil, fmt.Errorf("expected %d keys for %v, but got %d", len(q.find), kw, len(q.keys))
+		}
+	}
+
+	if rawWith, ok := queryMap[withKw]; ok {
+		with, err := parseWith(rawWith)
+		if err != nil {
+			return nil, err
+		}
+		q.with = with.([]variable)
+	}
+
+	if rawIn, ok := queryMap[inKw]; ok {
+		in, err := parseIn(rawIn)
+		if err != nil {
+			return nil, err
+		}
+		q.in = in.([]interface{})
+	}
+
+	q.where, err = parseWhere(queryMap[whereKw])
+	if err != nil {
+		return nil, err
+	}
+
+	bound := map[variable]bool{}
+	collectVars(queryMap[inKw], bound)
+	collectVars(queryMap[whereKw], bound)
+	unknown := []edn.Symbol{}
+	for _, elem := range q.find {
+		for _, v := range elem.findVars() {
+			if !bound[variable(v)] {
+				unknown = append(unknown, v)
+			}
+		}
+		if agg, ok := elem.(aggregate); ok && agg.name == aggregateSym && !bound[agg.fn] {
+			unknown = append(unknown, edn.Symbol(agg.fn))
+		}
+	}
+	for _, v := range q.with {
+		if !bound[v] {
+			unknown = append(unknown, edn.Symbol(v))
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("query for unknown vars: %v", unknown)
+	}
+
+	return q, nil
+}
+
+/// rules     = [ rule+ ]
+/// rule      = [ rule-head clause+ ]
+/// rule-head = [ rule-name rule-vars ]
+/// rule-name = plain-symbol
+
+type rule struct {
+	name    edn.Symbol
+	vars    ruleVars
+	clauses []clause
+}
+
+func parseRule(form interface{}) (*rule, error) {
+	forms, ok := form.([]interface{})
+	if !ok || len(forms) < 2 {
+		return nil, fmt.Errorf("expected [ rule-head clause+ ] but got %v", form)
+	}
+
+	head, ok := forms[0].([]interface{})
+	if !ok || len(head) < 2 {
+		return nil, fmt.Errorf("expected [ rule-name rule-vars ] but got %v", forms[0])
+	}
+
+	name, _ := parsePlainSymbol(head[0])
+	if name == nil {
+		return nil, fmt.Errorf("rule name must be a plain symbol, but was %v", head[0])
+	}
+
+	vars, err := parseRuleVars(head[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	clauses, err := parseWhere(forms[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &rule{name: name.(plainSymbol).name, vars: vars.(ruleVars), clauses: clauses}, nil
+}
+
+// parseRules parses the rules passed as the input for %, either as EDN
+// data or as a string.
+//
+// Rules with multiple bodies are returned in the order they were
+// given.
+func parseRules(form interface{}) (map[edn.Symbol][]rule, error) {
+	if s, ok := form.(string); ok {
+		var err error
+		form, err = edn.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	forms, ok := form.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected [ rule+ ] but got %v", form)
+	}
+
+	rules := map[edn.Symbol][]rule{}
+	for _, form := range forms {
+		rule, err := parseRule(form)
+		if err != nil {
+			return nil, err
+		}
+
+		if others, ok := rules[rule.name]; ok {
+			req1, free1 := others[0].vars.arity()
+			req2, free2 := rule.vars.arity()
+			if req1 != req2 || free1 != free2 {
+				return nil, fmt.Errorf("all bodies of rule %v must have the same arity", rule.name)
+			}
+		}
+		rules[rule.name] = append(rules[rule.name], *rule)
+	}
+	return rules, nil
 }
@@ -0,0 +1,308 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/heyLu/mu/database"
+)
+
+// Clauses are not resolved in the order they are written, instead the
+// pattern that is estimated to be the cheapest is resolved next.  The
+// estimates are based on the size of the index ranges the patterns
+// read, see database.Db.Estimate, so that selective patterns bind
+// their variables before the patterns using them are resolved.
+//
+// Patterns with variables that are already bound can be resolved by
+// substituting the bound values and searching the database for each
+// of them, instead of reading all datoms matching the constants and
+// joining them afterwards.  Which one is cheaper is estimated from the
+// number of distinct values of the variables and the estimates for a
+// sample of them.
+//
+// Clauses other than patterns keep their order relative to each other,
+// and are resolved after the patterns written before them, so they see
+// at least the variables they would see in the written order.
+// Predicates and not clauses are resolved earlier if all of their
+// variables are bound, because they only remove tuples.
+
+// sampleSize is the number of values of bound variables that are used
+// to estimate the cost of substituting them.
+const sampleSize = 16
+
+// A patternPlan describes how a pattern is resolved.
+type patternPlan struct {
+	clause patternClause
+	// the variables whose values are substituted, and their values,
+	// or nil if the pattern is resolved on its own
+	vars []variable
+	rows [][]value
+	// the estimated number of datoms (or tuples) to read
+	cost int
+}
+
+// planPattern estimates the cost of resolving the pattern, with and
+// without substituting the bound variables, and returns the cheaper
+// plan.
+func planPattern(context context, clause patternClause) (patternPlan, error) {
+	plan := patternPlan{clause: clause}
+
+	src, ok := context.sources[clause.source]
+	if !ok {
+		return plan, fmt.Errorf("no source %v for %v", clause.source, clause.pattern)
+	}
+	db, ok := src.(*database.Db)
+	if !ok {
+		if coll, ok := src.([]tuple); ok {
+			plan.cost = len(coll)
+		}
+		return plan, nil
+	}
+
+	dbPattern, _, err := toDbPattern(clause.pattern)
+	if err != nil {
+		return plan, err
+	}
+	plan.cost = db.Estimate(dbPattern)
+
+	vars := []variable{}
+	seen := map[variable]bool{}
+	for _, val := range clause.pattern {
+		if v, ok := val.(variable); ok && !seen[v] && isBound(context, v) {
+			seen[v] = true
+			vars = append(vars, v)
+		}
+	}
+	if len(vars) == 0 {
+		return plan, nil
+	}
+
+	rows, ok := boundValues(context, vars, plan.cost)
+	if !ok {
+		return plan, nil
+	}
+
+	// every search costs at least a lookup in the index
+	cost := len(rows)
+	sample := rows
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	sampleCost := 0
+	for _, row := range sample {
+		p, ok := substitute(clause.pattern, vars, row)
+		if !ok {
+			continue
+		}
+		dbPattern, _, err := toDbPattern(p)
+		if err != nil {
+			continue
+		}
+		sampleCost += db.Estimate(dbPattern)
+	}
+	if len(sample) > 0 {
+		cost += sampleCost * len(rows) / len(sample)
+	}
+
+	if cost < plan.cost {
+		plan.vars = vars
+		plan.rows = rows
+		plan.cost = cost
+	}
+	return plan, nil
+}
+
+// boundValues returns the distinct combinations of the values of the
+// variables in the context, or false if there are more than limit of
+// them.
+func boundValues(context context, vars []variable, limit int) ([][]value, bool) {
+	rel, _ := inToRel(bindIgnore{}, nil)
+	count := 1
+	for _, r := range context.rels {
+		relVars := []variable{}
+		for _, v := range vars {
+			if _, ok := r.attrs[v]; ok {
+				relVars = append(relVars, v)
+			}
+		}
+		if len(relVars) == 0 {
+			continue
+		}
+
+		projected := projectRel(r, relVars)
+		count *= len(projected.tuples)
+		if count > limit {
+			return nil, false
+		}
+		rel = productRels(rel, projected)
+	}
+
+	rows := make([][]value, len(rel.tuples))
+	for i, t := range rel.tuples {
+		row := make([]value, len(vars))
+		for j, v := range vars {
+			row[j] = t.ValueAt(rel.attrs[v])
+		}
+		rows[i] = row
+	}
+	return rows, true
+}
+
+// substitute replaces the variables in the pattern with the values,
+// or returns false if a value can't be part of a pattern at its
+// position, in which case no datom matches.
+func substitute(p pattern, vars []variable, vals []value) (pattern, bool) {
+	newPattern := make(pattern, len(p))
+	for i, val := range p {
+		newPattern[i] = val
+
+		v, ok := val.(variable)
+		if !ok {
+			continue
+		}
+		for j, bound := range vars {
+			if v != bound {
+				continue
+			}
+
+			switch i {
+			case 0, 1, 3: // e, a, tx
+				if _, err := lookupFromValue(vals[j]); err != nil {
+					return nil, false
+				}
+			case 2: // v
+				if !isSearchValue(plainValue(vals[j])) {
+					return nil, false
+				}
+			case 4: // added
+				if _, ok := vals[j].(bool); !ok {
+					return nil, false
+				}
+			}
+			newPattern[i] = vals[j]
+		}
+	}
+	return newPattern, true
+}
+
+// isSearchValue returns true if the value can be searched for in the
+// value position of a pattern.
+func isSearchValue(val value) bool {
+	switch val := val.(type) {
+	case int, int64, float32, float64:
+		return true
+	case []interface{}:
+		for _, elem := range val {
+			if elem != nil && !isSearchValue(elem) {
+				return false
+			}
+		}
+		return true
+	default:
+		return isIndexValue(val)
+	}
+}
+
+// resolvePlan resolves the pattern as planned and joins the result with
+// the relations of the context.
+func resolvePlan(context context, plan patternPlan) (context, error) {
+	src, ok := context.sources[plan.clause.source]
+	if !ok {
+		return context, fmt.Errorf("no source %v for %v", plan.clause.source, plan.clause.pattern)
+	}
+
+	var rel relation
+	var err error
+	if plan.vars == nil {
+		rel, err = lookupPattern(src, plan.clause.pattern)
+	} else {
+		rel, err = lookupPatternSubstituted(src.(*database.Db), plan)
+	}
+	if err != nil {
+		return context, err
+	}
+
+	newContext := context
+	newContext.rels = collapseRels(context.rels, rel)
+	return newContext, nil
+}
+
+// lookupPatternSubstituted returns a relation containing the datoms
+// matching the pattern for each of the values of the bound variables.
+//
+// The relation contains all variables of the pattern, so it is joined
+// with the relations the values came from.
+func lookupPatternSubstituted(db *database.Db, plan patternPlan) (relation, error) {
+	attrs := make(map[variable]int, 0)
+	for i, val := range plan.clause.pattern {
+		if v, ok := val.(variable); ok {
+			attrs[v] = i
+		}
+	}
+
+	tuples := []tuple{}
+	for _, row := range plan.rows {
+		p, ok := substitute(plan.clause.pattern, plan.vars, row)
+		if !ok {
+			continue
+		}
+
+		rel, err := lookupPatternDb(db, p)
+		if err != nil {
+			return relation{}, err
+		}
+		tuples = append(tuples, rel.tuples...)
+	}
+	return relation{attrs: attrs, tuples: tuples}, nil
+}
+
+// isFilter returns true if the clause only removes tuples from the
+// relations of the context, i.e. if it is a predicate or a not clause
+// whose variables are bound.
+func isFilter(context context, clause clause) bool {
+	switch clause.(type) {
+	case predicate, notClause:
+	default:
+		return false
+	}
+
+	for _, v := range clauseVars(clause) {
+		if !isBound(context, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// nextClause returns the position of the clause to resolve next, and
+// the plan if it is a pattern.
+func nextClause(context context, clauses []clause) (int, *patternPlan, error) {
+	barrier := len(clauses)
+	for i, clause := range clauses {
+		if _, ok := clause.(patternClause); !ok {
+			barrier = i
+			break
+		}
+	}
+	if barrier == 0 || (barrier < len(clauses) && isFilter(context, clauses[barrier])) {
+		return barrier, nil, nil
+	}
+
+	next := -1
+	var nextPlan patternPlan
+	for i, clause := range clauses {
+		pc, ok := clause.(patternClause)
+		if !ok {
+			continue
+		}
+
+		plan, err := planPattern(context, pc)
+		if err != nil {
+			return -1, nil, err
+		}
+		if next == -1 || plan.cost < nextPlan.cost {
+			next = i
+			nextPlan = plan
+		}
+	}
+	return next, &nextPlan, nil
+}
@@ -0,0 +1,109 @@
+package query
+
+import (
+	"github.com/heyLu/edn"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+)
+
+func whereClauses(t *testing.T, queryEDN string) []clause {
+	form, err := edn.DecodeString(queryEDN)
+	tu.RequireNil(t, err)
+	q, err := parseQuery(form)
+	tu.RequireNil(t, err)
+	return q.where
+}
+
+func dbContext(db *database.Db) context {
+	return context{sources: map[variable]source{newVar("$"): db}}
+}
+
+func TestNextClause(t *testing.T) {
+	db := taggedNotesDb(t)
+	context := dbContext(db)
+
+	// the unique title is more selective than all tags
+	where := whereClauses(t, `[:find ?t :where [?n :note/tags ?t] [?n :note/title "a"]]`)
+	i, plan, err := nextClause(context, where)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, i, 1)
+	tu.RequireNotNil(t, plan)
+	tu.ExpectEqual(t, plan.cost, 1)
+	tu.ExpectNil(t, plan.vars)
+
+	// ?n is substituted once it is bound
+	context, err = resolvePlan(context, *plan)
+	tu.RequireNil(t, err)
+	i, plan, err = nextClause(context, where[:1])
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, i, 0)
+	tu.ExpectEqual(t, plan.vars, []variable{newVar("?n")})
+	tu.ExpectEqual(t, len(plan.rows), 1)
+
+	context, err = resolvePlan(context, *plan)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(collect(context, []variable{newVar("?t")})), 2)
+
+	// other clauses are resolved after the patterns before them
+	where = whereClauses(t, `[:find ?n :where [?n :note/tags ?t] [(ground 1) ?x] [?n :note/title "a"]]`)
+	i, plan, err = nextClause(dbContext(db), where)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, i, 2)
+	i, plan, err = nextClause(dbContext(db), where[1:])
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, i, 0)
+	tu.ExpectNil(t, plan)
+
+	// ... unless they are filters
+	where = whereClauses(t, `[:find ?n :where [?n :note/title ?title] [?n :note/tags ?t] [(= ?title "a")]]`)
+	context, err = resolveClause(dbContext(db), where[0])
+	tu.RequireNil(t, err)
+	i, plan, err = nextClause(context, where[1:])
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, i, 1)
+	tu.ExpectNil(t, plan)
+}
+
+func TestPlanPattern(t *testing.T) {
+	db := taggedNotesDb(t)
+	context := dbContext(db)
+	where := whereClauses(t, `[:find ?n :where [?n :note/title ?title] [?n :note/tags ?t]]`)
+
+	plan, err := planPattern(context, where[1].(patternClause))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, plan.cost, 4)
+
+	// with all notes bound, scanning the tags is cheaper
+	context, err = resolveClause(context, where[0])
+	tu.RequireNil(t, err)
+	plan, err = planPattern(context, where[1].(patternClause))
+	tu.RequireNil(t, err)
+	tu.ExpectNil(t, plan.vars)
+
+	// collections are scanned
+	coll := []tuple{sliceTuple{"a", 1}, sliceTuple{"b", 2}}
+	collContext := dbContext(db)
+	collContext.sources[newVar("$")] = coll
+	plan, err = planPattern(collContext, patternClause{source: newVar("$"), pattern: pattern{newVar("?n"), 1}})
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, plan.cost, 2)
+	tu.ExpectNil(t, plan.vars)
+}
+
+func TestQSubstitution(t *testing.T) {
+	db := taggedNotesDb(t)
+
+	res := mustQ(t, `[:find ?tag :where [?n :note/tags ?t] [?t :tag/name ?tag] [?n :note/title "a"]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"db"}, []value{"go"}))
+
+	res = mustQ(t, `[:find ?title :in $ [?tag ...] :where [?t :tag/name ?tag] [?n :note/tags ?t] [?n :note/title ?title]]`, db, []string{"go", "clojure"})
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"b"}, []value{"c"}))
+
+	// values that can't be searched for match nothing
+	res = mustQ(t, `[:find ?n :in $ ?n :where [?n :note/title _]]`, db, "a")
+	tu.ExpectEqual(t, len(res), 0)
+	res = mustQ(t, `[:find ?n :in $ ?added :where [?n :note/title _ _ ?added]]`, db, "yes")
+	tu.ExpectEqual(t, len(res), 0)
+}
@@ -86,6 +86,7 @@ import (
 
 	"github.com/heyLu/mu/database"
 	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/pull"
 )
 
 // indexed is an interface for values that support access to fields by
@@ -132,13 +133,19 @@ type relation struct {
 type context struct {
 	sources map[variable]source
 	rels    []relation
+
+	// the rules passed as %, and their evaluation state by source
+	rules     map[edn.Symbol][]rule
+	ruleEvals map[variable]*rulesEval
+	// set while resolving the body of a rule
+	body *bodyEval
 }
 
 // a source contains the data that will be queried.
 type source interface{}
 
 // a clause selects data from a source.
-type clause interface{} // predicate, fn w/ binding, pattern, rule invocation
+type clause interface{} // predicate, fn w/ binding, pattern, rule invocation, not, or
 
 // a patternClause is a clause that selects tuples that
 // match the pattern from a source.
@@ -284,7 +291,7 @@ func (id indexedDatom) ValueAt(idx int) value {
 	case 1:
 		return d.Attribute()
 	case 2:
-		return d.Value().Val()
+		return hashableValue(d.Value().Val())
 	case 3:
 		return d.Transaction()
 	case 4:
@@ -298,14 +305,49 @@ var placeHolder = edn.Symbol{Namespace: "", Name: "_"}
 
 // isPlaceHolder chesk if the value is the symbol _.
 func isPlaceHolder(val interface{}) bool {
-	val, ok := val.(edn.Symbol)
-	return ok && val == placeHolder
+	switch val := val.(type) {
+	case placeholder:
+		return true
+	case edn.Symbol:
+		return val == placeHolder
+	default:
+		return false
+	}
+}
 
+// lookupFromValue converts a constant in the entity, attribute or
+// transaction position of a pattern to a lookup.
+func lookupFromValue(val interface{}) (database.HasLookup, error) {
+	switch val := val.(type) {
+	case int:
+		return database.Id(val), nil
+	case fressian.Keyword:
+		return database.Keyword{val}, nil
+	default:
+		return nil, fmt.Errorf("can't convert %v to an entity id", val)
+	}
 }
 
 // lookupPatternDb returns a relation containing the datoms from the db
 // that match the pattern.
-func lookupPatternDb(db *database.Db, pattern pattern) relation {
+func lookupPatternDb(db *database.Db, pattern pattern) (relation, error) {
+	dbPattern, attrs, err := toDbPattern(pattern)
+	if err != nil {
+		return relation{}, err
+	}
+
+	datoms := make([]tuple, 0)
+	iter := db.Search(dbPattern)
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		datoms = append(datoms, indexedDatom(*datom))
+	}
+
+	return relation{attrs: attrs, tuples: datoms}, nil
+}
+
+// toDbPattern converts the constants of the pattern to a pattern for
+// database.Search, and returns the positions of the variables.
+func toDbPattern(pattern pattern) (database.Pattern, map[variable]int, error) {
 	dbPattern := database.Pattern{}
 	attrs := make(map[variable]int, 0)
 	for i, val := range pattern {
@@ -320,14 +362,9 @@ func lookupPatternDb(db *database.Db, pattern pattern) relation {
 
 		switch i {
 		case 0, 1, 3: // e, a, tx (lookups)
-			var lookup database.HasLookup
-			switch val := val.(type) {
-			case int:
-				lookup = database.Id(val)
-			case edn.Keyword:
-				lookup = database.Keyword{fressian.Keyword{Namespace: val.Namespace, Name: val.Name}}
-			default:
-				panic(fmt.Sprintf("can't convert %#v to database.HasLookup", val))
+			lookup, err := lookupFromValue(val)
+			if err != nil {
+				return dbPattern, nil, err
 			}
 
 			if i == 0 {
@@ -338,20 +375,16 @@ func lookupPatternDb(db *database.Db, pattern pattern) relation {
 				dbPattern.Tx = lookup
 			}
 		case 2: // v
-			dbPattern.V = val
+			dbPattern.V = plainValue(val)
 		case 4: // added
-			v := val.(bool)
+			v, ok := val.(bool)
+			if !ok {
+				return dbPattern, nil, fmt.Errorf("added must be a boolean, but was %v", val)
+			}
 			dbPattern.Added = &v
 		}
 	}
-
-	datoms := make([]tuple, 0)
-	iter := db.Search(dbPattern)
-	for datom := iter.Next(); datom != nil; datom = iter.Next() {
-		datoms = append(datoms, indexedDatom(*datom))
-	}
-
-	return relation{attrs: attrs, tuples: datoms}
+	return dbPattern, attrs, nil
 }
 
 // matchesPattern checks if the given tuple matches the pattern.
@@ -363,7 +396,7 @@ func matchesPattern(pattern pattern, tuple tuple) bool {
 	for i < len(pattern) && i < tuple.Length() {
 		p := pattern[i]
 		t := tuple.ValueAt(i)
-		if _, isVar := p.(variable); !isVar && !hashEqual(p, t) {
+		if _, isVar := p.(variable); !isVar && !isPlaceHolder(p) && !hashEqual(p, t) {
 			return false
 		}
 		i += 1
@@ -393,14 +426,14 @@ func lookupPatternColl(coll []tuple, pattern pattern) relation {
 
 // lookupPattern returns a relation containing the tuples matching the
 // pattern from the source.
-func lookupPattern(source source, pattern pattern) relation {
+func lookupPattern(source source, pattern pattern) (relation, error) {
 	switch source := source.(type) {
 	case *database.Db:
 		return lookupPatternDb(source, pattern)
 	case []tuple:
-		return lookupPatternColl(source, pattern)
+		return lookupPatternColl(source, pattern), nil
 	default:
-		panic("invalid source")
+		return relation{}, fmt.Errorf("invalid source %v", source)
 	}
 }
 
@@ -427,27 +460,50 @@ func collapseRels(rels []relation, newRel relation) []relation {
 
 // resolveClause returns a new context with relations filtered
 // according to the given clause.
-func resolveClause(context context, clause clause) context {
+func resolveClause(context context, clause clause) (context, error) {
 	switch clause := clause.(type) {
 	case patternClause:
-		source := context.sources[clause.source]
-		relation := lookupPattern(source, clause.pattern)
-		newRels := collapseRels(context.rels, relation)
-
-		newContext := context
-		newContext.rels = newRels
-		return newContext
+		plan, err := planPattern(context, clause)
+		if err != nil {
+			return context, err
+		}
+		return resolvePlan(context, plan)
+	case ruleExpr:
+		return resolveRule(context, clause)
+	case predicate:
+		return resolvePredicate(context, clause)
+	case function:
+		return resolveFunction(context, clause)
+	case notClause:
+		return resolveNot(context, clause)
+	case orClause:
+		return resolveOr(context, clause)
 	default:
-		panic("invalid clause type")
+		return context, fmt.Errorf("invalid clause type %T", clause)
 	}
 }
 
-// runQuery resolves the clauses sequentially.
-func runQuery(context context, clauses []clause) context {
-	for _, clause := range clauses {
-		context = resolveClause(context, clause)
+// runQuery resolves the clauses, starting with the cheapest patterns,
+// see plan.go.
+func runQuery(context context, clauses []clause) (context, error) {
+	remaining := append([]clause{}, clauses...)
+	for len(remaining) > 0 {
+		i, plan, err := nextClause(context, remaining)
+		if err != nil {
+			return context, err
+		}
+
+		if plan != nil {
+			context, err = resolvePlan(context, *plan)
+		} else {
+			context, err = resolveClause(context, remaining[i])
+		}
+		if err != nil {
+			return context, err
+		}
+		remaining = append(remaining[:i], remaining[i+1:]...)
 	}
-	return context
+	return context, nil
 }
 
 // cloneSlice returns a new slice with the values from the original.
@@ -461,6 +517,11 @@ func cloneSlice(vals []value) []value {
 func internalCollect(context context, symbols []variable) [][]value {
 	acc := [][]value{make([]value, len(symbols))}
 	for _, rel := range context.rels {
+		// a relation without tuples means that nothing matched
+		if len(rel.tuples) == 0 {
+			return [][]value{}
+		}
+
 		keepAttrs := make(map[variable]int, 0)
 		keepIdxs := make([]int, len(symbols))
 		for i, symbol := range symbols {
@@ -520,111 +581,211 @@ func newVar(namespace string, name ...string) variable {
 	}
 }
 
-// toQueryMap parses a list of keywords and values into a query map.
-func toQueryMap(queryList []interface{}) map[interface{}]interface{} {
-	key := edn.Keyword{}
-	vals := make([]interface{}, 0)
-	queryMap := make(map[interface{}]interface{}, 0)
-	for _, val := range queryList {
-		if kw, ok := val.(edn.Keyword); ok {
-			if len(vals) != 0 {
-				queryMap[key] = vals
-			}
-			vals = make([]interface{}, 0)
-			key = kw
-		}
+// Q parses the query and runs it given the inputs.
+//
+// The inputs are bound to the names in :in, which defaults to [$].
+// Names starting with $ are sources, which can be databases
+// (*database.Db) or collections of tuples, e.g. [][]interface{}.
+// Other inputs are bound as scalars (?x), tuples ([?x ?y]),
+// collections ([?x ...]) or relations ([[?x ?y]]).  Rules are passed
+// as %, either as EDN data or as a string.
+//
+// Predicates ([(< ?x 3)]) and functions ([(str ?x "!") ?y]) can be
+// built-in functions, functions registered with RegisterFunction or
+// variables bound to a Function.
+//
+// Clauses can be negated with (not ...) and (not-join [?x] ...), and
+// combined with (or ...), (or-join [?x] ...) and (and ...) inside or.
+// The variables of not and the required variables of or-join must be
+// bound by the preceding clauses.
+//
+// Patterns are resolved in the order of their estimated cost instead
+// of the order they are written in, see runQuery.
+//
+// Find elements can be variables or pull expressions of the form
+// (pull ?e pattern), see the pull package.  The results of pull
+// expressions are *Document values.  The pattern is either given
+// literally, e.g. (pull ?e [:note/title]), or bound in :in by its name,
+// e.g. [:find (pull ?e pattern) :in $ pattern], and passed as EDN data,
+// a string or a *pull.Pattern.
+//
+// Aggregates like (count ?x) or (min 3 ?x) aggregate the values of the
+// variable, grouped by the other find elements.  The values are taken
+// from the set of results, use :with to keep duplicates.  Aggregates
+// returning multiple values return *Collection values.  Custom
+// aggregates can be registered with RegisterAggregate, or passed as
+// inputs and called as (aggregate ?fn ?x).
+//
+// The find spec determines the shape of the result: [:find ?a ?b]
+// returns a set of rows, [:find [?a ...]] a collection, [:find [?a ?b]]
+// a single tuple and [:find ?a .] a single value.  With :keys, :strs
+// or :syms the rows can be returned as maps, see Result.
+func Q(query interface{}, inputs ...interface{}) (*Result, error) {
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, err
 	}
-	return queryMap
-}
 
-// isSource returns true if the value is a symbol beginning with "$"
-func isSource(val interface{}) bool {
-	if sym, ok := val.(edn.Symbol); ok && sym.Name[0] == '$' {
-		return true
+	if len(inputs) != len(q.in) {
+		return nil, fmt.Errorf("query expects %d inputs, but got %d", len(q.in), len(inputs))
 	}
-	return false
-}
 
-// isVariable returns true if the value is a symbol beginning with "?".
-func isVariable(val interface{}) bool {
-	if sym, ok := val.(edn.Symbol); ok && sym.Name[0] == '?' {
-		return true
+	// the names of the patterns of pull expressions that are inputs,
+	// these may be plain symbols or variables
+	patterns := map[edn.Symbol]*pull.Pattern{}
+	for _, elem := range q.find {
+		if expr, ok := elem.(pullExpr); ok && expr.pattern == nil {
+			patterns[expr.patternName] = nil
+		}
 	}
-	return false
-}
 
-// parseQuery parses a query from untyped data.
-func parseQuery(rawQuery interface{}) (*query, error) {
-	var queryMap map[interface{}]interface{}
-	if queryList, ok := rawQuery.([]interface{}); ok {
-		queryMap = toQueryMap(queryList)
-	} else {
-		queryMap = rawQuery.(map[interface{}]interface{})
-	}
+	context := context{sources: map[variable]source{}}
+	for i, in := range q.in {
+		if scalar, ok := in.(bindScalar); ok {
+			if _, isPattern := patterns[edn.Symbol(scalar.variable)]; isPattern {
+				in = patternVar{name: edn.Symbol(scalar.variable)}
+			}
+		}
 
-	rawFindVars := queryMap[edn.Keyword{Namespace: "", Name: "find"}].([]interface{})
-	findVars := make([]variable, len(rawFindVars))
-	for i, findVar := range rawFindVars {
-		findVars[i] = variable(findVar.(edn.Symbol))
+		switch in := in.(type) {
+		case srcVar:
+			src, err := toSource(inputs[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid input for %v: %w", in.name, err)
+			}
+			context.sources[variable(in.name)] = src
+		case rulesVar:
+			rules, err := parseRules(inputs[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rules: %w", err)
+			}
+			context.rules = rules
+			context.ruleEvals = map[variable]*rulesEval{}
+		case patternVar:
+			if _, ok := patterns[in.name]; !ok {
+				return nil, fmt.Errorf("input %v is not used as a pull pattern", in.name)
+			}
+			pattern, err := toPattern(inputs[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid pull pattern for %v: %w", in.name, err)
+			}
+			patterns[in.name] = pattern
+		case binding:
+			rel, err := inToRel(in, inputs[i])
+			if err != nil {
+				return nil, err
+			}
+			context.rels = collapseRels(context.rels, rel)
+		}
 	}
 
-	rawClauses := queryMap[edn.Keyword{Namespace: "", Name: "where"}].([]interface{})
-	clauses := make([]clause, len(rawClauses))
-	for i, rawClause := range rawClauses {
-		rawClause := rawClause.([]interface{})
-		clause := patternClause{}
-		var rawPattern []interface{}
-		if isSource(rawClause[0]) {
-			clause.source = variable(rawClause[0].(edn.Symbol))
-			rawPattern = rawClause[1:]
-		} else {
-			clause.source = variable(edn.Symbol{Namespace: "", Name: "$"})
-			rawPattern = rawClause
+	for name, pattern := range patterns {
+		if pattern == nil {
+			return nil, fmt.Errorf("pull pattern %v is not bound in :in", name)
 		}
-		pattern := make(pattern, len(rawPattern))
-		clause.pattern = pattern
+	}
 
-		for i, rawValue := range rawPattern {
-			if isVariable(rawValue) {
-				pattern[i] = variable(rawValue.(edn.Symbol))
-			} else {
-				pattern[i] = rawValue
-			}
+	vars := make([]variable, len(q.find))
+	hasAggregates := false
+	for i, elem := range q.find {
+		vars[i] = variable(elem.findVars()[0])
+		if _, ok := elem.(aggregate); ok {
+			hasAggregates = true
 		}
+	}
 
-		clauses[i] = clause
+	context, err = runQuery(context, q.where)
+	if err != nil {
+		return nil, err
+	}
+
+	var res map[Indexed]bool
+	if hasAggregates {
+		res, err = aggregateResults(context, q.find, q.with)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		res = collect(context, vars)
 	}
+	res, err = pullResults(context, q.find, patterns, res)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(q, res), nil
+}
 
-	return &query{
-		find:  findVars,
-		in:    []variable{variable(edn.Symbol{Namespace: "", Name: "$"})},
-		where: clauses,
-	}, nil
+// A Document is the result of a pull expression in the results of a
+// query.
+//
+// Results are sets of tuples, which can't contain maps, so documents
+// are returned as pointers.
+type Document struct {
+	Id    int
+	Attrs map[database.Keyword]interface{}
 }
 
-type query struct {
-	find  []variable
-	in    []variable
-	where []clause
+func (d *Document) String() string {
+	return fmt.Sprint(d.Attrs)
 }
 
-// Q parses the query and runs it given the inputs.
-//
-// Inputs can be collections of type []interface{} or databases
-// (*database.Db).
-func Q(query interface{}, inputs ...interface{}) (map[Indexed]bool, error) {
-	q, err := parseQuery(query)
-	if err != nil {
-		return nil, err
+// toPattern converts a pull pattern passed as an input.
+func toPattern(input interface{}) (*pull.Pattern, error) {
+	switch input := input.(type) {
+	case *pull.Pattern:
+		return input, nil
+	case string:
+		return pull.PatternFromEDN(input)
+	default:
+		return pull.ParsePattern(input)
 	}
+}
 
-	sources := make(map[variable]source, 0)
-	for i, in := range q.in {
-		sources[in] = source(inputs[i])
+// pullResults replaces the entity ids in the results with documents
+// for the pull expressions in find, using the patterns bound in :in
+// for the ones that are not given literally.
+func pullResults(context context, find []findVars, patterns map[edn.Symbol]*pull.Pattern, res map[Indexed]bool) (map[Indexed]bool, error) {
+	hasPull := false
+	for _, elem := range find {
+		if _, ok := elem.(pullExpr); ok {
+			hasPull = true
+		}
+	}
+	if !hasPull {
+		return res, nil
 	}
 
-	context := context{sources: sources}
-	context = runQuery(context, q.where)
-	res := collect(context, q.find)
-	return res, nil
+	pulled := make(map[Indexed]bool, len(res))
+	for key := range res {
+		vals := make([]value, key.Length())
+		for i, elem := range find {
+			vals[i] = key.ValueAt(i)
+
+			expr, ok := elem.(pullExpr)
+			if !ok {
+				continue
+			}
+
+			db, ok := context.sources[variable(expr.source.name)].(*database.Db)
+			if !ok {
+				return nil, fmt.Errorf("source %v of %v must be a database", expr.source.name, expr.variable)
+			}
+			id, ok := vals[i].(int)
+			if !ok {
+				return nil, fmt.Errorf("cannot pull %v, %v is not an entity id", expr.variable, vals[i])
+			}
+
+			pattern := expr.pattern
+			if pattern == nil {
+				pattern = patterns[expr.patternName]
+			}
+			attrs, err := pull.Pull(db, pattern, database.Id(id))
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = &Document{Id: id, Attrs: attrs}
+		}
+		pulled[newHashKey(vals)] = true
+	}
+	return pulled, nil
 }
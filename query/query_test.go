@@ -2,10 +2,15 @@ package query
 
 import (
 	"fmt"
+	"github.com/heyLu/edn"
+	"github.com/heyLu/fressian"
 	tu "github.com/klingtnet/gol/util/testing"
 	"testing"
 
-	"github.com/heyLu/edn"
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+	"github.com/heyLu/mu/transactor"
 )
 
 func TestExamples(t *testing.T) {
@@ -97,7 +102,8 @@ func TestExamples(t *testing.T) {
 			pattern: pattern{newVar("name"), "pancakes"},
 		},
 	}
-	newCtx := runQuery(ctx, clauses)
+	newCtx, err := runQuery(ctx, clauses)
+	tu.RequireNil(t, err)
 	vars := []variable{newVar("name")}
 	fmt.Println(vars)
 	res := collect(newCtx, vars)
@@ -129,7 +135,8 @@ func TestExamples(t *testing.T) {
 			pattern: pattern{newVar("friend"), newVar("age")},
 		},
 	}
-	newCtx = runQuery(ctx, clauses)
+	newCtx, err = runQuery(ctx, clauses)
+	tu.RequireNil(t, err)
 	vars = []variable{newVar("age"), newVar("friend")}
 	fmt.Println(vars)
 	res = collect(newCtx, vars)
@@ -160,7 +167,769 @@ func TestQ(t *testing.T) {
 	res, err := Q(query, data)
 	tu.ExpectNil(t, err)
 
-	for res, _ := range res {
-		fmt.Println(res)
+	for _, row := range res.Rows() {
+		fmt.Println(row)
+	}
+}
+
+func notesDb(t *testing.T) *database.Db {
+	txData, err := transactor.TxDataFromEDN(testutil.Schema(testutil.Notes...))
+	tu.RequireNil(t, err)
+	_, txResult, err := transactor.Transact(transactor.InitialDb, txData)
+	tu.RequireNil(t, err)
+	txData, err = transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user] :note/title "first" :note/content "hello"}
+ {:db/id #db/id[:db.part/user] :note/title "second" :note/content "world"}]`)
+	tu.RequireNil(t, err)
+	_, txResult, err = transactor.Transact(txResult.DbAfter, txData)
+	tu.RequireNil(t, err)
+	return txResult.DbAfter
+}
+
+func TestQPull(t *testing.T) {
+	db := notesDb(t)
+
+	query, err := edn.DecodeString(`{:find [?title (pull ?e [:note/content])] :where [[?e :note/title ?title]]}`)
+	tu.RequireNil(t, err)
+	res, err := Q(query, db)
+	tu.RequireNil(t, err)
+	tu.RequireEqual(t, res.Len(), 2)
+
+	content := database.Keyword{fressian.Keyword{Namespace: "note", Name: "content"}}
+	contents := map[interface{}]interface{}{}
+	for _, row := range res.Rows() {
+		doc := row[1].(*Document)
+		tu.ExpectEqual(t, db.Entity(doc.Id).Get(database.Keyword{fressian.Keyword{Namespace: "note", Name: "title"}}), row[0])
+		contents[row[0]] = doc.Attrs[content]
+	}
+	tu.ExpectEqual(t, contents, map[interface{}]interface{}{"first": "hello", "second": "world"})
+
+	for _, invalid := range []string{
+		`{:find [(pull ?e)] :where [[?e :note/title]]}`,
+		`{:find [(pull ?e [foo])] :where [[?e :note/title]]}`,
+		`{:find [(pull $ "e" [*])] :where [[?e :note/title]]}`,
+	} {
+		query, err := edn.DecodeString(invalid)
+		tu.RequireNil(t, err)
+		_, err = Q(query, db)
+		tu.ExpectNotNil(t, err)
+	}
+
+	// only databases can be pulled from
+	query, err = edn.DecodeString(`{:find [(pull ?e [*])] :where [[?e "Jane"]]}`)
+	tu.RequireNil(t, err)
+	_, err = Q(query, []tuple{sliceTuple{1, "Jane"}})
+	tu.ExpectNotNil(t, err)
+}
+
+func TestQPullPatternInput(t *testing.T) {
+	db := notesDb(t)
+	content := database.Keyword{fressian.Keyword{Namespace: "note", Name: "content"}}
+
+	patternData, err := edn.DecodeString(`[:note/content]`)
+	tu.RequireNil(t, err)
+	for _, tc := range []struct {
+		query   string
+		pattern interface{}
+	}{
+		{`{:find [(pull ?e pattern) .] :in [$ pattern] :where [[?e :note/title "first"]]}`, patternData},
+		{`{:find [(pull ?e ?pattern) .] :in [$ ?pattern] :where [[?e :note/title "first"]]}`, `[:note/content]`},
+		{`{:find [(pull $db ?e pattern) .] :in [$db pattern] :where [[$db ?e :note/title "first"]]}`, `[:note/content]`},
+	} {
+		query, err := edn.DecodeString(tc.query)
+		tu.RequireNil(t, err)
+		res, err := Q(query, db, tc.pattern)
+		tu.RequireNil(t, err)
+		doc := res.Scalar().(*Document)
+		tu.ExpectEqual(t, doc.Attrs[content], "hello")
+	}
+
+	for _, invalid := range []struct {
+		query string
+		input interface{}
+	}{
+		// not bound in :in
+		{`{:find [(pull ?e pattern)] :where [[?e :note/title]]}`, nil},
+		// not a pattern
+		{`{:find [(pull ?e pattern)] :in [$ pattern] :where [[?e :note/title]]}`, 42},
+		// not used as a pattern
+		{`{:find [?e] :in [$ pattern] :where [[?e :note/title]]}`, `[*]`},
+	} {
+		query, err := edn.DecodeString(invalid.query)
+		tu.RequireNil(t, err)
+		inputs := []interface{}{db}
+		if invalid.input != nil {
+			inputs = append(inputs, invalid.input)
+		}
+		_, err = Q(query, inputs...)
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func mustQ(t *testing.T, queryEDN string, inputs ...interface{}) map[Indexed]bool {
+	query, err := edn.DecodeString(queryEDN)
+	tu.RequireNil(t, err)
+	res, err := Q(query, inputs...)
+	tu.RequireNil(t, err)
+
+	set := make(map[Indexed]bool, res.Len())
+	for _, row := range res.Rows() {
+		vals := make([]value, len(row))
+		for i, val := range row {
+			vals[i] = hashableValue(val)
+		}
+		set[newHashKey(vals)] = true
+	}
+	return set
+}
+
+func TestQInputs(t *testing.T) {
+	db := notesDb(t)
+	first := newHashKey([]value{"hello"})
+	second := newHashKey([]value{"world"})
+
+	res := mustQ(t, `{:find [?content] :in [$ ?title] :where [[?e :note/title ?title] [?e :note/content ?content]]}`, db, "first")
+	tu.ExpectEqual(t, res, map[Indexed]bool{first: true})
+
+	// the list form works as well
+	res = mustQ(t, `[:find ?content :in $ [?title ...] :where [?e :note/title ?title] [?e :note/content ?content]]`, db, []string{"first", "second"})
+	tu.ExpectEqual(t, res, map[Indexed]bool{first: true, second: true})
+
+	res = mustQ(t, `{:find [?content] :in [$ [?title _]] :where [[?e :note/title ?title] [?e :note/content ?content]]}`, db, []interface{}{"second", "ignored"})
+	tu.ExpectEqual(t, res, map[Indexed]bool{second: true})
+
+	res = mustQ(t, `{:find [?title ?rating] :in [$ [[?title ?rating]]] :where [[?e :note/title ?title]]}`, db, [][]interface{}{{"first", 3}, {"other", 5}})
+	tu.ExpectEqual(t, res, map[Indexed]bool{newHashKey([]value{"first", 3}): true})
+
+	// empty collections match nothing
+	res = mustQ(t, `{:find [?e] :in [$ [?title ...]] :where [[?e :note/title ?title]]}`, db, []string{})
+	tu.ExpectEqual(t, len(res), 0)
+
+	// multiple sources
+	ratings := [][]interface{}{{"first", 3}, {"second", 5}}
+	res = mustQ(t, `{:find [?content] :in [$ $ratings ?min] :where [[?e :note/title ?title] [$ratings ?title ?min] [?e :note/content ?content]]}`, db, ratings, 5)
+	tu.ExpectEqual(t, res, map[Indexed]bool{second: true})
+
+	// no source needed
+	res = mustQ(t, `{:find [?a ?b] :in [?a [?b ...]]}`, 1, []int{2, 3})
+	tu.ExpectEqual(t, res, map[Indexed]bool{newHashKey([]value{1, 2}): true, newHashKey([]value{1, 3}): true})
+}
+
+func TestQErrors(t *testing.T) {
+	db := notesDb(t)
+
+	for _, invalid := range []struct {
+		query  string
+		inputs []interface{}
+	}{
+		{`"query"`, []interface{}{db}},
+		{`{:where [[?e :note/title]]}`, []interface{}{db}},
+		{`{:find [] :where [[?e :note/title]]}`, []interface{}{db}},
+		{`{:find ?e :where [[?e :note/title]]}`, []interface{}{db}},
+		{`{:find [?e] :where [[?e :note/title]] :order [?e]}`, []interface{}{db}},
+		{`[?e :find ?e]`, []interface{}{db}},
+		{`{:find [?x] :where [[?e :note/title]]}`, []interface{}{db}},
+		{`{:find [?e] :where [?e :note/title]}`, []interface{}{db}},
+		{`{:find [?e] :where [[]]}`, []interface{}{db}},
+		{`{:find [?e] :where [[?e :note/title "a" 1 true 2]]}`, []interface{}{db}},
+		{`{:find [?e] :where [["e" :note/title]]}`, []interface{}{db}},
+		{`{:find [?e] :where [[$other ?e :note/title]]}`, []interface{}{db}},
+		{`{:find [?e] :in [$ ?x ?x...] :where [[?e :note/title ?x]]}`, []interface{}{db, 1}},
+		{`{:find [?e] :in [$ [?x]] :where [[?e :note/title ?x]]}`, []interface{}{db, 1}},
+		{`{:find [?e] :in [$ [?x ...]] :where [[?e :note/title ?x]]}`, []interface{}{db, "x"}},
+		{`{:find [?e] :where [[?e :note/title]]}`, []interface{}{}},
+		{`{:find [?e] :where [[?e :note/title]]}`, []interface{}{"db"}},
+	} {
+		query, err := edn.DecodeString(invalid.query)
+		tu.RequireNil(t, err)
+		_, err = Q(query, invalid.inputs...)
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func TestQRules(t *testing.T) {
+	links := [][]interface{}{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"d", "e"}, {"e", "f"}}
+	keys := func(vals ...value) map[Indexed]bool {
+		m := map[Indexed]bool{}
+		for _, val := range vals {
+			m[newHashKey([]value{val})] = true
+		}
+		return m
+	}
+
+	for _, rules := range []string{
+		// right-recursive
+		`[[(linked ?a ?b) [?a ?b]]
+		  [(linked ?a ?b) [?a ?x] (linked ?x ?b)]]`,
+		// left-recursive
+		`[[(linked ?a ?b) [?a ?b]]
+		  [(linked ?a ?b) (linked ?a ?x) [?x ?b]]]`,
+		// non-linear
+		`[[(linked ?a ?b) [?a ?b]]
+		  [(linked ?a ?b) (linked ?a ?x) (linked ?x ?b)]]`,
+		// required variables
+		`[[(linked [?a] ?b) [?a ?b]]
+		  [(linked [?a] ?b) [?a ?x] (linked ?x ?b)]]`,
+	} {
+		res := mustQ(t, `{:find [?b] :in [$ % ?a] :where [(linked ?a ?b)]}`, links, rules, "a")
+		tu.ExpectEqual(t, res, keys("a", "b", "c"))
+
+		res = mustQ(t, `{:find [?b] :in [$ %] :where [(linked "d" ?b)]}`, links, rules)
+		tu.ExpectEqual(t, res, keys("e", "f"))
+	}
+
+	// multiple bodies are alternatives
+	res := mustQ(t, `{:find [?a] :in [$ %] :where [(start ?a)]}`, links, `[[(start ?a) [?a "b"]] [(start ?a) [?a "e"]]]`)
+	tu.ExpectEqual(t, res, keys("a", "d"))
+
+	// rules can call other rules
+	res = mustQ(t, `{:find [?a] :in [$ %] :where [(twice ?a "c")]}`, links, `[[(link ?a ?b) [?a ?b]] [(twice ?a ?c) (link ?a ?b) (link ?b ?c)]]`)
+	tu.ExpectEqual(t, res, keys("a"))
+
+	for _, invalid := range []struct {
+		query string
+		rules interface{}
+	}{
+		// required variables must be bound
+		{`{:find [?a ?b] :in [$ %] :where [(linked ?a ?b)]}`, `[[(linked [?a] ?b) [?a ?b]]]`},
+		{`{:find [?b] :in [$ %] :where [(linked _ ?b)]}`, `[[(linked [?a] ?b) [?a ?b]]]`},
+		{`{:find [?b] :in [$ %] :where [(unknown "a" ?b)]}`, `[[(linked ?a ?b) [?a ?b]]]`},
+		{`{:find [?b] :in [$ %] :where [(linked "a" ?b ?c)]}`, `[[(linked ?a ?b) [?a ?b]]]`},
+		{`{:find [?b] :in [$ %] :where [(linked "a" ?b)]}`, `[[(linked ?a ?b) [?a ?x]]]`},
+		{`{:find [?b] :in [$ %] :where [(linked "a" ?b)]}`, `[[(linked ?a ?b) [?a ?b]] [(linked ?a) [?a]]]`},
+		{`{:find [?b] :in [$ %] :where [(linked "a" ?b)]}`, `[(linked ?a ?b) [?a ?b]]`},
+		{`{:find [?b] :in [$ %] :where [(linked "a" ?b)]}`, 42},
+	} {
+		query, err := edn.DecodeString(invalid.query)
+		tu.RequireNil(t, err)
+		_, err = Q(query, links, invalid.rules)
+		tu.ExpectNotNil(t, err)
+	}
+
+	// rules must be given
+	query, err := edn.DecodeString(`{:find [?b] :where [(linked "a" ?b)]}`)
+	tu.RequireNil(t, err)
+	_, err = Q(query, links)
+	tu.ExpectNotNil(t, err)
+}
+
+func TestQRulesDb(t *testing.T) {
+	txData, err := transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/db]
+  :db/ident :note/title
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}
+ {:db/id #db/id[:db.part/db]
+  :db/ident :note/links
+  :db/valueType :db.type/ref
+  :db/cardinality :db.cardinality/many}]`)
+	tu.RequireNil(t, err)
+	_, txResult, err := transactor.Transact(transactor.InitialDb, txData)
+	tu.RequireNil(t, err)
+	txData, err = transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user -1] :note/title "index"}
+ {:db/id #db/id[:db.part/user -2] :note/title "go"}
+ {:db/id #db/id[:db.part/user -3] :note/title "datomic"}
+ {:db/id #db/id[:db.part/user -4] :note/title "unrelated"}
+ [:db/add #db/id[:db.part/user -1] :note/links #db/id[:db.part/user -2]]
+ [:db/add #db/id[:db.part/user -2] :note/links #db/id[:db.part/user -3]]
+ [:db/add #db/id[:db.part/user -3] :note/links #db/id[:db.part/user -1]]]`)
+	tu.RequireNil(t, err)
+	_, txResult, err = transactor.Transact(txResult.DbAfter, txData)
+	tu.RequireNil(t, err)
+
+	res := mustQ(t, `[:find ?title
+ :in $ % ?start
+ :where [?from :note/title ?start]
+        (linked ?from ?to)
+        [?to :note/title ?title]]`, txResult.DbAfter, `[[(linked [?from] ?to) [?from :note/links ?to]]
+ [(linked [?from] ?to) [?from :note/links ?x] (linked ?x ?to)]]`, "go")
+	titles := map[interface{}]bool{}
+	for key := range res {
+		titles[key.ValueAt(0)] = true
+	}
+	tu.ExpectEqual(t, titles, map[interface{}]bool{"index": true, "go": true, "datomic": true})
+}
+
+func results(rows ...[]value) map[Indexed]bool {
+	m := map[Indexed]bool{}
+	for _, row := range rows {
+		vals := make([]value, len(row))
+		for i, val := range row {
+			vals[i] = hashableValue(val)
+		}
+		m[newHashKey(vals)] = true
+	}
+	return m
+}
+
+func TestQPredicates(t *testing.T) {
+	ratings := [][]interface{}{{"a", 1}, {"b", 3}, {"c", 5}, {"d", 2.5}}
+
+	res := mustQ(t, `[:find ?n :in $ :where [?n ?r] [(< ?r 3)]]`, ratings)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"d"}))
+
+	res = mustQ(t, `[:find ?n :in $ ?min :where [?n ?r] [(<= ?min ?r 3)]]`, ratings, 3)
+	tu.ExpectEqual(t, res, results([]value{"b"}))
+
+	res = mustQ(t, `[:find ?n :in $ :where [?n ?r] [(!= ?n "a")] [(not= ?r 5)]]`, ratings)
+	tu.ExpectEqual(t, res, results([]value{"b"}, []value{"d"}))
+
+	res = mustQ(t, `[:find ?n1 ?n2 :in $ :where [?n1 ?r1] [?n2 ?r2] [(= ?r1 ?r2)] [(> ?n1 "b")]]`, ratings)
+	tu.ExpectEqual(t, res, results([]value{"c", "c"}, []value{"d", "d"}))
+
+	// constant predicates
+	res = mustQ(t, `[:find ?n :in $ :where [?n _] [(< 1 0)]]`, ratings)
+	tu.ExpectEqual(t, len(res), 0)
+
+	res = mustQ(t, `[:find ?n :in $ :where [?n _] [(re-find "^[ab]" ?n)]]`, ratings)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"b"}))
+}
+
+func TestQFunctions(t *testing.T) {
+	db := notesDb(t)
+	ratings := [][]interface{}{{"a", 1}, {"b", 3}}
+
+	res := mustQ(t, `[:find ?n ?r2 :in $ :where [?n ?r] [(* ?r 2) ?r2]]`, ratings)
+	tu.ExpectEqual(t, res, results([]value{"a", 2}, []value{"b", 6}))
+
+	res = mustQ(t, `[:find ?s :in $ :where [?n ?r] [(inc ?r) ?r1] [(str ?n "=" ?r1) ?s]]`, ratings)
+	tu.ExpectEqual(t, res, results([]value{"a=2"}, []value{"b=4"}))
+
+	// bound variables in the binding must match
+	res = mustQ(t, `[:find ?n :in $ :where [?n ?r] [(- 4 ?r) ?r]]`, [][]interface{}{{"a", 1}, {"b", 2}})
+	tu.ExpectEqual(t, res, results([]value{"b"}))
+
+	// bindings
+	res = mustQ(t, `[:find ?x :where [(ground [1 2 3]) [?x ...]]]`, db)
+	tu.ExpectEqual(t, res, results([]value{1}, []value{2}, []value{3}))
+
+	res = mustQ(t, `[:find ?a ?b :where [(ground [[1 2] [3 4]]) [[?a ?b]]]]`, db)
+	tu.ExpectEqual(t, res, results([]value{1, 2}, []value{3, 4}))
+
+	res = mustQ(t, `[:find ?a ?b :where [(tuple 1 "x") ?t] [(untuple ?t) [?a ?b]]]`, db)
+	tu.ExpectEqual(t, res, results([]value{1, "x"}))
+
+	res = mustQ(t, `[:find ?user ?domain :in ?email :where [(re-find "(.*)@(.*)" ?email) [_ ?user ?domain]]]`, "jane@example.com")
+	tu.ExpectEqual(t, res, results([]value{"jane", "example.com"}))
+
+	// nil results don't bind anything
+	res = mustQ(t, `[:find ?m :in ?s :where [(re-find "x" ?s) ?m]]`, "abc")
+	tu.ExpectEqual(t, len(res), 0)
+
+	for _, example := range []struct {
+		expr string
+		res  value
+	}{
+		{`(+)`, 0},
+		{`(+ 1 2 3)`, 6},
+		{`(+ 1 2.5)`, 3.5},
+		{`(- 3)`, -3},
+		{`(- 10 1 2)`, 7},
+		{`(* 2 3)`, 6},
+		{`(/ 6 3)`, 2},
+		{`(/ 3 2)`, 1.5},
+		{`(quot 7 2)`, 3},
+		{`(rem -7 2)`, -1},
+		{`(mod -7 2)`, 1},
+		{`(dec 1)`, 0},
+		{`(str "a" 1 nil :b)`, "a1:b"},
+		{`(subs "hello" 1)`, "ello"},
+		{`(subs "hello" 1 3)`, "el"},
+		{`(re-find "l+" "hello")`, "ll"},
+	} {
+		res := mustQ(t, fmt.Sprintf(`[:find ?x :where [%s ?x]]`, example.expr), db)
+		tu.ExpectEqual(t, res, results([]value{example.res}))
+	}
+}
+
+func TestQEntityFunctions(t *testing.T) {
+	db := notesDb(t)
+	txData, err := transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user] :note/title "empty"}]`)
+	tu.RequireNil(t, err)
+	_, txResult, err := transactor.Transact(db, txData)
+	tu.RequireNil(t, err)
+	db = txResult.DbAfter
+
+	res := mustQ(t, `[:find ?title :where [?e :note/title ?title] [(missing? $ ?e :note/content)]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"empty"}))
+
+	res = mustQ(t, `[:find ?title ?content :where [?e :note/title ?title] [(get-else $ ?e :note/content "-") ?content]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"first", "hello"}, []value{"second", "world"}, []value{"empty", "-"}))
+
+	contentAttr := db.Entid(database.Keyword{fressian.Keyword{Namespace: "note", Name: "content"}})
+	titleAttr := db.Entid(database.Keyword{fressian.Keyword{Namespace: "note", Name: "title"}})
+	res = mustQ(t, `[:find ?title ?attr ?val :where [?e :note/title ?title] [(get-some $ ?e :note/content :note/title) [?attr ?val]]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"first", contentAttr, "hello"}, []value{"second", contentAttr, "world"}, []value{"empty", titleAttr, "empty"}))
+}
+
+func TestQCustomFunctions(t *testing.T) {
+	RegisterFunction(edn.Symbol{Namespace: "test", Name: "shout"}, func(args ...interface{}) (interface{}, error) {
+		return fmt.Sprint(args[0], "!"), nil
+	})
+	res := mustQ(t, `[:find ?y :in ?x :where [(test/shout ?x) ?y]]`, "hey")
+	tu.ExpectEqual(t, res, results([]value{"hey!"}))
+
+	// functions can be passed as inputs
+	even := Function(func(args ...interface{}) (interface{}, error) {
+		return args[0].(int)%2 == 0, nil
+	})
+	res = mustQ(t, `[:find ?x :in ?even? [?x ...] :where [(?even? ?x)]]`, even, []int{1, 2, 3, 4})
+	tu.ExpectEqual(t, res, results([]value{2}, []value{4}))
+
+	failing := Function(func(args ...interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	query, err := edn.DecodeString(`[:find ?x :in ?fail ?x :where [(?fail ?x)]]`)
+	tu.RequireNil(t, err)
+	_, err = Q(query, failing, 1)
+	tu.ExpectNotNil(t, err)
+}
+
+func TestQFunctionErrors(t *testing.T) {
+	db := notesDb(t)
+	for _, invalid := range []string{
+		`[:find ?z :in $ ?z :where [(< ?x 3)]]`,
+		`[:find ?y :in $ ?z :where [(inc ?x) ?y]]`,
+		`[:find ?x :in $ ?x :where [(unknown ?x)]]`,
+		`[:find ?x :in $ ?x :where [(?f ?x)]]`,
+		`[:find ?x :in $ ?x :where [(?x)]]`,
+		`[:find ?x :in $ ?x :where [(< ?x "a")]]`,
+		`[:find ?x :in $ ?x :where [(+ ?x "a") ?y]]`,
+		`[:find ?x :in $ ?x :where [(/ ?x 0) ?y]]`,
+		`[:find ?x :in $ ?x :where [(subs "abc" 4) ?y]]`,
+		`[:find ?x :in $ ?x :where [(untuple ?x) [?a ?b]]]`,
+		`[:find ?x :in $ ?x :where [(ground ?x) [?a ?b]]]`,
+		`[:find ?x :in $ ?x :where [(inc ?x) [?a ...] ?b]]`,
+		`[:find ?x :in $ ?x :where [($other ?x)]]`,
+		`[:find ?x :in $ ?x :where [(missing? $other ?x :note/title)]]`,
+		`[:find ?e :in $ ?x :where [?e :note/title] [(get-else $ ?e :note/content nil) ?c]]`,
+		`[:find ?e :in $ ?x :where [?e :note/title] [(get-else $ ?e :note/unknown "-") ?c]]`,
+		`[:find ?e :in $ ?x :where [?e :note/title] [(missing? ?e :note/content)]]`,
+	} {
+		query, err := edn.DecodeString(invalid)
+		tu.RequireNil(t, err)
+		_, err = Q(query, db, 1)
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func taggedNotesDb(t *testing.T) *database.Db {
+	txData, err := transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/db]
+  :db/ident :note/title
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}
+ {:db/id #db/id[:db.part/db]
+  :db/ident :note/tags
+  :db/valueType :db.type/ref
+  :db/cardinality :db.cardinality/many}
+ {:db/id #db/id[:db.part/db]
+  :db/ident :tag/name
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one}]`)
+	tu.RequireNil(t, err)
+	_, txResult, err := transactor.Transact(transactor.InitialDb, txData)
+	tu.RequireNil(t, err)
+	txData, err = transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user -1] :tag/name "go"}
+ {:db/id #db/id[:db.part/user -2] :tag/name "db"}
+ {:db/id #db/id[:db.part/user -3] :tag/name "clojure"}
+ {:db/id #db/id[:db.part/user -4] :note/title "a"}
+ {:db/id #db/id[:db.part/user -5] :note/title "b"}
+ {:db/id #db/id[:db.part/user -6] :note/title "c"}
+ {:db/id #db/id[:db.part/user -7] :note/title "d"}
+ [:db/add #db/id[:db.part/user -4] :note/tags #db/id[:db.part/user -1]]
+ [:db/add #db/id[:db.part/user -4] :note/tags #db/id[:db.part/user -2]]
+ [:db/add #db/id[:db.part/user -5] :note/tags #db/id[:db.part/user -1]]
+ [:db/add #db/id[:db.part/user -6] :note/tags #db/id[:db.part/user -3]]]`)
+	tu.RequireNil(t, err)
+	_, txResult, err = transactor.Transact(txResult.DbAfter, txData)
+	tu.RequireNil(t, err)
+	return txResult.DbAfter
+}
+
+func TestQNot(t *testing.T) {
+	db := taggedNotesDb(t)
+
+	res := mustQ(t, `[:find ?title :where [?n :note/title ?title] (not [?n :note/tags])]`, db)
+	tu.ExpectEqual(t, res, results([]value{"d"}))
+
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title] (not [(= ?title "a")] [?n :note/tags]) (not [(= ?title "b")])]`, db)
+	tu.ExpectEqual(t, res, results([]value{"c"}, []value{"d"}))
+
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title] (not-join [?n] [?n :note/tags ?t] [?t :tag/name ?name] [(= ?name "go")])]`, db)
+	tu.ExpectEqual(t, res, results([]value{"c"}, []value{"d"}))
+
+	// other sources
+	res = mustQ(t, `[:find ?title :in $ $excluded :where [?n :note/title ?title] ($excluded not [?title])]`, db, [][]interface{}{{"a"}, {"c"}})
+	tu.ExpectEqual(t, res, results([]value{"b"}, []value{"d"}))
+
+	// predicates
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title] (not [(< ?title "c")])]`, db)
+	tu.ExpectEqual(t, res, results([]value{"c"}, []value{"d"}))
+}
+
+func TestQOr(t *testing.T) {
+	db := taggedNotesDb(t)
+
+	res := mustQ(t, `[:find ?title :where [?n :note/title ?title] [?n :note/tags ?t] (or (and [?t :tag/name ?name] [(= ?name "db")]) (and [?t :tag/name ?name] [(= ?name "clojure")]))]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"c"}))
+
+	// or can bind variables
+	res = mustQ(t, `[:find ?title :where (or (and [?t :tag/name ?name] [(= ?name "db")]) (and [?t :tag/name ?name] [(= ?name "clojure")])) [?n :note/tags ?t] [?n :note/title ?title]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"c"}))
+
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title] (or-join [?n] (and [?n :note/tags ?t] [?t :tag/name ?name] [(= ?name "clojure")]) (and [?n :note/title ?title] [(= ?title "d")]))]`, db)
+	tu.ExpectEqual(t, res, results([]value{"c"}, []value{"d"}))
+
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title] (or-join [[?n]] (and [?n :note/tags ?t] [?t :tag/name ?name] [(= ?name "go")]) (not [?n :note/tags]))]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"b"}, []value{"d"}))
+
+	res = mustQ(t, `[:find ?x :in [?x ...] :where (or [(< ?x 2)] [(> ?x 3)])]`, []int{1, 2, 3, 4})
+	tu.ExpectEqual(t, res, results([]value{1}, []value{4}))
+}
+
+func TestQNotOrRules(t *testing.T) {
+	db := taggedNotesDb(t)
+
+	res := mustQ(t, `[:find ?title :in $ % :where (untagged ?n) [?n :note/title ?title]]`, db, `[[(untagged ?n) [?n :note/title] (not [?n :note/tags])]]`)
+	tu.ExpectEqual(t, res, results([]value{"d"}))
+
+	// recursive calls in or
+	links := [][]interface{}{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"d", "e"}}
+	res = mustQ(t, `[:find ?b :in $ % :where (reach "a" ?b)]`, links, `[[(reach ?a ?b) (or-join [?a ?b] [?a ?b] (and [?a ?x] (reach ?x ?b)))]]`)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"b"}, []value{"c"}))
+}
+
+func TestQNotOrErrors(t *testing.T) {
+	db := taggedNotesDb(t)
+	for _, invalid := range []string{
+		// variables must be bound
+		`[:find ?n :where [?n :note/title] (not [?n :note/tags ?t] [?t :tag/name])]`,
+		`[:find ?t :where [?t :tag/name] (not-join [?n] [?n :note/tags ?t])]`,
+		`[:find ?n :where (or-join [[?n]] [?n :note/tags] [?n :note/title])]`,
+		`[:find ?n :where (or-join [?n ?t] [?n :note/tags] [?n :note/title ?t])]`,
+		// all branches of or must use the same variables
+		`[:find ?n :where (or [?n :note/tags ?t] [?n :note/title])]`,
+		// malformed clauses
+		`[:find ?n :where [?n :note/title] (not)]`,
+		`[:find ?n :where [?n :note/title] (not-join [] [?n :note/tags])]`,
+		`[:find ?n :where [?n :note/title] (or)]`,
+		`[:find ?n :where [?n :note/title] (and [?n :note/tags])]`,
+		`[:find ?n :where [?n :note/title] ($other not [?n :note/tags])]`,
+		// variables in not don't bind anything
+		`[:find ?t :where [?n :note/title] (not [?n :note/tags ?t])]`,
+	} {
+		query, err := edn.DecodeString(invalid)
+		tu.RequireNil(t, err)
+		_, err = Q(query, db)
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func TestQValuePatterns(t *testing.T) {
+	db := taggedNotesDb(t)
+
+	// attribute and value without an entity
+	res := mustQ(t, `[:find ?title :where [?t :tag/name "go"] [?n :note/tags ?t] [?n :note/title ?title]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"b"}))
+
+	res = mustQ(t, `[:find ?tag :where [?n :note/title "a"] [?n :note/tags ?t] [?t :tag/name ?tag]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"db"}, []value{"go"}))
+
+	// only a value
+	res = mustQ(t, `[:find ?tag :where [?t _ "clojure"] [?t :tag/name ?tag]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"clojure"}))
+
+	// keyword idents and lookup refs as values of refs
+	title := fressian.Keyword{Namespace: "note", Name: "title"}
+	res = mustQ(t, `[:find ?ident :where [?a :db/valueType [:db/ident :db.type/string]] [?a :db/unique :db.unique/identity] [?a :db/ident ?ident]]`, db)
+	tu.ExpectEqual(t, res, results([]value{title}))
+
+	res = mustQ(t, `[:find ?a :where [?a :db/valueType [:db/ident :db.type/unknown]]]`, db)
+	tu.ExpectEqual(t, len(res), 0)
+
+	// added
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title _ true] [(= ?title "a")]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a"}))
+	res = mustQ(t, `[:find ?title :where [?n :note/title ?title _ false]]`, db)
+	tu.ExpectEqual(t, len(res), 0)
+}
+
+func TestQAggregates(t *testing.T) {
+	// [customer order amount]
+	sales := [][]interface{}{{"a", 1, 1}, {"a", 2, 1}, {"b", 3, 5}, {"b", 4, 2}, {"c", 5, 4}}
+
+	res := mustQ(t, `[:find ?c (sum ?amount) :in $ :where [?c _ ?amount]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{"a", 1}, []value{"b", 7}, []value{"c", 4}))
+
+	// :with keeps duplicates
+	res = mustQ(t, `[:find ?c (sum ?amount) :with ?order :in $ :where [?c ?order ?amount]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{"a", 2}, []value{"b", 7}, []value{"c", 4}))
+
+	res = mustQ(t, `[:find (count ?order) (count-distinct ?c) (min ?amount) (max ?amount) :in $ :where [?c ?order ?amount]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{5, 3, 1, 5}))
+
+	res = mustQ(t, `[:find (avg ?amount) (median ?amount) :with ?order :in $ :where [_ ?order ?amount]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{2.6, 2}))
+
+	res = mustQ(t, `[:find (median ?amount) :in $ :where [_ _ ?amount]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{3}))
+
+	res = mustQ(t, `[:find (min ?c) (max ?c) :in $ :where [?c]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{"a", "c"}))
+
+	// nothing to aggregate
+	res = mustQ(t, `[:find (count ?c) :in $ :where [?c 42]]`, sales)
+	tu.ExpectEqual(t, len(res), 0)
+
+	for _, example := range []struct {
+		find   string
+		values []interface{}
+	}{
+		{`(distinct ?amount)`, []interface{}{1, 5, 2, 4}},
+		{`(min 2 ?amount)`, []interface{}{1, 2}},
+		{`(max 2 ?amount)`, []interface{}{5, 4}},
+		{`(max 10 ?amount)`, []interface{}{5, 4, 2, 1}},
+	} {
+		res = mustQ(t, fmt.Sprintf(`[:find %s :with ?order :in $ :where [_ ?order ?amount]]`, example.find), sales)
+		tu.RequireEqual(t, len(res), 1)
+		for key := range res {
+			coll := key.ValueAt(0).(*Collection)
+			if example.find == `(distinct ?amount)` {
+				tu.ExpectEqual(t, len(coll.Values), len(example.values))
+			} else {
+				tu.ExpectEqual(t, coll.Values, example.values)
+			}
+		}
+	}
+
+	res = mustQ(t, `[:find ?c (sample 1 ?order) :in $ :where [?c ?order]]`, sales)
+	tu.ExpectEqual(t, len(res), 3)
+	for key := range res {
+		tu.ExpectEqual(t, len(key.ValueAt(1).(*Collection).Values), 1)
+	}
+}
+
+func tupleDb(t *testing.T) *database.Db {
+	txData, err := transactor.TxDataFromEDN(testutil.Schema(
+		testutil.One("item/name", "string").Identity(),
+		testutil.One("item/kind", "string"),
+		testutil.One("item/size", "long"),
+		testutil.One("item/kind+size", "tuple").TupleAttrs("item/kind", "item/size"),
+		testutil.One("item/data", "bytes")))
+	tu.RequireNil(t, err)
+	_, txResult, err := transactor.Transact(transactor.InitialDb, txData)
+	tu.RequireNil(t, err)
+	txData, err = transactor.TxDataFromEDN(`[{:db/id #db/id[:db.part/user] :item/name "a" :item/kind "x" :item/size 1}
+ {:db/id #db/id[:db.part/user] :item/name "b" :item/kind "x" :item/size 1}
+ {:db/id #db/id[:db.part/user] :item/name "c" :item/kind "y" :item/size 2}]`)
+	tu.RequireNil(t, err)
+	_, txResult, err = transactor.Transact(txResult.DbAfter, txData)
+	tu.RequireNil(t, err)
+
+	data := database.Keyword{fressian.Keyword{Namespace: "item", Name: "data"}}
+	txData = []transactor.TxDatum{}
+	for name, bs := range map[string][]byte{"a": {1, 2}, "b": {1, 2}, "c": {3}} {
+		item := database.LookupRef{
+			Attribute: database.Keyword{fressian.Keyword{Namespace: "item", Name: "name"}},
+			Value:     index.NewValue(name),
+		}
+		txData = append(txData, transactor.Datum{Op: transactor.Assert, E: item, A: data, V: transactor.NewValue(bs)})
+	}
+	_, txResult, err = transactor.Transact(txResult.DbAfter, txData)
+	tu.RequireNil(t, err)
+	return txResult.DbAfter
+}
+
+func TestQTupleAndBytesValues(t *testing.T) {
+	db := tupleDb(t)
+	xs := []interface{}{"x", 1}
+	ys := []interface{}{"y", 2}
+
+	res := mustQ(t, `[:find ?t :where [(tuple 1 "x") ?t]]`, db)
+	tu.ExpectEqual(t, res, results([]value{[]interface{}{1, "x"}}))
+
+	res = mustQ(t, `[:find ?n ?t :where [?e :item/kind+size ?t] [?e :item/name ?n]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a", xs}, []value{"b", xs}, []value{"c", ys}))
+
+	res = mustQ(t, `[:find ?d :where [_ :item/data ?d]]`, db)
+	tu.ExpectEqual(t, res, results([]value{[]byte{1, 2}}, []value{[]byte{3}}))
+
+	// joins
+	res = mustQ(t, `[:find ?n1 ?n2 :where [?e1 :item/kind+size ?t] [?e2 :item/kind+size ?t] [?e1 :item/name ?n1] [?e2 :item/name ?n2] [(< ?n1 ?n2)]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a", "b"}))
+
+	res = mustQ(t, `[:find ?n1 ?n2 :where [?e1 :item/data ?d] [?e2 :item/data ?d] [?e1 :item/name ?n1] [?e2 :item/name ?n2] [(< ?n1 ?n2)]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a", "b"}))
+
+	res = mustQ(t, `[:find ?n :where [(tuple "y" 2) ?t] [?e :item/kind+size ?t] [?e :item/name ?n]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"c"}))
+
+	res = mustQ(t, `[:find ?n :where [?e :item/kind+size ["x" 1]] [?e :item/name ?n]]`, db)
+	tu.ExpectEqual(t, res, results([]value{"a"}, []value{"b"}))
+
+	res = mustQ(t, `[:find ?n :in $ ?t :where [?e :item/kind+size ?t] [?e :item/name ?n]]`, db, ys)
+	tu.ExpectEqual(t, res, results([]value{"c"}))
+
+	res = mustQ(t, `[:find ?n :in $ :where [?n ["x" 1]]]`, [][]interface{}{{"a", xs}, {"c", ys}})
+	tu.ExpectEqual(t, res, results([]value{"a"}))
+
+	// aggregates
+	res = mustQ(t, `[:find (count ?t) (count-distinct ?t) (count-distinct ?d) :with ?e :where [?e :item/kind+size ?t] [?e :item/data ?d]]`, db)
+	tu.ExpectEqual(t, res, results([]value{3, 2, 2}))
+
+	res = mustQ(t, `[:find ?t (count ?e) :where [?e :item/kind+size ?t]]`, db)
+	tu.ExpectEqual(t, res, results([]value{xs, 2}, []value{ys, 1}))
+
+	res = mustQ(t, `[:find (distinct ?d) :with ?e :where [?e :item/data ?d]]`, db)
+	tu.RequireEqual(t, len(res), 1)
+	for key := range res {
+		tu.ExpectEqual(t, len(key.ValueAt(0).(*Collection).Values), 2)
+	}
+}
+
+func TestQCustomAggregates(t *testing.T) {
+	sales := [][]interface{}{{"a", 1, 2}, {"a", 2, 3}, {"b", 3, 5}}
+	product := func(args ...interface{}) (interface{}, error) {
+		res := 1
+		for _, val := range args[len(args)-1].([]interface{}) {
+			res *= val.(int)
+		}
+		return res, nil
+	}
+
+	RegisterAggregate(edn.Symbol{Namespace: "test", Name: "product"}, product)
+	res := mustQ(t, `[:find ?c (test/product ?amount) :in $ :where [?c _ ?amount]]`, sales)
+	tu.ExpectEqual(t, res, results([]value{"a", 6}, []value{"b", 5}))
+
+	res = mustQ(t, `[:find ?c (aggregate ?f ?amount) :in $ ?f :where [?c _ ?amount]]`, sales, Function(product))
+	tu.ExpectEqual(t, res, results([]value{"a", 6}, []value{"b", 5}))
+
+	// constant arguments come first
+	res = mustQ(t, `[:find (aggregate ?f 10 ?amount) :in $ ?f :where [_ _ ?amount]]`, sales, Function(product))
+	tu.ExpectEqual(t, res, results([]value{30}))
+}
+
+func TestQAggregateErrors(t *testing.T) {
+	sales := [][]interface{}{{"a", 1, 1}, {"b", 2, 5}}
+	for _, invalid := range []string{
+		`[:find (unknown ?amount) :in $ :where [_ _ ?amount]]`,
+		`[:find (count) :in $ :where [_ _ ?amount]]`,
+		`[:find (count 1) :in $ :where [_ _ ?amount]]`,
+		`[:find (min ?amount ?c) :in $ :where [?c _ ?amount]]`,
+		`[:find (sum ?c) :in $ :where [?c _ ?amount]]`,
+		`[:find (count 1 2 ?c) :in $ :where [?c _ ?amount]]`,
+		`[:find (min "two" ?c) :in $ :where [?c _ ?amount]]`,
+		`[:find (aggregate ?f ?c) :in $ :where [?c _ ?amount]]`,
+		`[:find (aggregate ?f ?c) :in $ ?f :where [?c _ ?amount]]`,
+	} {
+		query, err := edn.DecodeString(invalid)
+		tu.RequireNil(t, err)
+		q, _ := parseQuery(query)
+		inputs := []interface{}{sales}
+		if q != nil && len(q.in) == 2 {
+			inputs = append(inputs, "not a function")
+		}
+		_, err = Q(query, inputs...)
+		tu.ExpectNotNil(t, err)
 	}
 }
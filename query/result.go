@@ -0,0 +1,186 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// A Result contains the results of a query, in the shape given by the
+// find spec of the query.
+//
+// Rows are returned in no particular order, use Sort to get them in a
+// deterministic order.
+type Result struct {
+	spec findElements
+	keys []interface{}
+	rows [][]interface{}
+}
+
+// newResult returns the results of the query as rows.
+//
+// Find-tuple and find-scalar specs only return a single row, which is
+// the smallest one to make the result deterministic.
+func newResult(q *query, res map[Indexed]bool) *Result {
+	rows := make([][]interface{}, 0, len(res))
+	for key := range res {
+		row := make([]interface{}, key.Length())
+		for i := range row {
+			row[i] = plainValue(key.ValueAt(i))
+		}
+		rows = append(rows, row)
+	}
+
+	r := &Result{spec: q.spec, keys: q.keys, rows: rows}
+	switch q.spec.(type) {
+	case findTuple, findScalar:
+		if len(r.rows) > 1 {
+			r.Sort()
+			r.rows = r.rows[:1]
+		}
+	}
+	return r
+}
+
+// Len returns the number of rows in the result.
+func (r *Result) Len() int {
+	return len(r.rows)
+}
+
+// Rows returns the rows of the result, with one value per find
+// element.
+//
+// Results of find-tuple and find-scalar queries have at most one row.
+func (r *Result) Rows() [][]interface{} {
+	return r.rows
+}
+
+// Coll returns the first value of each row, which is the result of
+// find-coll queries like [:find [?e ...]].
+func (r *Result) Coll() []interface{} {
+	coll := make([]interface{}, len(r.rows))
+	for i, row := range r.rows {
+		coll[i] = row[0]
+	}
+	return coll
+}
+
+// Tuple returns the first row, which is the result of find-tuple
+// queries like [:find [?a ?b]], or nil if there are no results.
+func (r *Result) Tuple() []interface{} {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return r.rows[0]
+}
+
+// Scalar returns the first value of the first row, which is the result
+// of find-scalar queries like [:find ?e .], or nil if there are no
+// results.
+func (r *Result) Scalar() interface{} {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return r.rows[0][0]
+}
+
+// Maps returns the rows as maps from the keys given by :keys, :strs
+// or :syms to the values, or nil if the query has none of them.
+//
+// The keys are edn.Keyword for :keys, string for :strs and edn.Symbol
+// for :syms.
+func (r *Result) Maps() []map[interface{}]interface{} {
+	if r.keys == nil {
+		return nil
+	}
+
+	maps := make([]map[interface{}]interface{}, len(r.rows))
+	for i, row := range r.rows {
+		m := make(map[interface{}]interface{}, len(r.keys))
+		for j, key := range r.keys {
+			m[key] = row[j]
+		}
+		maps[i] = m
+	}
+	return maps
+}
+
+// Sort sorts the rows in ascending order and returns the result.
+//
+// Numbers are compared numerically and other values of the same type
+// in index order.  Documents are ordered by their ids, and values that
+// can't be compared by their types.
+func (r *Result) Sort() *Result {
+	sort.SliceStable(r.rows, func(i, j int) bool {
+		return compareRows(r.rows[i], r.rows[j]) < 0
+	})
+	return r
+}
+
+func (r *Result) String() string {
+	switch r.spec.(type) {
+	case findColl:
+		return fmt.Sprint(r.Coll())
+	case findTuple:
+		return fmt.Sprint(r.Tuple())
+	case findScalar:
+		return fmt.Sprint(r.Scalar())
+	default:
+		return fmt.Sprint(r.rows)
+	}
+}
+
+// compareRows compares the rows value by value.
+func compareRows(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if cmp := compareResults(a[i], b[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(a) - len(b)
+}
+
+// compareResults compares values of any type, unlike compareValues.
+func compareResults(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if cmp, err := compareValues(a, b); err == nil {
+		return cmp
+	}
+
+	switch a := a.(type) {
+	case *Document:
+		if b, ok := b.(*Document); ok {
+			return a.Id - b.Id
+		}
+	case *Collection:
+		if b, ok := b.(*Collection); ok {
+			return compareRows(a.Values, b.Values)
+		}
+	}
+
+	typeA, typeB := reflect.TypeOf(a).String(), reflect.TypeOf(b).String()
+	switch {
+	case typeA < typeB:
+		return -1
+	case typeA > typeB:
+		return 1
+	}
+
+	strA, strB := fmt.Sprint(a), fmt.Sprint(b)
+	switch {
+	case strA < strB:
+		return -1
+	case strA > strB:
+		return 1
+	default:
+		return 0
+	}
+}
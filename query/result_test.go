@@ -0,0 +1,111 @@
+package query
+
+import (
+	"github.com/heyLu/edn"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+)
+
+func queryResult(t *testing.T, queryEDN string, inputs ...interface{}) *Result {
+	query, err := edn.DecodeString(queryEDN)
+	tu.RequireNil(t, err)
+	res, err := Q(query, inputs...)
+	tu.RequireNil(t, err)
+	return res
+}
+
+func TestQFindSpecs(t *testing.T) {
+	ratings := [][]interface{}{{"c", 3}, {"a", 1}, {"b", 2}, {"d", 2}}
+
+	res := queryResult(t, `[:find ?n ?r :in $ :where [?n ?r]]`, ratings)
+	tu.ExpectEqual(t, res.Sort().Rows(), [][]interface{}{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 2}})
+
+	res = queryResult(t, `[:find [?n ...] :in $ :where [?n 2]]`, ratings)
+	tu.ExpectEqual(t, res.Sort().Coll(), []interface{}{"b", "d"})
+
+	res = queryResult(t, `{:find [[?n ...]] :in [$] :where [[?n 2]]}`, ratings)
+	tu.ExpectEqual(t, res.Sort().Coll(), []interface{}{"b", "d"})
+
+	// tuples and scalars are the smallest result
+	res = queryResult(t, `[:find [?n ?r] :in $ :where [?n 2] [?n ?r]]`, ratings)
+	tu.ExpectEqual(t, res.Len(), 1)
+	tu.ExpectEqual(t, res.Tuple(), []interface{}{"b", 2})
+
+	res = queryResult(t, `[:find ?n . :in $ :where [?n 2]]`, ratings)
+	tu.ExpectEqual(t, res.Len(), 1)
+	tu.ExpectEqual(t, res.Scalar(), "b")
+
+	res = queryResult(t, `[:find (max ?r) . :in $ :where [_ ?r]]`, ratings)
+	tu.ExpectEqual(t, res.Scalar(), 3)
+
+	// no results
+	res = queryResult(t, `[:find ?n . :in $ :where [?n 42]]`, ratings)
+	tu.ExpectEqual(t, res.Len(), 0)
+	tu.ExpectNil(t, res.Scalar())
+	res = queryResult(t, `[:find [?n ?r] :in $ :where [?n 42] [?n ?r]]`, ratings)
+	tu.ExpectNil(t, res.Tuple())
+}
+
+func TestQReturnMaps(t *testing.T) {
+	ratings := [][]interface{}{{"a", 1}, {"b", 2}}
+
+	res := queryResult(t, `[:find ?n ?r :keys name rating :in $ :where [?n ?r]]`, ratings)
+	tu.ExpectEqual(t, res.Sort().Maps(), []map[interface{}]interface{}{
+		{edn.Keyword{Name: "name"}: "a", edn.Keyword{Name: "rating"}: 1},
+		{edn.Keyword{Name: "name"}: "b", edn.Keyword{Name: "rating"}: 2},
+	})
+
+	res = queryResult(t, `{:find [?n ?r] :strs [name rating/value] :in [$] :where [[?n ?r] [(> ?r 1)]]}`, ratings)
+	tu.ExpectEqual(t, res.Maps(), []map[interface{}]interface{}{{"name": "b", "rating/value": 2}})
+
+	res = queryResult(t, `[:find [?n ?r] :syms n r :in $ :where [?n ?r]]`, ratings)
+	tu.ExpectEqual(t, res.Maps(), []map[interface{}]interface{}{
+		{edn.Symbol{Name: "n"}: "a", edn.Symbol{Name: "r"}: 1},
+	})
+
+	// without keys there are no maps
+	res = queryResult(t, `[:find ?n :in $ :where [?n _]]`, ratings)
+	tu.ExpectNil(t, res.Maps())
+}
+
+func TestQFindSpecErrors(t *testing.T) {
+	ratings := [][]interface{}{{"a", 1}, {"b", 2}}
+
+	for _, invalid := range []string{
+		`[:find ?n ... :in $ :where [?n _]]`,
+		`[:find [?n ?r ...] :in $ :where [?n ?r]]`,
+		`[:find ?n ?r . :in $ :where [?n ?r]]`,
+		`[:find [] :in $ :where [?n _]]`,
+		`[:find [?n .] :in $ :where [?n _]]`,
+		`[:find ?n ?r :keys name :in $ :where [?n ?r]]`,
+		`[:find ?n :keys "name" :in $ :where [?n _]]`,
+		`[:find ?n :keys :in $ :where [?n _]]`,
+		`[:find ?n :keys name :strs name :in $ :where [?n _]]`,
+		`[:find [?n ...] :keys name :in $ :where [?n _]]`,
+		`[:find ?n . :syms n :in $ :where [?n _]]`,
+	} {
+		query, err := edn.DecodeString(invalid)
+		tu.RequireNil(t, err)
+		_, err = Q(query, ratings)
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func TestResultSort(t *testing.T) {
+	res := &Result{
+		spec: findRel{},
+		rows: [][]interface{}{
+			{"b", 1},
+			{nil, 2},
+			{"a", 2.5},
+			{&Document{Id: 2}, 1},
+			{"a", 2},
+			{&Document{Id: 1}, 1},
+		},
+	}
+	sorted := res.Sort().Rows()
+	tu.ExpectEqual(t, sorted[0], []interface{}{nil, 2})
+	tu.ExpectEqual(t, sorted[1][0].(*Document).Id, 1)
+	tu.ExpectEqual(t, sorted[2][0].(*Document).Id, 2)
+	tu.ExpectEqual(t, sorted[3:], [][]interface{}{{"a", 2}, {"a", 2.5}, {"b", 1}})
+}
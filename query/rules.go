@@ -0,0 +1,402 @@
+package query
+
+import (
+	"fmt"
+	"github.com/heyLu/edn"
+)
+
+// Rules are evaluated bottom-up: all facts of a rule are computed by
+// resolving its bodies until no new facts are found, and calls to
+// the rule join with these facts.
+//
+// Recursive rules are evaluated using semi-naive iteration, i.e. in
+// each iteration a body is only resolved against the facts that were
+// new in the previous one.  (At least one of the rule calls in a body
+// sees only the new facts, the others see all facts.)  Bodies with
+// rule calls in not or or clauses are evaluated against all facts
+// whenever one of these rules found new facts.
+//
+// Rules with required variables can't be evaluated on their own,
+// because their bodies expect these variables to be bound.  Instead,
+// the values the variables are bound to at the call sites are
+// collected as seeds, and only the facts for these seeds are
+// computed.  Seeds are collected during the evaluation as well, so
+// recursive calls add new seeds, which are then evaluated in the
+// next iteration.
+
+// A factSet is a set of tuples.
+type factSet struct {
+	tuples []tuple
+	keys   map[Indexed]bool
+}
+
+func newFactSet() *factSet {
+	return &factSet{keys: map[Indexed]bool{}}
+}
+
+func (s *factSet) has(vals []value) bool {
+	return s != nil && s.keys[newHashKey(vals)]
+}
+
+func (s *factSet) add(vals []value) {
+	key := newHashKey(vals)
+	if !s.keys[key] {
+		s.keys[key] = true
+		s.tuples = append(s.tuples, sliceTuple(vals))
+	}
+}
+
+func (s *factSet) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.tuples)
+}
+
+func (s *factSet) all() []tuple {
+	if s == nil {
+		return nil
+	}
+	return s.tuples
+}
+
+// factSets holds a factSet per rule.
+type factSets map[edn.Symbol]*factSet
+
+func (fs factSets) add(name edn.Symbol, vals []value) {
+	s, ok := fs[name]
+	if !ok {
+		s = newFactSet()
+		fs[name] = s
+	}
+	s.add(vals)
+}
+
+// rulesEval contains the state of the evaluation of the rules of a
+// query for a source.
+type rulesEval struct {
+	sources map[variable]source
+	rules   map[edn.Symbol][]rule
+
+	facts factSets // over the variables of the rule
+	seeds factSets // over the required variables of the rule
+
+	// the facts and seeds found in the previous iteration
+	deltaFacts factSets
+	deltaSeeds factSets
+
+	// the facts and seeds found in the current iteration
+	newFacts factSets
+	newSeeds factSets
+
+	initialized bool
+}
+
+func newRulesEval(sources map[variable]source, rules map[edn.Symbol][]rule) *rulesEval {
+	return &rulesEval{
+		sources:    sources,
+		rules:      rules,
+		facts:      factSets{},
+		seeds:      factSets{},
+		deltaFacts: factSets{},
+		deltaSeeds: factSets{},
+	}
+}
+
+// bodyEval is the state of the evaluation of a single rule body.
+type bodyEval struct {
+	eval *rulesEval
+	// the position of the call that sees only the new facts, or -1
+	// if all calls see all facts
+	delta int
+	// the position of the next call
+	call int
+}
+
+// calls returns the names of the rules the body calls directly.
+func (r rule) calls() []edn.Symbol {
+	names := []edn.Symbol{}
+	for _, clause := range r.clauses {
+		if expr, ok := clause.(ruleExpr); ok {
+			names = append(names, expr.name)
+		}
+	}
+	return names
+}
+
+// nestedCalls returns the names of the rules the body calls in not
+// and or clauses.
+func (r rule) nestedCalls() []edn.Symbol {
+	var nested func(clauses []clause, top bool) []edn.Symbol
+	nested = func(clauses []clause, top bool) []edn.Symbol {
+		names := []edn.Symbol{}
+		for _, clause := range clauses {
+			switch clause := clause.(type) {
+			case ruleExpr:
+				if !top {
+					names = append(names, clause.name)
+				}
+			case notClause:
+				names = append(names, nested(clause.clauses, false)...)
+			case orClause:
+				names = append(names, nested(clause.branches, false)...)
+			case andClause:
+				names = append(names, nested(clause.clauses, false)...)
+			}
+		}
+		return names
+	}
+	return nested(r.clauses, true)
+}
+
+// hasNestedDelta returns true if one of the relations read by a nested
+// call changed in the previous iteration.
+func (e *rulesEval) hasNestedDelta(r rule) bool {
+	for _, name := range r.nestedCalls() {
+		if e.deltaFacts[name].len() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDelta returns true if the relation read by the call at position
+// i changed in the previous iteration.
+//
+// If the rule has required variables, the seeds are read at position
+// 0, before the calls in the body.
+func (e *rulesEval) hasDelta(r rule, i int) bool {
+	if len(r.vars.required) > 0 {
+		if i == 0 {
+			return e.deltaSeeds[r.name].len() > 0
+		}
+		i -= 1
+	}
+	return e.deltaFacts[r.calls()[i]].len() > 0
+}
+
+// solve evaluates the rules until no new facts or seeds are found.
+func (e *rulesEval) solve() error {
+	first := !e.initialized
+	e.initialized = true
+
+	for {
+		e.newFacts = factSets{}
+		e.newSeeds = factSets{}
+		for _, rules := range e.rules {
+			for _, r := range rules {
+				if first {
+					err := e.evalBody(r, -1)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				// nested calls can't be evaluated by position, so
+				// the whole body is evaluated again
+				if e.hasNestedDelta(r) {
+					err := e.evalBody(r, -1)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				numCalls := len(r.calls())
+				if len(r.vars.required) > 0 {
+					numCalls += 1
+				}
+				for i := 0; i < numCalls; i++ {
+					if !e.hasDelta(r, i) {
+						continue
+					}
+
+					err := e.evalBody(r, i)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		first = false
+
+		for name, s := range e.newFacts {
+			for _, t := range s.tuples {
+				e.facts.add(name, []value(t.(sliceTuple)))
+			}
+		}
+		for name, s := range e.newSeeds {
+			for _, t := range s.tuples {
+				e.seeds.add(name, []value(t.(sliceTuple)))
+			}
+		}
+		e.deltaFacts, e.deltaSeeds = e.newFacts, e.newSeeds
+
+		if len(e.newFacts) == 0 && len(e.newSeeds) == 0 {
+			return nil
+		}
+	}
+}
+
+// evalBody resolves the body of the rule and adds the facts that were
+// not known yet to e.newFacts.
+func (e *rulesEval) evalBody(r rule, delta int) error {
+	body := &bodyEval{eval: e, delta: delta}
+	context := context{sources: e.sources, body: body}
+
+	if len(r.vars.required) > 0 {
+		seeds := e.seeds[r.name]
+		if delta == 0 {
+			seeds = e.deltaSeeds[r.name]
+		}
+
+		attrs := map[variable]int{}
+		for i, v := range r.vars.required {
+			attrs[v] = i
+		}
+		context.rels = []relation{{attrs: attrs, tuples: seeds.all()}}
+		body.call = 1
+	}
+
+	context, err := runQuery(context, r.clauses)
+	if err != nil {
+		return err
+	}
+
+	vars := make([]variable, 0, len(r.vars.required)+len(r.vars.free))
+	vars = append(vars, r.vars.required...)
+	vars = append(vars, r.vars.free...)
+	for _, v := range vars {
+		if !isBound(context, v) {
+			return fmt.Errorf("variable %v of rule %v is not bound in its body", v, r.name)
+		}
+	}
+
+	for _, vals := range internalCollect(context, vars) {
+		if !e.facts[r.name].has(vals) {
+			e.newFacts.add(r.name, vals)
+		}
+	}
+	return nil
+}
+
+// isBound returns true if a relation of the context contains the
+// variable.
+func isBound(context context, v variable) bool {
+	for _, rel := range context.rels {
+		if _, ok := rel.attrs[v]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// callSeeds returns the values the required arguments of a rule call
+// are bound to.
+func callSeeds(context context, expr ruleExpr, args pattern) ([][]value, error) {
+	vars := []variable{}
+	for _, arg := range args {
+		if isPlaceHolder(arg) {
+			return nil, fmt.Errorf("insufficient bindings: required argument of %v can't be _", expr.name)
+		}
+		if v, ok := arg.(variable); ok {
+			if !isBound(context, v) {
+				return nil, fmt.Errorf("insufficient bindings: %v must be bound when calling %v", v, expr.name)
+			}
+			vars = append(vars, v)
+		}
+	}
+
+	rows := internalCollect(context, vars)
+	seeds := make([][]value, len(rows))
+	for i, row := range rows {
+		seed := make([]value, len(args))
+		j := 0
+		for k, arg := range args {
+			if _, ok := arg.(variable); ok {
+				seed[k] = row[j]
+				j += 1
+			} else {
+				seed[k] = arg
+			}
+		}
+		seeds[i] = seed
+	}
+	return seeds, nil
+}
+
+// resolveRule joins the facts of the rule with the relations of the
+// context.
+func resolveRule(context context, expr ruleExpr) (context, error) {
+	var e *rulesEval
+	if context.body != nil {
+		e = context.body.eval
+	} else {
+		if context.rules == nil {
+			return context, fmt.Errorf("no rules given for %v, use %% in :in", expr.name)
+		}
+
+		var ok bool
+		e, ok = context.ruleEvals[expr.source]
+		if !ok {
+			src, ok := context.sources[expr.source]
+			if !ok {
+				return context, fmt.Errorf("no source %v for rule %v", expr.source, expr.name)
+			}
+			sources := make(map[variable]source, len(context.sources))
+			for name, s := range context.sources {
+				sources[name] = s
+			}
+			sources[variable(defaultSrc.name)] = src
+			e = newRulesEval(sources, context.rules)
+			context.ruleEvals[expr.source] = e
+		}
+	}
+
+	rules, ok := e.rules[expr.name]
+	if !ok {
+		return context, fmt.Errorf("unknown rule %v", expr.name)
+	}
+	numRequired, numFree := rules[0].vars.arity()
+	if len(expr.args) != numRequired+numFree {
+		return context, fmt.Errorf("rule %v expects %d arguments, but got %d", expr.name, numRequired+numFree, len(expr.args))
+	}
+
+	if numRequired > 0 {
+		seeds, err := callSeeds(context, expr, expr.args[:numRequired])
+		if err != nil {
+			return context, err
+		}
+		for _, seed := range seeds {
+			if e.seeds[expr.name].has(seed) {
+				continue
+			}
+			if context.body != nil {
+				e.newSeeds.add(expr.name, seed)
+			} else {
+				e.seeds.add(expr.name, seed)
+				e.deltaSeeds.add(expr.name, seed)
+			}
+		}
+	}
+
+	facts := e.facts[expr.name]
+	if context.body != nil {
+		if context.body.call == context.body.delta {
+			facts = e.deltaFacts[expr.name]
+		}
+		context.body.call += 1
+	} else {
+		err := e.solve()
+		if err != nil {
+			return context, err
+		}
+		facts = e.facts[expr.name]
+	}
+
+	relation := lookupPatternColl(facts.all(), expr.args)
+	newContext := context
+	newContext.rels = collapseRels(context.rels, relation)
+	return newContext, nil
+}
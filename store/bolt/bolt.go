@@ -1,6 +1,7 @@
 package bolt
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"net/url"
@@ -93,6 +94,22 @@ func (s *boltStore) Put(id string, data []byte) error {
 	return err
 }
 
+func (s *boltStore) CompareAndSwap(id string, old, new []byte) (bool, error) {
+	swapped := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("mu_kvs"))
+		if !bytes.Equal(bucket.Get([]byte(id)), old) {
+			return nil
+		}
+		swapped = true
+		return bucket.Put([]byte(id), new)
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
 func (s *boltStore) Delete(id string) error {
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket([]byte("mu_kvs")).Delete([]byte(id))
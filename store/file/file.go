@@ -1,10 +1,13 @@
 package file
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
+	"time"
 
 	"github.com/heyLu/mu/store"
 )
@@ -57,6 +60,51 @@ func (s fileStore) Put(id string, data []byte) error {
 	return ioutil.WriteFile(s.blobPath(id), data, 0644)
 }
 
+// CompareAndSwap uses a lock file next to the data, which is only
+// safe if all processes access the store via the same file system.
+func (s fileStore) CompareAndSwap(id string, old, new []byte) (bool, error) {
+	err := os.MkdirAll(path.Join(s.path, id[len(id)-2:]), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	lockPath := s.blobPath(id) + ".lock"
+	var lock *os.File
+	for i := 0; i < 100; i++ {
+		lock, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil || !os.IsExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not lock %s: %v", id, err)
+	}
+	lock.Close()
+	defer os.Remove(lockPath)
+
+	current, err := s.Get(id)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if !bytes.Equal(current, old) {
+		return false, nil
+	}
+
+	// write to a temporary file first, so that readers never see
+	// partially written data
+	tmpPath := s.blobPath(id) + ".tmp"
+	err = ioutil.WriteFile(tmpPath, new, 0644)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tmpPath, s.blobPath(id))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (s fileStore) Delete(id string) error {
 	return os.Remove(s.blobPath(id))
 }
@@ -1,8 +1,10 @@
 package memory
 
 import (
+	"bytes"
 	"fmt"
 	"net/url"
+	"sync"
 
 	"github.com/heyLu/mu/store"
 )
@@ -28,15 +30,18 @@ func create(u *url.URL) (bool, error) {
 	if _, ok := dbs[name]; ok {
 		return false, nil
 	}
-	dbs[name] = &memoryStore{map[string][]byte{}}
+	dbs[name] = &memoryStore{store: map[string][]byte{}}
 	return true, nil
 }
 
 type memoryStore struct {
 	store map[string][]byte
+	lock  sync.RWMutex
 }
 
 func (s *memoryStore) Get(id string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if data, ok := s.store[id]; ok {
 		return data, nil
 	}
@@ -45,12 +50,26 @@ func (s *memoryStore) Get(id string) ([]byte, error) {
 }
 
 func (s *memoryStore) Put(id string, data []byte) error {
+	s.lock.Lock()
 	s.store[id] = data
+	s.lock.Unlock()
 	return nil
 }
 
+func (s *memoryStore) CompareAndSwap(id string, old, new []byte) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !bytes.Equal(s.store[id], old) {
+		return false, nil
+	}
+	s.store[id] = new
+	return true, nil
+}
+
 func (s *memoryStore) Delete(id string) error {
+	s.lock.Lock()
 	delete(s.store, id)
+	s.lock.Unlock()
 	return nil
 }
 
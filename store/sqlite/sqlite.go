@@ -90,6 +90,18 @@ func (s *sqliteStore) Put(id string, data []byte) error {
 	return err
 }
 
+func (s *sqliteStore) CompareAndSwap(id string, old, new []byte) (bool, error) {
+	res, err := s.db.Exec("UPDATE mu_kvs SET data = ? WHERE id = ? AND data = ?", new, id, old)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
 func (s *sqliteStore) Delete(id string) error {
 	_, err := s.db.Exec("DELETE FROM mu_kvs WHERE id = ?", id)
 	return err
@@ -12,6 +12,18 @@ type Store interface {
 	Close() error
 }
 
+// A CASStore is a store that can replace values atomically.
+//
+// Connections use it to update the root of a database, so that
+// transactions from different processes cannot overwrite each other.
+type CASStore interface {
+	Store
+	// CompareAndSwap replaces the data for the id with new if the
+	// current data is old.  It returns false if the data was not
+	// replaced.
+	CompareAndSwap(id string, old, new []byte) (bool, error)
+}
+
 type CreateFn func(u *url.URL) (bool, error)
 type OpenFn func(u *url.URL) (Store, error)
 
@@ -0,0 +1,202 @@
+package mu
+
+import (
+	"context"
+	"errors"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+	"time"
+
+	"github.com/heyLu/mu/connection"
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/log"
+	"github.com/heyLu/mu/transactor"
+)
+
+func TestTransactIf(t *testing.T) {
+	conn := typedConn(t)
+
+	txResult, err := Transact(conn, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "first")))
+	tu.RequireNil(t, err)
+	basisT := txResult.DbAfter.BasisT()
+	note := Id(txResult.Tempids[Tempid(DbPartUser, -1)])
+
+	_, err = TransactIf(conn, basisT, Datums(noteTitle.Datum(note, "second")))
+	tu.RequireNil(t, err)
+
+	// the previous transaction changed the database
+	_, err = TransactIf(conn, basisT, Datums(noteTitle.Datum(note, "third")))
+	var conflict *transactor.BasisConflictError
+	tu.RequireEqual(t, errors.As(err, &conflict), true)
+	tu.ExpectEqual(t, conflict.ExpectedBasisT, basisT)
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Conflict)
+	title, _ := noteTitle.Get(conn.Db().Entity(int(note)))
+	tu.ExpectEqual(t, title, "second")
+}
+
+func TestTransactIfBasisZero(t *testing.T) {
+	conn := typedConn(t)
+	tu.RequireEqual(t, conn.Db().BasisT() > 0, true)
+
+	_, err := TransactIf(conn, 0, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "first")))
+	var conflict *transactor.BasisConflictError
+	tu.RequireEqual(t, errors.As(err, &conflict), true)
+	tu.ExpectEqual(t, conflict.ExpectedBasisT, 0)
+}
+
+func TestTransactIfUntouched(t *testing.T) {
+	conn := typedConn(t)
+
+	txResult, err := Transact(conn, Datums(
+		noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "first"),
+		noteTitle.Datum(Id(Tempid(DbPartUser, -2)), "other")))
+	tu.RequireNil(t, err)
+	basisT := txResult.DbAfter.BasisT()
+	note := Id(txResult.Tempids[Tempid(DbPartUser, -1)])
+	other := Id(txResult.Tempids[Tempid(DbPartUser, -2)])
+
+	_, err = Transact(conn, Datums(noteTitle.Datum(other, "changed")))
+	tu.RequireNil(t, err)
+
+	// only the other entity was changed
+	_, err = TransactIfUntouched(conn, basisT, []database.HasLookup{note}, Datums(noteTitle.Datum(note, "second")))
+	tu.RequireNil(t, err)
+
+	_, err = TransactIfUntouched(conn, basisT, []database.HasLookup{note}, Datums(noteTitle.Datum(note, "third")))
+	var conflict *transactor.BasisConflictError
+	tu.RequireEqual(t, errors.As(err, &conflict), true)
+	tu.ExpectEqual(t, conflict.Entities, []int{int(note)})
+}
+
+func TestTransactConcurrentConnections(t *testing.T) {
+	conn := typedConn(t)
+	other, err := Connect("memory://mu?name=" + t.Name())
+	tu.RequireNil(t, err)
+	basisT := other.Db().BasisT()
+
+	first, err := Transact(conn, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "first")))
+	tu.RequireNil(t, err)
+
+	// the other connection has not seen the transaction, so it must
+	// not overwrite it, but transact against the new database instead
+	second, err := Transact(other, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "second")))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, second.DbAfter.BasisT() > first.DbAfter.BasisT(), true)
+	title, _ := noteTitle.Get(other.Db().Entity(first.Tempids[Tempid(DbPartUser, -1)]))
+	tu.ExpectEqual(t, title, "first")
+
+	third, err := Transact(conn, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "third")))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, third.DbAfter.BasisT() > second.DbAfter.BasisT(), true)
+
+	reconnected, err := Connect("memory://mu?name=" + t.Name())
+	tu.RequireNil(t, err)
+	for _, txResult := range []*transactor.TxResult{first, second, third} {
+		_, ok := noteTitle.Get(reconnected.Db().Entity(txResult.Tempids[Tempid(DbPartUser, -1)]))
+		tu.ExpectEqual(t, ok, true)
+	}
+
+	// only transactions with an explicit basis fail
+	_, err = TransactIf(other, basisT, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "fourth")))
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Conflict)
+	_, err = TransactIf(other, third.DbAfter.BasisT(), Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "fourth")))
+	tu.ExpectNil(t, err)
+}
+
+func TestTransactClientId(t *testing.T) {
+	conn := typedConn(t)
+
+	clientId := log.Squuid()
+	opts := transactor.DefaultOptions
+	opts.ClientId = &clientId
+	txData := Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "once"))
+
+	first, err := TransactWithOptions(conn, txData, opts)
+	tu.RequireNil(t, err)
+	basisT := conn.Db().BasisT()
+
+	retry, err := TransactWithOptions(conn, txData, opts)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, retry.Replayed, true)
+	tu.ExpectEqual(t, retry.DbAfter.BasisT(), first.DbAfter.BasisT())
+	tu.ExpectEqual(t, retry.Tempids, first.Tempids)
+	tu.ExpectEqual(t, retry.Datoms, first.Datoms)
+	tu.ExpectEqual(t, conn.Db().BasisT(), basisT)
+
+	// the client id is persisted, so that it is found after reconnecting
+	conn, err = Connect("memory://mu?name=" + t.Name())
+	tu.RequireNil(t, err)
+	retry, err = TransactWithOptions(conn, txData, opts)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, retry.Replayed, true)
+	tu.ExpectEqual(t, retry.Tempids, first.Tempids)
+	title, _ := noteTitle.Get(retry.DbAfter.Entity(retry.Tempids[Tempid(DbPartUser, -1)]))
+	tu.ExpectEqual(t, title, "once")
+}
+
+func TestTransactAsync(t *testing.T) {
+	conn := typedConn(t)
+
+	futures := []*connection.Future{}
+	for _, title := range []string{"first", "second", "third"} {
+		futures = append(futures, TransactAsync(conn, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), title))))
+	}
+	invalid := TransactAsync(conn, Datums(transactor.Datum{
+		Op: transactor.Assert,
+		E:  Id(Tempid(DbPartUser, -1)),
+		A:  noteTitle.Keyword,
+		V:  transactor.NewValue(42),
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the transactions are committed in the order they were submitted
+	prevBasisT := 0
+	for _, future := range futures {
+		txResult, err := future.Deref(ctx)
+		tu.RequireNil(t, err)
+		tu.ExpectEqual(t, txResult.DbAfter.BasisT() > prevBasisT, true)
+		prevBasisT = txResult.DbAfter.BasisT()
+	}
+
+	_, err := invalid.Deref(ctx)
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+	tu.ExpectEqual(t, conn.Db().BasisT(), prevBasisT)
+}
+
+func TestWithResult(t *testing.T) {
+	conn := typedConn(t)
+	db := conn.Db()
+
+	first, err := WithResult(db, Datums(noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "first")))
+	tu.RequireNil(t, err)
+	note, ok := first.Tempids[Tempid(DbPartUser, -1)]
+	tu.RequireEqual(t, ok, true)
+	tu.ExpectEqual(t, first.DbBefore, db)
+	tu.ExpectEqual(t, first.DbAfter.BasisT() > db.BasisT(), true)
+	for _, datom := range first.Datoms {
+		tu.ExpectEqual(t, datom.Tx(), 3*(1<<42)+first.DbAfter.BasisT())
+	}
+
+	// speculative transactions can be chained
+	second, err := WithResult(first.DbAfter, Datums(
+		noteTitle.Datum(Id(note), "changed"),
+		noteTitle.Datum(Id(Tempid(DbPartUser, -1)), "second")))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, second.DbAfter.BasisT() > first.DbAfter.BasisT(), true)
+	tu.ExpectEqual(t, second.Tempids[Tempid(DbPartUser, -1)] != note, true)
+	title, _ := noteTitle.Get(second.DbAfter.Entity(note))
+	tu.ExpectEqual(t, title, "changed")
+	title, _ = noteTitle.Get(first.DbAfter.Entity(note))
+	tu.ExpectEqual(t, title, "first")
+
+	// nothing was written to storage
+	tu.ExpectEqual(t, conn.Db().BasisT(), db.BasisT())
+	other, err := Connect("memory://mu?name=" + t.Name())
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, other.Db().BasisT(), db.BasisT())
+
+	_, err = WithResult(second.DbAfter.AsOf(first.DbAfter.BasisT()), Datums(noteTitle.Datum(Id(note), "past")))
+	tu.ExpectEqual(t, transactor.CategoryOf(err), transactor.Incorrect)
+}
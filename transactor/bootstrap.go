@@ -255,6 +255,78 @@ var BootstrapTxs = []log.LogTx{
 			index.NewDatom(13194139533375, 50, time.Unix(0, 0), 13194139533375, true),
 		},
 	},
+	log.LogTx{
+		Id: uuidFromString("5f6a2b1c-3d4e-4f50-8a1b-2c3d4e5f6a70"),
+		T:  64,
+		Datoms: []index.Datom{
+			index.NewDatom(0, 13, 63, 13194139533376, true),
+			index.NewDatom(0, 13, 64, 13194139533376, true),
+			index.NewDatom(0, 13, 65, 13194139533376, true),
+			index.NewDatom(0, 13, 66, 13194139533376, true),
+			index.NewDatom(0, 12, 67, 13194139533376, true),
+			index.NewDatom(0, 13, 68, 13194139533376, true),
+			index.NewDatom(0, 13, 69, 13194139533376, true),
+			index.NewDatom(0, 13, 70, 13194139533376, true),
+			index.NewDatom(63, 10, fressian.Keyword{Namespace: "db", Name: "ensure"}, 13194139533376, true),
+			index.NewDatom(63, 40, 20, 13194139533376, true),
+			index.NewDatom(63, 41, 36, 13194139533376, true),
+			index.NewDatom(63, 62, "Asserting this attribute on an entity with value v checks the entity against the entity spec v after the transaction. The assertion itself is not stored.", 13194139533376, true),
+			index.NewDatom(64, 10, fressian.Keyword{Namespace: "db.entity", Name: "attrs"}, 13194139533376, true),
+			index.NewDatom(64, 40, 21, 13194139533376, true),
+			index.NewDatom(64, 41, 36, 13194139533376, true),
+			index.NewDatom(64, 62, "Attributes that an entity must have to satisfy an entity spec.", 13194139533376, true),
+			index.NewDatom(65, 10, fressian.Keyword{Namespace: "db.entity", Name: "preds"}, 13194139533376, true),
+			index.NewDatom(65, 40, 21, 13194139533376, true),
+			index.NewDatom(65, 41, 36, 13194139533376, true),
+			index.NewDatom(65, 62, "Names of registered predicates that an entity must satisfy to satisfy an entity spec.", 13194139533376, true),
+			index.NewDatom(66, 10, fressian.Keyword{Namespace: "db.attr", Name: "preds"}, 13194139533376, true),
+			index.NewDatom(66, 40, 21, 13194139533376, true),
+			index.NewDatom(66, 41, 36, 13194139533376, true),
+			index.NewDatom(66, 62, "Names of registered predicates that every value asserted for an attribute must satisfy.", 13194139533376, true),
+			index.NewDatom(67, 10, fressian.Keyword{Namespace: "db.type", Name: "tuple"}, 13194139533376, true),
+			index.NewDatom(67, 39, fressian.Keyword{Namespace: "", Name: "list"}, 13194139533376, true),
+			index.NewDatom(67, 62, "Value type for tuples of scalar values. Composite tuples are maintained automatically from the attributes given by :db/tupleAttrs.", 13194139533376, true),
+			index.NewDatom(68, 10, fressian.Keyword{Namespace: "db", Name: "tupleAttrs"}, 13194139533376, true),
+			index.NewDatom(68, 40, 67, 13194139533376, true),
+			index.NewDatom(68, 41, 35, 13194139533376, true),
+			index.NewDatom(68, 62, "Attributes whose values make up a composite tuple attribute. The value of the tuple attribute is updated automatically when the values of these attributes change.", 13194139533376, true),
+			index.NewDatom(69, 10, fressian.Keyword{Namespace: "tx", Name: "client-id"}, 13194139533376, true),
+			index.NewDatom(69, 40, 56, 13194139533376, true),
+			index.NewDatom(69, 41, 35, 13194139533376, true),
+			index.NewDatom(69, 42, 37, 13194139533376, true),
+			index.NewDatom(69, 62, "Client-generated id of a transaction. A transaction with the id of an already committed one is not applied again.", 13194139533376, true),
+			index.NewDatom(70, 10, fressian.Keyword{Namespace: "tx", Name: "tempids"}, 13194139533376, true),
+			index.NewDatom(70, 40, 67, 13194139533376, true),
+			index.NewDatom(70, 41, 35, 13194139533376, true),
+			index.NewDatom(70, 62, "The tempids of a transaction with a :tx/client-id and the entity ids they were resolved to, as a tuple of alternating tempids and entity ids.", 13194139533376, true),
+			index.NewDatom(13194139533376, 50, time.Unix(0, 0), 13194139533376, true),
+		},
+	},
+}
+
+// bootstrapIdents maps the ids of the entities defined by the
+// bootstrap transactions to their idents.
+var bootstrapIdents = func() map[int]fressian.Keyword {
+	idents := map[int]fressian.Keyword{}
+	for _, tx := range BootstrapTxs {
+		for _, datom := range tx.Datoms {
+			if datom.A() == DbIdent {
+				idents[datom.E()] = datom.V().Val().(fressian.Keyword)
+			}
+		}
+	}
+	return idents
+}()
+
+// hasBuiltin returns true if the database has the entity with the id
+// as defined by the bootstrap transactions.
+//
+// Databases created before the entity was added to the bootstrap
+// transactions don't have it, and might use the id for one of their
+// own attributes instead.
+func hasBuiltin(db *database.Db, id int) bool {
+	attr := db.Attribute(id)
+	return attr != nil && attr.Ident() == bootstrapIdents[id]
 }
 
 func uuidFromString(s string) fressian.UUID {
@@ -0,0 +1,103 @@
+package transactor
+
+import (
+	"github.com/heyLu/fressian"
+	"sort"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	txlog "github.com/heyLu/mu/log"
+)
+
+const (
+	DbTxClientId = 69 // :tx/client-id
+	DbTxTempids  = 70 // :tx/tempids
+)
+
+// checkClientIds fails if the database was created before client ids
+// were supported, as it has no attributes to store them.
+func checkClientIds(db *database.Db) error {
+	if !hasBuiltin(db, DbTxClientId) || !hasBuiltin(db, DbTxTempids) {
+		return anomalyf(Unsupported, "client ids are not supported by this database, it has no :tx/client-id and :tx/tempids attributes")
+	}
+	return nil
+}
+
+// findClientTx returns the id of the transaction with the client id.
+//
+// The lookup uses the avet index, which also contains the transactions
+// in the log tail that are not yet part of the persisted index.
+func findClientTx(db *database.Db, clientId fressian.UUID) (int, bool) {
+	datom, ok := existsUniqueValue(db, DbTxClientId, index.NewValue(clientId))
+	if !ok || datom.A() != DbTxClientId || datom.V().Compare(index.NewValue(clientId)) != 0 {
+		return -1, false
+	}
+	return datom.E(), true
+}
+
+// tempidsDatom returns the datom that stores the tempids of the
+// transaction, so that they can be returned when it is replayed.
+func tempidsDatom(tx int, tempids map[int]int) index.Datom {
+	ids := make([]int, 0, len(tempids))
+	for tempid := range tempids {
+		ids = append(ids, tempid)
+	}
+	sort.Ints(ids)
+
+	elems := make([]interface{}, 0, 2*len(ids))
+	for _, tempid := range ids {
+		elems = append(elems, tempid, tempids[tempid])
+	}
+	return index.NewDatom(tx, DbTxTempids, index.NewTuple(elems...), tx, Assert)
+}
+
+// replayedTxResult reconstructs the result of the earlier transaction
+// tx from the database and the tempids stored with it.
+//
+// The datoms of the transaction are read from the log if there is one,
+// otherwise from the history of the database, which has to be read in
+// full, as the indexes are not sorted by transaction.
+func replayedTxResult(db *database.Db, dbLog *txlog.Log, tx int) (*TxResult, error) {
+	t := tx % (3 * (1 << 42))
+
+	datoms, err := txDatoms(db, dbLog, t)
+	if err != nil {
+		return nil, err
+	}
+
+	tempids := map[int]int{}
+	if val := currentValue(db, tx, DbTxTempids); val != nil {
+		elems := val.Val().([]interface{})
+		for i := 0; i+1 < len(elems); i += 2 {
+			tempids[elems[i].(int)] = elems[i+1].(int)
+		}
+	}
+
+	return &TxResult{
+		DbBefore: db.AsOf(t - 1),
+		DbAfter:  db.AsOf(t),
+		Tempids:  tempids,
+		Datoms:   datoms,
+		Replayed: true,
+	}, nil
+}
+
+// txDatoms returns the datoms of the transaction with the t.
+func txDatoms(db *database.Db, dbLog *txlog.Log, t int) ([]index.Datom, error) {
+	if dbLog != nil {
+		logTx, err := dbLog.Tx(t)
+		if err != nil {
+			return nil, err
+		}
+		if logTx != nil {
+			return logTx.Datoms, nil
+		}
+	}
+
+	datoms := []index.Datom{}
+	iter := db.History().Since(t).AsOf(t).Eavt().Datoms()
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		datoms = append(datoms, *datom)
+	}
+	return datoms, nil
+}
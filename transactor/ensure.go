@@ -0,0 +1,124 @@
+package transactor
+
+import (
+	"fmt"
+	"github.com/heyLu/fressian"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+const (
+	DbEnsure      = 63 // :db/ensure
+	DbEntityAttrs = 64 // :db.entity/attrs
+	DbEntityPreds = 65 // :db.entity/preds
+)
+
+// An EntityPredicate checks whether an entity is valid in the database
+// resulting from a transaction.
+type EntityPredicate func(db *database.Db, entity int) bool
+
+var registeredEntityPredicates = map[fressian.Keyword]EntityPredicate{}
+
+// RegisterEntityPredicate makes the predicate available under the
+// given name, so that it can be used in `:db.entity/preds`.
+func RegisterEntityPredicate(name database.Keyword, pred EntityPredicate) {
+	if _, ok := registeredEntityPredicates[name.Keyword]; ok {
+		panic(fmt.Sprint("duplicate entity predicate ", name))
+	}
+
+	registeredEntityPredicates[name.Keyword] = pred
+}
+
+// splitEnsures separates the `:db/ensure` datoms from the other datoms
+// of a transaction.
+//
+// `:db/ensure` only triggers validation, it is never stored.
+func splitEnsures(db *database.Db, datoms []index.Datom) ([]index.Datom, []index.Datom) {
+	if !hasBuiltin(db, DbEnsure) {
+		return datoms, nil
+	}
+
+	newDatoms := make([]index.Datom, 0, len(datoms))
+	ensures := []index.Datom{}
+	for _, datom := range datoms {
+		if datom.A() == DbEnsure {
+			if datom.Added() {
+				ensures = append(ensures, datom)
+			}
+			continue
+		}
+
+		newDatoms = append(newDatoms, datom)
+	}
+	return newDatoms, ensures
+}
+
+// checkEntitySpecs verifies that the entities satisfy the entity specs
+// they were asserted against using `:db/ensure`.
+//
+// An entity spec is an entity with `:db.entity/attrs`, the attributes
+// that an entity must have, and `:db.entity/preds`, the names of
+// registered predicates that must return true for the entity, e.g.:
+//
+//     {:db/ident :note/spec
+//      :db.entity/attrs #{:note/title :note/content}
+//      :db.entity/preds #{:note/valid-title?}}
+func checkEntitySpecs(db *database.Db, ensures []index.Datom) error {
+	for _, ensure := range ensures {
+		entity := ensure.E()
+		spec := ensure.V().Val().(int)
+		specName := fmt.Sprint(spec)
+		if ident := db.Ident(spec); ident != nil {
+			specName = fmt.Sprint(*ident)
+		}
+
+		foundSpec := false
+		iter := db.Eavt().DatomsAt(
+			index.NewDatom(spec, DbEntityAttrs, index.MinValue, index.MaxDatom.Tx(), false),
+			index.NewDatom(spec, DbEntityPreds, index.MaxValue, index.MinDatom.Tx(), true))
+		for datom := iter.Next(); datom != nil; datom = iter.Next() {
+			if datom.E() != spec {
+				break
+			}
+
+			name := datom.V().Val().(fressian.Keyword)
+			switch datom.A() {
+			case DbEntityAttrs:
+				foundSpec = true
+				attrId := db.Entid(database.Keyword{name})
+				if attrId == -1 {
+					return anomalyf(Incorrect, "entity spec %s requires unknown attribute %v", specName, name)
+				}
+
+				if !hasAttribute(db, entity, attrId) {
+					return anomalyf(Incorrect, "entity %d does not satisfy %s: missing required attribute %v", entity, specName, name)
+				}
+			case DbEntityPreds:
+				foundSpec = true
+				pred, ok := registeredEntityPredicates[name]
+				if !ok {
+					return anomalyf(Incorrect, "entity spec %s uses unknown predicate %v", specName, name)
+				}
+
+				if !pred(db, entity) {
+					return anomalyf(Incorrect, "entity %d does not satisfy %s: predicate %v failed", entity, specName, name)
+				}
+			}
+		}
+
+		if !foundSpec {
+			return anomalyf(Incorrect, "%s is not an entity spec", specName)
+		}
+	}
+
+	return nil
+}
+
+func hasAttribute(db *database.Db, entity int, attrId int) bool {
+	iter := db.Eavt().DatomsAt(
+		index.NewDatom(entity, attrId, index.MinValue, index.MaxDatom.Tx(), false),
+		index.NewDatom(entity, attrId, index.MaxValue, index.MinDatom.Tx(), true))
+	datom := iter.Next()
+	return datom != nil && datom.E() == entity && datom.A() == attrId
+}
@@ -0,0 +1,63 @@
+package transactor
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"strings"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+func init() {
+	RegisterEntityPredicate(database.Keyword{fressian.Keyword{"note", "short-title?"}}, func(db *database.Db, entity int) bool {
+		title, ok := db.Entity(entity).Get(database.Keyword{fressian.Keyword{"note", "title"}}).(string)
+		return ok && len(title) <= 10
+	})
+}
+
+func specDb(t *testing.T) *database.Db {
+	schema := mustTransact(t, InitialDb, testutil.Schema(testutil.Notes...))
+
+	spec := mustTransact(t, schema.DbAfter, `[{:db/id #db/id[:db.part/user]
+  :db/ident :note/spec
+  :db.entity/attrs #{:note/title :note/content}
+  :db.entity/preds #{:note/short-title?}}]`)
+	return spec.DbAfter
+}
+
+func TestEnsure(t *testing.T) {
+	db := specDb(t)
+
+	txResult := mustTransact(t, db, `[{:db/id #db/id[:db.part/user]
+  :note/title "hello"
+  :note/content "world"
+  :db/ensure :note/spec}]`)
+	for _, datom := range txResult.Datoms {
+		tu.ExpectEqual(t, datom.A() != DbEnsure, true)
+	}
+
+	note := txResult.Datoms[0].E()
+	ensures := txResult.DbAfter.Entity(note).Get(database.Keyword{fressian.Keyword{"db", "ensure"}})
+	tu.ExpectEqual(t, len(ensures.([]interface{})), 0)
+}
+
+func TestEnsureInvalid(t *testing.T) {
+	db := specDb(t)
+
+	for _, tc := range []struct {
+		txData string
+		err    string
+	}{
+		{`[{:db/id #db/id[:db.part/user] :note/title "hello" :db/ensure :note/spec}]`, "missing required attribute"},
+		{`[{:db/id #db/id[:db.part/user] :note/title "hello there!" :note/content "" :db/ensure :note/spec}]`, "predicate"},
+		{`[{:db/id #db/id[:db.part/user] :note/title "hello" :db/ensure :db/ident}]`, "not an entity spec"},
+	} {
+		txData, err := TxDataFromEDN(tc.txData)
+		tu.RequireNil(t, err)
+		_, _, err = Transact(db, txData)
+		tu.RequireNotNil(t, err)
+		tu.ExpectEqual(t, strings.Contains(err.Error(), tc.err), true)
+	}
+}
@@ -0,0 +1,176 @@
+package transactor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/heyLu/fressian"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+// A Category classifies errors, similar to the categories of
+// cognitect.anomalies used by datomic.
+type Category int
+
+const (
+	Incorrect   Category = iota + 1 // the request was invalid, don't retry it
+	Conflict                        // the request conflicts with the current state, e.g. uniqueness
+	NotFound                        // something the request refers to does not exist
+	Unavailable                     // temporarily unavailable, retrying might help
+	Fault                           // an unexpected error
+	Unsupported                     // the request is not supported, e.g. by an older database
+)
+
+func (c Category) String() string {
+	switch c {
+	case Incorrect:
+		return "cognitect.anomalies/incorrect"
+	case Conflict:
+		return "cognitect.anomalies/conflict"
+	case NotFound:
+		return "cognitect.anomalies/not-found"
+	case Unavailable:
+		return "cognitect.anomalies/unavailable"
+	case Fault:
+		return "cognitect.anomalies/fault"
+	case Unsupported:
+		return "cognitect.anomalies/unsupported"
+	default:
+		return fmt.Sprintf("Category(%d)", int(c))
+	}
+}
+
+// An Anomaly is an error with a category.
+//
+// All errors returned by the transactor can be inspected using
+// `errors.As(err, &anomaly)`, where anomaly is an `*Anomaly`.  The
+// more specific errors, like *UniqueConflictError, are available as
+// well.
+type Anomaly struct {
+	Category Category
+	Message  string
+	Err      error
+}
+
+func (a *Anomaly) Error() string { return a.Message }
+func (a *Anomaly) Unwrap() error { return a.Err }
+
+// CategoryOf returns the category of the error, or Fault if it has
+// none.
+func CategoryOf(err error) Category {
+	var anomaly *Anomaly
+	if errors.As(err, &anomaly) {
+		return anomaly.Category
+	}
+	return Fault
+}
+
+func anomalyf(category Category, format string, args ...interface{}) error {
+	return &Anomaly{Category: category, Message: fmt.Sprintf(format, args...)}
+}
+
+func asAnomaly(target interface{}, category Category, err error) bool {
+	anomaly, ok := target.(**Anomaly)
+	if !ok {
+		return false
+	}
+	*anomaly = &Anomaly{Category: category, Message: err.Error(), Err: err}
+	return true
+}
+
+// UniqueConflictError is returned if a value for a unique attribute
+// already exists on a different entity.
+type UniqueConflictError struct {
+	Attr           fressian.Keyword
+	Value          interface{}
+	ExistingEntity int
+}
+
+func (e *UniqueConflictError) Error() string {
+	return fmt.Sprintf("not unique, value %#v for %v already exists on entity %d", e.Value, e.Attr, e.ExistingEntity)
+}
+
+func (e *UniqueConflictError) As(target interface{}) bool {
+	return asAnomaly(target, Conflict, e)
+}
+
+// TypeMismatchError is returned if a value does not have the
+// :db/valueType of its attribute.
+type TypeMismatchError struct {
+	Attr     fressian.Keyword
+	Expected index.ValueType
+	Actual   index.ValueType
+	Value    interface{}
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("expected value of type %v for %v, but got %#v of type %v",
+		e.Expected, e.Attr, e.Value, e.Actual)
+}
+
+func (e *TypeMismatchError) As(target interface{}) bool {
+	return asAnomaly(target, Incorrect, e)
+}
+
+// CASFailedError is returned by :db.fn/cas if the current value is not
+// the expected one.  Expected and Actual are nil if there is no value.
+type CASFailedError struct {
+	Entity   int
+	Attr     fressian.Keyword
+	Expected *index.Value
+	Actual   *index.Value
+}
+
+func (e *CASFailedError) Error() string {
+	return fmt.Sprintf("cas failed for %v of %d, expected %v, but got %v",
+		e.Attr, e.Entity, valueOrNil(e.Expected), valueOrNil(e.Actual))
+}
+
+func (e *CASFailedError) As(target interface{}) bool {
+	return asAnomaly(target, Conflict, e)
+}
+
+func valueOrNil(val *index.Value) interface{} {
+	if val == nil {
+		return nil
+	}
+	return *val
+}
+
+// UnknownAttributeError is returned if an attribute does not exist,
+// either because there is no entity for it or because it has no
+// :db/valueType.
+type UnknownAttributeError struct {
+	Attr database.HasLookup
+}
+
+func (e *UnknownAttributeError) Error() string {
+	return fmt.Sprintf("unknown attribute %v", e.Attr)
+}
+
+func (e *UnknownAttributeError) As(target interface{}) bool {
+	return asAnomaly(target, Incorrect, e)
+}
+
+// BasisConflictError is returned if a transaction with
+// Options.IfBasisT is attempted after the database has changed.
+//
+// If Options.IfUntouched was given, Entities contains the ones that
+// were changed.
+type BasisConflictError struct {
+	ExpectedBasisT int
+	BasisT         int
+	Entities       []int
+}
+
+func (e *BasisConflictError) Error() string {
+	if len(e.Entities) > 0 {
+		return fmt.Sprintf("entities %v were changed since basisT %d (now %d)", e.Entities, e.ExpectedBasisT, e.BasisT)
+	}
+	return fmt.Sprintf("database was changed since basisT %d (now %d)", e.ExpectedBasisT, e.BasisT)
+}
+
+func (e *BasisConflictError) As(target interface{}) bool {
+	return asAnomaly(target, Conflict, e)
+}
@@ -0,0 +1,114 @@
+package transactor
+
+import (
+	"errors"
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"strconv"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+func transactError(t *testing.T, db *database.Db, edn string) error {
+	txData, err := TxDataFromEDN(edn)
+	tu.RequireNil(t, err)
+	_, _, err = Transact(db, txData)
+	tu.RequireNotNil(t, err)
+	return err
+}
+
+func errorsDb(t *testing.T) (*database.Db, int) {
+	db := mustTransact(t, InitialDb, testutil.Schema(testutil.One("user/email", "string").UniqueValue())).DbAfter
+	txResult := mustTransact(t, db, `[{:db/id #db/id[:db.part/user -1] :user/email "jane@example.com"}]`)
+	return txResult.DbAfter, txResult.Datoms[0].E()
+}
+
+func TestUniqueConflictError(t *testing.T) {
+	db, jane := errorsDb(t)
+
+	err := transactError(t, db, `[{:db/id #db/id[:db.part/user -1] :user/email "jane@example.com"}]`)
+	var conflict *UniqueConflictError
+	tu.RequireEqual(t, errors.As(err, &conflict), true)
+	tu.ExpectEqual(t, conflict.Attr, fressian.Keyword{"user", "email"})
+	tu.ExpectEqual(t, conflict.Value, "jane@example.com")
+	tu.ExpectEqual(t, conflict.ExistingEntity, jane)
+
+	var anomaly *Anomaly
+	tu.RequireEqual(t, errors.As(err, &anomaly), true)
+	tu.ExpectEqual(t, anomaly.Category, Conflict)
+	tu.ExpectEqual(t, CategoryOf(err), Conflict)
+}
+
+func TestTypeMismatchError(t *testing.T) {
+	db, _ := errorsDb(t)
+
+	err := transactError(t, db, `[{:db/id #db/id[:db.part/user -1] :user/email :not-a-string}]`)
+	var mismatch *TypeMismatchError
+	tu.RequireEqual(t, errors.As(err, &mismatch), true)
+	tu.ExpectEqual(t, mismatch.Expected, index.String)
+	tu.ExpectEqual(t, mismatch.Actual, index.Keyword)
+	tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+}
+
+func TestUnknownAttributeError(t *testing.T) {
+	db, _ := errorsDb(t)
+
+	err := transactError(t, db, `[{:db/id #db/id[:db.part/user -1] :user/unknown "value"}]`)
+	var unknown *UnknownAttributeError
+	tu.RequireEqual(t, errors.As(err, &unknown), true)
+	tu.ExpectEqual(t, unknown.Attr, database.Keyword{fressian.Keyword{"user", "unknown"}})
+	tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+}
+
+func TestCASFailedError(t *testing.T) {
+	db, jane := errorsDb(t)
+
+	expected := index.NewValue("judy@example.com")
+	newValue := index.NewValue("jane.lane@example.com")
+	_, _, err := Transact(db, []TxDatum{
+		FnCompareAndSwap(database.Id(jane), database.Keyword{fressian.Keyword{"user", "email"}}, &expected, &newValue),
+	})
+	tu.RequireNotNil(t, err)
+
+	var cas *CASFailedError
+	tu.RequireEqual(t, errors.As(err, &cas), true)
+	tu.ExpectEqual(t, cas.Entity, jane)
+	tu.ExpectEqual(t, *cas.Expected, expected)
+	tu.ExpectEqual(t, cas.Actual.Val(), "jane@example.com")
+	tu.ExpectEqual(t, CategoryOf(err), Conflict)
+
+	expected = index.NewValue("jane@example.com")
+	_, txResult, err := Transact(db, []TxDatum{
+		FnCompareAndSwap(database.Id(jane), database.Keyword{fressian.Keyword{"user", "email"}}, &expected, &newValue),
+	})
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, txResult.DbAfter.Entity(jane).Get(database.Keyword{fressian.Keyword{"user", "email"}}), "jane.lane@example.com")
+}
+
+func TestAnomalyCategory(t *testing.T) {
+	db, jane := errorsDb(t)
+
+	err := transactError(t, db, `[[:db/add `+strconv.Itoa(jane)+` :db/ensure :user/email]]`)
+	tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+
+	tu.ExpectEqual(t, CategoryOf(errors.New("something else")), Fault)
+}
+
+func TestTxDataFromEDNError(t *testing.T) {
+	for _, edn := range []string{
+		`[[:db/add`,
+		`{:db/id 1}`,
+		`[[:db/assert 1 :user/email "jane@example.com"]]`,
+		`[{:user/email "jane@example.com"}]`,
+	} {
+		_, err := TxDataFromEDN(edn)
+		tu.RequireNotNil(t, err)
+		tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+	}
+
+	_, err := HasLookupFromEDN(`"not an entity"`)
+	tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+}
@@ -0,0 +1,126 @@
+package transactor
+
+import (
+	"time"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+const (
+	DbExcise        = 15 // :db/excise
+	DbExciseAttrs   = 16 // :db.excise/attrs
+	DbExciseBeforeT = 17 // :db.excise/beforeT
+	DbExciseBefore  = 18 // :db.excise/before
+)
+
+// An excision describes which datoms of an entity should be removed
+// permanently.
+//
+// It is specified in a transaction by an entity with a `:db/excise`
+// attribute pointing to the entity to remove, e.g.:
+//
+//     {:db/id #db/id[:db.part/user]
+//      :db/excise 17592186045418
+//      :db.excise/attrs #{:note/content}
+//      :db.excise/beforeT 1042}
+//
+// `:db.excise/attrs` limits the excision to the given attributes,
+// `:db.excise/beforeT` and `:db.excise/before` limit it to datoms
+// from transactions before the given t or time.
+type excision struct {
+	entity  int
+	attrs   map[int]bool
+	beforeT int
+	before  *time.Time
+}
+
+// findExcisions collects the excisions requested by the datoms of a
+// transaction.
+func findExcisions(datoms []index.Datom) ([]excision, error) {
+	excisions := map[int]*excision{}
+	get := func(e int) *excision {
+		ex, ok := excisions[e]
+		if !ok {
+			ex = &excision{entity: -1, attrs: map[int]bool{}, beforeT: -1}
+			excisions[e] = ex
+		}
+		return ex
+	}
+
+	for _, datom := range datoms {
+		if !datom.Added() {
+			continue
+		}
+
+		switch datom.A() {
+		case DbExcise:
+			get(datom.E()).entity = datom.V().Val().(int)
+		case DbExciseAttrs:
+			ex := get(datom.E())
+			ex.attrs[datom.V().Val().(int)] = true
+		case DbExciseBeforeT:
+			get(datom.E()).beforeT = datom.V().Val().(int) % (3 * (1 << 42))
+		case DbExciseBefore:
+			before := datom.V().Val().(time.Time)
+			get(datom.E()).before = &before
+		}
+	}
+
+	res := make([]excision, 0, len(excisions))
+	for e, ex := range excisions {
+		if ex.entity == -1 {
+			return nil, anomalyf(Incorrect, "excision %d is missing a :db/excise target", e)
+		}
+
+		switch Part(ex.entity) {
+		case DbPartDb, DbPartTx:
+			return nil, anomalyf(Incorrect, "cannot excise entity %d in partition %d", ex.entity, Part(ex.entity))
+		}
+
+		res = append(res, *ex)
+	}
+	return res, nil
+}
+
+// excisedDatoms returns all datoms (including historic ones) that are
+// removed by the excisions.
+func excisedDatoms(db *database.Db, excisions []excision) []index.Datom {
+	historyDb := db.History()
+	txInstants := map[int]time.Time{}
+
+	datoms := make([]index.Datom, 0)
+	for _, ex := range excisions {
+		iter := historyDb.Eavt().DatomsAt(
+			index.NewDatom(ex.entity, index.MinDatom.A(), index.MinValue, index.MaxDatom.Tx(), false),
+			index.NewDatom(ex.entity, index.MaxDatom.A(), index.MaxValue, index.MinDatom.Tx(), true))
+		for datom := iter.Next(); datom != nil; datom = iter.Next() {
+			if datom.E() != ex.entity {
+				continue
+			}
+
+			if len(ex.attrs) > 0 && !ex.attrs[datom.A()] {
+				continue
+			}
+
+			if ex.beforeT != -1 && datom.Tx()%(3*(1<<42)) >= ex.beforeT {
+				continue
+			}
+
+			if ex.before != nil {
+				txInstant, ok := txInstants[datom.Tx()]
+				if !ok {
+					txInstant = txInstantOf(db, datom.Tx())
+					txInstants[datom.Tx()] = txInstant
+				}
+
+				if !txInstant.Before(*ex.before) {
+					continue
+				}
+			}
+
+			datoms = append(datoms, *datom)
+		}
+	}
+	return datoms
+}
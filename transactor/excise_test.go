@@ -0,0 +1,93 @@
+package transactor
+
+import (
+	tu "github.com/klingtnet/gol/util/testing"
+	"strconv"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+func mustTransact(t *testing.T, db *database.Db, edn string) *TxResult {
+	return testutil.MustTransact(t, TxDataFromEDN, func(txData []TxDatum) (*TxResult, error) {
+		_, txResult, err := Transact(db, txData)
+		return txResult, err
+	}, edn)
+}
+
+func entityDatoms(db *database.Db, entity int) []index.Datom {
+	iter := db.History().Eavt().DatomsAt(
+		index.NewDatom(entity, index.MinDatom.A(), index.MinValue, index.MaxDatom.Tx(), false),
+		index.NewDatom(entity, index.MaxDatom.A(), index.MaxValue, index.MinDatom.Tx(), true))
+	datoms := []index.Datom{}
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		if datom.E() == entity {
+			datoms = append(datoms, *datom)
+		}
+	}
+	return datoms
+}
+
+func TestExcise(t *testing.T) {
+	schema := mustTransact(t, InitialDb, testutil.Schema(testutil.Notes...))
+
+	note := mustTransact(t, schema.DbAfter, `[{:db/id #db/id[:db.part/user -1]
+  :note/title "secret"
+  :note/content "very secret"}]`)
+	id := note.Datoms[0].E()
+
+	updated := mustTransact(t, note.DbAfter, `[[:db/add [:note/title "secret"] :note/content "even more secret"]]`)
+	tu.ExpectEqual(t, len(entityDatoms(updated.DbAfter, id)), 4)
+
+	// excise only the content
+	excised := mustTransact(t, updated.DbAfter, `[{:db/id #db/id[:db.part/user]
+  :db/excise `+strconv.Itoa(id)+`
+  :db.excise/attrs #{:note/content}}]`)
+	tu.ExpectEqual(t, len(excised.Excised), 3)
+	datoms := entityDatoms(excised.DbAfter, id)
+	tu.ExpectEqual(t, len(datoms), 1)
+	tu.ExpectEqual(t, datoms[0].V().Val(), "secret")
+
+	// the database before the excision is unchanged
+	tu.ExpectEqual(t, len(entityDatoms(excised.DbBefore, id)), 4)
+
+	// excise everything
+	excised = mustTransact(t, excised.DbAfter, `[{:db/id #db/id[:db.part/user]
+  :db/excise `+strconv.Itoa(id)+`}]`)
+	tu.ExpectEqual(t, len(excised.Excised), 1)
+	tu.ExpectEqual(t, len(entityDatoms(excised.DbAfter, id)), 0)
+}
+
+func TestExciseBeforeT(t *testing.T) {
+	schema := mustTransact(t, InitialDb, `[{:db/id #db/id[:db.part/db]
+  :db/ident :counter/value
+  :db/valueType :db.type/long
+  :db/cardinality :db.cardinality/one}]`)
+
+	counter := mustTransact(t, schema.DbAfter, `[[:db/add #db/id[:db.part/user -1] :counter/value 1]]`)
+	id := counter.Datoms[0].E()
+	db := counter.DbAfter
+	for i := 2; i <= 3; i++ {
+		db = mustTransact(t, db, `[[:db/add `+strconv.Itoa(id)+` :counter/value `+strconv.Itoa(i)+`]]`).DbAfter
+	}
+	// 1 + 2*2 datoms (assertion and retraction of the previous value)
+	tu.ExpectEqual(t, len(entityDatoms(db, id)), 5)
+
+	excised := mustTransact(t, db, `[{:db/id #db/id[:db.part/user]
+  :db/excise `+strconv.Itoa(id)+`
+  :db.excise/beforeT `+strconv.Itoa(db.BasisT())+`}]`)
+	datoms := entityDatoms(excised.DbAfter, id)
+	tu.ExpectEqual(t, len(datoms), 2)
+	for _, datom := range datoms {
+		tu.ExpectEqual(t, datom.Tx()%(3*(1<<42)), db.BasisT())
+	}
+}
+
+func TestExciseInvalid(t *testing.T) {
+	txData, err := TxDataFromEDN(`[{:db/id #db/id[:db.part/user] :db/excise :db/ident}]`)
+	tu.RequireNil(t, err)
+	_, _, err = Transact(InitialDb, txData)
+	tu.ExpectNotNil(t, err)
+}
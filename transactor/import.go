@@ -0,0 +1,81 @@
+package transactor
+
+import (
+	"github.com/heyLu/mu/database"
+	txlog "github.com/heyLu/mu/log"
+)
+
+// An Importer validates the transactions of a bulk import and assigns
+// their ids, see connection.BulkImport.
+//
+// Unlike Transact, it does not build a TxResult for every transaction
+// and keeps track of the next ids in :db.part/db itself, instead of
+// searching the database for them.  The datoms of every transaction
+// are added to the in-memory indexes of the database, so that the
+// following transactions are validated against them.
+type Importer struct {
+	db           *database.Db
+	nextPartDbId int
+}
+
+func NewImporter(db *database.Db) *Importer {
+	return &Importer{db: db, nextPartDbId: findMaxEntity(db, 0) + 1}
+}
+
+// Db returns the database with all transactions imported so far.
+func (imp *Importer) Db() *database.Db {
+	return imp.db
+}
+
+// Reset continues the import with db, which must contain the same
+// datoms as Db, e.g. after they were written to the store.
+func (imp *Importer) Reset(db *database.Db) {
+	imp.db = db
+}
+
+// Transact validates the transaction, assigns its ids and returns it
+// as it would be stored in the log.
+//
+// Transactions that excise datoms fail with an Incorrect anomaly.
+func (imp *Importer) Transact(txData []TxDatum) (*txlog.LogTx, error) {
+	db := imp.db
+	txState := newTxStateAt(db, imp.nextPartDbId)
+
+	datums, err := resolveTxData(db, txData)
+	if err != nil {
+		return nil, err
+	}
+
+	datums, err = validate(db, datums)
+	if err != nil {
+		return nil, err
+	}
+
+	datoms := assignIds(txState, db, datums)
+
+	datoms, err = ensureTxInstant(txState, db, datoms, DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	datoms, ensures := splitEnsures(db, datoms)
+
+	excisions, err := findExcisions(datoms)
+	if err != nil {
+		return nil, err
+	}
+	if len(excisions) > 0 {
+		return nil, anomalyf(Incorrect, "cannot excise datoms during a bulk import")
+	}
+
+	dbAfter := db.WithDatomsT(db.NextT(), txState.nextId, datoms)
+
+	err = checkEntitySpecs(dbAfter, ensures)
+	if err != nil {
+		return nil, err
+	}
+
+	imp.db = dbAfter
+	imp.nextPartDbId = txState.nextPartDbId
+	return txlog.NewTx(db.NextT(), datoms), nil
+}
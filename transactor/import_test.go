@@ -0,0 +1,59 @@
+package transactor
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"strconv"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+func TestImporter(t *testing.T) {
+	importer := NewImporter(InitialDb)
+	importTx := func(edn string) ([]index.Datom, error) {
+		txData, err := TxDataFromEDN(edn)
+		tu.RequireNil(t, err)
+		tx, err := importer.Transact(txData)
+		if err != nil {
+			return nil, err
+		}
+		tu.ExpectEqual(t, tx.T, importer.Db().BasisT())
+		return tx.Datoms, nil
+	}
+
+	// attributes defined by earlier transactions can be used
+	_, err := importTx(testutil.Schema(
+		testutil.One("note/title", "string").Identity(),
+		testutil.One("note/rank", "long")))
+	tu.RequireNil(t, err)
+	db := importer.Db()
+	title := db.Entid(database.Keyword{fressian.Keyword{"note", "title"}})
+	rank := db.Entid(database.Keyword{fressian.Keyword{"note", "rank"}})
+	tu.ExpectEqual(t, rank, title+1)
+
+	datoms, err := importTx(`[{:db/id #db/id[:db.part/user] :note/title "first"}]`)
+	tu.RequireNil(t, err)
+	first := datoms[0].E()
+
+	// upserts see the entities of earlier transactions
+	datoms, err = importTx(`[{:db/id #db/id[:db.part/user] :note/title "first" :note/rank 1}]`)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, datoms[0].E(), first)
+
+	_, err = importTx(`[{:db/id #db/id[:db.part/user] :note/rank "not a long"}]`)
+	tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+
+	basisT := importer.Db().BasisT()
+	_, err = importTx(`[{:db/id #db/id[:db.part/user] :db/excise ` + strconv.Itoa(first) + `}]`)
+	tu.ExpectEqual(t, CategoryOf(err), Incorrect)
+	tu.ExpectEqual(t, importer.Db().BasisT(), basisT)
+
+	// the ids in :db.part/db continue after a reset
+	importer.Reset(importer.Db())
+	_, err = importTx(testutil.Schema(testutil.One("note/content", "string")))
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, importer.Db().Entid(database.Keyword{fressian.Keyword{"note", "content"}}), rank+1)
+}
@@ -0,0 +1,322 @@
+package transactor
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+// StructTx is the tx data for a struct with `mu` struct tags, see
+// NewStructTx.
+type StructTx struct {
+	TxData   []TxDatum
+	entities []structEntity
+	nextId   int
+	pointers map[uintptr]database.HasLookup
+}
+
+// structEntity is a struct that is part of the transaction and
+// whose :db/id field must be set once the transaction is done.
+type structEntity struct {
+	id     database.HasLookup
+	value  reflect.Value
+	fields []database.StructField
+}
+
+// NewStructTx returns the tx data that asserts the fields of the
+// struct pointed to by v.
+//
+// The entity is identified by the field tagged with `mu:"db/id"`.
+// If the id is not set, the values of fields for unique attributes
+// are used to find an existing entity, otherwise a tempid is used.
+//
+// Nested structs (and pointers to them) are transacted as well and
+// referenced by their id.  Slices are asserted as multiple values
+// for attributes with cardinality many, and values of an existing
+// entity that are not in the slice anymore are retracted.
+//
+// Nil pointers and slices and zero nested structs are not asserted,
+// and neither are zero values of fields tagged with `omitempty`.
+// Other zero values, like false, 0 or "", are asserted, use pointers
+// or `omitempty` for fields that might be unset.
+func NewStructTx(db *database.Db, v interface{}) (*StructTx, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a pointer to a struct, but got %T", v)
+	}
+
+	tx := &StructTx{pointers: map[uintptr]database.HasLookup{}}
+	_, err := tx.addPointer(db, rv)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (tx *StructTx) addPointer(db *database.Db, ptr reflect.Value) (database.HasLookup, error) {
+	if id, ok := tx.pointers[ptr.Pointer()]; ok {
+		return id, nil
+	}
+
+	return tx.addStruct(db, ptr.Elem(), ptr.Pointer())
+}
+
+func (tx *StructTx) addStruct(db *database.Db, sv reflect.Value, ptr uintptr) (database.HasLookup, error) {
+	fields, err := database.StructFields(sv.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := tx.structId(db, sv, fields)
+	if err != nil {
+		return nil, err
+	}
+	if ptr != 0 {
+		tx.pointers[ptr] = id
+	}
+	tx.entities = append(tx.entities, structEntity{id, sv, fields})
+
+	txMap := TxMap{Id: id, Attributes: map[database.Keyword][]Value{}}
+	for _, field := range fields {
+		fv := sv.Field(field.Index)
+		if field.IsId || isUnset(field, fv) {
+			continue
+		}
+
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+			vals := make([]Value, 0, fv.Len())
+			for i := 0; i < fv.Len(); i++ {
+				val, err := tx.fieldValue(db, fv.Index(i))
+				if err != nil {
+					return nil, err
+				}
+				vals = append(vals, val)
+			}
+			if len(vals) > 0 {
+				txMap.Attributes[field.Attribute] = vals
+			}
+
+			retractions, err := retractRemoved(db, id, field.Attribute, vals)
+			if err != nil {
+				return nil, err
+			}
+			tx.TxData = append(tx.TxData, retractions...)
+			continue
+		}
+
+		val, err := tx.fieldValue(db, fv)
+		if err != nil {
+			return nil, err
+		}
+		txMap.Attributes[field.Attribute] = []Value{val}
+	}
+
+	if len(txMap.Attributes) > 0 {
+		tx.TxData = append(tx.TxData, txMap)
+	}
+	return id, nil
+}
+
+// retractRemoved returns the retractions of the values of an existing
+// entity for the attribute that are not part of vals anymore.
+func retractRemoved(db *database.Db, id database.HasLookup, attribute database.Keyword, vals []Value) ([]TxDatum, error) {
+	eid, err := id.Lookup(db)
+	if err != nil || eid < 0 {
+		return nil, nil
+	}
+	attrId := db.Entid(attribute)
+	attr := db.Attribute(attrId)
+	if attr == nil {
+		return nil, nil
+	}
+	isRef := attr.Type() == index.Ref
+
+	current := make([]index.Value, 0, len(vals))
+	for _, val := range vals {
+		v, err := val.Get(db, isRef)
+		if err != nil {
+			// e.g. nested entities that don't exist yet
+			continue
+		}
+		// refs are compared by their ids, like they are stored
+		current = append(current, index.NewValue(v.Val()))
+	}
+
+	retractions := []TxDatum{}
+	iter := db.Eavt().Datoms2(database.Id(eid), database.Id(attrId), nil)
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		if containsValue(current, index.NewValue(datom.V().Val())) {
+			continue
+		}
+		retractions = append(retractions, Datum{Op: Retract, E: database.Id(eid), A: attribute, V: NewValue(datom.V().Val())})
+	}
+	return retractions, nil
+}
+
+// structId returns the id of the entity for the struct, either from
+// the :db/id field, a lookup ref for a unique attribute or a new
+// tempid.
+func (tx *StructTx) structId(db *database.Db, sv reflect.Value, fields []database.StructField) (database.HasLookup, error) {
+	for _, field := range fields {
+		fv := sv.Field(field.Index)
+		if field.IsId && !fv.IsZero() {
+			return database.Id(fv.Convert(reflect.TypeOf(0)).Int()), nil
+		}
+	}
+
+	for _, field := range fields {
+		fv := sv.Field(field.Index)
+		if field.IsId || isUnset(field, fv) || isRefField(fv) || !isUnique(db, field.Attribute) {
+			continue
+		}
+
+		val, err := tx.fieldValue(db, fv)
+		if err != nil || val.val == nil {
+			continue
+		}
+		id, err := database.LookupRef{field.Attribute, *val.val}.Lookup(db)
+		if err == nil {
+			return database.Id(id), nil
+		}
+	}
+
+	tx.nextId += 1
+	return database.Id(-(DbPartUser*(1<<42) + tx.nextId)), nil
+}
+
+func isUnique(db *database.Db, attribute database.Keyword) bool {
+	attrId := db.Entid(attribute)
+	if attrId == -1 {
+		return false
+	}
+	attr := db.Attribute(attrId)
+	return attr != nil && attr.Unique() != database.UniqueNil
+}
+
+func (tx *StructTx) fieldValue(db *database.Db, fv reflect.Value) (Value, error) {
+	if fv.Kind() == reflect.Ptr && fv.IsNil() {
+		return Value{}, fmt.Errorf("cannot transact nil value of type %v", fv.Type())
+	}
+
+	switch {
+	case fv.Kind() == reflect.Ptr && isRefField(fv):
+		id, err := tx.addPointer(db, fv)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(id), nil
+	case fv.Kind() == reflect.Struct && isMappedStruct(fv.Type()):
+		var ptr uintptr
+		if fv.CanAddr() {
+			ptr = fv.Addr().Pointer()
+			if id, ok := tx.pointers[ptr]; ok {
+				return NewValue(id), nil
+			}
+		}
+		id, err := tx.addStruct(db, fv, ptr)
+		if err != nil {
+			return Value{}, err
+		}
+		return NewValue(id), nil
+	case fv.Kind() == reflect.Ptr:
+		return tx.fieldValue(db, fv.Elem())
+	case fv.Type() == reflect.TypeOf(database.Id(0)):
+		return NewValue(fv.Interface()), nil
+	case database.IsIntKind(fv.Kind()):
+		return NewValue(int(fv.Convert(reflect.TypeOf(0)).Int())), nil
+	case fv.Kind() == reflect.Float32:
+		return NewValue(float32(fv.Float())), nil
+	case fv.Kind() == reflect.Float64:
+		return NewValue(fv.Float()), nil
+	case fv.Kind() == reflect.String:
+		return NewValue(fv.String()), nil
+	case fv.Kind() == reflect.Bool:
+		return NewValue(fv.Bool()), nil
+	default:
+		return NewValue(fv.Interface()), nil
+	}
+}
+
+// isRefField returns true if the field refers to a nested struct.
+func isRefField(fv reflect.Value) bool {
+	ty := fv.Type()
+	if ty.Kind() == reflect.Ptr {
+		ty = ty.Elem()
+	}
+	return ty.Kind() == reflect.Struct && isMappedStruct(ty)
+}
+
+// isMappedStruct returns true if the struct type has any `mu` fields,
+// so that e.g. time.Time values are not treated as entities.
+func isMappedStruct(ty reflect.Type) bool {
+	fields, err := database.StructFields(ty)
+	return err == nil && len(fields) > 0
+}
+
+// isUnset returns true if the field should not be asserted, because
+// it is nil, a zero nested struct or zero and tagged with omitempty.
+func isUnset(field database.StructField, fv reflect.Value) bool {
+	switch fv.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		if fv.IsNil() {
+			return true
+		}
+	case reflect.Struct:
+		if isMappedStruct(fv.Type()) && fv.IsZero() {
+			return true
+		}
+	}
+	return field.OmitEmpty && fv.IsZero()
+}
+
+// AssignIds sets the :db/id fields of all structs in the transaction
+// to the ids they were assigned by it.
+func (tx *StructTx) AssignIds(txResult *TxResult) error {
+	db := txResult.DbAfter
+	for _, entity := range tx.entities {
+		id, err := entity.id.Lookup(db)
+		if err != nil {
+			return err
+		}
+
+		if id < 0 {
+			newId, ok := txResult.Tempids[id]
+			if !ok {
+				// merged with an existing entity using a unique identity
+				newId, ok = tx.lookupUnique(db, entity)
+				if !ok {
+					continue
+				}
+			}
+			id = newId
+		}
+
+		for _, field := range entity.fields {
+			if field.IsId {
+				database.SetInt(entity.value.Field(field.Index), id)
+			}
+		}
+	}
+	return nil
+}
+
+func (tx *StructTx) lookupUnique(db *database.Db, entity structEntity) (int, bool) {
+	for _, field := range entity.fields {
+		fv := entity.value.Field(field.Index)
+		if field.IsId || isUnset(field, fv) || isRefField(fv) || !isUnique(db, field.Attribute) {
+			continue
+		}
+
+		val, err := tx.fieldValue(db, fv)
+		if err != nil || val.val == nil {
+			continue
+		}
+		id, err := database.LookupRef{field.Attribute, *val.val}.Lookup(db)
+		if err == nil {
+			return id, true
+		}
+	}
+	return -1, false
+}
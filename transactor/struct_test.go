@@ -0,0 +1,169 @@
+package transactor
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+type structNotebook struct {
+	Id   int    `mu:"db/id"`
+	Name string `mu:"notebook/name"`
+}
+
+type structNote struct {
+	Id       int             `mu:"db/id"`
+	Title    string          `mu:"note/title"`
+	Tags     []string        `mu:"note/tags"`
+	Notebook *structNotebook `mu:"note/notebook"`
+	Ignored  string
+}
+
+func structDb(t *testing.T) *database.Db {
+	return mustTransact(t, InitialDb, testutil.Schema(testutil.Notebooks...)).DbAfter
+}
+
+func transactStruct(t *testing.T, db *database.Db, v interface{}) *TxResult {
+	structTx, err := NewStructTx(db, v)
+	tu.RequireNil(t, err)
+	_, txResult, err := Transact(db, structTx.TxData)
+	tu.RequireNil(t, err)
+	tu.RequireNil(t, structTx.AssignIds(txResult))
+	return txResult
+}
+
+func TestStructTx(t *testing.T) {
+	db := structDb(t)
+
+	note := structNote{
+		Title:    "groceries",
+		Tags:     []string{"todo", "shopping"},
+		Notebook: &structNotebook{Name: "home"},
+		Ignored:  "not stored",
+	}
+	db = transactStruct(t, db, &note).DbAfter
+	tu.RequireEqual(t, note.Id > 0, true)
+	tu.RequireEqual(t, note.Notebook.Id > 0, true)
+
+	var decoded structNote
+	tu.RequireNil(t, db.Entity(note.Id).Decode(&decoded))
+	tu.ExpectEqual(t, decoded.Id, note.Id)
+	tu.ExpectEqual(t, decoded.Title, "groceries")
+	tu.ExpectEqual(t, len(decoded.Tags), 2)
+	tu.ExpectEqual(t, decoded.Ignored, "")
+	tu.RequireNotNil(t, decoded.Notebook)
+	tu.ExpectEqual(t, *decoded.Notebook, structNotebook{note.Notebook.Id, "home"})
+}
+
+func TestStructTxUpsert(t *testing.T) {
+	db := structDb(t)
+
+	note := structNote{Title: "groceries", Tags: []string{"todo"}}
+	db = transactStruct(t, db, &note).DbAfter
+
+	// a struct without an id is matched using its unique attributes
+	update := structNote{Title: "groceries", Tags: []string{"shopping"}}
+	db = transactStruct(t, db, &update).DbAfter
+	tu.ExpectEqual(t, update.Id, note.Id)
+
+	var decoded structNote
+	tu.RequireNil(t, db.Entity(note.Id).Decode(&decoded))
+	tu.ExpectEqual(t, decoded.Tags, []string{"shopping"})
+
+	// structs with an id are updated as well
+	decoded.Title = "shopping list"
+	db = transactStruct(t, db, &decoded).DbAfter
+	tu.ExpectEqual(t, decoded.Id, note.Id)
+	tu.ExpectEqual(t, db.Entity(note.Id).Get(database.Keyword{fressian.Keyword{"note", "title"}}), "shopping list")
+}
+
+func TestStructTxRemovedValues(t *testing.T) {
+	db := structDb(t)
+	tags := database.Keyword{fressian.Keyword{"note", "tags"}}
+
+	note := structNote{Title: "groceries", Tags: []string{"todo", "shopping", "home"}}
+	db = transactStruct(t, db, &note).DbAfter
+
+	// values that were removed from the slice are retracted
+	note.Tags = []string{"todo", "home"}
+	db = transactStruct(t, db, &note).DbAfter
+	var decoded structNote
+	tu.RequireNil(t, db.Entity(note.Id).Decode(&decoded))
+	tu.ExpectEqual(t, decoded.Tags, []string{"home", "todo"})
+
+	// nil slices are not changed, empty ones retract all values
+	note.Tags = nil
+	db = transactStruct(t, db, &note).DbAfter
+	tu.RequireNil(t, db.Entity(note.Id).Decode(&decoded))
+	tu.ExpectEqual(t, decoded.Tags, []string{"home", "todo"})
+
+	note.Tags = []string{}
+	db = transactStruct(t, db, &note).DbAfter
+	tu.ExpectEqual(t, db.Entity(note.Id).Get(tags), []interface{}{})
+}
+
+func TestStructTxInvalid(t *testing.T) {
+	db := structDb(t)
+
+	_, err := NewStructTx(db, structNote{})
+	tu.ExpectNotNil(t, err)
+
+	_, err = NewStructTx(db, &struct {
+		Id string `mu:"db/id"`
+	}{})
+	tu.ExpectNotNil(t, err)
+
+	structTx, err := NewStructTx(db, &struct {
+		Unknown string `mu:"note/unknown"`
+	}{"value"})
+	tu.RequireNil(t, err)
+	_, _, err = Transact(db, structTx.TxData)
+	tu.ExpectNotNil(t, err)
+}
+
+func TestStructTxZeroValues(t *testing.T) {
+	db := mustTransact(t, structDb(t), `[{:db/id #db/id[:db.part/db]
+  :db/ident :note/done
+  :db/valueType :db.type/boolean
+  :db/cardinality :db.cardinality/one}
+ {:db/id #db/id[:db.part/db]
+  :db/ident :note/priority
+  :db/valueType :db.type/long
+  :db/cardinality :db.cardinality/one}]`).DbAfter
+
+	type task struct {
+		Id       int    `mu:"db/id"`
+		Title    string `mu:"note/title"`
+		Done     bool   `mu:"note/done"`
+		Priority *int   `mu:"note/priority"`
+	}
+	done := database.Keyword{fressian.Keyword{"note", "done"}}
+	priority := database.Keyword{fressian.Keyword{"note", "priority"}}
+
+	zero := 0
+	t1 := task{Title: "zero", Priority: &zero}
+	db = transactStruct(t, db, &t1).DbAfter
+	tu.ExpectEqual(t, db.Entity(t1.Id).Get(done), false)
+	tu.ExpectEqual(t, db.Entity(t1.Id).Get(priority), 0)
+
+	// nil pointers are not asserted
+	t2 := task{Title: "unset"}
+	db = transactStruct(t, db, &t2).DbAfter
+	tu.ExpectNil(t, db.Entity(t2.Id).Get(priority))
+
+	// neither are zero values with omitempty
+	type partialTask struct {
+		Title    string `mu:"note/title"`
+		Done     bool   `mu:"note/done,omitempty"`
+		Priority int    `mu:"note/priority,omitempty"`
+	}
+	db = mustTransact(t, db, `[{:db/id #db/id[:db.part/user] :note/title "partial" :note/done true :note/priority 3}]`).DbAfter
+	db = transactStruct(t, db, &partialTask{Title: "partial"}).DbAfter
+	id := db.Entid(database.LookupRef{database.Keyword{fressian.Keyword{"note", "title"}}, index.NewValue("partial")})
+	tu.ExpectEqual(t, db.Entity(id).Get(done), true)
+	tu.ExpectEqual(t, db.Entity(id).Get(priority), 3)
+}
@@ -2,6 +2,7 @@ package transactor
 
 import (
 	"fmt"
+	"github.com/heyLu/fressian"
 	"time"
 
 	"github.com/heyLu/mu/database"
@@ -26,9 +27,82 @@ type TxResult struct {
 	DbAfter  *database.Db
 	Tempids  map[int]int
 	Datoms   []index.Datom
+	// Excised contains the datoms that were removed permanently by
+	// `:db/excise` in this transaction.
+	Excised []index.Datom
+	// Replayed is true if the transaction was not applied because one
+	// with the same Options.ClientId was committed before.  The
+	// result describes that transaction instead.
+	Replayed bool
+}
+
+// Options configure how a transaction is processed.
+type Options struct {
+	// MaxClockSkew is how far in the future a user-supplied
+	// :db/txInstant may be, and without AllowBackdating also how far
+	// in the past.
+	MaxClockSkew time.Duration
+	// AllowBackdating allows user-supplied :db/txInstant values that
+	// are further in the past than MaxClockSkew, e.g. for importing
+	// historical data.
+	//
+	// The txInstant still must not be before that of the previous
+	// transaction.
+	AllowBackdating bool
+	// IfBasisT makes the transaction fail with a *BasisConflictError
+	// if any transaction was committed after the given basisT, e.g.
+	// for read-modify-write flows.  It is ignored if it is nil.
+	IfBasisT *int
+	// IfUntouched limits the IfBasisT check to transactions that
+	// changed the given entities.
+	IfUntouched []database.HasLookup
+	// ClientId identifies the transaction, so that retrying it does
+	// not apply it twice.  It is stored as :tx/client-id on the
+	// transaction, together with its tempids as :tx/tempids.
+	//
+	// If a transaction with the same id was committed before, the
+	// result of that transaction is returned instead, see
+	// TxResult.Replayed.  Databases created before client ids were
+	// supported fail with an Unsupported anomaly.
+	ClientId *fressian.UUID
+}
+
+// DefaultOptions are the options used by Transact.
+var DefaultOptions = Options{
+	MaxClockSkew: 1 * time.Minute,
 }
 
 func Transact(db *database.Db, txData []TxDatum) (*txlog.LogTx, *TxResult, error) {
+	return TransactWithOptions(db, txData, DefaultOptions)
+}
+
+func TransactWithOptions(db *database.Db, txData []TxDatum, opts Options) (*txlog.LogTx, *TxResult, error) {
+	return TransactWithLog(db, nil, txData, opts)
+}
+
+// TransactWithLog is like TransactWithOptions, but reads the datoms of
+// replayed transactions, see Options.ClientId, from the log of the
+// database instead of its history.
+func TransactWithLog(db *database.Db, dbLog *txlog.Log, txData []TxDatum, opts Options) (*txlog.LogTx, *TxResult, error) {
+	if opts.ClientId != nil {
+		err := checkClientIds(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tx, ok := findClientTx(db, *opts.ClientId); ok {
+			txResult, err := replayedTxResult(db, dbLog, tx)
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, txResult, nil
+		}
+	}
+
+	err := checkBasisT(db, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	txState := newTxState(db)
 	//log.Println("max entities", txState.maxPartDbEntity, txState.maxPartUserEntity)
 
@@ -44,20 +118,81 @@ func Transact(db *database.Db, txData []TxDatum) (*txlog.LogTx, *TxResult, error
 
 	datoms := assignIds(txState, db, datums)
 
-	if !txState.hasTxInstant {
-		datoms = append(datoms, index.NewDatom(txState.tx, DbTxInstant, time.Now(), txState.tx, Assert))
+	datoms, err = ensureTxInstant(txState, db, datoms, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts.ClientId != nil {
+		datoms = append(datoms,
+			index.NewDatom(txState.tx, DbTxClientId, *opts.ClientId, txState.tx, Assert),
+			tempidsDatom(txState.tx, txState.newEntityCache))
+	}
+
+	datoms, ensures := splitEnsures(db, datoms)
+
+	excisions, err := findExcisions(datoms)
+	if err != nil {
+		return nil, nil, err
+	}
+	excised := excisedDatoms(db, excisions)
+
+	dbAfter := db.WithDatomsT(db.NextT(), txState.nextId, datoms)
+	if len(excised) > 0 {
+		dbAfter = dbAfter.WithoutDatoms(excised)
+	}
+
+	err = checkEntitySpecs(dbAfter, ensures)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	txResult := &TxResult{
 		DbBefore: db,
-		DbAfter:  db.WithDatomsT(db.NextT(), txState.nextId, datoms),
+		DbAfter:  dbAfter,
 		Tempids:  txState.newEntityCache,
 		Datoms:   datoms,
+		Excised:  excised,
 	}
 	tx := txlog.NewTx(db.NextT(), datoms)
 	return tx, txResult, nil
 }
 
+// checkBasisT verifies that no transactions were committed since
+// opts.IfBasisT, or only ones that did not change opts.IfUntouched.
+func checkBasisT(db *database.Db, opts Options) error {
+	if opts.IfBasisT == nil || db.BasisT() <= *opts.IfBasisT {
+		return nil
+	}
+	basisT := *opts.IfBasisT
+
+	if opts.IfUntouched == nil {
+		return &BasisConflictError{ExpectedBasisT: basisT, BasisT: db.BasisT()}
+	}
+
+	changes := db.Since(basisT + 1).History()
+	touched := []int{}
+	for _, entity := range opts.IfUntouched {
+		eid, err := entity.Lookup(db)
+		if err != nil {
+			return &Anomaly{Category: Incorrect, Message: err.Error(), Err: err}
+		}
+
+		iter := changes.Eavt().DatomsAt(
+			index.NewDatom(eid, index.MinDatom.A(), index.MinValue, index.MaxDatom.Tx(), false),
+			index.NewDatom(eid, index.MaxDatom.A(), index.MaxValue, index.MinDatom.Tx(), true))
+		datom := iter.Next()
+		if datom != nil && datom.E() == eid {
+			touched = append(touched, eid)
+		}
+	}
+
+	if len(touched) > 0 {
+		return &BasisConflictError{ExpectedBasisT: basisT, BasisT: db.BasisT(), Entities: touched}
+	}
+	return nil
+}
+
 type txState struct {
 	newEntityCache  map[int]int
 	tx              int
@@ -68,11 +203,17 @@ type txState struct {
 }
 
 func newTxState(db *database.Db) *txState {
+	return newTxStateAt(db, findMaxEntity(db, 0)+1)
+}
+
+// newTxStateAt is like newTxState, but with a known next id in
+// :db.part/db, see Importer.
+func newTxStateAt(db *database.Db, nextPartDbId int) *txState {
 	return &txState{
 		newEntityCache:  map[int]int{},
 		tx:              3*(1<<42) + db.NextT(),
 		nextId:          db.NextT() + 1,
-		nextPartDbId:    findMaxEntity(db, 0) + 1,
+		nextPartDbId:    nextPartDbId,
 		hasTxInstant:    false,
 		attributeValues: map[int][]index.Value{},
 	}
@@ -110,7 +251,6 @@ func assignIds(txState *txState, db *database.Db, origDatoms []RawDatum) []index
 		entity := datom.E
 		if entity < 0 {
 			if Part(entity) == DbPartTx && datom.A == DbTxInstant {
-				// FIXME: ensure that :db/txInstant is greater than the last
 				txState.hasTxInstant = true
 			}
 			entity = txState.resolveTempid(entity)
@@ -134,6 +274,56 @@ func assignIds(txState *txState, db *database.Db, origDatoms []RawDatum) []index
 	return datoms
 }
 
+// ensureTxInstant checks the :db/txInstant of the transaction, or
+// adds one if none was supplied.
+//
+// The txInstant must not be before that of the previous transaction,
+// otherwise AsOfTime and SinceTime would return wrong results.
+func ensureTxInstant(txState *txState, db *database.Db, datoms []index.Datom, opts Options) ([]index.Datom, error) {
+	now := time.Now()
+	prevTxInstant := txInstantOf(db, 3*(1<<42)+db.BasisT())
+
+	if !txState.hasTxInstant {
+		txInstant := now
+		if txInstant.Before(prevTxInstant) {
+			txInstant = prevTxInstant
+		}
+		return append(datoms, index.NewDatom(txState.tx, DbTxInstant, txInstant, txState.tx, Assert)), nil
+	}
+
+	for _, datom := range datoms {
+		if datom.E() != txState.tx || datom.A() != DbTxInstant || !datom.Added() {
+			continue
+		}
+
+		txInstant := datom.V().Val().(time.Time)
+		if txInstant.Before(prevTxInstant) {
+			return nil, anomalyf(Incorrect, ":db/txInstant %v is before the txInstant of the previous transaction (%v)", txInstant, prevTxInstant)
+		}
+
+		if txInstant.After(now.Add(opts.MaxClockSkew)) {
+			return nil, anomalyf(Incorrect, ":db/txInstant %v is too far in the future (max skew %v)", txInstant, opts.MaxClockSkew)
+		}
+
+		if !opts.AllowBackdating && txInstant.Before(now.Add(-opts.MaxClockSkew)) {
+			return nil, anomalyf(Incorrect, ":db/txInstant %v is in the past, backdating must be allowed explicitly", txInstant)
+		}
+	}
+
+	return datoms, nil
+}
+
+func txInstantOf(db *database.Db, tx int) time.Time {
+	iter := db.Eavt().DatomsAt(
+		index.NewDatom(tx, DbTxInstant, index.MinValue, index.MaxDatom.Tx(), false),
+		index.NewDatom(tx, DbTxInstant, index.MaxValue, index.MinDatom.Tx(), true))
+	datom := iter.Next()
+	if datom == nil || datom.E() != tx || datom.A() != DbTxInstant {
+		return time.Time{}
+	}
+	return datom.V().Val().(time.Time)
+}
+
 func findMaxEntity(db *database.Db, part int) int {
 	maxEntity := -1
 	start := part * (1 << 42)
@@ -0,0 +1,153 @@
+package transactor
+
+import (
+	"fmt"
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"testing"
+	"time"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+	txlog "github.com/heyLu/mu/log"
+)
+
+func transactAt(db *database.Db, txInstant time.Time, opts Options) (*TxResult, error) {
+	txData, err := TxDataFromEDN(`[[:db/add #db/id[:db.part/tx] :db/txInstant #inst "` +
+		txInstant.Format(time.RFC3339Nano) + `"]]`)
+	if err != nil {
+		return nil, err
+	}
+	_, txResult, err := TransactWithOptions(db, txData, opts)
+	return txResult, err
+}
+
+func TestTxInstant(t *testing.T) {
+	// instants are stored with millisecond precision
+	now := time.Now().Truncate(time.Millisecond)
+
+	txResult, err := transactAt(InitialDb, now, DefaultOptions)
+	tu.RequireNil(t, err)
+
+	// not before the previous transaction
+	_, err = transactAt(txResult.DbAfter, now.Add(-1*time.Second), DefaultOptions)
+	tu.ExpectNotNil(t, err)
+
+	// not too far in the future
+	_, err = transactAt(txResult.DbAfter, now.Add(2*DefaultOptions.MaxClockSkew), DefaultOptions)
+	tu.ExpectNotNil(t, err)
+
+	// generated txInstants are never before the previous one
+	future := now.Add(DefaultOptions.MaxClockSkew / 2)
+	txResult, err = transactAt(txResult.DbAfter, future, DefaultOptions)
+	tu.RequireNil(t, err)
+	txResult = mustTransact(t, txResult.DbAfter, `[]`)
+	tu.ExpectEqual(t, txInstantOf(txResult.DbAfter, 3*(1<<42)+txResult.DbAfter.BasisT()).Before(future), false)
+}
+
+func TestTxInstantBackdating(t *testing.T) {
+	past := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := transactAt(InitialDb, past, DefaultOptions)
+	tu.ExpectNotNil(t, err)
+
+	opts := DefaultOptions
+	opts.AllowBackdating = true
+	txResult, err := transactAt(InitialDb, past, opts)
+	tu.RequireNil(t, err)
+
+	txResult, err = transactAt(txResult.DbAfter, past.Add(24*time.Hour), opts)
+	tu.RequireNil(t, err)
+	db := txResult.DbAfter
+	tu.ExpectEqual(t, db.AsOfTime(past.Add(time.Hour)).AsOfT(), db.BasisT())
+
+	// backdating must still be monotonic
+	_, err = transactAt(db, past, opts)
+	tu.ExpectNotNil(t, err)
+}
+
+func TestClientId(t *testing.T) {
+	db := mustTransact(t, InitialDb, `[{:db/id #db/id[:db.part/db]
+  :db/ident :note/title
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one}]`).DbAfter
+
+	clientId := txlog.Squuid()
+	opts := DefaultOptions
+	opts.ClientId = &clientId
+
+	txData, err := TxDataFromEDN(`[{:db/id #db/id[:db.part/user -1] :note/title "once"}]`)
+	tu.RequireNil(t, err)
+	_, first, err := TransactWithOptions(db, txData, opts)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, first.Replayed, false)
+	db = first.DbAfter
+
+	// retrying the transaction returns the previous result
+	tx, retry, err := TransactWithOptions(db, txData, opts)
+	tu.RequireNil(t, err)
+	tu.ExpectNil(t, tx)
+	tu.ExpectEqual(t, retry.Replayed, true)
+	tu.ExpectEqual(t, retry.DbAfter.BasisT(), first.DbAfter.BasisT())
+	tu.ExpectEqual(t, len(retry.Datoms), len(first.Datoms))
+	tu.ExpectEqual(t, retry.Tempids, first.Tempids)
+	tu.ExpectEqual(t, retry.Tempids[-(4*(1<<42)+1)] > 0, true)
+
+	iter := db.Aevt().DatomsAt(
+		index.NewDatom(0, db.Entid(database.Keyword{fressian.Keyword{"note", "title"}}), index.MinValue, index.MaxDatom.Tx(), false),
+		index.NewDatom(index.MaxDatom.E(), db.Entid(database.Keyword{fressian.Keyword{"note", "title"}}), index.MaxValue, index.MinDatom.Tx(), true))
+	count := 0
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		count += 1
+	}
+	tu.ExpectEqual(t, count, 1)
+
+	// other client ids are transacted as usual
+	otherId := txlog.Squuid()
+	opts.ClientId = &otherId
+	_, other, err := TransactWithOptions(db, txData, opts)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, other.Replayed, false)
+}
+
+func TestOlderBootstrap(t *testing.T) {
+	// a database created before the last bootstrap transaction, whose
+	// own attributes use the ids of the newer built-in ones
+	db := database.Empty
+	for _, tx := range BootstrapTxs[:len(BootstrapTxs)-1] {
+		db = db.WithDatoms(tx.Datoms)
+	}
+	schemaEDN := "["
+	for i := 0; i < 8; i++ {
+		schemaEDN += fmt.Sprintf(`{:db/id #db/id[:db.part/db -%d] :db/ident :old/attr-%d :db/valueType :db.type/string :db/cardinality :db.cardinality/one}`, i+1, DbEnsure+i)
+	}
+	schema := mustTransact(t, db, schemaEDN+"]")
+	db = schema.DbAfter
+	attr := func(id int) database.Keyword {
+		kw := database.Keyword{fressian.Keyword{"old", fmt.Sprintf("attr-%d", id)}}
+		tu.RequireEqual(t, db.Entid(kw), id)
+		return kw
+	}
+
+	txResult := mustTransact(t, db, fmt.Sprintf(`[{:db/id #db/id[:db.part/user] %v "not an ensure"}
+ {:db/id %v %v "not a pred" %v "not tuple attrs"}]`,
+		attr(DbEnsure), attr(DbEnsure), attr(DbAttrPreds), attr(DbTupleAttrs)))
+	tu.ExpectEqual(t, len(txResult.Datoms), 4)
+
+	old := txResult.DbAfter.Attribute(DbEnsure)
+	tu.ExpectNil(t, old.Preds())
+	tu.ExpectNil(t, old.TupleAttrs())
+
+	// the newer attributes can't be used
+	txData, err := TxDataFromEDN(`[{:db/id #db/id[:db.part/user] :db/ensure :old/attr-63}]`)
+	tu.RequireNil(t, err)
+	_, _, err = Transact(txResult.DbAfter, txData)
+	tu.ExpectNotNil(t, err)
+
+	// as well as client ids
+	clientId := txlog.Squuid()
+	opts := DefaultOptions
+	opts.ClientId = &clientId
+	_, _, err = TransactWithOptions(txResult.DbAfter, []TxDatum{}, opts)
+	tu.ExpectEqual(t, CategoryOf(err), Unsupported)
+}
@@ -0,0 +1,145 @@
+package transactor
+
+import (
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
+)
+
+const (
+	DbTypeTuple  = 67 // :db.type/tuple
+	DbTupleAttrs = 68 // :db/tupleAttrs
+)
+
+// compositeTuples returns the composite tuple attributes of the
+// database, indexed by the attributes they are composed of.
+func compositeTuples(db *database.Db) (map[int][]int, map[int][]int, error) {
+	byComponent := map[int][]int{}
+	components := map[int][]int{}
+	if !hasBuiltin(db, DbTupleAttrs) {
+		return byComponent, components, nil
+	}
+
+	iter := db.Aevt().DatomsAt(
+		index.NewDatom(index.MinDatom.E(), DbTupleAttrs, index.MinValue, index.MaxDatom.Tx(), false),
+		index.NewDatom(index.MaxDatom.E(), DbTupleAttrs, index.MaxValue, index.MinDatom.Tx(), true))
+	for datom := iter.Next(); datom != nil; datom = iter.Next() {
+		if datom.A() != DbTupleAttrs {
+			break
+		}
+
+		tupleAttr := datom.E()
+		for _, name := range db.Attribute(tupleAttr).TupleAttrs() {
+			attrId := db.Entid(database.Keyword{name})
+			if attrId == -1 {
+				return nil, nil, anomalyf(Incorrect, "composite tuple %d uses unknown attribute %v", tupleAttr, name)
+			}
+
+			components[tupleAttr] = append(components[tupleAttr], attrId)
+			byComponent[attrId] = append(byComponent[attrId], tupleAttr)
+		}
+	}
+
+	return byComponent, components, nil
+}
+
+// addCompositeTuples adds datums that update the composite tuple
+// attributes of all entities whose component attributes are changed
+// by the datums.
+//
+// The value of a composite tuple contains the values of its component
+// attributes in order, with nil for missing values.  If none of the
+// attributes have a value, the tuple is retracted.
+func addCompositeTuples(db *database.Db, datums []RawDatum) ([]RawDatum, error) {
+	byComponent, components, err := compositeTuples(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(components) == 0 {
+		return datums, nil
+	}
+
+	type entityAttr struct {
+		entity    int
+		attribute int
+	}
+	asserted := map[entityAttr]index.Value{}
+	retracted := map[entityAttr]bool{}
+	changed := []entityAttr{}
+	seen := map[entityAttr]bool{}
+
+	for _, datum := range datums {
+		key := entityAttr{datum.E, datum.A}
+		if _, ok := components[datum.A]; ok {
+			if datum.Op == Assert {
+				return nil, anomalyf(Incorrect, "composite tuple %v cannot be asserted directly", db.Attribute(datum.A).Ident())
+			}
+			retracted[key] = true
+			continue
+		}
+
+		if datum.Op == Assert {
+			asserted[key] = datum.V
+		} else {
+			retracted[key] = true
+		}
+
+		for _, tupleAttr := range byComponent[datum.A] {
+			tupleKey := entityAttr{datum.E, tupleAttr}
+			if !seen[tupleKey] {
+				seen[tupleKey] = true
+				changed = append(changed, tupleKey)
+			}
+		}
+	}
+
+	for _, tupleKey := range changed {
+		// already retracted explicitly, e.g. by :db.fn/retractEntity
+		if retracted[tupleKey] {
+			continue
+		}
+
+		elems := make([]interface{}, len(components[tupleKey.attribute]))
+		hasValue := false
+		for i, attrId := range components[tupleKey.attribute] {
+			key := entityAttr{tupleKey.entity, attrId}
+			if val, ok := asserted[key]; ok {
+				elems[i] = val.Val()
+			} else if !retracted[key] {
+				if prev := currentValue(db, key.entity, attrId); prev != nil {
+					elems[i] = prev.Val()
+				}
+			}
+
+			if elems[i] != nil {
+				hasValue = true
+			}
+		}
+
+		prev := currentValue(db, tupleKey.entity, tupleKey.attribute)
+		if !hasValue {
+			if prev != nil {
+				datums = append(datums, RawDatum{Retract, tupleKey.entity, tupleKey.attribute, *prev})
+			}
+			continue
+		}
+
+		tuple := index.NewTuple(elems...)
+		if prev != nil && prev.Compare(tuple) == 0 {
+			continue
+		}
+		datums = append(datums, RawDatum{Assert, tupleKey.entity, tupleKey.attribute, tuple})
+	}
+
+	return datums, nil
+}
+
+func currentValue(db *database.Db, entity int, attribute int) *index.Value {
+	datom := existingAttribute(db, entity, attribute)
+	if datom == nil || datom.E() != entity || datom.A() != attribute {
+		return nil
+	}
+
+	val := datom.V()
+	return &val
+}
@@ -0,0 +1,105 @@
+package transactor
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"strconv"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+func tupleDb(t *testing.T) *database.Db {
+	schema := mustTransact(t, InitialDb, testutil.Schema(
+		testutil.One("note/notebook", "string"),
+		testutil.One("note/title", "string"),
+		testutil.One("note/notebook+title", "tuple").TupleAttrs("note/notebook", "note/title").UniqueValue()))
+	return schema.DbAfter
+}
+
+func notebookTitle(db *database.Db, entity int) interface{} {
+	return db.Entity(entity).Get(database.Keyword{fressian.Keyword{"note", "notebook+title"}})
+}
+
+func TestCompositeTuple(t *testing.T) {
+	db := tupleDb(t)
+
+	txResult := mustTransact(t, db, `[{:db/id #db/id[:db.part/user -1]
+  :note/notebook "work"
+  :note/title "todo"}]`)
+	note := txResult.Datoms[0].E()
+	db = txResult.DbAfter
+	tu.ExpectEqual(t, notebookTitle(db, note), []interface{}{"work", "todo"})
+
+	// the tuple is updated when one of the attributes changes
+	db = mustTransact(t, db, `[[:db/add `+strconv.Itoa(note)+` :note/title "done"]]`).DbAfter
+	tu.ExpectEqual(t, notebookTitle(db, note), []interface{}{"work", "done"})
+
+	// missing values are nil
+	db = mustTransact(t, db, `[[:db/retract `+strconv.Itoa(note)+` :note/notebook "work"]]`).DbAfter
+	tu.ExpectEqual(t, notebookTitle(db, note), []interface{}{nil, "done"})
+
+	// and the tuple is removed if all values are missing
+	db = mustTransact(t, db, `[[:db/retract `+strconv.Itoa(note)+` :note/title "done"]]`).DbAfter
+	tu.ExpectNil(t, notebookTitle(db, note))
+}
+
+func TestCompositeTupleUniqueness(t *testing.T) {
+	db := mustTransact(t, tupleDb(t), `[{:db/id #db/id[:db.part/user]
+  :note/notebook "work"
+  :note/title "todo"}]`).DbAfter
+
+	// same title in a different notebook is fine
+	mustTransact(t, db, `[{:db/id #db/id[:db.part/user]
+  :note/notebook "home"
+  :note/title "todo"}]`)
+
+	txData, err := TxDataFromEDN(`[{:db/id #db/id[:db.part/user]
+  :note/notebook "work"
+  :note/title "todo"}]`)
+	tu.RequireNil(t, err)
+	_, _, err = Transact(db, txData)
+	tu.ExpectNotNil(t, err)
+
+	// composite tuples cannot be asserted directly
+	txData, err = TxDataFromEDN(`[[:db/add #db/id[:db.part/user] :note/notebook+title ["home" "shopping"]]]`)
+	tu.RequireNil(t, err)
+	_, _, err = Transact(db, txData)
+	tu.ExpectNotNil(t, err)
+}
+
+func TestCompositeTupleUpsert(t *testing.T) {
+	db := mustTransact(t, tupleDb(t), `[{:db/id #db/id[:db.part/db]
+  :db/ident :note/slug
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db/unique :db.unique/identity}]`).DbAfter
+
+	txResult := mustTransact(t, db, `[{:db/id #db/id[:db.part/user]
+  :note/slug "todo"
+  :note/notebook "work"
+  :note/title "todo"}]`)
+	note := txResult.Datoms[0].E()
+	db = txResult.DbAfter
+
+	// the upsert only changes the title, the notebook is kept
+	txResult = mustTransact(t, db, `[{:db/id #db/id[:db.part/user]
+  :note/slug "todo"
+  :note/title "done"}]`)
+	db = txResult.DbAfter
+	tu.ExpectEqual(t, notebookTitle(db, note), []interface{}{"work", "done"})
+
+	// the uniqueness of the tuple is checked using the full value
+	db = mustTransact(t, db, `[{:db/id #db/id[:db.part/user]
+  :note/slug "shopping"
+  :note/notebook "home"
+  :note/title "done"}]`).DbAfter
+	txData, err := TxDataFromEDN(`[{:db/id #db/id[:db.part/user]
+  :note/slug "shopping"
+  :note/notebook "work"}]`)
+	tu.RequireNil(t, err)
+	_, _, err = Transact(db, txData)
+	tu.RequireNotNil(t, err)
+	tu.ExpectEqual(t, CategoryOf(err), Conflict)
+}
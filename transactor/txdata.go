@@ -1,9 +1,10 @@
 package transactor
 
 import (
-	"fmt"
 	"github.com/heyLu/fressian"
+	"math/big"
 	"net/url"
+	"strconv"
 
 	"github.com/heyLu/mu/database"
 	"github.com/heyLu/mu/index"
@@ -59,7 +60,7 @@ func (d Datum) Retraction() Datum {
 func (d Datum) Resolve(db *database.Db) ([]RawDatum, error) {
 	eid, err := d.E.Lookup(db)
 	if err != nil {
-		return nil, err
+		return nil, &Anomaly{Category: Incorrect, Message: err.Error(), Err: err}
 	}
 
 	isReverseAttr := false
@@ -70,11 +71,11 @@ func (d Datum) Resolve(db *database.Db) ([]RawDatum, error) {
 	}
 	aid, err := a.Lookup(db)
 	if err != nil {
-		return nil, err
+		return nil, &UnknownAttributeError{d.A}
 	}
 	attr := db.Attribute(aid)
 	if attr == nil {
-		return nil, fmt.Errorf("no such attribute: %v", d.A)
+		return nil, &UnknownAttributeError{d.A}
 	}
 	val, err := d.V.Get(db, attr.Type() == index.Ref)
 	if err != nil {
@@ -92,6 +93,8 @@ func (d Datum) Resolve(db *database.Db) ([]RawDatum, error) {
 			return nil, err
 		}
 		*val = index.NewValue(u)
+	} else if attr.Type() != val.Type() {
+		*val = coerceValue(attr.Type(), *val)
 	}
 
 	rawDatum := RawDatum{d.Op, eid, aid, *val}
@@ -101,6 +104,43 @@ func (d Datum) Resolve(db *database.Db) ([]RawDatum, error) {
 	return []RawDatum{rawDatum}, nil
 }
 
+// coerceValue converts numeric values to the type of the attribute,
+// e.g. so that floats and bigints can be specified using plain
+// numbers.
+//
+// Values that cannot be converted are returned unchanged.
+func coerceValue(ty index.ValueType, val index.Value) index.Value {
+	switch val := val.Val().(type) {
+	case int:
+		switch ty {
+		case index.Float:
+			return index.NewValue(float32(val))
+		case index.Double:
+			return index.NewValue(float64(val))
+		case index.BigInt:
+			return index.NewValue(big.NewInt(int64(val)))
+		case index.BigDec:
+			return index.NewValue(index.NewDecimal(big.NewInt(int64(val)), 0))
+		}
+	case float64:
+		switch ty {
+		case index.Float:
+			return index.NewValue(float32(val))
+		case index.BigDec:
+			// the shortest decimal for the float, e.g. 0.1 for 0.1
+			d, err := index.ParseDecimal(strconv.FormatFloat(val, 'g', -1, 64))
+			if err == nil {
+				return index.NewValue(d)
+			}
+		}
+	case *big.Int:
+		if ty == index.BigDec {
+			return index.NewValue(index.NewDecimal(new(big.Int).Set(val), 0))
+		}
+	}
+	return val
+}
+
 type Value struct {
 	val    *index.Value
 	lookup *database.HasLookup
@@ -127,7 +167,7 @@ func (v Value) Get(db *database.Db, isRef bool) (*index.Value, error) {
 			val := index.NewValue(kw.Keyword)
 			return &val, nil
 		} else {
-			return nil, fmt.Errorf("invalid value: %v", v)
+			return nil, anomalyf(Incorrect, "invalid value: %v", v)
 		}
 	}
 	return v.val, nil
@@ -204,25 +244,26 @@ func FnCompareAndSwap(entity database.HasLookup, attribute database.HasLookup, o
 
 		aid, err := attribute.Lookup(db)
 		if err != nil {
-			return nil, err
+			return nil, &UnknownAttributeError{attribute}
+		}
+		var ident fressian.Keyword
+		if attr := db.Attribute(aid); attr != nil {
+			ident = attr.Ident()
 		}
 
 		datums := make([]RawDatum, 0)
 
-		iter := db.Eavt().DatomsAt(
-			index.NewDatom(eid, aid, oldValue, 0, true),
-			index.NewDatom(eid, aid, oldValue, index.MaxDatom.Tx(), true))
-		datom := iter.Next()
+		actual := currentValue(db, eid, aid)
 		if oldValue == nil { // old value must not exist
-			if datom != nil {
-				return nil, fmt.Errorf("cas failed, expected nil, but got %v", datom.V())
+			if actual != nil {
+				return nil, &CASFailedError{eid, ident, nil, actual}
 			}
 		} else {
-			if datom == nil || datom.V().Compare(oldValue) != 0 {
-				return nil, fmt.Errorf("cas failed, expected %v, but got %v", oldValue, datom.V())
+			if actual == nil || actual.Compare(*oldValue) != 0 {
+				return nil, &CASFailedError{eid, ident, oldValue, actual}
 			}
 
-			datums = append(datums, RawDatum{Op: Retract, E: eid, A: aid, V: *oldValue})
+			datums = append(datums, RawDatum{Op: Retract, E: eid, A: aid, V: *actual})
 		}
 
 		datums = append(datums, RawDatum{Op: Assert, E: eid, A: aid, V: *newValue})
@@ -5,12 +5,25 @@ import (
 	"github.com/heyLu/edn"
 	"github.com/heyLu/fressian"
 	"math/big"
+	"net/url"
 	"time"
 
 	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/index"
 )
 
+// TxDataFromEDN parses tx data from its edn representation.
+//
+// Invalid tx data is reported as an Incorrect anomaly.
 func TxDataFromEDN(s string) ([]TxDatum, error) {
+	txData, err := txDataFromEDN(s)
+	if err != nil {
+		return nil, &Anomaly{Category: Incorrect, Message: err.Error(), Err: err}
+	}
+	return txData, nil
+}
+
+func txDataFromEDN(s string) ([]TxDatum, error) {
 	val, err := edn.DecodeString(s)
 	if err != nil {
 		return nil, err
@@ -34,18 +47,22 @@ func TxDataFromEDN(s string) ([]TxDatum, error) {
 	return txData, nil
 }
 
+// HasLookupFromEDN parses an entity id, ident or lookup ref from its
+// edn representation.
+//
+// Invalid values are reported as an Incorrect anomaly.
 func HasLookupFromEDN(s string) (database.HasLookup, error) {
 	val, err := edn.DecodeString(s)
 	if err != nil {
-		return nil, err
+		return nil, &Anomaly{Category: Incorrect, Message: err.Error(), Err: err}
 	}
 
 	lookup, err := EntityFromValue(val)
 	if err != nil {
-		return nil, err
+		return nil, &Anomaly{Category: Incorrect, Message: err.Error(), Err: err}
 	}
 
-	return lookup, err
+	return lookup, nil
 }
 
 func txDatumFromValue(val interface{}) (TxDatum, error) {
@@ -104,6 +121,7 @@ func datumFromValue(val []interface{}) (*Datum, error) {
 
 var dbId = edn.Keyword{Namespace: "db", Name: "id"}
 var dbIdSym = edn.Symbol{Namespace: "db", Name: "id"}
+var uriSym = edn.Symbol{Namespace: "", Name: "uri"}
 
 func txMapFromValue(val map[interface{}]interface{}) (*TxMap, error) {
 	idRaw, ok := val[dbId]
@@ -229,12 +247,39 @@ func datumValueFromValue(val interface{}) (*Value, error) {
 	case bool, int64, float64, string, time.Time, *big.Int:
 		v := NewValue(val)
 		return &v, nil
+	case *big.Float:
+		d, err := index.DecimalFromFloat(val)
+		if err != nil {
+			return nil, err
+		}
+		v := NewValue(d)
+		return &v, nil
 	case edn.Keyword:
 		v := NewValue(toKeyword(val))
 		return &v, nil
 	case edn.UUID:
 		v := NewValue(fressian.UUID{Msb: val.Msb, Lsb: val.Lsb})
 		return &v, nil
+	case []interface{}:
+		elems := make([]interface{}, len(val))
+		for i, elemRaw := range val {
+			if elemRaw == nil {
+				continue
+			}
+
+			elem, err := datumValueFromValue(elemRaw)
+			if err != nil {
+				return nil, err
+			}
+
+			v, err := elem.Get(nil, false)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = v.Val()
+		}
+		v := NewValue(index.NewTuple(elems...))
+		return &v, nil
 	default:
 		if tagged, ok := val.(edn.Tagged); ok && tagged.Tag == dbIdSym {
 			lookup, err := idFromValue(tagged)
@@ -243,6 +288,17 @@ func datumValueFromValue(val interface{}) (*Value, error) {
 			}
 			value := NewValue(lookup)
 			return &value, nil
+		} else if tagged, ok := val.(edn.Tagged); ok && tagged.Tag == uriSym {
+			s, ok := tagged.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("uri must be of the form #uri \"...\", but was %v", tagged.Value)
+			}
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			value := NewValue(u)
+			return &value, nil
 		}
 		return nil, fmt.Errorf("invalid value %v", val)
 	}
@@ -296,3 +352,39 @@ func toKeyword(kw edn.Keyword) database.Keyword {
 		},
 	}
 }
+
+// ValueFromEDN converts literal edn values, e.g. in queries or pull
+// patterns, to the types used in the database.  Values without such a
+// type are returned unchanged.
+func ValueFromEDN(val interface{}) interface{} {
+	switch val := val.(type) {
+	case int64:
+		return int(val)
+	case edn.Keyword:
+		return fressian.Keyword{Namespace: val.Namespace, Name: val.Name}
+	case edn.UUID:
+		return fressian.UUID{Msb: val.Msb, Lsb: val.Lsb}
+	case *big.Float:
+		d, err := index.DecimalFromFloat(val)
+		if err != nil {
+			return val
+		}
+		return d
+	case edn.Tagged:
+		if s, ok := val.Value.(string); ok && val.Tag == uriSym {
+			u, err := url.Parse(s)
+			if err == nil {
+				return u
+			}
+		}
+		return val
+	case []interface{}:
+		vals := make([]interface{}, len(val))
+		for i, v := range val {
+			vals[i] = ValueFromEDN(v)
+		}
+		return vals
+	default:
+		return val
+	}
+}
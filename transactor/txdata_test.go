@@ -3,7 +3,10 @@ package transactor
 import (
 	"github.com/heyLu/fressian"
 	tu "github.com/klingtnet/gol/util/testing"
+	"math/big"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/heyLu/mu/database"
 	"github.com/heyLu/mu/index"
@@ -41,3 +44,91 @@ func TestResolve(t *testing.T) {
 	_, err = datum.Resolve(db)
 	tu.ExpectNotNil(t, err)
 }
+
+func TestValueTypes(t *testing.T) {
+	schema := `[`
+	for _, ty := range []string{"keyword", "long", "string", "boolean", "instant", "uuid", "double", "float", "uri", "bigint", "bigdec", "bytes"} {
+		schema += `{:db/id #db/id[:db.part/db] :db/ident :value/` + ty +
+			` :db/valueType :db.type/` + ty + ` :db/cardinality :db.cardinality/one}`
+	}
+	schema += `]`
+	db := mustTransact(t, InitialDb, schema).DbAfter
+
+	txResult := mustTransact(t, db, `[{:db/id #db/id[:db.part/user -1]
+  :value/keyword :hello
+  :value/long 42
+  :value/string "hello"
+  :value/boolean true
+  :value/instant #inst "2016-10-19T12:30:00.123Z"
+  :value/uuid #uuid "2a0a1982-96b6-11e6-bf91-02423fefa4c2"
+  :value/double 3.25
+  :value/float 1.5
+  :value/uri #uri "https://example.com/notes"
+  :value/bigint 12345678901234567890N
+  :value/bigdec 1.25M}]`)
+	entity := txResult.DbAfter.Entity(txResult.Datoms[0].E())
+	get := func(name string) interface{} {
+		return entity.Get(database.Keyword{fressian.Keyword{"value", name}})
+	}
+
+	tu.ExpectEqual(t, get("keyword"), fressian.Keyword{"", "hello"})
+	tu.ExpectEqual(t, get("long"), 42)
+	tu.ExpectEqual(t, get("float"), float32(1.5))
+	tu.ExpectEqual(t, get("instant").(time.Time).Nanosecond(), 123000000)
+	tu.ExpectEqual(t, get("uri").(*url.URL).Host, "example.com")
+	tu.ExpectEqual(t, get("bigint").(*big.Int).String(), "12345678901234567890")
+	tu.ExpectEqual(t, get("bigdec").(*index.Decimal).String(), "1.25")
+
+	// numbers are converted to the type of the attribute
+	txResult = mustTransact(t, txResult.DbAfter, `[{:db/id #db/id[:db.part/user -1]
+  :value/float 2
+  :value/bigint 3
+  :value/bigdec 4.5}]`)
+	entity = txResult.DbAfter.Entity(txResult.Datoms[0].E())
+	tu.ExpectEqual(t, get("float"), float32(2))
+	tu.ExpectEqual(t, get("bigint").(*big.Int).Int64(), int64(3))
+	tu.ExpectEqual(t, get("bigdec").(*index.Decimal).String(), "4.5")
+
+	// decimals are exact, also beyond the precision of float64
+	for _, text := range []string{"0.1", "3.14159265358979323846264338327950288"} {
+		txResult = mustTransact(t, txResult.DbAfter, `[{:db/id #db/id[:db.part/user -1] :value/bigdec `+text+`M}]`)
+		entity = txResult.DbAfter.Entity(txResult.Datoms[0].E())
+		tu.ExpectEqual(t, get("bigdec").(*index.Decimal).String(), text)
+	}
+
+	// bytes can only be transacted from Go
+	_, txResult, err := Transact(txResult.DbAfter, []TxDatum{
+		Datum{Op: Assert, E: database.Id(txResult.Datoms[0].E()), A: database.Keyword{fressian.Keyword{"value", "bytes"}}, V: NewValue([]byte("hello"))},
+	})
+	tu.RequireNil(t, err)
+	entity = txResult.DbAfter.Entity(txResult.Datoms[0].E())
+	tu.ExpectEqual(t, get("bytes"), []byte("hello"))
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db, jane := cardinalityDb(t)
+	email := database.Keyword{fressian.Keyword{"person", "email"}}
+	name := database.Keyword{fressian.Keyword{"person", "name"}}
+	cas := func(db *database.Db, attr database.Keyword, oldValue *index.Value, newValue string) (*TxResult, error) {
+		val := index.NewValue(newValue)
+		_, txResult, err := Transact(db, []TxDatum{
+			FnCompareAndSwap(database.Id(jane), attr, oldValue, &val),
+		})
+		return txResult, err
+	}
+
+	wrong := index.NewValue("judy@example.com")
+	_, err := cas(db, email, &wrong, "jane.lane@example.com")
+	tu.ExpectNotNil(t, err)
+	_, err = cas(db, email, nil, "jane.lane@example.com")
+	tu.ExpectNotNil(t, err)
+
+	current := index.NewValue("jane@example.com")
+	txResult, err := cas(db, email, &current, "jane.lane@example.com")
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, txResult.DbAfter.Entity(jane).Get(email), "jane.lane@example.com")
+
+	txResult, err = cas(txResult.DbAfter, name, nil, "Jane")
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, txResult.DbAfter.Entity(jane).Get(name), "Jane")
+}
@@ -2,6 +2,7 @@ package transactor
 
 import (
 	"fmt"
+	"github.com/heyLu/fressian"
 	//"log"
 
 	"github.com/heyLu/mu/database"
@@ -19,6 +20,24 @@ import (
 // - :db.part/db restrictions (for new entities, either just :db/ident,
 //     or more attributes + :db.install/attribute)
 
+const DbAttrPreds = 66 // :db.attr/preds
+
+// An AttributePredicate checks whether a value is valid for an
+// attribute.
+type AttributePredicate func(value interface{}) bool
+
+var registeredAttributePredicates = map[fressian.Keyword]AttributePredicate{}
+
+// RegisterAttributePredicate makes the predicate available under the
+// given name, so that it can be used in `:db.attr/preds`.
+func RegisterAttributePredicate(name database.Keyword, pred AttributePredicate) {
+	if _, ok := registeredAttributePredicates[name.Keyword]; ok {
+		panic(fmt.Sprint("duplicate attribute predicate ", name))
+	}
+
+	registeredAttributePredicates[name.Keyword] = pred
+}
+
 // validate verifies that the datums are a valid transaction.
 func validate(db *database.Db, datums []RawDatum) ([]RawDatum, error) {
 	err := checkTypes(db, datums)
@@ -26,6 +45,18 @@ func validate(db *database.Db, datums []RawDatum) ([]RawDatum, error) {
 		return nil, err
 	}
 
+	// upserts are resolved first, so that composite tuples are
+	// computed from the values of the existing entities
+	datums = resolveUpserts(db, datums)
+
+	datums, err = addCompositeTuples(db, datums)
+	if err != nil {
+		return nil, err
+	}
+
+	// composite tuples with :db.unique/identity upsert as well
+	datums = resolveUpserts(db, datums)
+
 	err = validateUniqueness(db, datums)
 	if err != nil {
 		return nil, err
@@ -55,55 +86,72 @@ func checkTypes(db *database.Db, datums []RawDatum) error {
 
 		attr := db.Attribute(datum.A)
 		if attr == nil {
-			return fmt.Errorf("unknown attribute %d", datum.A)
+			return &UnknownAttributeError{database.Id(datum.A)}
 		}
 
 		if attr.Type() != val.Type() {
-			return fmt.Errorf("expected value of type %v, but got %#v of type %v",
-				attr.Type(), val.Val(), val.Type())
+			return &TypeMismatchError{attr.Ident(), attr.Type(), val.Type(), val.Val()}
 		}
 
 		// TODO: maybe do this in `index/value.go#Compare`?
 		if attr.Type() == index.Ref {
 			datums[i].V = index.NewValue(val.Val())
 		}
+
+		if datum.Op == Assert {
+			err := checkAttributePredicates(attr, val)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func validateUniqueness(db *database.Db, datums []RawDatum) error {
+func checkAttributePredicates(attr *database.Attribute, val index.Value) error {
+	for _, name := range attr.Preds() {
+		pred, ok := registeredAttributePredicates[name]
+		if !ok {
+			return anomalyf(Incorrect, "attribute %v uses unknown predicate %v", attr.Ident(), name)
+		}
+
+		if !pred(val.Val()) {
+			return anomalyf(Incorrect, "value %#v for attribute %v does not satisfy predicate %v",
+				val.Val(), attr.Ident(), name)
+		}
+	}
+
+	return nil
+}
+
+// resolveUpserts replaces the tempids of entities that have a value
+// for a :db.unique/identity attribute that already exists with the id
+// of the existing entity.
+func resolveUpserts(db *database.Db, datums []RawDatum) []RawDatum {
 	mergedIds := make(map[int]int)
 
 	for i, datum := range datums {
-		attr := db.Attribute(datum.A)
+		if datum.Op == Retract || datum.E >= 0 {
+			continue
+		}
 
-		switch attr.Unique() {
-		case database.UniqueValue:
-			prev, ok := existsUniqueValue(db, datum.A, datum.V)
-			if ok {
-				return fmt.Errorf("not unique, value for %v already exists: %v", attr.Ident(), prev)
-			}
-		case database.UniqueIdentity:
-			if datum.E < 0 {
-				prev, ok := existsUniqueValue(db, datum.A, datum.V)
-				if ok {
-					//log.Printf("merging %d with %d\n", datum.E, prev.E())
-					mergedIds[datum.E] = prev.E()
-					datums[i].E = prev.E()
-				}
-			} else {
-				prev, ok := existsUniqueValue(db, datum.A, datum.V)
-				if ok {
-					return fmt.Errorf("not unique, value for %v already exists: %v", attr.Ident(), prev)
-				}
-			}
-		case database.UniqueNil:
-		default:
-			return fmt.Errorf("invalid unique value for attribute %d: %v", datum.A, attr.Unique())
+		if db.Attribute(datum.A).Unique() != database.UniqueIdentity {
+			continue
+		}
+
+		prev, ok := existsUniqueValue(db, datum.A, datum.V)
+		if ok {
+			//log.Printf("merging %d with %d\n", datum.E, prev.E())
+			mergedIds[datum.E] = prev.E()
+			datums[i].E = prev.E()
 		}
 	}
 
+	if len(mergedIds) == 0 {
+		return datums
+	}
+
 	for i, datum := range datums {
 		if id, ok := mergedIds[datum.E]; ok {
 			datums[i].E = id
@@ -117,6 +165,32 @@ func validateUniqueness(db *database.Db, datums []RawDatum) error {
 		}
 	}
 
+	return datums
+}
+
+// validateUniqueness verifies that values of unique attributes don't
+// exist on other entities already.  Upserts must be resolved before,
+// see resolveUpserts.
+func validateUniqueness(db *database.Db, datums []RawDatum) error {
+	for _, datum := range datums {
+		if datum.Op == Retract {
+			continue
+		}
+
+		attr := db.Attribute(datum.A)
+
+		switch attr.Unique() {
+		case database.UniqueValue, database.UniqueIdentity:
+			prev, ok := existsUniqueValue(db, datum.A, datum.V)
+			if ok && prev.E() != datum.E {
+				return &UniqueConflictError{attr.Ident(), datum.V.Val(), prev.E()}
+			}
+		case database.UniqueNil:
+		default:
+			return anomalyf(Fault, "invalid unique value for attribute %d: %v", datum.A, attr.Unique())
+		}
+	}
+
 	return nil
 }
 
@@ -131,13 +205,20 @@ func existsUniqueValue(db *database.Db, attrId int, val index.Value) (*index.Dat
 
 func removeNoops(db *database.Db, datums []RawDatum) ([]RawDatum, error) {
 	newDatums := make([]RawDatum, 0, len(datums))
-	duplicates := make(map[RawDatum]bool)
+	// values are not always comparable using ==, e.g. tuples
+	type datumKey struct {
+		op bool
+		e  int
+		a  int
+	}
+	seen := make(map[datumKey][]index.Value)
 
 	for _, datum := range datums {
-		if _, ok := duplicates[datum]; ok {
+		key := datumKey{datum.Op, datum.E, datum.A}
+		if containsValue(seen[key], datum.V) {
 			continue
 		}
-		duplicates[datum] = true
+		seen[key] = append(seen[key], datum.V)
 
 		exists := alreadyExists(db, datum)
 		if datum.Op == Assert && !exists {
@@ -152,6 +233,15 @@ func removeNoops(db *database.Db, datums []RawDatum) ([]RawDatum, error) {
 	return newDatums, nil
 }
 
+func containsValue(vals []index.Value, val index.Value) bool {
+	for _, v := range vals {
+		if v.Compare(val) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func alreadyExists(db *database.Db, datum RawDatum) bool {
 	if datum.E < 0 {
 		return false
@@ -173,20 +263,33 @@ type prevDatum struct {
 func validateCardinality(db *database.Db, datums []RawDatum) ([]RawDatum, error) {
 	newDatums := make([]RawDatum, 0, len(datums))
 	cardinalityOneAttributes := make(map[prevDatum]bool)
+	retracted := make(map[prevDatum][]index.Value)
+
+	for _, datum := range datums {
+		if datum.Op == Retract {
+			key := prevDatum{e: datum.E, a: datum.A}
+			retracted[key] = append(retracted[key], datum.V)
+		}
+	}
 
 	for _, datum := range datums {
 		attr := db.Attribute(datum.A)
 
+		if datum.Op == Retract {
+			newDatums = append(newDatums, datum)
+			continue
+		}
+
 		switch attr.Cardinality() {
 		case database.CardinalityOne:
 			_, ok := cardinalityOneAttributes[prevDatum{e: datum.E, a: datum.A}]
 			if ok {
-				return nil, fmt.Errorf("duplicate value for %v: %d", attr.Ident(), datum.A)
+				return nil, anomalyf(Conflict, "duplicate value for %v: %d", attr.Ident(), datum.A)
 			}
 			cardinalityOneAttributes[prevDatum{e: datum.E, a: datum.A}] = true
 
 			prev := existingAttribute(db, datum.E, datum.A)
-			if prev != nil {
+			if prev != nil && !containsValue(retracted[prevDatum{e: datum.E, a: datum.A}], prev.V()) {
 				retractPrev := RawDatum{
 					Op: Retract,
 					E:  datum.E,
@@ -199,7 +302,7 @@ func validateCardinality(db *database.Db, datums []RawDatum) ([]RawDatum, error)
 		case database.CardinalityMany:
 			newDatums = append(newDatums, datum)
 		default:
-			return nil, fmt.Errorf("invalid cardinality for %v: %v", datum, attr.Cardinality)
+			return nil, anomalyf(Fault, "invalid cardinality for %v: %v", datum, attr.Cardinality())
 		}
 	}
 
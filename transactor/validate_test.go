@@ -0,0 +1,85 @@
+package transactor
+
+import (
+	"github.com/heyLu/fressian"
+	tu "github.com/klingtnet/gol/util/testing"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/heyLu/mu/database"
+	"github.com/heyLu/mu/internal/testutil"
+)
+
+func init() {
+	RegisterAttributePredicate(database.Keyword{fressian.Keyword{"string", "non-empty?"}}, func(value interface{}) bool {
+		s, ok := value.(string)
+		return ok && s != ""
+	})
+	RegisterAttributePredicate(database.Keyword{fressian.Keyword{"string", "short?"}}, func(value interface{}) bool {
+		s, ok := value.(string)
+		return ok && len(s) <= 10
+	})
+}
+
+func TestAttributePredicates(t *testing.T) {
+	schema := mustTransact(t, InitialDb, `[{:db/id #db/id[:db.part/db]
+  :db/ident :tag/name
+  :db/valueType :db.type/string
+  :db/cardinality :db.cardinality/one
+  :db.attr/preds #{:string/non-empty? :string/short?}}]`)
+	db := schema.DbAfter
+
+	txResult := mustTransact(t, db, `[[:db/add #db/id[:db.part/user -1] :tag/name "go"]]`)
+	tag := txResult.Datoms[0].E()
+
+	for _, tc := range []struct {
+		value string
+		pred  string
+	}{
+		{`""`, "non-empty?"},
+		{`"much too long"`, "short?"},
+	} {
+		txData, err := TxDataFromEDN(`[[:db/add #db/id[:db.part/user -1] :tag/name ` + tc.value + `]]`)
+		tu.RequireNil(t, err)
+		_, _, err = Transact(db, txData)
+		tu.RequireNotNil(t, err)
+		tu.ExpectEqual(t, strings.Contains(err.Error(), "tag"), true)
+		tu.ExpectEqual(t, strings.Contains(err.Error(), tc.pred), true)
+	}
+
+	// retractions are not checked
+	_, _, err := Transact(txResult.DbAfter, []TxDatum{
+		Datum{Op: Retract, E: database.Id(tag), A: database.Keyword{fressian.Keyword{"tag", "name"}}, V: NewValue("go")},
+	})
+	tu.ExpectNil(t, err)
+}
+
+func cardinalityDb(t *testing.T) (*database.Db, int) {
+	db := mustTransact(t, InitialDb, testutil.Schema(
+		testutil.One("person/name", "string"),
+		testutil.One("person/email", "string"))).DbAfter
+	txResult := mustTransact(t, db, `[[:db/add #db/id[:db.part/user -1] :person/email "jane@example.com"]]`)
+	return txResult.DbAfter, txResult.Datoms[0].E()
+}
+
+func TestCardinalityOneRetraction(t *testing.T) {
+	db, jane := cardinalityDb(t)
+	email := database.Keyword{fressian.Keyword{"person", "email"}}
+
+	// retracting the old value explicitly is allowed and not retracted
+	// twice
+	txResult := mustTransact(t, db, `[[:db/retract `+strconv.Itoa(jane)+` :person/email "jane@example.com"]
+ [:db/add `+strconv.Itoa(jane)+` :person/email "jane.lane@example.com"]]`)
+	tu.ExpectEqual(t, txResult.DbAfter.Entity(jane).Get(email), "jane.lane@example.com")
+	retractions := 0
+	for _, datom := range txResult.Datoms {
+		if !datom.Added() {
+			retractions++
+		}
+	}
+	tu.ExpectEqual(t, retractions, 1)
+
+	txResult = mustTransact(t, txResult.DbAfter, `[[:db/retract `+strconv.Itoa(jane)+` :person/email "jane.lane@example.com"]]`)
+	tu.ExpectNil(t, txResult.DbAfter.Entity(jane).Get(email))
+}